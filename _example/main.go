@@ -8,7 +8,6 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
-	"regexp"
 	"strings"
 	"time"
 
@@ -96,8 +95,8 @@ func main() {
 	if err := service.AddAppleProvider(appleCfg, provider.LoadApplePrivateKeyFromFile(os.Getenv("AEXMPL_APPLE_PRIVKEY_PATH"))); err != nil {
 		log.Printf("[ERROR] create AppleProvider failed: %v", err)
 	}
-	// allow anonymous user via custom (direct) provider
-	service.AddDirectProvider("anonymous", anonymousAuthProvider())
+	// allow anonymous user with any valid name
+	service.AddAnonymousProvider("anonymous", provider.AnonymousCredChecker{})
 
 	// add verified provider
 	service.AddVerifProvider("email",
@@ -216,26 +215,6 @@ func main() {
 	}
 }
 
-// anonymousAuthProvider allows auth-free login with any valid user name
-func anonymousAuthProvider() provider.CredCheckerFunc {
-	log.Printf("[WARN] anonymous access enabled")
-	var isValidAnonName = regexp.MustCompile(`^[a-zA-Z][\w ]+$`).MatchString
-
-	return func(user, _ string) (ok bool, err error) {
-		user = strings.TrimSpace(user)
-		if len(user) < 3 {
-			log.Printf("[WARN] name %q is too short, should be at least 3 characters", user)
-			return false, nil
-		}
-
-		if !isValidAnonName(user) {
-			log.Printf("[WARN] name %q should have letters, digits, underscores and spaces only", user)
-			return false, nil
-		}
-		return true, nil
-	}
-}
-
 // FileServer conveniently sets up a http.FileServer handler to serve static files from a http.FileSystem.
 // Borrowed from https://github.com/go-chi/chi/blob/master/_examples/fileserver/main.go
 func fileServer(r chi.Router, path string, root http.FileSystem) {
@@ -33,6 +33,8 @@ type Service struct {
 	avatarProxy    *avatar.Proxy
 	issuer         string
 	useGravatar    bool
+	gravatar       *avatar.GravatarCache
+	trustedProxies *provider.TrustedProxies
 }
 
 // Opts is a full set of all parameters to initialize Service
@@ -42,9 +44,17 @@ type Opts struct {
 	SecureCookies  bool                // makes jwt cookie secure
 	TokenDuration  time.Duration       // token's TTL, refreshed automatically
 	CookieDuration time.Duration       // cookie's TTL. This cookie stores JWT token
+	PersistentTTL  time.Duration       // TTL of persistent (non-session) cookies, i.e. "remember me" period. Overrides CookieDuration
 
-	DisableXSRF bool // disable XSRF protection, useful for testing/debugging
-	DisableIAT  bool // disable IssuedAt claim
+	// ExtraClaims returns custom top-level claims of the token, i.e. tenant id or plan, see token.Opts.ExtraClaims
+	ExtraClaims func(claims token.Claims) map[string]interface{}
+
+	DisableXSRF bool          // disable XSRF protection, useful for testing/debugging
+	DisableIAT  bool          // disable IssuedAt claim
+	RotateXSRF  bool          // bind XSRF value to the session with HMAC and rotate it on each token re-issue
+	XSRFGrace   time.Duration // previous XSRF value accepted for it after rotation with RotateXSRF, default 1m
+	JWTLeeway   time.Duration // tolerance of clock skew between nodes checking token expiration, i.e. 30s, default 0
+	SecretTTL   time.Duration // cache secrets of SecretReader per aud for it on token parsing, disabled if 0
 
 	// optional (custom) names for cookies and headers
 	JWTCookieName   string        // default "JWT"
@@ -54,28 +64,144 @@ type Opts struct {
 	XSRFHeaderKey   string        // default "X-XSRF-TOKEN"
 	JWTQuery        string        // default "token"
 	SendJWTHeader   bool          // if enabled send JWT as a header instead of cookie
+	TokenHeader     string        // response header with user's token in addition to cookie, i.e. "X-Auth-Token", none if empty
 	SameSiteCookie  http.SameSite // limit cross-origin requests with SameSite cookie attribute
 
-	Issuer string // optional value for iss claim, usually the application name, default "go-pkgz/auth"
+	Issuer      string   // optional value for iss claim, usually the application name, default "go-pkgz/auth"
+	AllowedAlgs []string // signing algorithms accepted for tokens, default is HS256 only, "none" is never accepted
+
+	IssuerFunc provider.IssuerFunc // optional issuer by request, i.e. by host or site of multi-brand setup, Issuer used if empty
+	Issuers    []string            // all issuers IssuerFunc returns, tokens with other iss rejected if set
 
 	URL       string          // root url for the rest service, i.e. http://blah.example.com, required
 	Validator token.Validator // validator allows to reject some valid tokens with user-defined logic
 
-	AvatarStore       avatar.Store // store to save/load avatars, required (use avatar.NoOp to disable avatars support)
-	AvatarResizeLimit int          // resize avatar's limit in pixels
-	AvatarRoutePath   string       // avatar routing prefix, i.e. "/api/v1/avatar", default `/avatar`
-	UseGravatar       bool         // for email based auth (verified provider) use gravatar service
-
-	AdminPasswd      string                   // if presented, allows basic auth with user admin and given password
-	BasicAuthChecker middleware.BasicAuthFunc // user custom checker for basic auth, if one defined then "AdminPasswd" will ignored
-	AudienceReader   token.Audience           // list of allowed aud values, default (empty) allows any
-	AudSecrets       bool                     // allow multiple secrets (secret per aud)
-	Logger           logger.L                 // logger interface, default is no logging at all
-	RefreshCache     middleware.RefreshCache  // optional cache to keep refreshed tokens
+	AvatarStore       avatar.Store             // store to save/load avatars, required (use avatar.NoOp to disable avatars support)
+	AvatarResizeLimit int                      // resize avatar's limit in pixels
+	AvatarRoutePath   string                   // avatar routing prefix, i.e. "/api/v1/avatar", default `/avatar`
+	AvatarDefault     avatar.DefaultAvatar     // response to request of missing avatar, i.e. placeholder image, error by default
+	AvatarFetch       provider.AvatarFetch     // client and policy of avatar downloads by providers, i.e. egress proxy and retries
+	AvatarSkip        map[string]bool          // per provider name override of AvatarFetch.Skip, i.e. {"github": true}
+	PictureUpdate     provider.PictureUpdate   // update of existing user's picture on login, i.e. keep one customized in the app
+	OAuthRetry        provider.OAuthRetry      // retries of oauth2 token exchange and user info requests failed with 5xx
+	OAuthStateTTL     time.Duration            // validity of oauth login state, time to complete login on provider's side, default 30m
+	OAuthFormPost     []string                 // names of oauth2 providers posting callback data as form, response_mode=form_post
+	OAuthMaxPending   int                      // oauth2 login flows in progress kept per browser, i.e. logins started in several tabs
+	RedirectStatus    int                      // status of redirect to back url after login, i.e. 303, default 307
+	FirstLoginStore   provider.FirstLoginStore // keeps profile fields sent only on first login, i.e. apple name, default in-memory
+	FirstLoginFields  map[string][]string      // oauth2 provider's fields sent only on first login, by provider name
+	UseGravatar       bool                     // for email based auth (verified provider) use gravatar service
+	GravatarCache     avatar.GravatarOpts      // ttl, size and failure cooldown of gravatar lookups cache
+	VerifSharedState  bool                     // verified providers share handshake states, allows to redeem tokens of one provider with another
+	VerifBindNonce    bool                     // verified providers accept confirmation links only in the browser requested them
+	VerifSendInterval time.Duration            // min interval between confirmations sent to the same address, disabled if 0
+	VerifLimitStore   provider.LockoutStore    // send interval counters store, shared one enforces the interval across instances
+	VerifMaxPerAddr   int                      // max confirmations sent to the same address within VerifSendWindow, unlimited if 0
+	VerifMaxPerIP     int                      // max confirmation requests from the same client IP within VerifSendWindow, unlimited if 0
+	VerifSendWindow   time.Duration            // window of VerifMaxPerAddr and VerifMaxPerIP, default 1h
+	VerifMaxSends     int                      // max confirmations sent at once by verified provider, i.e. to protect SMTP server
+	VerifSendWait     time.Duration            // wait for a free send slot with VerifMaxSends up to it, 503 at once if 0
+	VerifLoginLock    time.Duration            // ttl of lock serializing login completions of the same user in VerifLimitStore, disabled if 0
+	VerifLockWait     time.Duration            // wait for the login lock held by another completion up to it, 409 at once if 0
+	VerifRequireTLS   bool                     // verified providers reject plain http requests with 426
+	VerifTrustProxy   bool                     // verified providers trust X-Forwarded-Proto of reverse proxy terminating TLS
+	VerifNumericPass  bool                     // verified providers with password accept json number as password, i.e. PIN
+	VerifLinkBypass   bool                     // verified providers with password log in by confirmation link, without password step
+	VerifRedirects    []string                 // origins or url prefixes of back urls of verified providers, any url if empty
+
+	VerifAuthTTLFunc func(withPassword bool, u token.User) time.Duration // verified providers auth token ttl by login flow
+
+	VerifTokenTTL time.Duration // lifetime of verified providers confirmation tokens, default 30m
+	VerifCredsTTL time.Duration // lifetime of verified providers password step tokens, default VerifTokenTTL
+
+	// VerifPassChecker checks password of verified providers with password, required for them. It returns
+	// provider.ErrPasswordNotSet for the user without password, the password is registered with VerifPassSaver then.
+	VerifPassChecker func(user, address, password string) (ok bool, err error)
+	VerifPassSaver   func(user, address, password string) error
+	VerifLockout     *provider.Lockout // optional brute-force lockout of verified providers password step
+
+	VerifCorrelation     bool                               // verified providers link sent and redeemed confirmations with cookie
+	VerifCorrelationFunc func(ev provider.CorrelationEvent) // receives correlation events of verified providers
+
+	VerifConfirmAttrs    func(r *http.Request) bool // allows request to post attrs carried by confirmation to the user
+	VerifConfirmAttrsMax int                        // max size of posted confirmation attrs, default 1KB
+
+	VerifDomainBlocklist *provider.DomainBlocklist // verified providers reject addresses of blocked domains, i.e. disposable
+	VerifBlockSilently   bool                      // verified providers pretend confirmation sent to blocked address
+	VerifEmailCheck      []string                  // names of verified providers checking addresses with provider.EmailAddress
+	VerifSanitizer       func(string) string       // cleans user, address and site of verified providers, provider.Sanitize if nil
+
+	VerifSendCode  []string                  // names of verified providers sending short codes instead of tokens, i.e. for SMS
+	VerifCodeStore provider.ConfirmCodeStore // confirmation codes store, shared one works across instances, default in-memory
+	VerifCodeTries int                       // wrong codes for the address before its pending code dropped, default 5
+	VerifUsedStore provider.UsedTokenStore   // makes confirmation tokens of verified providers single-use, replays allowed if nil
+
+	SiteDisplayName func(site string) string // display name of the site for confirmation templates, {{.SiteName}}
+
+	// VerifTemplateData makes data of verified providers confirmation templates from the base one, i.e. with link url
+	VerifTemplateData func(r *http.Request, base provider.ConfirmData) interface{}
+
+	AdminPasswd      string                      // if presented, allows basic auth with user admin and given password
+	BasicAuthChecker middleware.BasicAuthFunc    // user custom checker for basic auth, if one defined then "AdminPasswd" will ignored
+	AudienceReader   token.Audience              // list of allowed aud values, default (empty) allows any
+	AudSecrets       bool                        // allow multiple secrets (secret per aud)
+	Logger           logger.L                    // logger interface, default is no logging at all
+	RefreshCache     middleware.RefreshCache     // optional cache to keep refreshed tokens
+	ExternalVerifier middleware.ExternalVerifier // optional verifier of bearer tokens issued by others, i.e. middleware.JWKSVerifier
+	ProviderInfo     bool                        // add provider_name and provider_type to JSON responses of providers
+	SignResponses    bool                        // sign successful JSON responses of providers with X-Auth-Signature header
+	ProvidersDebug   bool                        // serve registered providers with their routes on /auth/providers, for development
+	DevTLS           provider.DevTLS             // serve dev oauth2 server over https, with generated or provided certificate
 
 	UserSaver func(token.User) error // function that saves user after successful authorization
+
+	// UserUpsert saves user like UserSaver, reporting insert of the new user, i.e. by result of upsert query.
+	// Used instead of UserSaver if set.
+	UserUpsert func(u token.User) (isNew bool, err error)
+	// OnUserCreated called once UserUpsert reported new user, not on updates, i.e. to send welcome email.
+	// Called synchronously during login, slow work should be done in background.
+	OnUserCreated func(u token.User)
+
+	HTTPTransport  http.RoundTripper // transport for calls of providers (token exchange, avatars) and gravatar, shared if nil
+	TrustedProxies []string          // IPs and CIDRs of proxies trusted to pass client ip with X-Forwarded-For, none if empty
+
+	DirectLockout        *provider.Lockout       // optional brute-force lockout for direct providers
+	DirectPasswordReset  *provider.PasswordReset // optional password reset flow for direct providers
+	DirectPasswordSetter provider.PasswordSetter // optional, enables password change for logged-in direct providers users
+	DirectCheckTimeout   time.Duration           // timeout of context-aware credentials check, default 10s
+	DirectNoIDPrefix     bool                    // use user ID from the store as-is, without "direct_" prefix
+	DirectTOTP           *provider.TOTP          // optional TOTP second factor for direct providers
+	AnonymousID          *provider.PersistentID  // optional, anonymous users keep ID in the browser's cookie across logins
+	PasswordPolicy       provider.PasswordPolicy // optional strength policy for new passwords
+	AuditHook            provider.AuditFunc      // optional receiver of audit events, like failed logins and lockouts
+	BlockedMessage       string                  // response of middleware.Blocklist to banned users, default "Access denied"
+	BlockFailClosed      bool                    // middleware.Blocklist rejects requests if its store fails, passes them by default
+	UserInvalidator      token.UserInvalidator   // optional per-user sessions invalidation, used on password reset and change
+
+	AudienceInvalidator token.AudienceInvalidator // optional per-audience (site) tokens invalidation, i.e. for site offboarding
+
+	MaxBodySize int64 // max size of request body for providers parsing it, default provider.MaxHTTPBodySize
+
+	ReferrerPolicy  string            // Referrer-Policy of auth responses, i.e. redirects to providers, default "no-referrer"
+	SecurityHeaders map[string]string // headers added to auth responses over default ones, empty value removes the header
+
+	// Content-Security-Policy of HTML auth responses, default restrictive defaultContentSecurityPolicy, "-" disables it
+	ContentSecurityPolicy string
 }
 
+// defaultSecurityHeaders set on all auth responses, some of them carry tokens and can't be cached
+var defaultSecurityHeaders = map[string]string{
+	"Cache-Control":          "no-store",
+	"Pragma":                 "no-cache",
+	"X-Content-Type-Options": "nosniff",
+	"Referrer-Policy":        "no-referrer",
+}
+
+// defaultContentSecurityPolicy allows HTML auth responses inline styles and own images only, no scripts, frames
+// and forms posted elsewhere
+const defaultContentSecurityPolicy = "default-src 'none'; style-src 'unsafe-inline'; img-src 'self' data:; " +
+	"form-action 'self'; frame-ancestors 'none'; base-uri 'none'"
+
 // NewService initializes everything
 func NewService(opts Opts) (res *Service) {
 	res = &Service{
@@ -86,6 +212,10 @@ func NewService(opts Opts) (res *Service) {
 			AdminPasswd:      opts.AdminPasswd,
 			BasicAuthChecker: opts.BasicAuthChecker,
 			RefreshCache:     opts.RefreshCache,
+			ExternalVerifier: opts.ExternalVerifier,
+			BlockedMessage:   opts.BlockedMessage,
+			BlockFailClosed:  opts.BlockFailClosed,
+			Audit:            opts.AuditHook,
 		},
 		issuer:      opts.Issuer,
 		useGravatar: opts.UseGravatar,
@@ -95,29 +225,68 @@ func NewService(opts Opts) (res *Service) {
 		res.issuer = "go-pkgz/auth"
 	}
 
+	if opts.FirstLoginStore == nil {
+		res.opts.FirstLoginStore = provider.NewMemFirstLoginStore()
+	}
+
+	if opts.UserUpsert != nil {
+		res.opts.UserSaver = res.upsertUser
+	}
+
+	if opts.UseGravatar {
+		gopts := opts.GravatarCache
+		if gopts.Transport == nil {
+			gopts.Transport = opts.HTTPTransport
+		}
+		res.gravatar = avatar.NewGravatarCache(gopts)
+	}
+
+	if opts.UserInvalidator != nil {
+		res.authMiddleware.Validator = chainValidators(opts.Validator, opts.UserInvalidator)
+	}
+
 	if opts.Logger == nil {
 		res.logger = logger.NoOp{}
 	}
 
+	// proxies kept by the service and passed to its handlers, other services and defaults are not affected
+	trustedProxies, err := provider.NewTrustedProxies(opts.TrustedProxies)
+	if err != nil {
+		res.logger.Error("[ERROR] trusted proxies ignored, forwarded client ip not trusted, %v", err)
+		trustedProxies = &provider.TrustedProxies{}
+	}
+	res.trustedProxies = trustedProxies
+	res.authMiddleware.TrustedProxies = trustedProxies
+
 	jwtService := token.NewService(token.Opts{
-		SecretReader:    opts.SecretReader,
-		ClaimsUpd:       opts.ClaimsUpd,
-		SecureCookies:   opts.SecureCookies,
-		TokenDuration:   opts.TokenDuration,
-		CookieDuration:  opts.CookieDuration,
-		DisableXSRF:     opts.DisableXSRF,
-		DisableIAT:      opts.DisableIAT,
-		JWTCookieName:   opts.JWTCookieName,
-		JWTCookieDomain: opts.JWTCookieDomain,
-		JWTHeaderKey:    opts.JWTHeaderKey,
-		XSRFCookieName:  opts.XSRFCookieName,
-		XSRFHeaderKey:   opts.XSRFHeaderKey,
-		SendJWTHeader:   opts.SendJWTHeader,
-		JWTQuery:        opts.JWTQuery,
-		Issuer:          res.issuer,
-		AudienceReader:  opts.AudienceReader,
-		AudSecrets:      opts.AudSecrets,
-		SameSite:        opts.SameSiteCookie,
+		SecretReader:        opts.SecretReader,
+		ClaimsUpd:           opts.ClaimsUpd,
+		ExtraClaims:         opts.ExtraClaims,
+		SecureCookies:       opts.SecureCookies,
+		TokenDuration:       opts.TokenDuration,
+		CookieDuration:      opts.CookieDuration,
+		PersistentTTL:       opts.PersistentTTL,
+		DisableXSRF:         opts.DisableXSRF,
+		DisableIAT:          opts.DisableIAT,
+		RotateXSRF:          opts.RotateXSRF,
+		XSRFGrace:           opts.XSRFGrace,
+		Leeway:              opts.JWTLeeway,
+		SecretTTL:           opts.SecretTTL,
+		JWTCookieName:       opts.JWTCookieName,
+		JWTCookieDomain:     opts.JWTCookieDomain,
+		JWTHeaderKey:        opts.JWTHeaderKey,
+		XSRFCookieName:      opts.XSRFCookieName,
+		XSRFHeaderKey:       opts.XSRFHeaderKey,
+		SendJWTHeader:       opts.SendJWTHeader,
+		TokenHeader:         opts.TokenHeader,
+		JWTQuery:            opts.JWTQuery,
+		Issuer:              res.issuer,
+		AllowedIssuers:      opts.Issuers,
+		AudienceReader:      opts.AudienceReader,
+		AudienceInvalidator: opts.AudienceInvalidator,
+		AudSecrets:          opts.AudSecrets,
+		SameSite:            opts.SameSiteCookie,
+		AllowedAlgs:         opts.AllowedAlgs,
 	})
 
 	if opts.SecretReader == nil {
@@ -137,6 +306,7 @@ func NewService(opts Opts) (res *Service) {
 			URL:         opts.URL,
 			RoutePath:   opts.AvatarRoutePath,
 			ResizeLimit: opts.AvatarResizeLimit,
+			Default:     opts.AvatarDefault,
 			L:           res.logger,
 		}
 		if res.avatarProxy.RoutePath == "" {
@@ -166,6 +336,12 @@ func (s *Service) Handlers() (authHandler, avatarHandler http.Handler) {
 			return
 		}
 
+		// providers with routes, for development
+		if s.opts.ProvidersDebug && elems[len(elems)-1] == "providers" {
+			rest.RenderJSON(w, s.providerRoutes(strings.Join(elems[:len(elems)-1], "/")))
+			return
+		}
+
 		// allow logout without specifying provider
 		if elems[len(elems)-1] == "logout" {
 			if len(s.providers) == 0 {
@@ -173,7 +349,12 @@ func (s *Service) Handlers() (authHandler, avatarHandler http.Handler) {
 				rest.RenderJSON(w, rest.JSON{"error": "providers not defined"})
 				return
 			}
-			s.providers[0].Handler(w, r)
+			p := s.providers[0]
+			p.ProviderInfo = s.opts.ProviderInfo
+			if s.opts.SignResponses {
+				p.Signer = s.jwtService
+			}
+			p.Handler(w, r)
 			return
 		}
 
@@ -206,16 +387,82 @@ func (s *Service) Handlers() (authHandler, avatarHandler http.Handler) {
 
 		// regular auth handlers
 		provName := elems[len(elems)-2]
+		if provName == "" || elems[len(elems)-1] == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			rest.RenderJSON(w, rest.JSON{"error": "provider or route not specified"})
+			return
+		}
 		p, err := s.Provider(provName)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			rest.RenderJSON(w, rest.JSON{"error": fmt.Sprintf("provider %s not supported", provName)})
+			w.WriteHeader(http.StatusNotFound)
+			rest.RenderJSON(w, rest.JSON{"error": fmt.Sprintf("provider %s not found", provName)})
 			return
 		}
+		p.ProviderInfo = s.opts.ProviderInfo
+		if s.opts.SignResponses {
+			p.Signer = s.jwtService
+		}
 		p.Handler(w, r)
 	}
 
-	return http.HandlerFunc(ah), http.HandlerFunc(s.avatarProxy.Handler)
+	securedAh := func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range s.securityHeaders() {
+			w.Header().Set(k, v)
+		}
+		policy := s.opts.ContentSecurityPolicy
+		if policy == "" {
+			policy = defaultContentSecurityPolicy
+		}
+		if policy == "-" {
+			ah(w, r)
+			return
+		}
+		cw := &cspWriter{ResponseWriter: w, policy: policy}
+		ah(cw, r)
+		cw.flush()
+	}
+	// avatars cached by the proxy's own headers
+	avh := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		s.avatarProxy.Handler(w, r)
+	}
+
+	return http.HandlerFunc(securedAh), http.HandlerFunc(avh)
+}
+
+// providerRoutes returns names of registered providers with their routes under prefix, i.e. "/auth"
+func (s *Service) providerRoutes(prefix string) []rest.JSON {
+	res := make([]rest.JSON, 0, len(s.providers))
+	for _, p := range s.providers {
+		name := p.Name()
+		res = append(res, rest.JSON{
+			"name":     name,
+			"login":    prefix + "/" + name + "/login",
+			"callback": prefix + "/" + name + "/callback",
+			"logout":   prefix + "/" + name + "/logout",
+		})
+	}
+	return res
+}
+
+// securityHeaders returns default headers of auth responses with ReferrerPolicy and SecurityHeaders applied
+func (s *Service) securityHeaders() map[string]string {
+	res := make(map[string]string, len(defaultSecurityHeaders)+len(s.opts.SecurityHeaders))
+	for k, v := range defaultSecurityHeaders {
+		res[k] = v
+	}
+	if s.opts.ReferrerPolicy != "" {
+		res["Referrer-Policy"] = s.opts.ReferrerPolicy
+	}
+	for k, v := range s.opts.SecurityHeaders {
+		k = http.CanonicalHeaderKey(k)
+		if v == "" {
+			delete(res, k)
+			continue
+		}
+		res[k] = v
+	}
+	return res
 }
 
 // Middleware returns auth middleware
@@ -226,14 +473,27 @@ func (s *Service) Middleware() middleware.Authenticator {
 // AddProvider adds provider for given name
 func (s *Service) AddProvider(name, cid, csecret string) {
 	p := provider.Params{
-		URL:         s.opts.URL,
-		JwtService:  s.jwtService,
-		Issuer:      s.issuer,
-		AvatarSaver: s.avatarProxy,
-		UserSaver:   s.opts.UserSaver,
-		Cid:         cid,
-		Csecret:     csecret,
-		L:           s.logger,
+		URL:              s.opts.URL,
+		JwtService:       s.jwtService,
+		Issuer:           s.issuer,
+		IssuerFunc:       s.opts.IssuerFunc,
+		AvatarSaver:      s.avatarProxy,
+		AvatarFetch:      s.avatarFetch(name),
+		PictureUpdate:    s.opts.PictureUpdate,
+		OAuthRetry:       s.opts.OAuthRetry,
+		StateTTL:         s.opts.OAuthStateTTL,
+		MaxPendingLogins: s.opts.OAuthMaxPending,
+		RedirectStatus:   s.opts.RedirectStatus,
+		FormPost:         s.formPost(name),
+		FirstLoginStore:  s.opts.FirstLoginStore,
+		FirstLoginFields: s.opts.FirstLoginFields[name],
+		UserSaver:        s.opts.UserSaver,
+		MaxBodySize:      s.opts.MaxBodySize,
+		Transport:        s.opts.HTTPTransport,
+		Cid:              cid,
+		Csecret:          csecret,
+		L:                s.logger,
+		DevTLS:           s.opts.DevTLS,
 	}
 
 	switch strings.ToLower(name) {
@@ -265,14 +525,23 @@ func (s *Service) AddProvider(name, cid, csecret string) {
 // AddDevProvider with a custom host and port
 func (s *Service) AddDevProvider(host string, port int) {
 	p := provider.Params{
-		URL:         s.opts.URL,
-		JwtService:  s.jwtService,
-		Issuer:      s.issuer,
-		AvatarSaver: s.avatarProxy,
-		UserSaver:   s.opts.UserSaver,
-		L:           s.logger,
-		Port:        port,
-		Host:        host,
+		URL:            s.opts.URL,
+		JwtService:     s.jwtService,
+		Issuer:         s.issuer,
+		IssuerFunc:     s.opts.IssuerFunc,
+		AvatarSaver:    s.avatarProxy,
+		AvatarFetch:    s.avatarFetch("dev"),
+		PictureUpdate:  s.opts.PictureUpdate,
+		OAuthRetry:     s.opts.OAuthRetry,
+		StateTTL:       s.opts.OAuthStateTTL,
+		RedirectStatus: s.opts.RedirectStatus,
+		UserSaver:      s.opts.UserSaver,
+		MaxBodySize:    s.opts.MaxBodySize,
+		Transport:      s.opts.HTTPTransport,
+		L:              s.logger,
+		Port:           port,
+		Host:           host,
+		DevTLS:         s.opts.DevTLS,
 	}
 	s.providers = append(s.providers, provider.NewService(provider.NewDev(p)))
 }
@@ -280,12 +549,22 @@ func (s *Service) AddDevProvider(host string, port int) {
 // AddAppleProvider allow SignIn with Apple ID
 func (s *Service) AddAppleProvider(appleConfig provider.AppleConfig, privKeyLoader provider.PrivateKeyLoaderInterface) error {
 	p := provider.Params{
-		URL:         s.opts.URL,
-		JwtService:  s.jwtService,
-		Issuer:      s.issuer,
-		AvatarSaver: s.avatarProxy,
-		UserSaver:   s.opts.UserSaver,
-		L:           s.logger,
+		URL:              s.opts.URL,
+		JwtService:       s.jwtService,
+		Issuer:           s.issuer,
+		IssuerFunc:       s.opts.IssuerFunc,
+		AvatarSaver:      s.avatarProxy,
+		AvatarFetch:      s.avatarFetch("apple"),
+		PictureUpdate:    s.opts.PictureUpdate,
+		OAuthRetry:       s.opts.OAuthRetry,
+		StateTTL:         s.opts.OAuthStateTTL,
+		RedirectStatus:   s.opts.RedirectStatus,
+		FirstLoginStore:  s.opts.FirstLoginStore,
+		FirstLoginFields: s.opts.FirstLoginFields["apple"],
+		UserSaver:        s.opts.UserSaver,
+		MaxBodySize:      s.opts.MaxBodySize,
+		Transport:        s.opts.HTTPTransport,
+		L:                s.logger,
 	}
 
 	// Error checking at create need for catch one when apple private key init
@@ -301,14 +580,26 @@ func (s *Service) AddAppleProvider(appleConfig provider.AppleConfig, privKeyLoad
 // AddCustomProvider adds custom provider (e.g. https://gopkg.in/oauth2.v3)
 func (s *Service) AddCustomProvider(name string, client Client, copts provider.CustomHandlerOpt) {
 	p := provider.Params{
-		URL:         s.opts.URL,
-		JwtService:  s.jwtService,
-		Issuer:      s.issuer,
-		AvatarSaver: s.avatarProxy,
-		UserSaver:   s.opts.UserSaver,
-		Cid:         client.Cid,
-		Csecret:     client.Csecret,
-		L:           s.logger,
+		URL:              s.opts.URL,
+		JwtService:       s.jwtService,
+		Issuer:           s.issuer,
+		IssuerFunc:       s.opts.IssuerFunc,
+		AvatarSaver:      s.avatarProxy,
+		AvatarFetch:      s.avatarFetch(name),
+		PictureUpdate:    s.opts.PictureUpdate,
+		OAuthRetry:       s.opts.OAuthRetry,
+		StateTTL:         s.opts.OAuthStateTTL,
+		MaxPendingLogins: s.opts.OAuthMaxPending,
+		RedirectStatus:   s.opts.RedirectStatus,
+		FormPost:         s.formPost(name),
+		FirstLoginStore:  s.opts.FirstLoginStore,
+		FirstLoginFields: s.opts.FirstLoginFields[name],
+		UserSaver:        s.opts.UserSaver,
+		MaxBodySize:      s.opts.MaxBodySize,
+		Transport:        s.opts.HTTPTransport,
+		Cid:              client.Cid,
+		Csecret:          client.Csecret,
+		L:                s.logger,
 	}
 
 	s.providers = append(s.providers, provider.NewService(provider.NewCustom(name, p, copts)))
@@ -318,14 +609,8 @@ func (s *Service) AddCustomProvider(name string, client Client, copts provider.C
 // AddDirectProvider adds provider with direct check against data store
 // it doesn't do any handshake and uses provided credChecker to verify user and password from the request
 func (s *Service) AddDirectProvider(credChecker provider.CredChecker) {
-	dh := provider.DirectHandler{
-		L:            s.logger,
-		ProviderName: "direct",
-		Issuer:       s.issuer,
-		TokenService: s.jwtService,
-		CredChecker:  credChecker,
-		AvatarSaver:  s.avatarProxy,
-	}
+	dh := s.directHandler()
+	dh.CredChecker = credChecker
 	s.providers = append(s.providers, provider.NewService(dh))
 	s.authMiddleware.Providers = s.providers
 }
@@ -334,37 +619,214 @@ func (s *Service) AddDirectProvider(credChecker provider.CredChecker) {
 // to modify user's ID on the client side.
 // it doesn't do any handshake and uses provided credChecker to verify user and password from the request
 func (s *Service) AddDirectProviderWithUserIDFunc(credChecker provider.CredChecker, ufn provider.UserIDFunc) {
-	dh := provider.DirectHandler{
-		L:            s.logger,
-		ProviderName: "direct",
-		Issuer:       s.issuer,
-		TokenService: s.jwtService,
-		CredChecker:  credChecker,
-		AvatarSaver:  s.avatarProxy,
-		UserIDFunc:   ufn,
+	dh := s.directHandler()
+	dh.CredChecker = credChecker
+	dh.UserIDFunc = ufn
+	s.providers = append(s.providers, provider.NewService(dh))
+	s.authMiddleware.Providers = s.providers
+}
+
+// AddDirectProviderWithCtx adds provider with direct check against data store with context-aware checker.
+// The checker gets request's context limited by Opts.DirectCheckTimeout, client IP, user agent and audience.
+func (s *Service) AddDirectProviderWithCtx(credChecker provider.CredCheckerCtx) {
+	dh := s.directHandler()
+	dh.CredCheckerCtx = credChecker
+	s.providers = append(s.providers, provider.NewService(dh))
+	s.authMiddleware.Providers = s.providers
+}
+
+// AddAnonymousProvider adds direct provider allowing login with any valid user name without password.
+// Names are normalized and validated by checker, rejected names responded with 400 and the reason code.
+func (s *Service) AddAnonymousProvider(name string, checker provider.AnonymousCredChecker) {
+	dh := s.directHandler()
+	dh.ProviderName = name
+	dh.AvatarFetch = s.avatarFetch(name)
+	dh.CredChecker = checker
+	dh.Lockout, dh.PasswordReset, dh.PasswordSetter, dh.TOTP = nil, nil, nil, nil // no passwords to protect
+	if s.opts.AnonymousID != nil {
+		pid := *s.opts.AnonymousID
+		pid.Secure = pid.Secure || s.opts.SecureCookies
+		dh.PersistentID = &pid
 	}
 	s.providers = append(s.providers, provider.NewService(dh))
 	s.authMiddleware.Providers = s.providers
 }
 
-// AddVerifProvider adds provider user's verification sent by sender
-func (s *Service) AddVerifProvider(name string, tmpl *template.Template, sender provider.Sender, withPassword bool) {
-	dh := provider.VerifyHandler{
+// AddLDAPProvider adds direct provider checking credentials against LDAP or Active Directory.
+// Incorrect credentials responded with 401, unreachable directory with 502. Passwords are managed by the directory,
+// so password reset and change are not available.
+func (s *Service) AddLDAPProvider(name string, checker *provider.LDAPCredChecker) {
+	if checker.L == nil {
+		checker.L = s.logger
+	}
+	dh := s.directHandler()
+	dh.ProviderName = name
+	dh.AvatarFetch = s.avatarFetch(name)
+	dh.CredCheckerCtx = checker
+	dh.FailedStatus = http.StatusUnauthorized
+	dh.PasswordReset, dh.PasswordSetter = nil, nil
+	s.providers = append(s.providers, provider.NewService(dh))
+	s.authMiddleware.Providers = s.providers
+}
+
+// AddSecondFactorProvider adds provider confirming sessions made by any other provider with TOTP code, for routes
+// protected with StepUp middleware. TOTP can be shared with Opts.DirectTOTP, recovery codes store is optional.
+func (s *Service) AddSecondFactorProvider(name string, totp *provider.TOTP, recovery provider.RecoveryCodeStore) {
+	s.providers = append(s.providers, provider.NewService(provider.SecondFactorHandler{
 		L:            s.logger,
 		ProviderName: name,
-		Issuer:       s.issuer,
 		TokenService: s.jwtService,
-		AvatarSaver:  s.avatarProxy,
-		UserSaver:    s.opts.UserSaver,
-		Sender:       sender,
-		Template:     tmpl,
-		UseGravatar:  s.useGravatar,
-		WithPassword: withPassword,
+		Issuer:       s.issuer,
+		IssuerFunc:   s.opts.IssuerFunc,
+		TOTP:         totp,
+		Recovery:     recovery,
+		Audit:        s.opts.AuditHook,
+		MaxBodySize:  s.opts.MaxBodySize,
+
+		TrustedProxies: s.trustedProxies,
+	}))
+	s.authMiddleware.Providers = s.providers
+}
+
+// AddSMSProvider adds provider authorizing users by one-time code sent to the phone number.
+// Sender, limits and stores set in h, common options filled by the service.
+func (s *Service) AddSMSProvider(name string, h provider.SMSHandler) {
+	h.L = s.logger
+	h.ProviderName = name
+	h.TokenService = s.jwtService
+	h.Issuer = s.issuer
+	h.IssuerFunc = s.opts.IssuerFunc
+	h.TrustedProxies = s.trustedProxies
+	if h.MaxBodySize == 0 {
+		h.MaxBodySize = s.opts.MaxBodySize
+	}
+	s.providers = append(s.providers, provider.NewService(h))
+	s.authMiddleware.Providers = s.providers
+}
+
+// directHandler makes direct provider's handler with common options, without credentials checker
+func (s *Service) directHandler() provider.DirectHandler {
+	return provider.DirectHandler{
+		L:               s.logger,
+		ProviderName:    "direct",
+		Issuer:          s.issuer,
+		IssuerFunc:      s.opts.IssuerFunc,
+		TokenService:    s.jwtService,
+		AvatarSaver:     s.avatarProxy,
+		AvatarFetch:     s.avatarFetch("direct"),
+		PictureUpdate:   s.opts.PictureUpdate,
+		Lockout:         s.opts.DirectLockout,
+		Audit:           s.opts.AuditHook,
+		TrustedProxies:  s.trustedProxies,
+		PasswordReset:   s.opts.DirectPasswordReset,
+		PasswordSetter:  s.opts.DirectPasswordSetter,
+		PasswordPolicy:  s.opts.PasswordPolicy,
+		Invalidator:     s.opts.UserInvalidator,
+		CheckTimeout:    s.opts.DirectCheckTimeout,
+		NoStoreIDPrefix: s.opts.DirectNoIDPrefix,
+		TOTP:            s.opts.DirectTOTP,
+		MaxBodySize:     s.opts.MaxBodySize,
+	}
+}
+
+// AddVerifProvider adds provider user's verification sent by sender.
+// Provider with invalid options, i.e. negative VerifTokenTTL, logged and not added.
+func (s *Service) AddVerifProvider(name string, tmpl *template.Template, sender provider.Sender, withPassword bool) {
+	dh := s.verifHandler(name, sender, withPassword)
+	dh.Template = tmpl
+	s.addVerifHandler(dh)
+}
+
+// AddVerifProviderWithTemplates adds provider with confirmation templates by site and locale of the request
+func (s *Service) AddVerifProviderWithTemplates(name string, templates *provider.TemplateRegistry, sender provider.Sender,
+	withPassword bool) {
+	dh := s.verifHandler(name, sender, withPassword)
+	dh.Templates = templates
+	s.addVerifHandler(dh)
+}
+
+// addVerifHandler validates verified provider's handler and adds it, invalid one logged and not added
+func (s *Service) addVerifHandler(dh provider.VerifyHandler) {
+	if err := dh.Validate(); err != nil {
+		s.logger.Logf("[ERROR] verified provider %s not added, %v", dh.ProviderName, err)
+		return
 	}
 	s.providers = append(s.providers, provider.NewService(dh))
 	s.authMiddleware.Providers = s.providers
 }
 
+// verifHandler makes verified provider's handler with common options, without template
+func (s *Service) verifHandler(name string, sender provider.Sender, withPassword bool) provider.VerifyHandler {
+	return provider.VerifyHandler{
+		L:                    s.logger,
+		ProviderName:         name,
+		Issuer:               s.issuer,
+		IssuerFunc:           s.opts.IssuerFunc,
+		TokenService:         s.jwtService,
+		AvatarSaver:          s.avatarProxy,
+		AvatarFetch:          s.avatarFetch(name),
+		PictureUpdate:        s.opts.PictureUpdate,
+		UserSaver:            s.opts.UserSaver,
+		Sender:               sender,
+		UseGravatar:          s.useGravatar,
+		Gravatar:             s.gravatar,
+		WithPassword:         withPassword,
+		PasswordPolicy:       s.opts.PasswordPolicy,
+		SharedState:          s.opts.VerifSharedState,
+		BindNonce:            s.opts.VerifBindNonce,
+		SendInterval:         s.opts.VerifSendInterval,
+		LimitStore:           s.opts.VerifLimitStore,
+		MaxSendsPerAddress:   s.opts.VerifMaxPerAddr,
+		MaxSendsPerIP:        s.opts.VerifMaxPerIP,
+		TrustedProxies:       s.trustedProxies,
+		SendWindow:           s.opts.VerifSendWindow,
+		MaxConcurrentSends:   s.opts.VerifMaxSends,
+		SendWait:             s.opts.VerifSendWait,
+		LoginLockTTL:         s.opts.VerifLoginLock,
+		LoginLockWait:        s.opts.VerifLockWait,
+		RequireTLS:           s.opts.VerifRequireTLS,
+		TrustProxyTLS:        s.opts.VerifTrustProxy,
+		CorrelationTracking:  s.opts.VerifCorrelation,
+		CorrelationFunc:      s.opts.VerifCorrelationFunc,
+		AuthTTLFunc:          s.opts.VerifAuthTTLFunc,
+		TokenLifetime:        s.opts.VerifTokenTTL,
+		CredentialsTTL:       s.opts.VerifCredsTTL,
+		PasswordChecker:      s.opts.VerifPassChecker,
+		PasswordSaver:        s.opts.VerifPassSaver,
+		Lockout:              s.opts.VerifLockout,
+		MaxBodySize:          s.opts.MaxBodySize,
+		AllowNumericPassword: s.opts.VerifNumericPass,
+		LinkBypassesPassword: s.opts.VerifLinkBypass,
+		RedirectStatus:       s.opts.RedirectStatus,
+		AllowedRedirects:     s.opts.VerifRedirects,
+		ConfirmAttrsAllowed:  s.opts.VerifConfirmAttrs,
+		MaxConfirmAttrsSize:  s.opts.VerifConfirmAttrsMax,
+		SiteDisplayName:      s.opts.SiteDisplayName,
+		TemplateData:         s.opts.VerifTemplateData,
+		DomainBlocklist:      s.opts.VerifDomainBlocklist,
+		BlockSilently:        s.opts.VerifBlockSilently,
+		AddressValidator:     s.emailCheck(name),
+		Sanitizer:            s.opts.VerifSanitizer,
+		SendCode:             hasName(s.opts.VerifSendCode, name),
+		CodeStore:            s.opts.VerifCodeStore,
+		MaxCodeAttempts:      s.opts.VerifCodeTries,
+		UsedTokens:           s.opts.VerifUsedStore,
+	}
+}
+
+// upsertUser saves user with UserUpsert and calls OnUserCreated for the new one
+func (s *Service) upsertUser(u token.User) error {
+	isNew, err := s.opts.UserUpsert(u)
+	if err != nil {
+		return err
+	}
+	if isNew && s.opts.OnUserCreated != nil {
+		u.Password = "" // passed to the saver only, with password set by verified provider
+		s.opts.OnUserCreated(u)
+	}
+	return nil
+}
+
 // AddCustomHandler adds user-defined self-implemented handler of auth provider
 func (s *Service) AddCustomHandler(handler provider.Provider) {
 	s.providers = append(s.providers, provider.NewService(handler))
@@ -405,3 +867,106 @@ func (s *Service) TokenService() *token.Service {
 func (s *Service) AvatarProxy() *avatar.Proxy {
 	return s.avatarProxy
 }
+
+// avatarFetch returns AvatarFetch of the provider with AvatarSkip override and HTTPTransport applied
+func (s *Service) avatarFetch(name string) provider.AvatarFetch {
+	res := s.opts.AvatarFetch
+	if res.Transport == nil {
+		res.Transport = s.opts.HTTPTransport
+	}
+	if skip, ok := s.opts.AvatarSkip[name]; ok {
+		res.Skip = skip
+	}
+	return res
+}
+
+// formPost checks if oauth2 provider is set to post callback data as form
+func (s *Service) formPost(name string) bool {
+	return hasName(s.opts.OAuthFormPost, name)
+}
+
+// emailCheck returns validator of email addresses for verified provider listed in VerifEmailCheck
+func (s *Service) emailCheck(name string) provider.AddressValidator {
+	if !hasName(s.opts.VerifEmailCheck, name) {
+		return nil
+	}
+	return provider.EmailAddress
+}
+
+// hasName checks if provider name is in the list, case-insensitive
+func hasName(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// chainValidators makes validator accepting token only if all non-nil validators accept it
+func chainValidators(validators ...token.Validator) token.Validator {
+	return token.ValidatorFunc(func(tkn string, claims token.Claims) bool {
+		for _, v := range validators {
+			if v != nil && !v.Validate(tkn, claims) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// cspWriter sets Content-Security-Policy on HTML responses. Type of response without Content-Type detected
+// from its body, so status of such response held till the first Write.
+type cspWriter struct {
+	http.ResponseWriter
+	policy  string
+	status  int  // held status, waiting for body to detect type
+	written bool // header passed to ResponseWriter
+}
+
+// WriteHeader passes header with policy set for HTML, or holds it for response without Content-Type
+func (c *cspWriter) WriteHeader(code int) {
+	if c.written || c.status != 0 {
+		return
+	}
+	if c.Header().Get("Content-Type") == "" {
+		c.status = code
+		return
+	}
+	c.written = true
+	c.setPolicy(nil)
+	c.ResponseWriter.WriteHeader(code)
+}
+
+// Write sets policy for HTML body and passes held status before the first write
+func (c *cspWriter) Write(b []byte) (int, error) {
+	if !c.written {
+		c.written = true
+		c.setPolicy(b)
+		if c.status != 0 {
+			c.ResponseWriter.WriteHeader(c.status)
+		}
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+// flush passes held status of response without body
+func (c *cspWriter) flush() {
+	if !c.written && c.status != 0 {
+		c.written = true
+		c.ResponseWriter.WriteHeader(c.status)
+	}
+}
+
+func (c *cspWriter) setPolicy(body []byte) {
+	if c.Header().Get("Content-Security-Policy") != "" {
+		return // set by handler or SecurityHeaders
+	}
+	ct := c.Header().Get("Content-Type")
+	if ct == "" && len(body) > 0 {
+		ct = http.DetectContentType(body)
+	}
+	if strings.HasPrefix(strings.ToLower(strings.TrimSpace(ct)), "text/html") {
+		c.Header().Set("Content-Security-Policy", c.policy)
+	}
+}
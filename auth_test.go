@@ -2,22 +2,33 @@ package auth
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha1" //nolint
+	"encoding/base32"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
 	"io"
 	"net"
 	"net/http"
 	"net/http/cookiejar"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
 
 	"github.com/go-pkgz/auth/avatar"
+	"github.com/go-pkgz/auth/httpclient"
 	"github.com/go-pkgz/auth/logger"
 	"github.com/go-pkgz/auth/provider"
 	"github.com/go-pkgz/auth/token"
@@ -318,6 +329,83 @@ func TestLogoutNoProviders(t *testing.T) {
 	assert.Equal(t, "{\"error\":\"providers not defined\"}\n", string(b))
 }
 
+func TestProviderInfo(t *testing.T) {
+	svc := NewService(Opts{
+		SecretReader: token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+		AvatarStore:  avatar.NewNoOp(),
+		Logger:       logger.Std{},
+		ProviderInfo: true,
+	})
+	svc.AddDirectProvider(provider.CredCheckerFunc(func(user, password string) (ok bool, err error) {
+		return user == "dev_direct" && password == "password", nil
+	}))
+	authRoute, _ := svc.Handlers()
+
+	mux := http.NewServeMux()
+	mux.Handle("/auth/", authRoute)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/auth/direct/login?user=dev_direct&passwd=bad")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 403, resp.StatusCode)
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, `{"error":"incorrect user or password","provider_name":"direct","provider_type":"direct"}`+"\n", string(b))
+
+	resp, err = http.Get(ts.URL + "/auth/direct/login?user=dev_direct&passwd=password")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	b, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), `"name":"dev_direct"`)
+	assert.Contains(t, string(b), `"provider_name":"direct","provider_type":"direct"`)
+}
+
+func TestProvidersDebug(t *testing.T) {
+	opts := Opts{
+		SecretReader: token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+		AvatarStore:  avatar.NewNoOp(),
+		Logger:       logger.Std{},
+	}
+	svc := NewService(opts)
+	svc.AddProvider("dev", "", "")
+	svc.AddDirectProvider(provider.CredCheckerFunc(func(string, string) (bool, error) { return false, nil }))
+	authRoute, _ := svc.Handlers()
+	ts := httptest.NewServer(authRoute)
+	defer ts.Close()
+
+	get := func(path string) (status int, body string) {
+		resp, err := http.Get(ts.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(b)
+	}
+
+	status, body := get("/auth/unknown/login")
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Equal(t, `{"error":"provider unknown not found"}`+"\n", body)
+
+	status, _ = get("/auth/providers")
+	assert.Equal(t, http.StatusNotFound, status, "disabled by default")
+
+	opts.ProvidersDebug = true
+	svc = NewService(opts)
+	svc.AddProvider("dev", "", "")
+	svc.AddDirectProvider(provider.CredCheckerFunc(func(string, string) (bool, error) { return false, nil }))
+	authRoute, _ = svc.Handlers()
+	ts.Config.Handler = authRoute
+
+	status, body = get("/auth/providers")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, `[{"callback":"/auth/dev/callback","login":"/auth/dev/login","logout":"/auth/dev/logout","name":"dev"},`+
+		`{"callback":"/auth/direct/callback","login":"/auth/direct/login","logout":"/auth/direct/logout","name":"direct"}]`+"\n", body)
+}
+
 func TestBadRequests(t *testing.T) {
 	_, teardown := prepService(t)
 	defer teardown()
@@ -325,8 +413,11 @@ func TestBadRequests(t *testing.T) {
 	client := &http.Client{Timeout: 5 * time.Second}
 	resp, err := client.Get("http://127.0.0.1:8089/auth/bad/login")
 	require.Nil(t, err)
-	assert.Equal(t, 400, resp.StatusCode)
-	defer resp.Body.Close()
+	assert.Equal(t, 404, resp.StatusCode)
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, `{"error":"provider bad not found"}`+"\n", string(b))
+	assert.NoError(t, resp.Body.Close())
 
 	resp, err = client.Get("http://127.0.0.1:8089/auth")
 	require.Nil(t, err)
@@ -411,6 +502,228 @@ func TestDirectProvider_WithCustomUserIDFunc(t *testing.T) {
 	assert.NoError(t, resp.Body.Close())
 }
 
+func TestDirectProvider_WithUserCredChecker(t *testing.T) {
+	svc := NewService(Opts{
+		SecretReader:   token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+		TokenDuration:  time.Hour,
+		CookieDuration: time.Hour * 24,
+		DisableXSRF:    true,
+		AvatarStore:    avatar.NewNoOp(),
+		Logger:         logger.Std{},
+	})
+	svc.AddDirectProvider(provider.UserCredCheckerFunc(func(user, password string) (bool, token.User, error) {
+		if password != "password" {
+			return false, token.User{}, nil
+		}
+		u := token.User{ID: "db-" + user, Name: "Dev " + user, Email: user + "@example.com"}
+		if user == "admin" {
+			u.SetRole("admin")
+			u.SetStrAttr("team", "ops")
+		}
+		return true, u, nil
+	}))
+
+	m := svc.Middleware()
+	mux := http.NewServeMux()
+	mux.Handle("/admin", m.Auth(m.RBAC("admin")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, err := token.GetUserInfo(r)
+		require.NoError(t, err)
+		_, _ = w.Write([]byte(u.ID + " " + u.StrAttr("team")))
+	}))))
+	authRoute, _ := svc.Handlers()
+	mux.Handle("/auth/", authRoute)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	login := func(user string) *http.Client {
+		jar, err := cookiejar.New(nil)
+		require.NoError(t, err)
+		client := &http.Client{Jar: jar, Timeout: 5 * time.Second}
+		resp, err := client.Get(ts.URL + "/auth/direct/login?user=" + user + "&passwd=password")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(body), `"name":"Dev `+user+`","id":"direct_db-`+user+`"`)
+		assert.Contains(t, string(body), `"email":"`+user+`@example.com"`)
+		return client
+	}
+
+	resp, err := login("admin").Get(ts.URL + "/admin")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "direct_db-admin ops", string(body))
+
+	resp, err = login("user1").Get(ts.URL + "/admin")
+	require.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestDirectProvider_PasswordResetInvalidatesSessions(t *testing.T) {
+	passwords := map[string]string{"dev_user": "password"}
+	sent := make(chan string, 1)
+	svc := NewService(Opts{
+		SecretReader:    token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+		TokenDuration:   time.Hour,
+		CookieDuration:  time.Hour * 24,
+		DisableXSRF:     true,
+		AvatarStore:     avatar.NewNoOp(),
+		Logger:          logger.Std{},
+		UserInvalidator: token.NewMemUserInvalidator(),
+		DirectPasswordReset: &provider.PasswordReset{
+			Store:    resetStore{passwords: passwords},
+			Sender:   provider.SenderFunc(func(_, text string) error { sent <- text; return nil }),
+			Template: template.Must(template.New("reset").Parse("{{.Token}}")),
+		},
+	})
+	svc.AddDirectProvider(provider.CredCheckerFunc(func(user, password string) (ok bool, err error) {
+		return passwords[user] == password, nil
+	}))
+
+	m := svc.Middleware()
+	mux := http.NewServeMux()
+	mux.Handle("/private", m.Auth(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("private"))
+	})))
+	authRoute, _ := svc.Handlers()
+	mux.Handle("/auth/", authRoute)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	client := &http.Client{Jar: jar, Timeout: 5 * time.Second}
+	resp, err := client.Get(ts.URL + "/auth/direct/login?user=dev_user&passwd=password")
+	require.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = client.Get(ts.URL + "/private")
+	require.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	time.Sleep(time.Second) // iat has seconds resolution
+
+	resp, err = http.Post(ts.URL+"/auth/direct/reset-request", "application/json", strings.NewReader(`{"user":"dev_user"}`))
+	require.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var resetToken string
+	select {
+	case resetToken = <-sent: // sent in background
+	case <-time.After(time.Second):
+		t.Fatal("reset token not sent")
+	}
+
+	resp, err = http.Post(ts.URL+"/auth/direct/reset", "application/json",
+		strings.NewReader(`{"token":"`+resetToken+`","passwd":"new-password"}`))
+	require.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "new-password", passwords["dev_user"])
+
+	resp, err = client.Get(ts.URL + "/private")
+	require.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "old session invalidated")
+
+	resp, err = client.Get(ts.URL + "/auth/direct/login?user=dev_user&passwd=new-password")
+	require.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, err = client.Get(ts.URL + "/private")
+	require.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "new session accepted")
+}
+
+func TestDirectProvider_PasswordChange(t *testing.T) {
+	passwords := map[string]string{"dev_user": "password"}
+	svc := NewService(Opts{
+		SecretReader:         token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+		TokenDuration:        time.Hour,
+		CookieDuration:       time.Hour * 24,
+		AvatarStore:          avatar.NewNoOp(),
+		Logger:               logger.Std{},
+		UserInvalidator:      token.NewMemUserInvalidator(),
+		DirectPasswordSetter: resetStore{passwords: passwords},
+		PasswordPolicy:       provider.DefaultPasswordPolicy{},
+	})
+	svc.AddDirectProvider(provider.CredCheckerFunc(func(user, password string) (ok bool, err error) {
+		return passwords[user] == password, nil
+	}))
+
+	m := svc.Middleware()
+	mux := http.NewServeMux()
+	mux.Handle("/private", m.Auth(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("private"))
+	})))
+	authRoute, _ := svc.Handlers()
+	mux.Handle("/auth/", authRoute)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	// do makes request with xsrf header from client's cookie
+	do := func(client *http.Client, method, path, body string) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		for _, c := range client.Jar.Cookies(req.URL) {
+			if c.Name == "XSRF-TOKEN" {
+				req.Header.Set("X-XSRF-TOKEN", c.Value)
+			}
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		assert.NoError(t, resp.Body.Close())
+		return resp
+	}
+	login := func() *http.Client {
+		jar, err := cookiejar.New(nil)
+		require.NoError(t, err)
+		client := &http.Client{Jar: jar, Timeout: 5 * time.Second}
+		resp := do(client, "GET", "/auth/direct/login?user=dev_user&passwd="+passwords["dev_user"], "")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		return client
+	}
+
+	device1, device2 := login(), login()
+	assert.Equal(t, http.StatusOK, do(device2, "GET", "/private", "").StatusCode)
+
+	time.Sleep(time.Second) // iat has seconds resolution
+
+	// no xsrf header
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+	for _, c := range device1.Jar.Cookies(u) {
+		if c.Name == "JWT" {
+			jar.SetCookies(u, []*http.Cookie{c})
+		}
+	}
+	noXsrf := &http.Client{Jar: jar, Timeout: 5 * time.Second}
+	resp := do(noXsrf, "POST", "/auth/direct/password", `{"old":"password","new":"new-password"}`)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = do(device1, "POST", "/auth/direct/password", `{"old":"bad","new":"new-password"}`)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp = do(device1, "POST", "/auth/direct/password", `{"old":"password","new":"short"}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = do(device1, "POST", "/auth/direct/password", `{"old":"password","new":"new-password"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "new-password", passwords["dev_user"])
+
+	assert.Equal(t, http.StatusOK, do(device1, "GET", "/private", "").StatusCode, "re-issued session works")
+	assert.Equal(t, http.StatusUnauthorized, do(device2, "GET", "/private", "").StatusCode, "other session invalidated")
+}
+
 func TestVerifProvider(t *testing.T) {
 	_, teardown := prepService(t)
 	defer teardown()
@@ -450,6 +763,273 @@ func TestVerifProvider(t *testing.T) {
 	assert.NotEqual(t, "", resp.Cookies()[1].Value, "xsrf cookie set")
 }
 
+func TestUserUpsert(t *testing.T) {
+	saved := map[string]token.User{}
+	var created []token.User
+	svc := NewService(Opts{
+		SecretReader: token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+		UserSaver:    func(token.User) error { return errors.New("not used with UserUpsert") },
+		UserUpsert: func(u token.User) (bool, error) {
+			if u.Name == "bad" {
+				return true, errors.New("failed")
+			}
+			_, found := saved[u.ID]
+			saved[u.ID] = u
+			return !found, nil
+		},
+		OnUserCreated: func(u token.User) { created = append(created, u) },
+	})
+
+	u := token.User{ID: "email_123", Name: "dev", Password: "secret password"}
+	require.NoError(t, svc.opts.UserSaver(u))
+	require.NoError(t, svc.opts.UserSaver(u), "update")
+	assert.Error(t, svc.opts.UserSaver(token.User{ID: "email_456", Name: "bad"}))
+	assert.Equal(t, []token.User{{ID: "email_123", Name: "dev"}}, created, "called once, without password")
+	assert.Equal(t, "secret password", saved["email_123"].Password)
+
+	// upsert passed to providers as user saver
+	svc.AddProvider("github", "cid", "csec")
+	p, err := svc.Provider("github")
+	require.NoError(t, err)
+	require.NoError(t, p.Provider.(provider.Oauth2Handler).UserSaver(token.User{ID: "github_123", Name: "dev"}))
+	assert.Equal(t, 2, len(created))
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	svc := NewService(Opts{
+		SecretReader: token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+		URL:          "http://127.0.0.1:8089",
+		AvatarStore:  avatar.NewLocalFS(t.TempDir()),
+		Logger:       logger.NoOp{},
+	})
+	svc.AddProvider("github", "cid", "csec")
+	authRoute, avaRoute := svc.Handlers()
+
+	for _, path := range []string{"/auth/github/login?from=http://example.com/secret", "/auth/user", "/auth/status",
+		"/auth/list", "/auth/logout", "/auth/unknown/login"} {
+		rr := httptest.NewRecorder()
+		authRoute.ServeHTTP(rr, httptest.NewRequest("GET", path, http.NoBody))
+		assert.Equal(t, "no-store", rr.Header().Get("Cache-Control"), path)
+		assert.Equal(t, "no-cache", rr.Header().Get("Pragma"), path)
+		assert.Equal(t, "nosniff", rr.Header().Get("X-Content-Type-Options"), path)
+		assert.Equal(t, "no-referrer", rr.Header().Get("Referrer-Policy"), path)
+	}
+
+	rr := httptest.NewRecorder()
+	avaRoute.ServeHTTP(rr, httptest.NewRequest("GET", "/ccfa2abd01667605b4e1fc4fcb91b1e1af323240.image", http.NoBody))
+	assert.Equal(t, "max-age=604800", rr.Header().Get("Cache-Control"), "avatars cached")
+	assert.Equal(t, "", rr.Header().Get("Pragma"))
+	assert.Equal(t, "nosniff", rr.Header().Get("X-Content-Type-Options"))
+
+	svc.opts.ReferrerPolicy = "strict-origin"
+	svc.opts.SecurityHeaders = map[string]string{"pragma": "", "Strict-Transport-Security": "max-age=31536000"}
+	rr = httptest.NewRecorder()
+	authRoute.ServeHTTP(rr, httptest.NewRequest("GET", "/auth/github/login", http.NoBody))
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, "strict-origin", rr.Header().Get("Referrer-Policy"))
+	assert.Equal(t, "max-age=31536000", rr.Header().Get("Strict-Transport-Security"))
+	assert.Equal(t, "", rr.Header().Get("Pragma"), "removed")
+	assert.Equal(t, "no-store", rr.Header().Get("Cache-Control"))
+}
+
+func TestContentSecurityPolicy(t *testing.T) {
+	svc := NewService(Opts{
+		SecretReader: token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+		URL:          "http://127.0.0.1:8089",
+		Logger:       logger.NoOp{},
+	})
+	svc.AddCustomHandler(htmlProvider{})
+	authRoute, _ := svc.Handlers()
+
+	rr := httptest.NewRecorder()
+	authRoute.ServeHTTP(rr, httptest.NewRequest("GET", "/auth/html/login", http.NoBody))
+	assert.Equal(t, http.StatusForbidden, rr.Code, "held status passed")
+	assert.Equal(t, defaultContentSecurityPolicy, rr.Header().Get("Content-Security-Policy"), "sniffed html")
+	assert.Equal(t, "<html><body>login</body></html>", rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	authRoute.ServeHTTP(rr, httptest.NewRequest("GET", "/auth/html/callback", http.NoBody))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "", rr.Header().Get("Content-Security-Policy"), "not for json")
+
+	rr = httptest.NewRecorder()
+	authRoute.ServeHTTP(rr, httptest.NewRequest("GET", "/auth/html/logout", http.NoBody))
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	assert.Equal(t, "", rr.Header().Get("Content-Security-Policy"), "no body, no policy")
+
+	rr = httptest.NewRecorder()
+	authRoute.ServeHTTP(rr, httptest.NewRequest("GET", "/auth/status", http.NoBody))
+	assert.Equal(t, "", rr.Header().Get("Content-Security-Policy"))
+
+	svc.opts.ContentSecurityPolicy = "default-src 'self'"
+	rr = httptest.NewRecorder()
+	authRoute.ServeHTTP(rr, httptest.NewRequest("GET", "/auth/html/login", http.NoBody))
+	assert.Equal(t, "default-src 'self'", rr.Header().Get("Content-Security-Policy"))
+
+	svc.opts.ContentSecurityPolicy = "-"
+	rr = httptest.NewRecorder()
+	authRoute.ServeHTTP(rr, httptest.NewRequest("GET", "/auth/html/login", http.NoBody))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Equal(t, "", rr.Header().Get("Content-Security-Policy"), "disabled")
+
+	svc.opts.ContentSecurityPolicy = ""
+	svc.opts.SecurityHeaders = map[string]string{"Content-Security-Policy": "sandbox"}
+	rr = httptest.NewRecorder()
+	authRoute.ServeHTTP(rr, httptest.NewRequest("GET", "/auth/html/login", http.NoBody))
+	assert.Equal(t, "sandbox", rr.Header().Get("Content-Security-Policy"), "set for all responses kept")
+}
+
+// htmlProvider serves HTML login page without Content-Type, JSON callback and empty logout
+type htmlProvider struct{}
+
+func (htmlProvider) Name() string { return "html" }
+
+func (htmlProvider) LoginHandler(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusForbidden)
+	_, _ = w.Write([]byte("<html><body>login</body></html>"))
+}
+
+func (htmlProvider) AuthHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(`{"status":"ok"}`))
+}
+
+func (htmlProvider) LogoutHandler(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func TestAvatarSkip(t *testing.T) {
+	var oauth *httptest.Server
+	oauth = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"access_token":"tkn","token_type":"Bearer","expires_in":3600}`))
+		case "/user":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = fmt.Fprintf(w, `{"id":"1","name":"dev_user","picture":"%s/pic.png"}`, oauth.URL)
+		case "/pic.png":
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write([]byte{0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer oauth.Close()
+
+	svc := NewService(Opts{
+		SecretReader: token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+		URL:          "http://127.0.0.1:8089",
+		DisableXSRF:  true,
+		AvatarStore:  avatar.NewLocalFS(t.TempDir()),
+		AvatarFetch:  provider.AvatarFetch{Skip: true},     // keep pictures by default
+		AvatarSkip:   map[string]bool{"selfhosted": false}, // and proxy ones of self-hosted provider
+		Logger:       logger.NoOp{},
+	})
+	copts := provider.CustomHandlerOpt{
+		Endpoint: oauth2.Endpoint{AuthURL: oauth.URL + "/auth", TokenURL: oauth.URL + "/token"},
+		InfoURL:  oauth.URL + "/user",
+		MapUserFn: func(data provider.UserData, _ []byte) token.User {
+			return token.User{ID: "custom_" + data.Value("id"), Name: data.Value("name"), Picture: data.Value("picture")}
+		},
+	}
+	svc.AddCustomProvider("cdn", Client{"cid", "csecret"}, copts)
+	svc.AddCustomProvider("selfhosted", Client{"cid", "csecret"}, copts)
+	authRoute, _ := svc.Handlers()
+	ts := httptest.NewServer(authRoute)
+	defer ts.Close()
+
+	login := func(name string) token.User {
+		jar, err := cookiejar.New(nil)
+		require.NoError(t, err)
+		client := &http.Client{Jar: jar, Timeout: 5 * time.Second,
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+		resp, err := client.Get(ts.URL + "/auth/" + name + "/login")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusFound, resp.StatusCode)
+		loc, err := url.Parse(resp.Header.Get("Location"))
+		require.NoError(t, err)
+		resp, err = client.Get(ts.URL + "/auth/" + name + "/callback?code=123&state=" + loc.Query().Get("state"))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		u := token.User{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&u))
+		return u
+	}
+
+	u := login("cdn")
+	assert.Equal(t, oauth.URL+"/pic.png", u.Picture, "original url kept")
+
+	u = login("selfhosted")
+	assert.True(t, strings.HasPrefix(u.Picture, "http://127.0.0.1:8089/avatar/"), u.Picture)
+	assert.True(t, strings.HasSuffix(u.Picture, ".image"), u.Picture)
+}
+
+func TestVerifTokenTTL(t *testing.T) {
+	var logs []string
+	l := logger.Func(func(format string, args ...interface{}) { logs = append(logs, fmt.Sprintf(format, args...)) })
+
+	svc := NewService(Opts{Logger: l, VerifTokenTTL: 2 * time.Hour, VerifCredsTTL: 5 * time.Minute})
+	h := svc.verifHandler("email", nil, true)
+	assert.Equal(t, 2*time.Hour, h.TokenLifetime)
+	assert.Equal(t, 5*time.Minute, h.CredentialsTTL)
+
+	// negative ttls rejected on construction, provider logged and not added
+	tmpl := template.Must(template.New("email").Parse("{{.Token}}"))
+	svc = NewService(Opts{Logger: l, VerifTokenTTL: -time.Minute})
+	svc.AddVerifProvider("email", tmpl, nil, true)
+	assert.Empty(t, svc.providers)
+	assert.Contains(t, logs, "[ERROR] verified provider email not added, negative TokenLifetime -1m0s")
+	svc = NewService(Opts{Logger: l, VerifCredsTTL: -time.Second})
+	svc.AddVerifProviderWithTemplates("email", &provider.TemplateRegistry{}, nil, true)
+	assert.Empty(t, svc.providers)
+	assert.Contains(t, logs, "[ERROR] verified provider email not added, negative CredentialsTTL -1s")
+
+	svc = NewService(Opts{Logger: l})
+	svc.AddVerifProvider("email", tmpl, nil, true)
+	assert.Len(t, svc.providers, 1)
+}
+
+func TestTrustedProxies(t *testing.T) {
+	var logs []string
+	l := logger.Func(func(format string, args ...interface{}) { logs = append(logs, fmt.Sprintf(format, args...)) })
+
+	req := httptest.NewRequest("GET", "/", http.NoBody)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+
+	svc1 := NewService(Opts{Logger: l, TrustedProxies: []string{"10.0.0.0/8"}})
+	svc2 := NewService(Opts{Logger: l, TrustedProxies: []string{"192.168.0.0/16"}})
+	svc3 := NewService(Opts{Logger: l})
+	assert.Equal(t, "1.2.3.4", svc1.directHandler().TrustedProxies.ClientIP(req))
+	assert.Equal(t, "1.2.3.4", svc1.verifHandler("email", nil, false).TrustedProxies.ClientIP(req))
+	assert.Equal(t, "1.2.3.4", svc1.authMiddleware.TrustedProxies.ClientIP(req))
+	assert.Equal(t, "10.0.0.1", svc2.directHandler().TrustedProxies.ClientIP(req), "proxies of svc1 not used")
+	assert.Equal(t, "10.0.0.1", svc3.directHandler().TrustedProxies.ClientIP(req), "empty list trusts no proxies")
+	assert.Equal(t, "10.0.0.1", provider.ClientIP(req), "defaults not changed")
+	assert.NotContains(t, strings.Join(logs, "\n"), "trusted proxies")
+
+	svc4 := NewService(Opts{Logger: l, TrustedProxies: []string{"10.0.0.0/8", "proxy.local"}})
+	assert.Equal(t, "10.0.0.1", svc4.directHandler().TrustedProxies.ClientIP(req), "invalid list trusts no proxies")
+	assert.Contains(t, logs, `[ERROR] trusted proxies ignored, forwarded client ip not trusted, invalid trusted proxy "proxy.local"`)
+}
+
+func TestHTTPTransport(t *testing.T) {
+	shared := httpclient.Transport()
+	tr := httpclient.NewTransport()
+	svc := NewService(Opts{HTTPTransport: tr})
+	assert.True(t, httpclient.Transport() == shared, "shared transport not changed")
+	assert.True(t, svc.avatarFetch("github").Transport == tr)
+
+	own := httpclient.NewTransport()
+	svc = NewService(Opts{HTTPTransport: tr, AvatarFetch: provider.AvatarFetch{Transport: own}})
+	assert.True(t, svc.avatarFetch("github").Transport == own, "avatar transport kept")
+
+	svc = NewService(Opts{})
+	assert.Nil(t, svc.avatarFetch("github").Transport)
+}
+
 func TestStatus(t *testing.T) {
 
 	svc, teardown := prepService(t)
@@ -488,6 +1068,99 @@ func TestStatus(t *testing.T) {
 
 }
 
+func TestIntegrationSecondFactor(t *testing.T) {
+	svc := NewService(Opts{
+		SecretReader:   token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+		TokenDuration:  time.Hour,
+		CookieDuration: time.Hour * 24,
+		Issuer:         "my-test-app",
+		URL:            "http://127.0.0.1:8090",
+		DisableXSRF:    true,
+		AvatarStore:    avatar.NewNoOp(),
+		Logger:         logger.Std{},
+	})
+	svc.AddDevProvider("localhost", 18085)
+	totpStore := &mockTOTPStore{secrets: map[string]string{}}
+	svc.AddSecondFactorProvider("2fa", &provider.TOTP{Store: totpStore}, nil)
+
+	devAuth, err := svc.DevAuth()
+	require.NoError(t, err)
+	devAuth.Automatic = true
+	go devAuth.Run(context.TODO())
+	defer devAuth.Shutdown()
+	time.Sleep(time.Millisecond * 50)
+
+	mux := http.NewServeMux()
+	authRoute, _ := svc.Handlers()
+	mux.Handle("/auth/", authRoute)
+	m := svc.Middleware()
+	mux.Handle("/admin", m.StepUp(time.Hour)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("admin area\n"))
+	})))
+	l, err := net.Listen("tcp", "127.0.0.1:8090")
+	require.NoError(t, err)
+	ts := httptest.NewUnstartedServer(mux)
+	assert.NoError(t, ts.Listener.Close())
+	ts.Listener = l
+	ts.Start()
+	defer ts.Close()
+
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	client := &http.Client{Jar: jar, Timeout: 5 * time.Second}
+	get := func(u string) int {
+		resp, e := client.Get(u)
+		require.NoError(t, e)
+		require.NoError(t, resp.Body.Close())
+		return resp.StatusCode
+	}
+	post := func(u string, vals url.Values) (int, []byte) {
+		resp, e := client.PostForm(u, vals)
+		require.NoError(t, e)
+		defer resp.Body.Close()
+		body, e := io.ReadAll(resp.Body)
+		require.NoError(t, e)
+		return resp.StatusCode, body
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, get("http://127.0.0.1:8090/admin"))
+	require.Equal(t, http.StatusOK, get("http://127.0.0.1:8090/auth/dev/login?site=my-test-site"))
+	assert.Equal(t, http.StatusForbidden, get("http://127.0.0.1:8090/admin"), "oauth2 session without second factor")
+
+	code, body := post("http://127.0.0.1:8090/auth/2fa/enroll", url.Values{})
+	require.Equal(t, http.StatusOK, code, string(body))
+	enrollResp := struct {
+		Secret string `json:"secret"`
+	}{}
+	require.NoError(t, json.Unmarshal(body, &enrollResp))
+	code, body = post("http://127.0.0.1:8090/auth/2fa/enroll", url.Values{"code": {totpCode(t, enrollResp.Secret, time.Now())}})
+	require.Equal(t, http.StatusOK, code, string(body))
+	assert.Equal(t, http.StatusOK, get("http://127.0.0.1:8090/admin"), "enrollment verifies session")
+
+	// new login requires second factor again
+	require.Equal(t, http.StatusOK, get("http://127.0.0.1:8090/auth/dev/login?site=my-test-site"))
+	assert.Equal(t, http.StatusForbidden, get("http://127.0.0.1:8090/admin"))
+	code, body = post("http://127.0.0.1:8090/auth/2fa/login", url.Values{"code": {"000000"}})
+	assert.Equal(t, http.StatusForbidden, code, string(body))
+	code, body = post("http://127.0.0.1:8090/auth/2fa/login", url.Values{"code": {totpCode(t, enrollResp.Secret,
+		time.Now().Add(30*time.Second))}})
+	require.Equal(t, http.StatusOK, code, string(body))
+	assert.Equal(t, http.StatusOK, get("http://127.0.0.1:8090/admin"))
+}
+
+// totpCode makes RFC 6238 code for the secret and time
+func totpCode(t *testing.T, secret string, ts time.Time) string {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	require.NoError(t, err)
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(ts.Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	_, _ = mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:offset+4])&0x7fffffff)%1000000)
+}
+
 func prepService(t *testing.T) (svc *Service, teardown func()) { //nolint unparam
 
 	options := Opts{
@@ -516,21 +1189,26 @@ func prepService(t *testing.T) (svc *Service, teardown func()) { //nolint unpara
 	svc.AddCustomProvider("custom123", Client{"cid", "csecret"}, provider.CustomHandlerOpt{})
 
 	// add direct provider
-	svc.AddDirectProvider("direct", provider.CredCheckerFunc(func(user, password string) (ok bool, err error) {
+	svc.AddDirectProvider(provider.CredCheckerFunc(func(user, password string) (ok bool, err error) {
 		return user == "dev_direct" && password == "password", nil
 	}))
 
 	// add direct provider with custom user id func
-	svc.AddDirectProviderWithUserIDFunc("direct_custom",
-		provider.CredCheckerFunc(func(user, password string) (ok bool, err error) {
+	svc.AddCustomHandler(provider.DirectHandler{
+		L:            svc.logger,
+		ProviderName: "direct_custom",
+		Issuer:       svc.issuer,
+		TokenService: svc.jwtService,
+		AvatarSaver:  svc.avatarProxy,
+		CredChecker: provider.CredCheckerFunc(func(user, password string) (ok bool, err error) {
 			return user == "dev_direct" && password == "password", nil
 		}),
-		func(user string, r *http.Request) string {
+		UserIDFunc: func(user string, r *http.Request) string {
 			return "blah"
 		},
-	)
+	})
 
-	svc.AddVerifProvider("email", "{{.Token}}", &sender)
+	svc.AddVerifProvider("email", template.Must(template.New("email").Parse("{{.Token}}")), &sender, false)
 
 	// run dev/test oauth2 server on :18084
 	devAuth, err := svc.DevAuth()
@@ -586,6 +1264,22 @@ func (m *mockSender) Send(to, text string) error {
 	return nil
 }
 
+type resetStore struct {
+	passwords map[string]string
+}
+
+func (s resetStore) FindUser(userOrEmail string) (user token.User, address string, found bool, err error) {
+	if _, ok := s.passwords[userOrEmail]; !ok {
+		return token.User{}, "", false, nil
+	}
+	return token.User{Name: userOrEmail}, userOrEmail + "@example.com", true, nil
+}
+
+func (s resetStore) SetPassword(user, password string) error {
+	s.passwords[user] = password
+	return nil
+}
+
 type customHandler struct{}
 
 func (c customHandler) Name() string {
@@ -594,3 +1288,22 @@ func (c customHandler) Name() string {
 func (c customHandler) LoginHandler(http.ResponseWriter, *http.Request)  {}
 func (c customHandler) AuthHandler(http.ResponseWriter, *http.Request)   {}
 func (c customHandler) LogoutHandler(http.ResponseWriter, *http.Request) {}
+
+type mockTOTPStore struct {
+	lock    sync.Mutex
+	secrets map[string]string
+}
+
+func (m *mockTOTPStore) TOTPSecret(userID string) (secret string, enrolled bool, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	secret, enrolled = m.secrets[userID]
+	return secret, enrolled, nil
+}
+
+func (m *mockTOTPStore) SetTOTPSecret(userID, secret string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.secrets[userID] = secret
+	return nil
+}
@@ -5,20 +5,25 @@ package avatar
 import (
 	"bytes"
 	"crypto/md5" //nolint gosec
+	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"image"
 	"image/png"
 	"io"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-pkgz/rest"
 	"github.com/nullrocks/identicon"
 	"golang.org/x/image/draw"
 
+	"github.com/go-pkgz/auth/httpclient"
 	"github.com/go-pkgz/auth/logger"
 	"github.com/go-pkgz/auth/token"
 )
@@ -31,8 +36,26 @@ type Proxy struct {
 	RoutePath   string
 	URL         string
 	ResizeLimit int
+	Default     DefaultAvatar // response to request of missing avatar, error by default
+
+	defaultOnce sync.Once
+	defaultImg  []byte
+	defaultErr  error
+}
+
+// DefaultAvatar defines response to request of missing avatar, i.e. deleted one, instead of error, so the page
+// shows a placeholder rather than broken image. RedirectURL, Generate, Image and File checked in this order.
+// Images served with 200 and short cache lifetime, so avatar uploaded later takes effect.
+type DefaultAvatar struct {
+	RedirectURL string        // redirect with 302 to this url
+	Generate    bool          // identicon generated by requested avatar id, stable placeholder for each user
+	Image       []byte        // image, i.e. embedded with go:embed
+	File        string        // path of image file, read once on the first request
+	CacheTTL    time.Duration // max-age of served default image, default 5m
 }
 
+const defaultAvatarCacheTTL = 5 * time.Minute
+
 // Put stores retrieved avatar to avatar.Store. Gets image from user info. Returns proxied url
 func (p *Proxy) Put(u token.User, client *http.Client) (avatarURL string, err error) {
 
@@ -77,8 +100,17 @@ func (p *Proxy) Put(u token.User, client *http.Client) (avatarURL string, err er
 	return p.URL + p.RoutePath + "/" + avatarID, nil
 }
 
-// load avatar from remote url and return body. Caller has to close the reader
+// load avatar from remote url and return body. Caller has to close the reader.
+// Inline base64 data urls, like ones made of pictures from a directory, decoded without fetching.
 func (p *Proxy) load(url string, client *http.Client) (rc io.ReadCloser, err error) {
+	if strings.HasPrefix(url, "data:") {
+		b, e := decodeDataURL(url)
+		if e != nil {
+			return nil, e
+		}
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}
+
 	// load avatar from remote location
 	var resp *http.Response
 	err = retry(5, time.Second, func() error {
@@ -98,6 +130,19 @@ func (p *Proxy) load(url string, client *http.Client) (rc io.ReadCloser, err err
 	return resp.Body, nil
 }
 
+// decodeDataURL returns content of base64 data url, i.e. data:image/jpeg;base64,...
+func decodeDataURL(url string) ([]byte, error) {
+	elems := strings.SplitN(strings.TrimPrefix(url, "data:"), ",", 2)
+	if len(elems) != 2 || !strings.HasSuffix(elems[0], ";base64") {
+		return nil, fmt.Errorf("unsupported data url")
+	}
+	b, err := base64.StdEncoding.DecodeString(elems[1])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode data url: %w", err)
+	}
+	return b, nil
+}
+
 // Handler returns token routes for given provider
 func (p *Proxy) Handler(w http.ResponseWriter, r *http.Request) {
 
@@ -126,6 +171,9 @@ func (p *Proxy) Handler(w http.ResponseWriter, r *http.Request) {
 
 	avReader, size, err := p.Store.Get(avatarID)
 	if err != nil {
+		if p.serveDefault(w, r, avatarID, err) {
+			return
+		}
 		rest.SendErrorJSON(w, r, p.L, http.StatusBadRequest, err, "can't load avatar")
 		return
 	}
@@ -187,6 +235,55 @@ func (p *Proxy) resize(reader io.Reader, limit int) io.Reader {
 	return &out
 }
 
+// serveDefault responds with default avatar to request of missing avatar, returns false if no default set
+func (p *Proxy) serveDefault(w http.ResponseWriter, r *http.Request, avatarID string, getErr error) bool {
+	d := p.Default
+	var img []byte
+	switch {
+	case d.RedirectURL != "":
+	case d.Generate:
+		b, err := GenerateAvatar(strings.TrimSuffix(avatarID, imgSfx))
+		if err != nil {
+			p.Warn("[WARN] can't generate default avatar for %s, %v", avatarID, err)
+			return false
+		}
+		if img, err = io.ReadAll(p.resize(bytes.NewReader(b), p.ResizeLimit)); err != nil {
+			return false
+		}
+	case len(d.Image) > 0:
+		img = d.Image
+	case d.File != "":
+		p.defaultOnce.Do(func() { p.defaultImg, p.defaultErr = os.ReadFile(d.File) })
+		if p.defaultErr != nil {
+			p.Warn("[WARN] can't read default avatar, %v", p.defaultErr)
+			return false
+		}
+		img = p.defaultImg
+	default:
+		return false
+	}
+	p.Debug("[DEBUG] default avatar for %s, %v", avatarID, getErr)
+
+	// etag is of the avatar id, the uploaded avatar would be matched with it and not loaded
+	w.Header().Del("Etag")
+	ttl := d.CacheTTL
+	if ttl <= 0 {
+		ttl = defaultAvatarCacheTTL
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(ttl.Seconds())))
+	if d.RedirectURL != "" {
+		http.Redirect(w, r, d.RedirectURL, http.StatusFound)
+		return true
+	}
+	w.Header().Set("Content-Type", http.DetectContentType(img))
+	w.Header().Set("Content-Length", strconv.Itoa(len(img)))
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(img); err != nil {
+		p.Warn("[WARN] can't send response to %s, %s", r.RemoteAddr, err)
+	}
+	return true
+}
+
 // GenerateAvatar for give user with identicon
 func GenerateAvatar(user string) ([]byte, error) {
 
@@ -207,21 +304,28 @@ func GenerateAvatar(user string) ([]byte, error) {
 
 // GetGravatarURL returns url to gravatar picture for given email
 func GetGravatarURL(email string) (res string, err error) {
+	res, _, err = gravatarLookup(httpclient.New(1*time.Second), gravatarURL, gravatarHash(email))
+	return res, err
+}
 
-	hash := md5.Sum([]byte(email))
-	hexHash := hex.EncodeToString(hash[:])
-
-	client := http.Client{Timeout: 1 * time.Second}
-	res = "https://www.gravatar.com/avatar/" + hexHash + ".jpg"
+// gravatarLookup checks gravatar picture of the email hash exists, failed set for network errors and 5xx responses
+func gravatarLookup(client *http.Client, baseURL, hash string) (res string, failed bool, err error) {
+	res = baseURL + hash + ".jpg"
 	resp, err := client.Get(res + "?d=404&s=80")
 	if err != nil {
-		return "", err
+		return "", true, err
 	}
 	defer resp.Body.Close() //nolint gosec // we don't care about response body
 	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("%s", resp.Status)
+		return "", resp.StatusCode >= 500, fmt.Errorf("%s", resp.Status)
 	}
-	return res, nil
+	return res, false, nil
+}
+
+// gravatarHash returns md5 of trimmed and lowercased email, as gravatar requires
+func gravatarHash(email string) string {
+	hash := md5.Sum([]byte(strings.ToLower(strings.TrimSpace(email)))) //nolint gosec
+	return hex.EncodeToString(hash[:])
 }
 
 func retry(retries int, delay time.Duration, fn func() error) (err error) {
@@ -229,6 +333,9 @@ func retry(retries int, delay time.Duration, fn func() error) (err error) {
 		if err = fn(); err == nil {
 			return nil
 		}
+		if errors.Is(err, httpclient.ErrTooLarge) || errors.Is(err, httpclient.ErrNotPublic) {
+			break // the same response on retry
+		}
 		time.Sleep(delay)
 	}
 	if err != nil {
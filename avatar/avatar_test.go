@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
@@ -58,6 +59,27 @@ func TestAvatar_Put(t *testing.T) {
 	assert.Equal(t, int64(21), fi.Size())
 }
 
+func TestAvatar_PutDataURL(t *testing.T) {
+	p := Proxy{RoutePath: "/avatar", URL: "http://localhost:8080", Store: NewLocalFS("/tmp/avatars.test"), L: logger.NoOp{}}
+	assert.NoError(t, os.MkdirAll("/tmp/avatars.test", 0o700))
+	defer os.RemoveAll("/tmp/avatars.test")
+
+	u := token.User{ID: "user1", Name: "user1 name", Picture: "data:image/png;base64,c29tZSBwaWN0dXJlIGJpbiBkYXRh"}
+	res, err := p.Put(u, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://localhost:8080/avatar/b3daa77b4c04a9551b8781d03191fe098f325e67.image", res)
+	fi, err := os.Stat("/tmp/avatars.test/30/b3daa77b4c04a9551b8781d03191fe098f325e67.image")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(21), fi.Size())
+
+	u.ID, u.Picture = "user2", "data:image/png,plain"
+	_, err = p.Put(u, nil)
+	assert.NoError(t, err)
+	fi, err = os.Stat("/tmp/avatars.test/84/a1881c06eec96db9901c7bbfe41c42a3f08e9cb4.image")
+	assert.NoError(t, err)
+	assert.NotEqual(t, int64(21), fi.Size(), "identicon made for not base64 data url")
+}
+
 func TestAvatar_PutIdenticon(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		log.Print("request: ", r.URL.Path)
@@ -183,6 +205,76 @@ func TestAvatar_Routes(t *testing.T) {
 
 }
 
+func TestAvatar_Default(t *testing.T) {
+	dir := t.TempDir()
+	p := &Proxy{RoutePath: "/avatar", Store: NewLocalFS(dir), L: logger.NoOp{}}
+	avatarURL, err := p.Put(token.User{ID: "user1", Name: "user1 name"}, nil)
+	require.NoError(t, err)
+	existing := avatarURL[strings.LastIndex(avatarURL, "/"):]
+	missing := "/123aa77b4c04a9551b8781d03191fe098f325e67.image"
+
+	get := func(p *Proxy, path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		p.Handler(rr, httptest.NewRequest("GET", path, http.NoBody))
+		return rr
+	}
+
+	rr := get(p, missing)
+	assert.Equal(t, http.StatusBadRequest, rr.Code, "no default")
+
+	pngImg, err := os.ReadFile("testdata/circles.png")
+	require.NoError(t, err)
+	file := filepath.Join(dir, "default.png")
+	require.NoError(t, os.WriteFile(file, pngImg, 0o600))
+
+	tbl := []struct {
+		name string
+		def  DefaultAvatar
+		code int
+		ttl  string
+		body []byte
+	}{
+		{"image", DefaultAvatar{Image: pngImg}, http.StatusOK, "max-age=300", pngImg},
+		{"file", DefaultAvatar{File: file, CacheTTL: time.Minute}, http.StatusOK, "max-age=60", pngImg},
+		{"redirect", DefaultAvatar{RedirectURL: "https://example.com/default.png", Image: pngImg}, http.StatusFound,
+			"max-age=300", nil},
+		{"generated", DefaultAvatar{Generate: true, Image: pngImg}, http.StatusOK, "max-age=300", nil},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			dp := &Proxy{RoutePath: "/avatar", Store: p.Store, L: logger.NoOp{}, Default: tt.def}
+			rr := get(dp, missing)
+			require.Equal(t, tt.code, rr.Code)
+			assert.Equal(t, tt.ttl, rr.Header().Get("Cache-Control"))
+			assert.Equal(t, "", rr.Header().Get("Etag"), "no etag of the missing avatar id")
+			if tt.code == http.StatusFound {
+				assert.Equal(t, "https://example.com/default.png", rr.Header().Get("Location"))
+				return
+			}
+			assert.Equal(t, "image/png", rr.Header().Get("Content-Type"))
+			if tt.body != nil {
+				assert.Equal(t, tt.body, rr.Body.Bytes())
+			}
+
+			// existing avatar served as before, with long cache
+			rr = get(dp, existing)
+			assert.Equal(t, http.StatusOK, rr.Code)
+			assert.Equal(t, "max-age=604800", rr.Header().Get("Cache-Control"))
+			assert.NotEqual(t, "", rr.Header().Get("Etag"))
+		})
+	}
+
+	// generated placeholder stable for the id, differs for others
+	dp := &Proxy{RoutePath: "/avatar", Store: p.Store, L: logger.NoOp{}, Default: DefaultAvatar{Generate: true}}
+	img1, img2 := get(dp, missing).Body.Bytes(), get(dp, missing).Body.Bytes()
+	assert.Equal(t, img1, img2)
+	assert.NotEqual(t, img1, get(dp, "/223aa77b4c04a9551b8781d03191fe098f325e67.image").Body.Bytes())
+
+	// unreadable file falls back to error
+	dp = &Proxy{RoutePath: "/avatar", Store: p.Store, L: logger.NoOp{}, Default: DefaultAvatar{File: "/no/such/file"}}
+	assert.Equal(t, http.StatusBadRequest, get(dp, missing).Code)
+}
+
 func TestAvatar_resize(t *testing.T) {
 	checkC := func(t *testing.T, r io.Reader, cExp []byte) {
 		content, err := io.ReadAll(r)
@@ -0,0 +1,143 @@
+package avatar
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-pkgz/auth/httpclient"
+)
+
+const gravatarURL = "https://www.gravatar.com/avatar/"
+
+// ErrGravatarCooldown returned by GravatarCache while lookups skipped after network failures
+var ErrGravatarCooldown = errors.New("gravatar lookups paused after failures")
+
+// GravatarOpts defines cache of gravatar lookups, zero values mean defaults
+type GravatarOpts struct {
+	TTL         time.Duration // ttl of cached results, found and missing pictures, default 1h
+	MaxEntries  int           // max number of cached addresses, default 10000
+	MaxFailures int           // consecutive network failures pausing lookups for Cooldown, default 3
+	Cooldown    time.Duration // pause of lookups after MaxFailures, default 1m
+
+	Transport http.RoundTripper // transport of lookups, i.e. with egress proxy, shared httpclient one if nil
+}
+
+// GravatarCache caches results of gravatar lookups by email hash and pauses lookups after network failures.
+// Concurrent lookups of the same address wait for the single request.
+type GravatarCache struct {
+	opts   GravatarOpts
+	url    string
+	client *http.Client
+
+	mu           sync.Mutex
+	entries      map[string]*gravatarEntry
+	failures     int
+	blockedUntil time.Time
+}
+
+type gravatarEntry struct {
+	url     string
+	err     error
+	expires time.Time
+	ready   chan struct{} // closed when lookup is done
+}
+
+// NewGravatarCache makes cache of gravatar lookups
+func NewGravatarCache(opts GravatarOpts) *GravatarCache {
+	if opts.TTL == 0 {
+		opts.TTL = time.Hour
+	}
+	if opts.MaxEntries == 0 {
+		opts.MaxEntries = 10000
+	}
+	if opts.MaxFailures == 0 {
+		opts.MaxFailures = 3
+	}
+	if opts.Cooldown == 0 {
+		opts.Cooldown = time.Minute
+	}
+	client := httpclient.New(1 * time.Second)
+	if opts.Transport != nil {
+		client.Transport = opts.Transport
+	}
+	return &GravatarCache{opts: opts, url: gravatarURL, client: client, entries: map[string]*gravatarEntry{}}
+}
+
+// GetGravatarURL returns url to gravatar picture for given email, the same as GetGravatarURL function but cached
+func (c *GravatarCache) GetGravatarURL(email string) (string, error) {
+	hash := gravatarHash(email)
+
+	c.mu.Lock()
+	if e, ok := c.entries[hash]; ok {
+		if !e.done() || time.Now().Before(e.expires) {
+			c.mu.Unlock()
+			<-e.ready
+			return e.url, e.err
+		}
+		delete(c.entries, hash)
+	}
+	if time.Now().Before(c.blockedUntil) {
+		c.mu.Unlock()
+		return "", ErrGravatarCooldown
+	}
+	e := &gravatarEntry{ready: make(chan struct{})}
+	c.evict()
+	c.entries[hash] = e
+	c.mu.Unlock()
+
+	res, failed, err := gravatarLookup(c.client, c.url, hash)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e.url, e.err = res, err
+	if failed {
+		// network failures not cached, counted for cooldown instead
+		if c.entries[hash] == e {
+			delete(c.entries, hash)
+		}
+		if c.failures++; c.failures >= c.opts.MaxFailures {
+			c.blockedUntil = time.Now().Add(c.opts.Cooldown)
+			c.failures = 0
+		}
+	} else {
+		c.failures = 0
+		e.expires = time.Now().Add(c.opts.TTL)
+	}
+	close(e.ready)
+	return e.url, e.err
+}
+
+// evict removes expired entries and the oldest one if the cache is still full, called under lock
+func (c *GravatarCache) evict() {
+	if len(c.entries) < c.opts.MaxEntries {
+		return
+	}
+	now := time.Now()
+	var oldest string
+	for k, e := range c.entries {
+		if !e.done() {
+			continue // lookup in progress
+		}
+		if now.After(e.expires) {
+			delete(c.entries, k)
+			continue
+		}
+		if oldest == "" || e.expires.Before(c.entries[oldest].expires) {
+			oldest = k
+		}
+	}
+	if len(c.entries) >= c.opts.MaxEntries && oldest != "" {
+		delete(c.entries, oldest)
+	}
+}
+
+func (e *gravatarEntry) done() bool {
+	select {
+	case <-e.ready:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,148 @@
+package avatar
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGravatarCache(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(10 * time.Millisecond) // let concurrent lookups of the same address overlap
+		if strings.HasPrefix(r.URL.Path, "/"+gravatarHash("found@example.com")) {
+			_, _ = w.Write([]byte("jpg"))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	c := NewGravatarCache(GravatarOpts{TTL: 100 * time.Millisecond})
+	c.url = ts.URL + "/"
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := c.GetGravatarURL("found@example.com")
+			assert.NoError(t, err)
+			assert.Equal(t, ts.URL+"/"+gravatarHash("found@example.com")+".jpg", res)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "one request for concurrent lookups")
+
+	for i := 0; i < 3; i++ {
+		_, err := c.GetGravatarURL("missing@example.com")
+		assert.EqualError(t, err, "404 Not Found")
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls), "missing picture cached too")
+
+	time.Sleep(150 * time.Millisecond)
+	_, err := c.GetGravatarURL("found@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls), "expired entry looked up again")
+}
+
+func TestGravatarCache_Cooldown(t *testing.T) {
+	var calls, fail int32
+	atomic.StoreInt32(&fail, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&fail) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_, _ = w.Write([]byte("jpg"))
+	}))
+	defer ts.Close()
+
+	c := NewGravatarCache(GravatarOpts{MaxFailures: 2, Cooldown: 100 * time.Millisecond})
+	c.url = ts.URL + "/"
+
+	_, err := c.GetGravatarURL("user@example.com")
+	assert.EqualError(t, err, "502 Bad Gateway")
+	_, err = c.GetGravatarURL("user@example.com")
+	assert.EqualError(t, err, "502 Bad Gateway", "failures not cached")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	_, err = c.GetGravatarURL("other@example.com")
+	assert.Equal(t, ErrGravatarCooldown, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls), "no lookups during cooldown")
+
+	atomic.StoreInt32(&fail, 0)
+	time.Sleep(150 * time.Millisecond)
+	res, err := c.GetGravatarURL("other@example.com")
+	require.NoError(t, err)
+	assert.Contains(t, res, gravatarHash("other@example.com"))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+func TestGravatarCache_MaxEntries(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("jpg"))
+	}))
+	defer ts.Close()
+
+	c := NewGravatarCache(GravatarOpts{MaxEntries: 2})
+	c.url = ts.URL + "/"
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		_, err := c.GetGravatarURL(email)
+		require.NoError(t, err)
+	}
+	assert.Len(t, c.entries, 2)
+	assert.NotContains(t, c.entries, gravatarHash("a@example.com"), "the oldest evicted")
+}
+
+func TestGravatarCache_Transport(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("jpg"))
+	}))
+	defer ts.Close()
+
+	tr := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&calls, 1)
+		return http.DefaultTransport.RoundTrip(r)
+	})
+	c := NewGravatarCache(GravatarOpts{Transport: tr})
+	c.url = ts.URL + "/"
+	_, err := c.GetGravatarURL("a@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "lookup made with the transport")
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestGravatarHash(t *testing.T) {
+	// canonical hash from gravatar docs, of "myemailaddress@example.com"
+	assert.Equal(t, "0bc83cb571cd1c50ba6f3e8a78ef1346", gravatarHash("myemailaddress@example.com"))
+	assert.Equal(t, "0bc83cb571cd1c50ba6f3e8a78ef1346", gravatarHash(" MyEmailAddress@example.com  "))
+
+	var paths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		_, _ = w.Write([]byte("jpg"))
+	}))
+	defer ts.Close()
+	c := NewGravatarCache(GravatarOpts{})
+	c.url = ts.URL + "/"
+	res, err := c.GetGravatarURL("John@Example.com")
+	require.NoError(t, err)
+	assert.Equal(t, ts.URL+"/"+gravatarHash("john@example.com")+".jpg", res)
+	_, err = c.GetGravatarURL("john@example.com ")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/" + gravatarHash("john@example.com") + ".jpg"}, paths, "the same address cached")
+}
@@ -4,6 +4,8 @@ go 1.18
 
 require (
 	github.com/dghubble/oauth1 v0.7.2
+	github.com/go-asn1-ber/asn1-ber v1.5.4
+	github.com/go-ldap/ldap/v3 v3.4.4
 	github.com/go-oauth2/oauth2/v4 v4.5.2
 	github.com/go-pkgz/email v0.4.1
 	github.com/go-pkgz/repeater v1.1.3
@@ -16,11 +18,14 @@ require (
 	go.etcd.io/bbolt v1.3.7
 	go.mongodb.org/mongo-driver v1.11.3
 	golang.org/x/image v0.6.0
+	golang.org/x/net v0.8.0
 	golang.org/x/oauth2 v0.6.0
+	golang.org/x/text v0.8.0
 )
 
 require (
 	cloud.google.com/go/compute/metadata v0.2.0 // indirect
+	github.com/Azure/go-ntlmssp v0.0.0-20221128193559-754e69321358 // indirect
 	github.com/aymerick/douceur v0.2.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/golang/protobuf v1.5.2 // indirect
@@ -46,10 +51,8 @@ require (
 	github.com/xdg-go/stringprep v1.0.3 // indirect
 	github.com/youmark/pkcs8 v0.0.0-20181117223130-1be2e3e5546d // indirect
 	golang.org/x/crypto v0.0.0-20220622213112-05595931fe9d // indirect
-	golang.org/x/net v0.8.0 // indirect
 	golang.org/x/sync v0.1.0 // indirect
 	golang.org/x/sys v0.7.0 // indirect
-	golang.org/x/text v0.8.0 // indirect
 	google.golang.org/appengine v1.6.7 // indirect
 	google.golang.org/protobuf v1.28.1 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
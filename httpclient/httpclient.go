@@ -0,0 +1,56 @@
+// Package httpclient provides shared http transport for outbound calls made by the auth packages,
+// like avatar fetches, gravatar checks and HTTP-based senders. Sharing the transport keeps
+// connection pool in one place, so connections reused and idle ones limited.
+package httpclient
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	lock      sync.RWMutex
+	transport http.RoundTripper = NewTransport()
+)
+
+// NewTransport makes transport with pool settings used by default
+func NewTransport() *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   10,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// Transport returns shared transport
+func Transport() http.RoundTripper {
+	lock.RLock()
+	defer lock.RUnlock()
+	return transport
+}
+
+// SetTransport replaces shared transport, i.e. to tune pool or route calls via proxy.
+// Clients made before the call keep using the previous transport. Nil resets transport to the default one.
+func SetTransport(t http.RoundTripper) {
+	if t == nil {
+		t = NewTransport()
+	}
+	lock.Lock()
+	transport = t
+	lock.Unlock()
+}
+
+// New makes client with shared transport and given timeout
+func New(timeout time.Duration) *http.Client {
+	return &http.Client{Transport: Transport(), Timeout: timeout}
+}
@@ -0,0 +1,88 @@
+package httpclient
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type countingTransport struct {
+	calls int32
+}
+
+func (c *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&c.calls, 1)
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: r}, nil
+}
+
+func TestNew(t *testing.T) {
+	c1, c2 := New(time.Second), New(5*time.Second)
+	assert.Equal(t, time.Second, c1.Timeout)
+	assert.Equal(t, 5*time.Second, c2.Timeout)
+	assert.Same(t, c1.Transport, c2.Transport, "clients share transport")
+}
+
+func TestSetTransport(t *testing.T) {
+	defer SetTransport(nil)
+
+	ct := &countingTransport{}
+	SetTransport(ct)
+	resp, err := New(time.Second).Get("http://example.com/blah")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&ct.calls))
+
+	SetTransport(nil)
+	_, isDefault := Transport().(*http.Transport)
+	assert.True(t, isDefault, "reset to default transport")
+}
+
+// BenchmarkConnections compares new connections made with the shared transport and with a client per request.
+// Reported as conns/op, shared transport reuses keep-alive connections.
+func BenchmarkConnections(b *testing.B) {
+	var conns int64
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	ts.Config.ConnState = func(_ net.Conn, st http.ConnState) {
+		if st == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	get := func(b *testing.B, c *http.Client) {
+		resp, err := c.Get(ts.URL)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+
+	b.Run("shared", func(b *testing.B) {
+		atomic.StoreInt64(&conns, 0)
+		for i := 0; i < b.N; i++ {
+			get(b, New(time.Second))
+		}
+		b.ReportMetric(float64(atomic.LoadInt64(&conns))/float64(b.N), "conns/op")
+	})
+
+	b.Run("per-request", func(b *testing.B) {
+		atomic.StoreInt64(&conns, 0)
+		for i := 0; i < b.N; i++ {
+			tr := NewTransport()
+			get(b, &http.Client{Transport: tr, Timeout: time.Second})
+			tr.CloseIdleConnections()
+		}
+		b.ReportMetric(float64(atomic.LoadInt64(&conns))/float64(b.N), "conns/op")
+	})
+}
@@ -0,0 +1,86 @@
+package httpclient
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// ErrTooLarge returned by transport made with Policy for responses larger than MaxSize
+var ErrTooLarge = errors.New("response body too large")
+
+const defaultRetryDelay = 500 * time.Millisecond
+
+// Policy defines retries and size limit of responses, applied by transport wrapping the base one.
+// Zero Policy changes nothing.
+type Policy struct {
+	Retries    int           // retries of GET requests responded with 5xx, default no retries
+	RetryDelay time.Duration // delay between retries, default 500ms
+	MaxSize    int64         // max size of response body, larger ones fail with ErrTooLarge, default no limit
+}
+
+// Transport returns transport applying the policy to requests made with base, the shared one if base is nil
+func (p Policy) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = Transport()
+	}
+	if p.Retries <= 0 && p.MaxSize <= 0 {
+		return base
+	}
+	return &policyTransport{Policy: p, base: base}
+}
+
+type policyTransport struct {
+	Policy
+	base http.RoundTripper
+}
+
+// RoundTrip makes request with retries of 5xx responses and reads limited body of the successful one
+func (t *policyTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	retries := t.Retries
+	if r.Method != "GET" {
+		retries = 0 // only idempotent requests without body retried
+	}
+	delay := t.RetryDelay
+	if delay == 0 {
+		delay = defaultRetryDelay
+	}
+
+	resp, err := t.base.RoundTrip(r)
+	for i := 0; i < retries && err == nil && resp.StatusCode >= 500; i++ {
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		_ = resp.Body.Close()
+		select {
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		case <-time.After(delay):
+		}
+		resp, err = t.base.RoundTrip(r)
+	}
+	if err != nil || t.MaxSize <= 0 {
+		return resp, err
+	}
+	return t.limit(resp)
+}
+
+// limit reads the body up to MaxSize, so too large responses rejected before the caller gets partial data
+func (t *policyTransport) limit(resp *http.Response) (*http.Response, error) {
+	if resp.ContentLength > t.MaxSize {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("%w, %d bytes", ErrTooLarge, resp.ContentLength)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, t.MaxSize+1))
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	if int64(len(body)) > t.MaxSize {
+		return nil, fmt.Errorf("%w, over %d bytes", ErrTooLarge, t.MaxSize)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	return resp, nil
+}
@@ -0,0 +1,89 @@
+package httpclient
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicy_Retries(t *testing.T) {
+	var calls, failures int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	client := &http.Client{Transport: Policy{Retries: 2, RetryDelay: time.Millisecond}.Transport(nil)}
+	get := func(method string, fail int32) (*http.Response, int32) {
+		atomic.StoreInt32(&calls, 0)
+		atomic.StoreInt32(&failures, fail)
+		req, err := http.NewRequest(method, ts.URL, http.NoBody)
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		return resp, atomic.LoadInt32(&calls)
+	}
+
+	resp, calls := get("GET", 2)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int32(3), calls)
+
+	resp, calls = get("GET", 3)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode, "retries exhausted")
+	assert.Equal(t, int32(3), calls)
+
+	resp, calls = get("POST", 1)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode, "no retries of POST")
+	assert.Equal(t, int32(1), calls)
+}
+
+func TestPolicy_MaxSize(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := strings.Repeat("x", 100)
+		if r.URL.Query().Get("chunked") == "" {
+			w.Header().Set("Content-Length", "100")
+		}
+		_, _ = w.Write([]byte(body))
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}))
+	defer ts.Close()
+
+	client := &http.Client{Transport: Policy{MaxSize: 100}.Transport(nil)}
+	resp, err := client.Get(ts.URL)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, 100, len(body))
+
+	client = &http.Client{Transport: Policy{MaxSize: 99}.Transport(nil)}
+	_, err = client.Get(ts.URL)
+	assert.ErrorIs(t, err, ErrTooLarge)
+	_, err = client.Get(ts.URL + "?chunked=1")
+	assert.ErrorIs(t, err, ErrTooLarge, "no content length")
+}
+
+func TestPolicy_Transport(t *testing.T) {
+	ct := &countingTransport{}
+	assert.Same(t, ct, Policy{}.Transport(ct), "zero policy keeps base")
+	assert.Same(t, Transport(), Policy{}.Transport(nil), "shared transport by default")
+
+	resp, err := (&http.Client{Transport: Policy{Retries: 1, MaxSize: 10}.Transport(ct)}).Get("http://example.com")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&ct.calls))
+}
@@ -0,0 +1,76 @@
+package httpclient
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// ErrNotPublic returned for requests to non-public address made with transport from PublicOnly
+var ErrNotPublic = errors.New("address is not public")
+
+// PublicOnly returns transport refusing to connect to loopback, private, link-local and other non-public
+// addresses, i.e. cloud metadata at 169.254.169.254, for requests to urls from untrusted sources.
+// Base, the shared transport if nil, cloned if it is *http.Transport and addresses checked on connect, so
+// redirects and names resolved to such addresses rejected too. Proxy from environment and keep-alive disabled
+// for the clone, as proxy would be connected instead and the transport is short-lived. Other transports can't
+// be checked on connect, host of request resolved and checked before passing it to base then.
+func PublicOnly(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = Transport()
+	}
+	tr, ok := base.(*http.Transport)
+	if !ok {
+		return &publicTransport{base: base}
+	}
+	tr = tr.Clone()
+	tr.Proxy = nil
+	tr.DisableKeepAlives = true
+	tr.DialContext = (&net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			return checkPublic(net.ParseIP(host), host)
+		},
+	}).DialContext
+	return tr
+}
+
+type publicTransport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip passes request to base if all addresses of its host are public
+func (t *publicTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	host := r.URL.Hostname()
+	if ip := net.ParseIP(host); ip != nil {
+		if err := checkPublic(ip, host); err != nil {
+			return nil, err
+		}
+		return t.base.RoundTrip(r)
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(r.Context(), host)
+	if err != nil {
+		return nil, fmt.Errorf("can't resolve %s: %w", host, err)
+	}
+	for _, a := range addrs {
+		if err := checkPublic(a.IP, host); err != nil {
+			return nil, err
+		}
+	}
+	return t.base.RoundTrip(r)
+}
+
+func checkPublic(ip net.IP, host string) error {
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("%w, %s", ErrNotPublic, host)
+	}
+	return nil
+}
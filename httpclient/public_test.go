@@ -0,0 +1,55 @@
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublicOnly(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	resp, err := (&http.Client{Transport: NewTransport()}).Get(ts.URL)
+	require.NoError(t, err, "allowed without PublicOnly")
+	_ = resp.Body.Close()
+
+	for name, base := range map[string]http.RoundTripper{
+		"shared": nil,
+		"custom": &countingTransport{},
+	} {
+		client := &http.Client{Transport: PublicOnly(base)}
+		for _, u := range []string{ts.URL, "http://localhost:8080/", "http://[::1]:8080/", "http://10.0.0.1/"} {
+			_, err = client.Get(u)
+			require.Error(t, err, name+" "+u)
+			assert.True(t, errors.Is(err, ErrNotPublic), "%s %s: %v", name, u, err)
+		}
+	}
+
+	// connection to metadata server rejected
+	pub := PublicOnly(NewTransport())
+	tr := pub.(*http.Transport)
+	assert.Nil(t, tr.Proxy)
+	assert.True(t, tr.DisableKeepAlives)
+	_, err = tr.DialContext(context.Background(), "tcp", "169.254.169.254:80")
+	assert.True(t, errors.Is(err, ErrNotPublic), err)
+}
+
+func TestCheckPublic(t *testing.T) {
+	for _, ip := range []string{"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254", "::1",
+		"fe80::1", "fc00::1", "0.0.0.0", "224.0.0.1"} {
+		assert.Error(t, checkPublic(net.ParseIP(ip), ip), ip)
+	}
+	for _, ip := range []string{"8.8.8.8", "2001:4860:4860::8888"} {
+		assert.NoError(t, checkPublic(net.ParseIP(ip), ip), ip)
+	}
+	assert.Error(t, checkPublic(nil, "bad"))
+}
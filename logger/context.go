@@ -0,0 +1,46 @@
+package logger
+
+import "context"
+
+type contextKey struct{}
+
+// NewContext returns ctx carrying request-scoped logger l
+func NewContext(ctx context.Context, l L) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// FromContext returns request-scoped logger of ctx, set by NewContext, i.e. by auth middleware
+func FromContext(ctx context.Context) (l L, ok bool) {
+	l, ok = ctx.Value(contextKey{}).(L)
+	return l, ok
+}
+
+// WithFields returns logger appending fields, i.e. "user=abc aud=site", to every message of l
+func WithFields(l L, fields string) L {
+	return fieldsLogger{l: l, fields: fields}
+}
+
+type fieldsLogger struct {
+	l      L
+	fields string
+}
+
+func (f fieldsLogger) Logf(format string, args ...interface{}) {
+	f.l.Logf(format+" %s", append(args[:len(args):len(args)], f.fields)...)
+}
+
+func (f fieldsLogger) Debug(format string, args ...interface{}) {
+	f.l.Debug(format+" %s", append(args[:len(args):len(args)], f.fields)...)
+}
+
+func (f fieldsLogger) Info(format string, args ...interface{}) {
+	f.l.Info(format+" %s", append(args[:len(args):len(args)], f.fields)...)
+}
+
+func (f fieldsLogger) Warn(format string, args ...interface{}) {
+	f.l.Warn(format+" %s", append(args[:len(args):len(args)], f.fields)...)
+}
+
+func (f fieldsLogger) Error(format string, args ...interface{}) {
+	f.l.Error(format+" %s", append(args[:len(args):len(args)], f.fields)...)
+}
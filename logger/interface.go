@@ -10,3 +10,21 @@ type L interface {
 	Warn(format string, args ...interface{})
 	Error(format string, args ...interface{})
 }
+
+// Func type is an adapter to allow the use of ordinary functions as L, all levels call f
+type Func func(format string, args ...interface{})
+
+// Logf calls f(format, args...)
+func (f Func) Logf(format string, args ...interface{}) { f(format, args...) }
+
+// Debug calls f(format, args...)
+func (f Func) Debug(format string, args ...interface{}) { f(format, args...) }
+
+// Info calls f(format, args...)
+func (f Func) Info(format string, args ...interface{}) { f(format, args...) }
+
+// Warn calls f(format, args...)
+func (f Func) Warn(format string, args ...interface{}) { f(format, args...) }
+
+// Error calls f(format, args...)
+func (f Func) Error(format string, args ...interface{}) { f(format, args...) }
@@ -2,13 +2,19 @@
 // - Auth: adds auth from session and populates user info
 // - Trace: populates user info if token presented
 // - AdminOnly: restrict access to admin users only
+// - RBAC: restrict access to users with given roles
+// - StepUp: restrict access to users verified with second factor
 package middleware
 
 import (
+	"context"
+	"crypto/sha256"
 	"crypto/subtle"
+	"encoding/hex"
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/go-pkgz/auth/logger"
 	"github.com/go-pkgz/auth/provider"
@@ -24,6 +30,13 @@ type Authenticator struct {
 	AdminPasswd      string
 	BasicAuthChecker BasicAuthFunc
 	RefreshCache     RefreshCache
+	ExternalVerifier ExternalVerifier // optional verifier of bearer tokens issued by others, tried if JWTService rejects the request
+
+	BlockedMessage  string             // response of Blocklist to banned users, default "Access denied"
+	BlockFailClosed bool               // Blocklist rejects requests if BlockStore fails, passes them by default
+	Audit           provider.AuditFunc // optional receiver of audit events, like requests of banned users
+
+	TrustedProxies *provider.TrustedProxies // proxies trusted to pass client ip for audit events, default ones if nil
 }
 
 // RefreshCache defines interface storing and retrieving refreshed tokens
@@ -81,8 +94,7 @@ func (a *Authenticator) auth(reqAuth bool) func(http.Handler) http.Handler {
 
 			// use admin user basic auth if enabled but ignore when BasicAuthChecker defined
 			if a.BasicAuthChecker == nil && a.basicAdminUser(r) {
-				r = token.SetUserInfo(r, adminUser)
-				h.ServeHTTP(w, r)
+				h.ServeHTTP(w, a.withIdentity(r, adminUser, "", ""))
 				return
 			}
 
@@ -98,14 +110,22 @@ func (a *Authenticator) auth(reqAuth bool) func(http.Handler) http.Handler {
 						onError(h, w, r, fmt.Errorf("credentials are wrong for basic auth: %w", err))
 						return
 					}
-					r = token.SetUserInfo(r, userInfo) // pass user claims into context of incoming request
-					h.ServeHTTP(w, r)
+					h.ServeHTTP(w, a.withIdentity(r, userInfo, "", "")) // pass user claims into context of incoming request
 					return
 				}
 			}
 
 			claims, tkn, err := a.JWTService.Get(r)
 			if err != nil {
+				if u, extTkn, ok := a.externalUser(r); ok {
+					// externally verified tokens never refreshed, they have no our cookie to refresh
+					if a.Validator != nil && !a.Validator.Validate(extTkn, token.Claims{User: &u}) {
+						onError(h, w, r, fmt.Errorf("user %s/%s blocked", u.Name, u.ID))
+						return
+					}
+					h.ServeHTTP(w, a.withIdentity(r, u, "", ""))
+					return
+				}
 				onError(h, w, r, fmt.Errorf("can't get token: %w", err))
 				return
 			}
@@ -136,7 +156,7 @@ func (a *Authenticator) auth(reqAuth bool) func(http.Handler) http.Handler {
 					}
 				}
 
-				r = token.SetUserInfo(r, *claims.User) // populate user info to request context
+				r = a.withIdentity(r, *claims.User, claims.Audience, claims.Provider) // populate user info to request context
 			}
 
 			h.ServeHTTP(w, r)
@@ -146,6 +166,59 @@ func (a *Authenticator) auth(reqAuth bool) func(http.Handler) http.Handler {
 	return f
 }
 
+// withIdentity sets user and provider into request context with request-scoped logger appending hashed user id,
+// provider and audience to every message, so logs of downstream handlers carry identity. Logger set by upstream
+// middleware extended, Authenticator's one used otherwise, get it with logger.FromContext.
+// Provider is the one stamped into claims, guessed from user id for tokens issued without it.
+func (a *Authenticator) withIdentity(r *http.Request, u token.User, aud, provider string) *http.Request {
+	l, ok := logger.FromContext(r.Context())
+	if !ok {
+		l = a.L
+	}
+	if l == nil {
+		l = logger.NoOp{}
+	}
+	if provider == "" {
+		provider = a.providerName(u.ID)
+	}
+	idHash := sha256.Sum256([]byte(u.ID))
+	fields := fmt.Sprintf("{user=%s provider=%s aud=%s}", hex.EncodeToString(idHash[:8]), provider, aud)
+	ctx := logger.NewContext(r.Context(), logger.WithFields(l, fields))
+	ctx = context.WithValue(ctx, providerKey{}, provider)
+	return token.SetUserInfo(r.WithContext(ctx), u)
+}
+
+type providerKey struct{}
+
+// providerName returns name of the provider made user id, i.e. "github" for "github_1234", the longest one matched
+func (a *Authenticator) providerName(userID string) string {
+	res := ""
+	for _, p := range a.Providers {
+		if name := p.Name(); strings.HasPrefix(userID, name+"_") && len(name) > len(res) {
+			res = name
+		}
+	}
+	return res
+}
+
+// externalUser verifies bearer token of the request with ExternalVerifier, if defined
+func (a *Authenticator) externalUser(r *http.Request) (u token.User, tkn string, ok bool) {
+	if a.ExternalVerifier == nil {
+		return token.User{}, "", false
+	}
+	authHeader := r.Header.Get("Authorization")
+	if len(authHeader) < 7 || !strings.EqualFold(authHeader[:7], "bearer ") {
+		return token.User{}, "", false
+	}
+	tkn = strings.TrimSpace(authHeader[7:])
+	u, err := a.ExternalVerifier.Verify(tkn)
+	if err != nil {
+		a.Debug("[DEBUG] external token rejected, %v", err)
+		return token.User{}, "", false
+	}
+	return u, tkn, true
+}
+
 // refreshExpiredToken makes a new token with passed claims
 func (a *Authenticator) refreshExpiredToken(w http.ResponseWriter, claims token.Claims, tkn string) (token.Claims, error) {
 
@@ -239,3 +312,58 @@ func (a *Authenticator) RBAC(roles ...string) func(http.Handler) http.Handler {
 	}
 	return f
 }
+
+// StepUp middleware allows access for users verified with second factor, like TOTP, within maxAge.
+// Zero maxAge accepts second factor verified at any time of the session.
+// this handler internally wrapped with auth(true) to avoid situation if StepUp defined without prior Auth
+func (a *Authenticator) StepUp(maxAge time.Duration) func(http.Handler) http.Handler {
+	f := func(h http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			user, err := token.GetUserInfo(r)
+			if err != nil {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			verifiedAt := user.SecondFactorAt()
+			if verifiedAt.IsZero() || (maxAge > 0 && time.Since(verifiedAt) > maxAge) {
+				http.Error(w, "Second factor required", http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, r)
+		}
+		return a.auth(true)(http.HandlerFunc(fn)) // enforce auth
+	}
+	return f
+}
+
+// RequireProvider middleware allows access for users logged in with one of the named providers, like "github".
+// Provider taken from the token, for tokens issued without it guessed from the prefix of user id.
+// this handler internally wrapped with auth(true) to avoid situation if RequireProvider defined without prior Auth
+func (a *Authenticator) RequireProvider(names ...string) func(http.Handler) http.Handler {
+	f := func(h http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			user, err := token.GetUserInfo(r)
+			if err != nil {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			provider, _ := r.Context().Value(providerKey{}).(string)
+			if provider == "" {
+				if i := strings.Index(user.ID, "_"); i > 0 {
+					provider = user.ID[:i]
+				}
+			}
+			for _, name := range names {
+				if provider != "" && name == provider {
+					h.ServeHTTP(w, r)
+					return
+				}
+			}
+			http.Error(w, "Access denied", http.StatusForbidden)
+		}
+		return a.auth(true)(http.HandlerFunc(fn)) // enforce auth
+	}
+	return f
+}
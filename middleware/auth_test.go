@@ -12,10 +12,12 @@ import (
 	"testing"
 	"time"
 
+	"github.com/golang-jwt/jwt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/go-pkgz/auth/logger"
+	"github.com/go-pkgz/auth/provider"
 	"github.com/go-pkgz/auth/token"
 )
 
@@ -102,6 +104,55 @@ func TestAuthJWTHeader(t *testing.T) {
 	assert.Equal(t, 401, resp.StatusCode, "token expired")
 }
 
+func TestAuthRequestLogger(t *testing.T) {
+	a := makeTestAuth(t)
+	var lines []string
+	a.L = logger.Func(func(format string, args ...interface{}) { lines = append(lines, fmt.Sprintf(format, args...)) })
+	handler := a.Trace(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l, ok := logger.FromContext(r.Context())
+		if !ok {
+			l = logger.NoOp{}
+		}
+		l.Logf("[WARN] something failed, %s", "some err")
+	}))
+
+	req := httptest.NewRequest("GET", "/trace", http.NoBody)
+	req.Header.Add("X-JWT", testJwtValid)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	require.Equal(t, 1, len(lines))
+	assert.Equal(t, "[WARN] something failed, some err {user=f3436f50b2f7f161 provider= aud=test_sys}", lines[0])
+	assert.NotContains(t, lines[0], "id1", "user id hashed")
+
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	require.Equal(t, 2, len(lines))
+	assert.Equal(t, lines[0], lines[1], "same hash for the same user")
+
+	// anonymous request has no logger
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/trace", http.NoBody))
+	assert.Equal(t, 2, len(lines))
+
+	// logger set upstream extended
+	var upstream []string
+	req = req.WithContext(logger.NewContext(req.Context(),
+		logger.Func(func(format string, args ...interface{}) { upstream = append(upstream, fmt.Sprintf(format, args...)) })))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, 2, len(lines))
+	assert.Equal(t, []string{lines[0]}, upstream)
+}
+
+func TestAuthProviderName(t *testing.T) {
+	a := Authenticator{Providers: []provider.Service{
+		{Provider: provider.VerifyHandler{ProviderName: "direct"}},
+		{Provider: provider.VerifyHandler{ProviderName: "direct_custom"}},
+		{Provider: provider.VerifyHandler{ProviderName: "github"}},
+	}}
+	assert.Equal(t, "github", a.providerName("github_1234"))
+	assert.Equal(t, "direct", a.providerName("direct_1234"))
+	assert.Equal(t, "direct_custom", a.providerName("direct_custom_1234"))
+	assert.Equal(t, "", a.providerName("google_1234"))
+	assert.Equal(t, "", a.providerName("github"))
+}
+
 func TestAuthJWTRefresh(t *testing.T) {
 	a := makeTestAuth(t)
 	server := httptest.NewServer(makeTestMux(t, &a, true))
@@ -134,6 +185,43 @@ func TestAuthJWTRefresh(t *testing.T) {
 	log.Print(time.Unix(claims.ExpiresAt, 0))
 }
 
+func TestAuthJWTRefreshRotateXSRF(t *testing.T) {
+	a := makeTestAuth(t)
+	j := a.JWTService.(*token.Service)
+	j.RotateXSRF = true
+	server := httptest.NewServer(makeTestMux(t, &a, true))
+	defer server.Close()
+
+	// expired token with its xsrf
+	rr := httptest.NewRecorder()
+	_, err := j.Set(rr, token.Claims{User: &token.User{ID: "id1", Name: "name1"},
+		StandardClaims: jwt.StandardClaims{Id: "session1", ExpiresAt: time.Now().Add(-time.Minute).Unix()}})
+	require.NoError(t, err)
+	jwtCookie, xsrf := rr.Result().Cookies()[0], rr.Result().Cookies()[1].Value
+
+	get := func(jwtCookie *http.Cookie, xsrf string) *http.Response {
+		req, err := http.NewRequest("GET", server.URL+"/auth", http.NoBody)
+		require.NoError(t, err)
+		req.AddCookie(jwtCookie)
+		req.Header.Add("X-XSRF-TOKEN", xsrf)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp
+	}
+
+	resp := get(jwtCookie, xsrf)
+	assert.Equal(t, 201, resp.StatusCode, "token expired and refreshed")
+	require.Equal(t, 2, len(resp.Cookies()))
+	refreshed, newXSRF := resp.Cookies()[0], resp.Cookies()[1].Value
+	assert.NotEqual(t, xsrf, newXSRF, "xsrf rotated")
+
+	assert.Equal(t, 201, get(refreshed, newXSRF).StatusCode)
+	assert.Equal(t, 201, get(refreshed, xsrf).StatusCode, "previous xsrf in grace period")
+	j.XSRFGrace = time.Nanosecond
+	assert.Equal(t, 401, get(refreshed, xsrf).StatusCode)
+}
+
 func TestAuthJWTRefreshConcurrentWithCache(t *testing.T) {
 
 	a := makeTestAuth(t)
@@ -466,6 +554,114 @@ func TestRBAC(t *testing.T) {
 	assert.Equal(t, "Access denied\n", string(data))
 }
 
+func TestStepUp(t *testing.T) {
+	a := makeTestAuth(t)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(201) })
+	mux := http.NewServeMux()
+	mux.Handle("/any", a.StepUp(0)(handler))
+	mux.Handle("/fresh", a.StepUp(10*time.Minute)(handler))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	makeToken := func(verifiedAt time.Time) string {
+		u := token.User{Name: "name1", ID: "id1"}
+		if !verifiedAt.IsZero() {
+			u.SetSecondFactor(verifiedAt)
+		}
+		tkn, err := a.JWTService.(*token.Service).Token(token.Claims{User: &u,
+			StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Hour).Unix()}})
+		require.NoError(t, err)
+		return tkn
+	}
+
+	tbl := []struct {
+		path   string
+		tkn    string
+		status int
+	}{
+		{"/any", "", http.StatusUnauthorized},
+		{"/any", makeToken(time.Time{}), http.StatusForbidden},
+		{"/any", makeToken(time.Now().Add(-time.Hour)), http.StatusCreated},
+		{"/fresh", makeToken(time.Now().Add(-time.Hour)), http.StatusForbidden},
+		{"/fresh", makeToken(time.Now().Add(-time.Minute)), http.StatusCreated},
+	}
+	for i, tt := range tbl {
+		req, err := http.NewRequest("GET", server.URL+tt.path, http.NoBody)
+		require.NoError(t, err)
+		if tt.tkn != "" {
+			req.Header.Set("X-JWT", tt.tkn)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, tt.status, resp.StatusCode, "case #%d", i)
+	}
+}
+
+func TestRequireProvider(t *testing.T) {
+	a := makeTestAuth(t)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(201) })
+	mux := http.NewServeMux()
+	mux.Handle("/dev", a.RequireProvider("dev")(handler))
+	mux.Handle("/any", a.RequireProvider("dev", "direct")(handler))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	makeToken := func(id, prov string, expiresAt time.Time) string {
+		tkn, err := a.JWTService.(*token.Service).Token(token.Claims{User: &token.User{Name: "name1", ID: id},
+			Provider: prov, StandardClaims: jwt.StandardClaims{ExpiresAt: expiresAt.Unix()}})
+		require.NoError(t, err)
+		return tkn
+	}
+	exp := time.Now().Add(time.Hour)
+
+	tbl := []struct {
+		path   string
+		tkn    string
+		status int
+	}{
+		{"/dev", "", http.StatusUnauthorized},
+		{"/dev", makeToken("dev_user1", "dev", exp), http.StatusCreated},
+		{"/dev", makeToken("direct_user1", "direct", exp), http.StatusForbidden},
+		{"/dev", makeToken("dev_user1", "direct", exp), http.StatusForbidden}, // claim wins over id prefix
+		{"/dev", makeToken("dev_user1", "", exp), http.StatusCreated},         // issued before provider claim
+		{"/dev", makeToken("direct_user1", "", exp), http.StatusForbidden},    // issued before provider claim
+		{"/dev", makeToken("user1", "", exp), http.StatusForbidden},           // no provider at all
+		{"/any", makeToken("dev_user1", "dev", exp), http.StatusCreated},
+		{"/any", makeToken("direct_user1", "direct", exp), http.StatusCreated},
+		{"/any", makeToken("github_user1", "github", exp), http.StatusForbidden},
+	}
+	for i, tt := range tbl {
+		req, err := http.NewRequest("GET", server.URL+tt.path, http.NoBody)
+		require.NoError(t, err)
+		if tt.tkn != "" {
+			req.Header.Set("X-JWT", tt.tkn)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, tt.status, resp.StatusCode, "case #%d", i)
+	}
+
+	// expired token refreshed with provider kept
+	tkn, err := a.JWTService.(*token.Service).Token(token.Claims{User: &token.User{Name: "name1", ID: "user1"},
+		Provider: "dev", StandardClaims: jwt.StandardClaims{Id: "xsrf1", ExpiresAt: time.Now().Add(-time.Minute).Unix()}})
+	require.NoError(t, err)
+	req, err := http.NewRequest("GET", server.URL+"/dev", http.NoBody)
+	require.NoError(t, err)
+	req.AddCookie(&http.Cookie{Name: "JWT", Value: tkn})
+	req.Header.Set("X-XSRF-TOKEN", "xsrf1")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Equal(t, "JWT", resp.Cookies()[0].Name)
+	claims, err := a.JWTService.Parse(resp.Cookies()[0].Value)
+	require.NoError(t, err)
+	assert.Equal(t, "dev", claims.Provider)
+	assert.True(t, claims.ExpiresAt > time.Now().Unix())
+}
+
 func makeTestMux(_ *testing.T, a *Authenticator, required bool) http.Handler {
 	mux := http.NewServeMux()
 	authMiddleware := a.Auth
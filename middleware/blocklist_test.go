@@ -0,0 +1,135 @@
+package middleware
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/auth/provider"
+	"github.com/go-pkgz/auth/token"
+)
+
+func TestBlocklist(t *testing.T) {
+	a := makeTestAuth(t)
+	var events []provider.AuditEvent
+	a.Audit = func(ev provider.AuditEvent) { events = append(events, ev) }
+	store := NewMemBlockStore()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(201) })
+	mux := http.NewServeMux()
+	mux.Handle("/admin", a.Blocklist(store)(a.RBAC("admin")(handler)))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	makeToken := func(id, role string) string {
+		tkn, err := a.JWTService.(*token.Service).Token(token.Claims{User: &token.User{Name: "name1", ID: id, Role: role},
+			Provider: "dev", StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Hour).Unix()}})
+		require.NoError(t, err)
+		return tkn
+	}
+	get := func(tkn string) (status int, body string) {
+		req, err := http.NewRequest("GET", server.URL+"/admin", http.NoBody)
+		require.NoError(t, err)
+		if tkn != "" {
+			req.Header.Set("X-JWT", tkn)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(b)
+	}
+
+	admin, user := makeToken("dev_admin", "admin"), makeToken("dev_user", "user")
+	status, _ := get("")
+	assert.Equal(t, http.StatusUnauthorized, status)
+	status, _ = get(user)
+	assert.Equal(t, http.StatusForbidden, status, "rbac still applied")
+	status, _ = get(admin)
+	assert.Equal(t, http.StatusCreated, status)
+
+	// ban of the user in session takes effect on the next request with the same token
+	store.Add("dev_admin", 0)
+	status, body := get(admin)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, "Access denied\n", body)
+	require.Len(t, events, 1)
+	assert.Equal(t, provider.AuditBlocked, events[0].Type)
+	assert.Equal(t, "dev_admin", events[0].User)
+	assert.Equal(t, "dev", events[0].Provider)
+	assert.Equal(t, "127.0.0.1", events[0].IP)
+
+	a.BlockedMessage = "Banned"
+	_, body = get(admin)
+	assert.Equal(t, "Banned\n", body)
+
+	store.Remove("dev_admin")
+	status, _ = get(admin)
+	assert.Equal(t, http.StatusCreated, status, "unbanned")
+
+	store.Add("dev_admin", 50*time.Millisecond)
+	status, _ = get(admin)
+	assert.Equal(t, http.StatusForbidden, status)
+	time.Sleep(60 * time.Millisecond)
+	status, _ = get(admin)
+	assert.Equal(t, http.StatusCreated, status, "ban expired")
+}
+
+func TestBlocklist_StoreError(t *testing.T) {
+	a := makeTestAuth(t)
+	store := blockStoreFunc(func(string) (bool, error) { return false, errors.New("store down") })
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(201) })
+	server := httptest.NewServer(a.Blocklist(store)(handler))
+	defer server.Close()
+
+	tkn, err := a.JWTService.(*token.Service).Token(token.Claims{User: &token.User{Name: "name1", ID: "id1"},
+		StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Hour).Unix()}})
+	require.NoError(t, err)
+	get := func() int {
+		req, err := http.NewRequest("GET", server.URL, http.NoBody)
+		require.NoError(t, err)
+		req.Header.Set("X-JWT", tkn)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusCreated, get(), "fail-open by default")
+	a.BlockFailClosed = true
+	assert.Equal(t, http.StatusForbidden, get(), "fail-closed")
+}
+
+func TestMemBlockStore(t *testing.T) {
+	s := NewMemBlockStore()
+	blocked, err := s.IsBlocked("u1")
+	require.NoError(t, err)
+	assert.False(t, blocked)
+
+	s.Add("u1", 0)
+	s.Add("u2", time.Millisecond)
+	blocked, _ = s.IsBlocked("u1")
+	assert.True(t, blocked)
+	time.Sleep(2 * time.Millisecond)
+	blocked, _ = s.IsBlocked("u2")
+	assert.False(t, blocked, "expired")
+	assert.Len(t, s.blocked, 1, "expired ban removed")
+
+	s.Add("u1", time.Hour)
+	blocked, _ = s.IsBlocked("u1")
+	assert.True(t, blocked, "replaced with ttl")
+	s.Remove("u1")
+	blocked, _ = s.IsBlocked("u1")
+	assert.False(t, blocked)
+}
+
+type blockStoreFunc func(userID string) (bool, error)
+
+func (f blockStoreFunc) IsBlocked(userID string) (bool, error) { return f(userID) }
@@ -0,0 +1,193 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+
+	"github.com/go-pkgz/auth/httpclient"
+	"github.com/go-pkgz/auth/token"
+)
+
+// ExternalVerifier checks tokens issued by others, i.e. by corporate identity provider, and returns their user
+type ExternalVerifier interface {
+	Verify(tkn string) (token.User, error)
+}
+
+const (
+	defaultJWKSRefresh    = time.Hour
+	defaultJWKSMinRefresh = time.Minute
+)
+
+// JWKSVerifier implements ExternalVerifier for RSA-signed tokens with keys published as JWKS, i.e. by Azure AD.
+// Keys are cached and refreshed in background after RefreshInterval, unknown key id triggers refresh as well,
+// not more often than once a minute. URL, Issuer, Audience and MapClaims are required.
+type JWKSVerifier struct {
+	URL             string                                         // JWKS url, i.e. https://login.microsoftonline.com/<tenant>/discovery/v2.0/keys
+	Issuer          string                                         // expected iss claim
+	Audience        string                                         // expected aud claim, one of values if aud is a list
+	MapClaims       func(claims jwt.MapClaims) (token.User, error) // converts verified claims to user
+	RefreshInterval time.Duration                                  // interval of keys refresh, default 1h
+	Client          *http.Client                                   // client fetching keys, default one uses shared transport
+
+	mu         sync.RWMutex
+	keys       map[string]*rsa.PublicKey
+	fetched    time.Time // time of the last fetch attempt
+	refreshing int32     // non-zero while background refresh is running
+}
+
+// Verify checks signature of the token with the key from JWKS, issuer, audience and expiration, and maps claims to user
+func (v *JWKSVerifier) Verify(tkn string) (token.User, error) {
+	if v.MapClaims == nil || v.Issuer == "" || v.Audience == "" {
+		return token.User{}, errors.New("jwks verifier misconfigured, issuer, audience and claims mapper required")
+	}
+
+	parser := jwt.Parser{ValidMethods: []string{"RS256", "RS384", "RS512"}}
+	claims := jwt.MapClaims{}
+	if _, err := parser.ParseWithClaims(tkn, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return v.key(kid)
+	}); err != nil {
+		return token.User{}, fmt.Errorf("can't verify external token: %w", err)
+	}
+
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return token.User{}, errors.New("external token expired or has no exp")
+	}
+	if !claims.VerifyIssuer(v.Issuer, true) {
+		return token.User{}, fmt.Errorf("external token issuer %v rejected", claims["iss"])
+	}
+	if !claims.VerifyAudience(v.Audience, true) {
+		return token.User{}, fmt.Errorf("external token audience %v rejected", claims["aud"])
+	}
+
+	u, err := v.MapClaims(claims)
+	if err != nil {
+		return token.User{}, fmt.Errorf("can't map external claims: %w", err)
+	}
+	if u.ID == "" {
+		return token.User{}, errors.New("external claims mapped to user without id")
+	}
+	return u, nil
+}
+
+// key returns public key by id, fetches keys on first use and for unknown id, refreshes stale ones in background
+func (v *JWKSVerifier) key(kid string) (*rsa.PublicKey, error) {
+	refresh := v.RefreshInterval
+	if refresh == 0 {
+		refresh = defaultJWKSRefresh
+	}
+
+	v.mu.RLock()
+	key, ok := v.keys[kid]
+	fetched := v.fetched
+	v.mu.RUnlock()
+
+	switch {
+	case ok:
+		if time.Since(fetched) > refresh && atomic.CompareAndSwapInt32(&v.refreshing, 0, 1) {
+			go func() {
+				defer atomic.StoreInt32(&v.refreshing, 0)
+				_ = v.fetch()
+			}()
+		}
+		return key, nil
+	case !fetched.IsZero() && time.Since(fetched) < defaultJWKSMinRefresh:
+		return nil, fmt.Errorf("unknown key id %q", kid) // fetched recently, don't hammer jwks url
+	}
+
+	if err := v.fetch(); err != nil {
+		return nil, err
+	}
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	if key, ok = v.keys[kid]; !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	return key, nil
+}
+
+// fetch loads keys from URL, keeps previous ones on failure
+func (v *JWKSVerifier) fetch() error {
+	client := v.Client
+	if client == nil {
+		client = httpclient.New(5 * time.Second)
+	}
+
+	v.mu.Lock()
+	v.fetched = time.Now()
+	v.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", v.URL, http.NoBody)
+	if err != nil {
+		return fmt.Errorf("failed to make jwks request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch jwks: %w", err)
+	}
+	defer resp.Body.Close() // nolint
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch jwks, status %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return fmt.Errorf("failed to read jwks: %w", err)
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	v.keys = keys
+	v.mu.Unlock()
+	return nil
+}
+
+// parseJWKS returns RSA keys of the set by key id, other key types skipped
+func parseJWKS(data []byte) (map[string]*rsa.PublicKey, error) {
+	var set struct {
+		Keys []struct {
+			KTY string `json:"kty"`
+			KID string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("failed to parse jwks: %w", err)
+	}
+
+	decode := base64.RawURLEncoding.DecodeString
+	res := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if !strings.EqualFold(k.KTY, "RSA") {
+			continue
+		}
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode modulus of key %q: %w", k.KID, err)
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode exponent of key %q: %w", k.KID, err)
+		}
+		res[k.KID] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return res, nil
+}
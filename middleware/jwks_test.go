@@ -0,0 +1,183 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/auth/token"
+)
+
+type testJWKS struct {
+	key     *rsa.PrivateKey
+	kid     string
+	fetches int32
+	srv     *httptest.Server
+}
+
+func newTestJWKS(t *testing.T) *testJWKS {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	res := &testJWKS{key: key, kid: "key1"}
+	res.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&res.fetches, 1)
+		enc := base64.RawURLEncoding.EncodeToString
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+			{"kty": "EC", "kid": "ec-key"},
+			{"kty": "RSA", "kid": res.kid, "use": "sig", "n": enc(key.N.Bytes()), "e": enc(big.NewInt(int64(key.E)).Bytes())},
+		}})
+	}))
+	t.Cleanup(res.srv.Close)
+	return res
+}
+
+func (j *testJWKS) token(t *testing.T, kid string, claims jwt.MapClaims) string {
+	tkn := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	tkn.Header["kid"] = kid
+	res, err := tkn.SignedString(j.key)
+	require.NoError(t, err)
+	return res
+}
+
+func (j *testJWKS) verifier() *JWKSVerifier {
+	return &JWKSVerifier{URL: j.srv.URL, Issuer: "https://sts.example.com/tenant/", Audience: "api://my-app",
+		MapClaims: func(claims jwt.MapClaims) (token.User, error) {
+			oid, _ := claims["oid"].(string)
+			name, _ := claims["name"].(string)
+			return token.User{ID: "azure_" + oid, Name: name}, nil
+		}}
+}
+
+func validExtClaims() jwt.MapClaims {
+	return jwt.MapClaims{"iss": "https://sts.example.com/tenant/", "aud": []string{"api://my-app"}, "oid": "123",
+		"name": "john", "exp": time.Now().Add(time.Hour).Unix()}
+}
+
+func TestJWKSVerifier_Verify(t *testing.T) {
+	j := newTestJWKS(t)
+	v := j.verifier()
+
+	u, err := v.Verify(j.token(t, "key1", validExtClaims()))
+	require.NoError(t, err)
+	assert.Equal(t, token.User{ID: "azure_123", Name: "john"}, u)
+
+	tbl := []struct {
+		name   string
+		upd    func(c jwt.MapClaims)
+		errMsg string
+	}{
+		{"issuer", func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" }, "issuer"},
+		{"audience", func(c jwt.MapClaims) { c["aud"] = "api://other" }, "audience"},
+		{"expired", func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() }, "expired"},
+		{"no exp", func(c jwt.MapClaims) { delete(c, "exp") }, "has no exp"},
+	}
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			c := validExtClaims()
+			tt.upd(c)
+			_, err := v.Verify(j.token(t, "key1", c))
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errMsg)
+		})
+	}
+
+	// token signed by other key
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	tkn := jwt.NewWithClaims(jwt.SigningMethodRS256, validExtClaims())
+	tkn.Header["kid"] = "key1"
+	signed, err := tkn.SignedString(other)
+	require.NoError(t, err)
+	_, err = v.Verify(signed)
+	assert.Error(t, err)
+
+	// hmac token with public key as secret rejected
+	hs := jwt.NewWithClaims(jwt.SigningMethodHS256, validExtClaims())
+	hs.Header["kid"] = "key1"
+	signed, err = hs.SignedString(j.key.N.Bytes())
+	require.NoError(t, err)
+	_, err = v.Verify(signed)
+	assert.Error(t, err)
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&j.fetches), "keys cached")
+}
+
+func TestJWKSVerifier_Refresh(t *testing.T) {
+	j := newTestJWKS(t)
+	v := j.verifier()
+	v.RefreshInterval = 50 * time.Millisecond
+
+	_, err := v.Verify(j.token(t, "key1", validExtClaims()))
+	require.NoError(t, err)
+
+	// unknown kid right after fetch rejected without refetch
+	_, err = v.Verify(j.token(t, "key2", validExtClaims()))
+	assert.Contains(t, err.Error(), `unknown key id "key2"`)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&j.fetches))
+
+	// stale keys used and refreshed in background
+	time.Sleep(60 * time.Millisecond)
+	_, err = v.Verify(j.token(t, "key1", validExtClaims()))
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&j.fetches) == 2 }, time.Second, 10*time.Millisecond)
+
+	// rotated key fetched on unknown kid once min interval passed
+	v.mu.Lock()
+	v.fetched = time.Now().Add(-2 * time.Minute)
+	v.mu.Unlock()
+	j.kid = "key2"
+	_, err = v.Verify(j.token(t, "key2", validExtClaims()))
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&j.fetches))
+}
+
+func TestAuthExternalVerifier(t *testing.T) {
+	j := newTestJWKS(t)
+	a := makeTestAuth(t)
+	a.ExternalVerifier = j.verifier()
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		u, err := token.GetUserInfo(r)
+		require.NoError(t, err)
+		_, _ = fmt.Fprintf(w, "%s/%s", u.ID, u.Name)
+	}
+	h := a.Auth(http.HandlerFunc(handler))
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/auth", http.NoBody)
+	req.Header.Set("Authorization", "Bearer "+j.token(t, "key1", validExtClaims()))
+	h.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "azure_123/john", rr.Body.String())
+	assert.Empty(t, rr.Header().Values("Set-Cookie"), "external tokens never refreshed")
+
+	// invalid external token
+	c := validExtClaims()
+	c["aud"] = "api://other"
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/auth", http.NoBody)
+	req.Header.Set("Authorization", "Bearer "+j.token(t, "key1", c))
+	h.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// blocked by validator
+	a.Validator = token.ValidatorFunc(func(_ string, claims token.Claims) bool { return claims.User.ID != "azure_123" })
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/auth", http.NoBody)
+	req.Header.Set("Authorization", "Bearer "+j.token(t, "key1", validExtClaims()))
+	a.Auth(http.HandlerFunc(handler)).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
@@ -0,0 +1,93 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// AddressValidator checks confirmation address and returns it normalized, invalid address rejected with 400
+// and the error's message
+type AddressValidator func(address string) (string, error)
+
+// emailDomainProfile converts IDN domains to ASCII, lowercased and checked for DNS label rules and length
+var emailDomainProfile = idna.New(idna.MapForLookup(), idna.BidiRule(), idna.VerifyDNSLength(true))
+
+// EmailAddress is AddressValidator of email addresses by RFC 5321 syntax, with dot-string or quoted local part
+// and domain name, address literals like user@[10.0.0.1] rejected. Domain returned lowercased, IDN converted
+// to punycode, the local part, including plus tag, kept as is.
+func EmailAddress(address string) (string, error) {
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return "", errors.New("invalid email address, no @")
+	}
+	local, domain := address[:at], strings.TrimSuffix(address[at+1:], ".")
+	if err := checkLocalPart(local); err != nil {
+		return "", fmt.Errorf("invalid email address, %w", err)
+	}
+
+	asciiDomain, err := emailDomainProfile.ToASCII(domain)
+	if err != nil || domain == "" {
+		return "", errors.New("invalid email address, bad domain")
+	}
+	dot := strings.LastIndex(asciiDomain, ".")
+	if dot < 0 || strings.Trim(asciiDomain[dot+1:], "0123456789") == "" {
+		return "", errors.New("invalid email address, bad domain") // single label or ip address
+	}
+
+	res := local + "@" + asciiDomain
+	if len(res) > 254 { // max path of 256 octets includes angle brackets
+		return "", errors.New("invalid email address, too long")
+	}
+	return res, nil
+}
+
+// isEmail checks address is valid email address
+func isEmail(address string) bool {
+	_, err := EmailAddress(address)
+	return err == nil
+}
+
+// checkLocalPart checks local part of email address is dot-string or quoted string of RFC 5321
+func checkLocalPart(local string) error {
+	switch {
+	case local == "":
+		return errors.New("empty local part")
+	case len(local) > 64:
+		return errors.New("local part too long")
+	}
+
+	if strings.HasPrefix(local, `"`) {
+		if len(local) < 2 || !strings.HasSuffix(local, `"`) {
+			return errors.New("bad quoted local part")
+		}
+		quoted := local[1 : len(local)-1]
+		for i := 0; i < len(quoted); i++ {
+			c := quoted[i]
+			if c == '\\' && i+1 < len(quoted) && quoted[i+1] >= 32 && quoted[i+1] <= 126 {
+				i++ // quoted pair
+				continue
+			}
+			if c < 32 || c > 126 || c == '"' || c == '\\' {
+				return errors.New("bad quoted local part")
+			}
+		}
+		return nil
+	}
+
+	for _, atom := range strings.Split(local, ".") {
+		if atom == "" {
+			return errors.New("bad dots in local part")
+		}
+		for i := 0; i < len(atom); i++ {
+			c := atom[i]
+			isAlnum := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+			if !isAlnum && !strings.ContainsRune("!#$%&'*+-/=?^_`{|}~", rune(c)) {
+				return fmt.Errorf("bad character %q in local part", c)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package provider
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmailAddress(t *testing.T) {
+	tbl := []struct {
+		address, res string
+	}{
+		{"user@example.com", "user@example.com"},
+		{"User.Name@Example.COM", "User.Name@example.com"},
+		{"user+tag@example.com", "user+tag@example.com"},
+		{"user+tag+more@sub.example.co.uk", "user+tag+more@sub.example.co.uk"},
+		{"o'brien@example.com", "o'brien@example.com"},
+		{`"john doe"@example.com`, `"john doe"@example.com`},
+		{`"a\"b@c"@example.com`, `"a\"b@c"@example.com`},
+		{"user@example.com.", "user@example.com"},
+		{"user@münchen.de", "user@xn--mnchen-3ya.de"},
+		{"user@MÜNCHEN.DE", "user@xn--mnchen-3ya.de"},
+		{"user@xn--mnchen-3ya.de", "user@xn--mnchen-3ya.de"},
+		{"user@пример.рф", "user@xn--e1afmkfd.xn--p1ai"},
+	}
+	for _, tt := range tbl {
+		res, err := EmailAddress(tt.address)
+		require.NoError(t, err, tt.address)
+		assert.Equal(t, tt.res, res, tt.address)
+	}
+
+	for _, address := range []string{
+		"", "user", "@example.com", "user@", "user@localhost", "user@[10.0.0.1]", "user@10.0.0.1",
+		"user..name@example.com", ".user@example.com", "user.@example.com", "user name@example.com",
+		"user<x>@example.com", "üser@example.com", `"unterminated@example.com`, `"a"b"@example.com`,
+		"user@exa mple.com", "user@-example.com", "user@example..com", "user@ex_ample.com",
+		strings.Repeat("a", 65) + "@example.com", "user@" + strings.Repeat("a", 64) + ".com",
+		"user@" + strings.Repeat(strings.Repeat("a", 60)+".", 5) + "com",
+	} {
+		_, err := EmailAddress(address)
+		assert.Error(t, err, address)
+	}
+}
@@ -0,0 +1,192 @@
+package provider
+
+import (
+	"crypto/sha1" //nolint
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+
+	"github.com/go-pkgz/auth/token"
+)
+
+// name rejection codes, sent to the client as "code" to be translated by the frontend
+const (
+	NameTooShort     = "name_too_short"
+	NameTooLong      = "name_too_long"
+	NameInvalidChars = "name_invalid_chars"
+	NameReserved     = "name_reserved"
+	NameRejected     = "name_rejected"
+)
+
+const (
+	defaultAnonMinLength = 3
+	defaultAnonMaxLength = 64
+
+	defaultPersistentIDCookiePrefix = "ANON-ID-"
+	defaultPersistentIDTTL          = 365 * 24 * time.Hour
+)
+
+// DefaultReservedNames used by AnonymousCredChecker if Reserved not set
+var DefaultReservedNames = []string{"admin", "administrator", "moderator", "support", "root", "system"}
+
+var defaultAnonAllowed = regexp.MustCompile(`^\p{L}[\p{L}\p{M}\p{N}_ ]*$`)
+
+// NameError is returned by AnonymousCredChecker for rejected names, DirectHandler responds to it with 400
+// and {"error":reason,"code":code}
+type NameError struct {
+	Code   string
+	Reason string
+}
+
+func (e *NameError) Error() string { return e.Reason }
+
+// AnonymousCredChecker allows login with any valid user name and ignores the password.
+// The name is normalized to NFC with repeated whitespace collapsed, checked for length and allowed characters and
+// compared against reserved names by confusable skeleton, so "аdmin" with cyrillic "а", "Ádmin" or "adm1n"
+// are rejected as "admin". Zero values replaced by defaults.
+type AnonymousCredChecker struct {
+	MinLength int                     // min length in characters, default 3
+	MaxLength int                     // max length in characters, default 64
+	Allowed   *regexp.Regexp          // allowed name, default is a letter followed by letters, digits, underscores and spaces
+	Reserved  []string                // reserved names, default DefaultReservedNames, empty non-nil list disables it
+	Validator func(name string) error // optional extra check of normalized name, error rejects the name with its message
+}
+
+// Check validates the user name, password ignored
+func (c AnonymousCredChecker) Check(user, _ string) (ok bool, err error) {
+	_, err = c.Normalize(user)
+	return err == nil, err
+}
+
+// CheckUser validates the user name and returns the user with normalized name and ID based on it
+func (c AnonymousCredChecker) CheckUser(user, _ string) (ok bool, u token.User, err error) {
+	name, err := c.Normalize(user)
+	if err != nil {
+		return false, token.User{}, err
+	}
+	return true, token.User{Name: name, ID: token.HashID(sha1.New(), name)}, nil
+}
+
+// Normalize returns normalized user name or *NameError if the name is rejected
+func (c AnonymousCredChecker) Normalize(user string) (string, error) {
+	minLen, maxLen, allowed, reserved := c.MinLength, c.MaxLength, c.Allowed, c.Reserved
+	if minLen == 0 {
+		minLen = defaultAnonMinLength
+	}
+	if maxLen == 0 {
+		maxLen = defaultAnonMaxLength
+	}
+	if allowed == nil {
+		allowed = defaultAnonAllowed
+	}
+	if reserved == nil {
+		reserved = DefaultReservedNames
+	}
+
+	name := strings.Join(strings.Fields(norm.NFC.String(user)), " ")
+	if strings.IndexFunc(name, func(r rune) bool { return unicode.In(r, unicode.Cc, unicode.Cf) }) >= 0 {
+		// zero-width and other invisible chars rejected regardless of allowed pattern
+		return "", &NameError{Code: NameInvalidChars, Reason: "name should not contain invisible characters"}
+	}
+
+	nl := len([]rune(name))
+	if nl < minLen {
+		return "", &NameError{Code: NameTooShort, Reason: fmt.Sprintf("name should be at least %d characters long", minLen)}
+	}
+	if nl > maxLen {
+		return "", &NameError{Code: NameTooLong, Reason: fmt.Sprintf("name should be at most %d characters long", maxLen)}
+	}
+	if !allowed.MatchString(name) {
+		return "", &NameError{Code: NameInvalidChars, Reason: "name contains not allowed characters"}
+	}
+
+	sk := skeleton(name)
+	for _, r := range reserved {
+		if sk == skeleton(r) {
+			return "", &NameError{Code: NameReserved, Reason: "name is reserved"}
+		}
+	}
+
+	if c.Validator != nil {
+		if err := c.Validator(name); err != nil {
+			return "", &NameError{Code: NameRejected, Reason: err.Error()}
+		}
+	}
+	return name, nil
+}
+
+// PersistentID keeps random identity of the user in a long-lived cookie, separate from auth token, so
+// the same browser gets the same user ID on each login regardless of the name, and users with the same name
+// don't collide. Lost cookie yields a fresh identity. Zero values replaced by defaults.
+type PersistentID struct {
+	CookieName string        // default is ANON-ID-<provider>
+	TTL        time.Duration // cookie lifetime, extended on each login, default 1 year
+	Secure     bool          // set secure flag on the cookie
+}
+
+var persistentIDRe = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// userID returns user ID for the identity from the cookie, makes new identity if no valid cookie.
+// The cookie is (re)set on each call, user ID is a hash of its value, so the public ID doesn't reveal the cookie.
+func (pid PersistentID) userID(w http.ResponseWriter, r *http.Request, provider string) (string, error) {
+	name, ttl := pid.CookieName, pid.TTL
+	if name == "" {
+		name = defaultPersistentIDCookiePrefix + provider
+	}
+	if ttl == 0 {
+		ttl = defaultPersistentIDTTL
+	}
+
+	var id string
+	if c, err := r.Cookie(name); err == nil && persistentIDRe.MatchString(c.Value) {
+		id = c.Value
+	}
+	if id == "" {
+		var err error
+		if id, err = randToken(); err != nil {
+			return "", fmt.Errorf("can't make persistent id: %w", err)
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: name, Value: id, HttpOnly: true, Path: "/", MaxAge: int(ttl.Seconds()),
+		Secure: pid.Secure, SameSite: http.SameSiteLaxMode})
+	// hashed explicitly, as token.HashID keeps sha-like values as-is
+	return provider + "_" + fmt.Sprintf("%x", sha1.Sum([]byte(id))), nil //nolint:gosec // not a password
+}
+
+// confusables maps chars looking alike latin letters to them, lowercase only as skeleton is case-insensitive.
+// Everything looking like "i" or "l", including "i" itself, mapped to "l".
+var confusables = map[rune]rune{
+	// cyrillic
+	'а': 'a', 'в': 'b', 'е': 'e', 'ё': 'e', 'һ': 'h', 'і': 'l', 'ї': 'l', 'ј': 'j', 'к': 'k', 'м': 'm', 'н': 'h',
+	'о': 'o', 'р': 'p', 'с': 'c', 'т': 't', 'у': 'y', 'х': 'x', 'ѕ': 's', 'ԁ': 'd', 'ԛ': 'q', 'ԝ': 'w',
+	// greek
+	'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'n', 'ι': 'l', 'κ': 'k', 'μ': 'u', 'ν': 'v', 'ο': 'o', 'ρ': 'p',
+	'τ': 't', 'υ': 'u', 'χ': 'x',
+	// digits and symbols
+	'0': 'o', '1': 'l', '3': 'e', '4': 'a', '5': 's', '7': 't', '8': 'b', '@': 'a', '$': 's', '|': 'l', '!': 'l',
+	// latin
+	'i': 'l', 'ı': 'l', 'ł': 'l', 'ø': 'o', 'đ': 'd', 'ħ': 'h',
+}
+
+// skeleton makes comparable form of the name: compatibility decomposition with diacritics, invisible chars,
+// spaces and punctuation removed, lowercase, confusables mapped to latin letters, "rn" to "m" and "vv" to "w"
+func skeleton(s string) string {
+	var b strings.Builder
+	for _, r := range norm.NFKD.String(s) {
+		if unicode.In(r, unicode.Mn, unicode.Cc, unicode.Cf, unicode.Z) || r == '_' || r == '-' || r == '.' {
+			continue
+		}
+		r = unicode.ToLower(r)
+		if m, ok := confusables[r]; ok {
+			r = m
+		}
+		b.WriteRune(r)
+	}
+	res := strings.ReplaceAll(b.String(), "rn", "m")
+	return strings.ReplaceAll(res, "vv", "w")
+}
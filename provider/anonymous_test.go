@@ -0,0 +1,213 @@
+package provider
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/auth/logger"
+	"github.com/go-pkgz/auth/token"
+)
+
+func TestAnonymousCredChecker_Normalize(t *testing.T) {
+	tbl := []struct {
+		name string
+		inp  string
+		res  string
+		code string
+	}{
+		{"plain", "john", "john", ""},
+		{"spaces collapsed", "  john \t  doe ", "john doe", ""},
+		{"nfc", "José", "José", ""},
+		{"unicode letters", "Иван Петров", "Иван Петров", ""},
+		{"digits and underscore", "john_doe 42", "john_doe 42", ""},
+		{"too short", "jo", "", NameTooShort},
+		{"too short after trim", "  jo \t", "", NameTooShort},
+		{"too long", strings.Repeat("a", 65), "", NameTooLong},
+		{"emoji", "john 😀", "", NameInvalidChars},
+		{"starts with digit", "1john", "", NameInvalidChars},
+		{"punctuation", "john.doe", "", NameInvalidChars},
+		{"zero-width space", "jo​hn", "", NameInvalidChars},
+		{"rtl override", "john‮", "", NameInvalidChars},
+
+		{"reserved", "admin", "", NameReserved},
+		{"reserved case", "AdMiN", "", NameReserved},
+		{"reserved spaces", "ad min", "", NameReserved},
+		{"reserved underscore", "ad_min", "", NameReserved},
+		{"cyrillic a", "аdmin", "", NameReserved},
+		{"cyrillic o and e", "mоdеrator", "", NameReserved},
+		{"greek omicron", "rοοt", "", NameReserved},
+		{"accented", "Ádmín", "", NameReserved},
+		{"combining marks", "ádmïn", "", NameReserved},
+		{"digit for letter", "adm1n", "", NameReserved},
+		{"digit for o", "r00t", "", NameReserved},
+		{"rn for m", "adrnin", "", NameReserved},
+		{"dotless i", "admın", "", NameReserved},
+		{"capital i for l", "admIn", "", NameReserved},
+		{"fullwidth", "ａｄｍｉｎ", "", NameReserved},
+		{"not reserved", "admiral", "admiral", ""},
+		{"reserved as part", "admin john", "admin john", ""},
+	}
+	c := AnonymousCredChecker{}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := c.Normalize(tt.inp)
+			if tt.code == "" {
+				require.NoError(t, err)
+				assert.Equal(t, tt.res, res)
+				return
+			}
+			nameErr := &NameError{}
+			require.True(t, errors.As(err, &nameErr), "error %v", err)
+			assert.Equal(t, tt.code, nameErr.Code)
+			assert.Empty(t, res)
+		})
+	}
+}
+
+func TestAnonymousCredChecker_Custom(t *testing.T) {
+	c := AnonymousCredChecker{
+		MinLength: 2,
+		MaxLength: 5,
+		Allowed:   regexp.MustCompile(`^[a-z]+$`),
+		Reserved:  []string{"brand"},
+		Validator: func(name string) error {
+			if name == "bad" {
+				return errors.New("name not allowed")
+			}
+			return nil
+		},
+	}
+	tbl := []struct {
+		inp, code string
+	}{
+		{"jo", ""}, {"j", NameTooShort}, {"johnny", NameTooLong}, {"John", NameInvalidChars},
+		{"admin", ""}, {"brand", NameReserved}, {"br4nd", NameInvalidChars}, {"bad", NameRejected},
+	}
+	for _, tt := range tbl {
+		_, err := c.Normalize(tt.inp)
+		if tt.code == "" {
+			assert.NoError(t, err, tt.inp)
+			continue
+		}
+		nameErr := &NameError{}
+		require.True(t, errors.As(err, &nameErr), tt.inp)
+		assert.Equal(t, tt.code, nameErr.Code, tt.inp)
+	}
+	_, err := c.Normalize("bad")
+	assert.EqualError(t, err, "name not allowed")
+
+	_, err = AnonymousCredChecker{Reserved: []string{}}.Normalize("admin")
+	assert.NoError(t, err, "empty list disables default reserved names")
+}
+
+func TestAnonymousCredChecker_LoginHandler(t *testing.T) {
+	d := DirectHandler{
+		ProviderName: "anonymous",
+		CredChecker:  AnonymousCredChecker{},
+		TokenService: token.NewService(token.Opts{
+			SecretReader:   token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+			TokenDuration:  time.Hour,
+			CookieDuration: time.Hour * 24 * 31,
+		}),
+		Issuer: "iss-test",
+		L:      logger.NoOp{},
+	}
+	login := func(user string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/login?user="+url.QueryEscape(user), http.NoBody)
+		http.HandlerFunc(d.LoginHandler).ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := login("  john   doe ")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Contains(t, rr.Body.String(), `"name":"john doe","id":"anonymous_`)
+	assert.Contains(t, login("john doe").Body.String(), `"id":"anonymous_fa0688a33f549f434a2802febc34e6ed8d6d0de8"`)
+	assert.Contains(t, rr.Body.String(), `"id":"anonymous_fa0688a33f549f434a2802febc34e6ed8d6d0de8"`, "the same user for normalized name")
+
+	rr = login("аdmin")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, `{"code":"name_reserved","error":"name is reserved"}`+"\n", rr.Body.String())
+
+	rr = login("jo")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, `{"code":"name_too_short","error":"name should be at least 3 characters long"}`+"\n", rr.Body.String())
+}
+
+func TestAnonymousCredChecker_PersistentID(t *testing.T) {
+	d := DirectHandler{
+		ProviderName: "anonymous",
+		CredChecker:  AnonymousCredChecker{},
+		TokenService: token.NewService(token.Opts{
+			SecretReader:   token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+			TokenDuration:  time.Hour,
+			CookieDuration: time.Hour * 24 * 31,
+		}),
+		Issuer:       "iss-test",
+		L:            logger.NoOp{},
+		PersistentID: &PersistentID{TTL: time.Hour},
+	}
+	type resp struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}
+	login := func(user string, c *http.Cookie) (resp, *http.Cookie) {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/login?user="+url.QueryEscape(user), http.NoBody)
+		if c != nil {
+			req.AddCookie(c)
+		}
+		http.HandlerFunc(d.LoginHandler).ServeHTTP(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		res := resp{}
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &res))
+		for _, ck := range rr.Result().Cookies() {
+			if ck.Name == "ANON-ID-anonymous" {
+				return res, ck
+			}
+		}
+		t.Fatal("no persistent id cookie")
+		return res, nil
+	}
+
+	// the same name in different browsers doesn't collide
+	u1, c1 := login("guest", nil)
+	u2, c2 := login("guest", nil)
+	assert.Equal(t, "guest", u1.Name)
+	assert.NotEqual(t, u1.ID, u2.ID)
+	assert.NotEqual(t, c1.Value, c2.Value)
+	assert.True(t, strings.HasPrefix(u1.ID, "anonymous_"))
+	assert.True(t, c1.HttpOnly)
+	assert.Equal(t, 3600, c1.MaxAge)
+	assert.NotContains(t, u1.ID, c1.Value, "id doesn't reveal cookie")
+
+	// returning browser gets the same id with any name
+	u3, c3 := login("other name", c1)
+	assert.Equal(t, u1.ID, u3.ID)
+	assert.Equal(t, "other name", u3.Name)
+	assert.Equal(t, c1.Value, c3.Value, "cookie refreshed with the same value")
+
+	// cleared or forged cookie yields fresh identity
+	u4, _ := login("guest", nil)
+	assert.NotEqual(t, u1.ID, u4.ID)
+	u5, c5 := login("guest", &http.Cookie{Name: "ANON-ID-anonymous", Value: "bad value"})
+	assert.NotEqual(t, "bad value", c5.Value)
+	assert.NotEqual(t, u1.ID, u5.ID)
+
+	ids := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		u, _ := login("guest", nil)
+		assert.False(t, ids[u.ID], "collision")
+		ids[u.ID] = true
+	}
+}
@@ -26,6 +26,7 @@ import (
 	"github.com/go-pkgz/rest"
 	"github.com/golang-jwt/jwt"
 
+	"github.com/go-pkgz/auth/httpclient"
 	"github.com/go-pkgz/auth/logger"
 	"github.com/go-pkgz/auth/token"
 )
@@ -162,6 +163,10 @@ func NewApple(p Params, appleCfg AppleConfig, privateKeyLoader PrivateKeyLoaderI
 		responseMode = appleCfg.ResponseMode
 	}
 
+	if p.FirstLoginStore == nil {
+		p.FirstLoginStore = NewMemFirstLoginStore()
+	}
+
 	ah := AppleHandler{
 		Params: p,
 		name:   "apple", // static name for an Apple provider
@@ -263,7 +268,7 @@ func (ah *AppleHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 		StandardClaims: jwt.StandardClaims{
 			Id:        cid,
 			Audience:  r.URL.Query().Get("site"),
-			ExpiresAt: time.Now().Add(30 * time.Minute).Unix(),
+			ExpiresAt: ah.stateExpiresAt(),
 			NotBefore: time.Now().Add(-1 * time.Minute).Unix(),
 		},
 	}
@@ -290,6 +295,7 @@ func (ah *AppleHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 // GET /callback
 func (ah *AppleHandler) AuthHandler(w http.ResponseWriter, r *http.Request) {
 	// read response form data
+	limitBody(w, r, ah.MaxBodySize)
 	if err := r.ParseForm(); err != nil {
 		rest.SendErrorJSON(w, r, ah.L, http.StatusInternalServerError, err, "read callback response from data failed")
 		return
@@ -313,6 +319,9 @@ func (ah *AppleHandler) AuthHandler(w http.ResponseWriter, r *http.Request) {
 		rest.SendErrorJSON(w, r, ah.L, http.StatusForbidden, nil, "invalid handshake token")
 		return
 	}
+	if ah.stateExpired(w, oauthClaims) {
+		return
+	}
 
 	retrievedState := oauthClaims.Handshake.State
 	if retrievedState == "" || retrievedState != state {
@@ -321,7 +330,9 @@ func (ah *AppleHandler) AuthHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var resp appleVerificationResponse
-	err = ah.exchange(context.Background(), code, ah.makeRedirURL(r.URL.Path), &resp)
+	ctx, cancel := ah.OAuthRetry.context(context.Background())
+	defer cancel()
+	err = ah.exchange(ctx, code, ah.makeRedirURL(r.URL.Path), &resp)
 	if err != nil {
 		rest.SendErrorJSON(w, r, ah.L, http.StatusInternalServerError, err, "exchange failed")
 		return
@@ -333,7 +344,7 @@ func (ah *AppleHandler) AuthHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// trying to fetch Apple public key (JWK) for verify token signature, it need for verify IDToken received from Apple
-	keySet, err := fetchAppleJWK(r.Context(), ah.conf.jwkURL)
+	keySet, err := fetchAppleJWK(r.Context(), ah.Transport, ah.conf.jwkURL)
 	if err != nil {
 		ah.L.Error("[ERROR] failed to fetch JWK from Apple key service: " + err.Error())
 		rest.SendErrorJSON(w, r, ah.L, http.StatusInternalServerError, nil, fmt.Sprintf("failed to fetch JWK from Apple key service: %s", resp.Error))
@@ -351,19 +362,27 @@ func (ah *AppleHandler) AuthHandler(w http.ResponseWriter, r *http.Request) {
 
 	u := ah.mapUser(tokenClaims)
 
-	u, err = setAvatar(ah.AvatarSaver, u, &http.Client{Timeout: 5 * time.Second})
-	if err != nil {
-		rest.SendErrorJSON(w, r, ah.L, http.StatusInternalServerError, err, "failed to save avatar to proxy")
-		return
+	if !ah.AvatarFetch.Skip {
+		u, err = ah.PictureUpdate.setAvatar(ah.L, ah.AvatarSaver, u, ah.AvatarFetch.client(nil))
+		if err != nil {
+			rest.SendErrorJSON(w, r, ah.L, http.StatusInternalServerError, err, "failed to save avatar to proxy")
+			return
+		}
 	}
 
-	// try parse username if one exist at response or noname assign
-	ah.parseUserData(&u, jUser)
+	// user name sent by apple only on the first login, kept in FirstLoginStore for next logins
+	if jUser != "" {
+		ah.parseUserData(&u, jUser)
+	}
+	ah.firstLogin(&u, append([]string{"name"}, ah.FirstLoginFields...))
+	if u.Name == "" {
+		u.Name = "noname_" + u.ID[6:12]
+	}
 
 	if ah.UserSaver != nil {
 		err = ah.UserSaver(u)
 		if err != nil {
-			rest.SendErrorJSON(w, r, ah.L, http.StatusInternalServerError, err, "failed to save user")
+			sendSaveUserError(w, r, ah.L, err)
 			return
 		}
 	}
@@ -377,11 +396,12 @@ func (ah *AppleHandler) AuthHandler(w http.ResponseWriter, r *http.Request) {
 	claims := token.Claims{
 		User: &u,
 		StandardClaims: jwt.StandardClaims{
-			Issuer:   ah.Issuer,
+			Issuer:   ah.IssuerFunc.get(r, ah.Issuer),
 			Id:       cid,
 			Audience: oauthClaims.Audience,
 		},
 		SessionOnly: false,
+		Provider:    ah.name,
 	}
 
 	if _, err = ah.JwtService.Set(w, claims); err != nil {
@@ -393,7 +413,7 @@ func (ah *AppleHandler) AuthHandler(w http.ResponseWriter, r *http.Request) {
 
 	// redirect to back url if presented in login query params
 	if oauthClaims.Handshake != nil && oauthClaims.Handshake.From != "" {
-		http.Redirect(w, r, oauthClaims.Handshake.From, http.StatusTemporaryRedirect)
+		redirectBack(w, r, oauthClaims.Handshake.From, ah.RedirectStatus)
 		return
 	}
 	rest.RenderJSON(w, &u)
@@ -427,17 +447,30 @@ func (ah *AppleHandler) exchange(ctx context.Context, code, redirectURI string,
 	data.Set("redirect_uri", redirectURI) // redirect URL can't refer to localhost and must have trusted certificate and https protocol
 	data.Set("grant_type", "authorization_code")
 
-	client := http.Client{Timeout: time.Second * 5}
-	req, err := http.NewRequestWithContext(ctx, "POST", ah.endpoint.TokenURL, strings.NewReader(data.Encode()))
-	if err != nil {
-		return err
+	client := httpclient.New(5 * time.Second)
+	if ah.Transport != nil {
+		client.Transport = ah.Transport
 	}
+	var res *http.Response
+	err := ah.OAuthRetry.do(ctx, ah.L, ah.name, "exchange", func() error {
+		req, err := http.NewRequestWithContext(ctx, "POST", ah.endpoint.TokenURL, strings.NewReader(data.Encode()))
+		if err != nil {
+			return err
+		}
 
-	req.Header.Add("content-type", appleRequestContentType)
-	req.Header.Add("accept", AcceptJSONHeader)
-	req.Header.Add("user-agent", defaultUserAgent) // apple requires a user agent
+		req.Header.Add("content-type", appleRequestContentType)
+		req.Header.Add("accept", AcceptJSONHeader)
+		req.Header.Add("user-agent", defaultUserAgent) // apple requires a user agent
 
-	res, err := client.Do(req)
+		if res, err = client.Do(req); err != nil {
+			return err
+		}
+		if res.StatusCode >= 500 {
+			_ = res.Body.Close()
+			return errStatus5xx{status: res.Status}
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
@@ -17,6 +17,8 @@ import (
 	"time"
 
 	"github.com/golang-jwt/jwt"
+
+	"github.com/go-pkgz/auth/httpclient"
 )
 
 // appleKeysURL is the endpoint URL for fetch Apple’s public key
@@ -44,9 +46,12 @@ type appleRawKey struct {
 	E   string `json:"e"`
 }
 
-// fetchAppleJWK to make web request to Apple service for get Apple public keys (JWK)
-func fetchAppleJWK(ctx context.Context, keyURL string) (set appleKeySet, err error) {
-	client := http.Client{Timeout: time.Second * 5}
+// fetchAppleJWK to make web request to Apple service for get Apple public keys (JWK), with shared transport if tr is nil
+func fetchAppleJWK(ctx context.Context, tr http.RoundTripper, keyURL string) (set appleKeySet, err error) {
+	client := httpclient.New(5 * time.Second)
+	if tr != nil {
+		client.Transport = tr
+	}
 
 	if keyURL == "" {
 		keyURL = appleKeysURL
@@ -22,18 +22,18 @@ func TestApplePublicKey_Fetch(t *testing.T) {
 	// valid response checking
 	ctx := context.Background()
 	url := fmt.Sprintf("http://127.0.0.1:%d/keys", 8982)
-	set, err := fetchAppleJWK(ctx, url)
+	set, err := fetchAppleJWK(ctx, nil, url)
 	assert.NoError(t, err)
 	assert.NotEqual(t, appleKeySet{}, set)
 
 	// check service response error
 	url = fmt.Sprintf("http://127.0.0.1:%d/error", 8982)
-	_, err = fetchAppleJWK(ctx, url)
+	_, err = fetchAppleJWK(ctx, nil, url)
 	assert.Error(t, err)
 
 	url = fmt.Sprintf("http://127.0.0.1:%d/no-answer", 8982)
 	ctx, cancelFunc := context.WithTimeout(ctx, time.Second*2)
-	_, err = fetchAppleJWK(ctx, url)
+	_, err = fetchAppleJWK(ctx, nil, url)
 	defer cancelFunc()
 	assert.Error(t, err)
 
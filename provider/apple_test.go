@@ -12,6 +12,7 @@ import (
 	"log"
 	"net/http"
 	"net/http/cookiejar"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -337,6 +338,69 @@ func TestAppleHandler_LogoutHandler(t *testing.T) {
 
 }
 
+func TestAppleHandler_FirstLoginName(t *testing.T) {
+	signKey, testJWK := createTestSignKeyPairs(t)
+	idToken, err := createTestResponseToken(signKey)
+	require.NoError(t, err)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/token":
+			_, _ = fmt.Fprintf(w, `{"access_token":"MTQ0NjJkZmQ5","token_type":"bearer","id_token":%q}`, idToken)
+		case "/keys":
+			_, _ = fmt.Fprintf(w, `{"keys":[%s]}`, testJWK)
+		}
+	}))
+	defer srv.Close()
+
+	ah, err := prepareAppleHandlerTest("", []string{})
+	require.NoError(t, err)
+	ah.endpoint.TokenURL = srv.URL + "/token"
+	ah.conf.jwkURL = srv.URL + "/keys"
+	ah.L = logger.NoOp{}
+	ah.JwtService = token.NewService(token.Opts{SecretReader: token.SecretFunc(mockKeyStore), TokenDuration: time.Hour,
+		CookieDuration: days31})
+
+	login := func(user string) token.User {
+		rr := httptest.NewRecorder()
+		ah.LoginHandler(rr, httptest.NewRequest("GET", "/login?site=remark", http.NoBody))
+		require.Equal(t, http.StatusFound, rr.Code, rr.Body.String())
+		loc, err := url.Parse(rr.Header().Get("Location"))
+		require.NoError(t, err)
+		form := url.Values{"code": {"abc"}, "state": {loc.Query().Get("state")}}
+		if user != "" {
+			form.Set("user", user)
+		}
+		req := httptest.NewRequest("POST", "/callback", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range rr.Result().Cookies() {
+			req.AddCookie(c)
+		}
+		rr = httptest.NewRecorder()
+		ah.AuthHandler(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		u := token.User{}
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &u))
+		return u
+	}
+
+	userID := "apple_" + token.HashID(sha1.New(), "userid1")
+	assert.Equal(t, "John Doe", login(`{"name":{"firstName":"John","lastName":"Doe"},"email":"john@example.com"}`).Name,
+		"first login with user data")
+	assert.Equal(t, "John Doe", login("").Name, "second login without user data, name kept")
+	stored, err := ah.FirstLoginStore.Get(userID)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"name": "John Doe"}, stored)
+
+	// name sent again replaces kept one
+	assert.Equal(t, "Johnny Doe", login(`{"name":{"firstName":"Johnny","lastName":"Doe"}}`).Name)
+	assert.Equal(t, "Johnny Doe", login("").Name)
+
+	// nothing kept, i.e. in-memory store after restart
+	ah.FirstLoginStore = NewMemFirstLoginStore()
+	assert.Equal(t, "noname_"+userID[6:12], login("").Name)
+}
+
 func TestAppleHandler_Exchange(t *testing.T) {
 	var testResponseToken string
 	teardown := prepareAppleOauthTest(t, 8981, 8982, &testResponseToken)
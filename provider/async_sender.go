@@ -0,0 +1,131 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-pkgz/auth/logger"
+)
+
+// ErrSendQueueFull returned by AsyncSender if its queue has no room for the message
+var ErrSendQueueFull = errors.New("send queue is full")
+
+// ErrSenderClosed returned by AsyncSender after Drain called
+var ErrSenderClosed = errors.New("sender is closed")
+
+// Drainer can be implemented by Sender queueing messages to deliver them on shutdown, called by VerifyHandler.Close
+type Drainer interface {
+	Drain(ctx context.Context) (undelivered int, err error)
+}
+
+// AsyncSenderOpts defines queue of AsyncSender. Zero values replaced by defaults.
+type AsyncSenderOpts struct {
+	QueueSize int // max messages waiting for delivery, default 100
+	Workers   int // messages delivered at once, default 1
+}
+
+// AsyncSender queues messages and delivers them with inner sender in background, so requests don't wait for
+// slow delivery. Delivery errors are logged only, as the request already succeeded.
+type AsyncSender struct {
+	inner   Sender
+	l       logger.L
+	queue   chan asyncMessage
+	stop    chan struct{}
+	wg      sync.WaitGroup
+	pending int32 // queued and in-flight messages
+
+	lock     sync.RWMutex
+	closed   bool
+	stopOnce sync.Once
+}
+
+type asyncMessage struct {
+	address, text string
+}
+
+// NewAsyncSender makes AsyncSender delivering messages with inner sender and starts its workers
+func NewAsyncSender(inner Sender, opts AsyncSenderOpts, l logger.L) *AsyncSender {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 100
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = 1
+	}
+	if l == nil {
+		l = logger.NoOp{}
+	}
+	res := &AsyncSender{inner: inner, l: l, queue: make(chan asyncMessage, opts.QueueSize), stop: make(chan struct{})}
+	for i := 0; i < opts.Workers; i++ {
+		res.wg.Add(1)
+		go res.worker()
+	}
+	return res
+}
+
+// Send queues the message, fails with ErrSendQueueFull if no room for it and ErrSenderClosed after Drain
+func (s *AsyncSender) Send(address, text string) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		return ErrSenderClosed
+	}
+	atomic.AddInt32(&s.pending, 1)
+	select {
+	case s.queue <- asyncMessage{address: address, text: text}:
+		return nil
+	default:
+		atomic.AddInt32(&s.pending, -1)
+		return ErrSendQueueFull
+	}
+}
+
+// Drain stops accepting new messages and waits for queued ones to be delivered up to ctx deadline.
+// Returns number of messages left undelivered with ctx error if it is done first.
+func (s *AsyncSender) Drain(ctx context.Context) (undelivered int, err error) {
+	s.lock.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		if n := int(atomic.LoadInt32(&s.pending)); n > 0 {
+			return n, ErrSenderClosed // dropped after deadline of the previous drain
+		}
+		return 0, nil
+	case <-ctx.Done():
+		s.stopOnce.Do(func() { close(s.stop) }) // workers exit after messages in flight
+		n := int(atomic.LoadInt32(&s.pending))
+		s.l.Logf("[WARN] %d messages undelivered on drain, %v", n, ctx.Err())
+		return n, ctx.Err()
+	}
+}
+
+// Channel returns channel name of the inner sender
+func (s *AsyncSender) Channel() string {
+	return senderChannel(s.inner)
+}
+
+func (s *AsyncSender) worker() {
+	defer s.wg.Done()
+	for m := range s.queue {
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+		if err := s.inner.Send(m.address, m.text); err != nil {
+			s.l.Logf("[WARN] failed to send message to %s, %v", m.address, err)
+		}
+		atomic.AddInt32(&s.pending, -1)
+	}
+}
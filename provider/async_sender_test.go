@@ -0,0 +1,88 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAsyncSender(t *testing.T) {
+	var lock sync.Mutex
+	var sent []string
+	release := make(chan struct{})
+	inner := SenderFunc(func(address, text string) error {
+		<-release
+		lock.Lock()
+		defer lock.Unlock()
+		sent = append(sent, address)
+		if address == "bad" {
+			return errors.New("some err")
+		}
+		return nil
+	})
+
+	s := NewAsyncSender(inner, AsyncSenderOpts{QueueSize: 3}, nil)
+	assert.Equal(t, "provider.SenderFunc", senderChannel(s))
+	require.NoError(t, s.Send("a1", "text"))
+	time.Sleep(10 * time.Millisecond) // a1 in flight
+	require.NoError(t, s.Send("bad", "text"))
+	require.NoError(t, s.Send("a2", "text"))
+	require.NoError(t, s.Send("a3", "text"))
+	assert.Equal(t, ErrSendQueueFull, s.Send("a4", "text"))
+
+	close(release)
+	n, err := s.Drain(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, []string{"a1", "bad", "a2", "a3"}, sent, "all queued sent, failed one too")
+	assert.Equal(t, ErrSenderClosed, s.Send("a5", "text"))
+
+	n, err = s.Drain(context.Background())
+	require.NoError(t, err, "drained again")
+	assert.Equal(t, 0, n)
+}
+
+func TestAsyncSender_DrainDeadline(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	inner := SenderFunc(func(address, text string) error {
+		<-release
+		return nil
+	})
+	s := NewAsyncSender(inner, AsyncSenderOpts{}, nil)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, s.Send("addr", "text"))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	n, err := s.Drain(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 5, n, "one in flight and four queued")
+}
+
+func TestVerifyHandler_Close(t *testing.T) {
+	release := make(chan struct{})
+	inner := SenderFunc(func(address, text string) error {
+		<-release
+		return nil
+	})
+	async := NewAsyncSender(inner, AsyncSenderOpts{}, nil)
+	e := VerifyHandler{Sender: InstrumentedSender(async, nil)}
+	require.NoError(t, async.Send("addr", "text"))
+	require.NoError(t, async.Send("addr", "text"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.EqualError(t, e.Close(ctx), "2 confirmations undelivered: context deadline exceeded")
+
+	close(release)
+	assert.EqualError(t, e.Close(context.Background()), "1 confirmations undelivered: sender is closed",
+		"one in flight delivered, queued one dropped by the first close")
+	assert.NoError(t, VerifyHandler{Sender: &mockSender{}}.Close(context.Background()), "not drainer")
+}
@@ -0,0 +1,38 @@
+package provider
+
+import "time"
+
+// audit event types
+const (
+	AuditLoginFailed = "login_failed" // wrong credentials
+	AuditLockout     = "lockout"      // user or ip locked after too many failures
+	AuditLockedLogin = "locked_login" // login attempt rejected due to active lock
+
+	AuditSecondFactorFailed = "second_factor_failed" // wrong second factor code
+
+	AuditBlocked = "blocked" // request of banned user rejected by middleware, User is user id
+)
+
+// AuditEvent describes security-relevant event reported by providers
+type AuditEvent struct {
+	Type     string    // event type, one of Audit* constants
+	Provider string    // provider name
+	User     string    // user name as presented in the request
+	IP       string    // client ip
+	Time     time.Time // event time
+}
+
+// AuditFunc receives audit events. It is called synchronously and should not block.
+// Can be used to feed audit logs and metrics.
+type AuditFunc func(ev AuditEvent)
+
+// send passes event to f, does nothing for nil f
+func (f AuditFunc) send(ev AuditEvent) {
+	if f == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	f(ev)
+}
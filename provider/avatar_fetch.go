@@ -0,0 +1,81 @@
+package provider
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/go-pkgz/auth/httpclient"
+)
+
+const defaultAvatarFetchTimeout = 5 * time.Second
+
+// AvatarFetch defines how avatars downloaded from users' pictures by providers saving them with AvatarSaver.
+// Zero AvatarFetch keeps the default behavior, shared transport and 5s timeout, no retries and size limit.
+type AvatarFetch struct {
+	Client    *http.Client      // client for avatar downloads, i.e. with egress proxy, default one uses Transport
+	Transport http.RoundTripper // transport of the default client, shared httpclient one if nil
+	Timeout   time.Duration     // timeout of the download, with retries, default 5s or Client's one
+	Retries   int               // retries of downloads responded with 5xx, default no retries
+	MaxSize   int64             // max size of avatar in bytes, larger ones replaced by identicon, default no limit
+
+	// PublicOnly rejects downloads from loopback, private, link-local and other non-public addresses,
+	// i.e. 169.254.169.254, for pictures coming from external sources. See httpclient.PublicOnly.
+	PublicOnly bool
+
+	// Skip keeps provider's picture url in the token untouched, avatar is neither downloaded nor saved with
+	// AvatarSaver, i.e. for pictures served from reliable public CDN
+	Skip bool
+}
+
+// client makes avatar client applying the policy over base one, Client or the default one if base is nil.
+// Timeout of injected Client kept unless Timeout set, the default one applied to the default client only.
+func (f AvatarFetch) client(base *http.Client) *http.Client {
+	if base == nil {
+		base = f.Client
+	}
+	if base == nil {
+		base = f.defaultClient()
+	}
+	timeout := f.Timeout
+	if timeout == 0 && f.Client != nil {
+		timeout = f.Client.Timeout
+	}
+	if timeout == 0 && f.Client == nil {
+		timeout = defaultAvatarFetchTimeout
+	}
+	res := *base
+	res.Timeout = timeout
+	res.Transport = httpclient.Policy{Retries: f.Retries, MaxSize: f.MaxSize}.Transport(f.publicOnly(base.Transport))
+	return &res
+}
+
+// publicOnly returns transport made with httpclient.PublicOnly if PublicOnly set, for oauth2 one over its base
+func (f AvatarFetch) publicOnly(tr http.RoundTripper) http.RoundTripper {
+	if !f.PublicOnly {
+		return tr
+	}
+	if ot, ok := tr.(*oauth2.Transport); ok {
+		return &oauth2.Transport{Source: ot.Source, Base: httpclient.PublicOnly(ot.Base)}
+	}
+	return httpclient.PublicOnly(tr)
+}
+
+// oauth2Context returns context making oauth2 clients on top of Client or the default client
+func (f AvatarFetch) oauth2Context(ctx context.Context) context.Context {
+	if f.Client != nil {
+		return context.WithValue(ctx, oauth2.HTTPClient, f.Client)
+	}
+	return context.WithValue(ctx, oauth2.HTTPClient, f.defaultClient())
+}
+
+// defaultClient makes client with Transport or the shared one
+func (f AvatarFetch) defaultClient() *http.Client {
+	res := httpclient.New(0)
+	if f.Transport != nil {
+		res.Transport = f.Transport
+	}
+	return res
+}
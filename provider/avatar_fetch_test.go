@@ -0,0 +1,199 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+
+	"github.com/go-pkgz/auth/httpclient"
+	"github.com/go-pkgz/auth/logger"
+	"github.com/go-pkgz/auth/token"
+	"github.com/go-pkgz/auth/token/tokentest"
+)
+
+type countingRoundTripper struct {
+	calls int32
+}
+
+func (c *countingRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&c.calls, 1)
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// fetchingAvatarSaver downloads url with the client passed by provider
+type fetchingAvatarSaver struct {
+	url string
+}
+
+func (s *fetchingAvatarSaver) Put(_ token.User, client *http.Client) (avatarURL string, err error) {
+	resp, err := client.Get(s.url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return "http://example.com/ava.png", nil
+}
+
+func TestAvatarFetch_Providers(t *testing.T) {
+	// every odd request to avatar server fails with 503, so each download succeeds on retry
+	var avaCalls int32
+	avaSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&avaCalls, 1)%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("png"))
+	}))
+	defer avaSrv.Close()
+
+	rt := &countingRoundTripper{}
+	fetch := AvatarFetch{Client: &http.Client{Transport: rt}, Retries: 1}
+	saver := &fetchingAvatarSaver{url: avaSrv.URL + "/ava.png"}
+	tokenService := token.NewService(token.Opts{
+		SecretReader:   token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+		TokenDuration:  time.Hour,
+		CookieDuration: time.Hour * 24 * 31,
+		DisableXSRF:    true,
+	})
+
+	// checkLogin checks login response and two avatar requests, failed and retried, made with the injected client
+	checkLogin := func(t *testing.T, rr *httptest.ResponseRecorder) {
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		assert.Contains(t, rr.Body.String(), `"picture":"http://example.com/ava.png"`)
+		assert.Equal(t, int32(2), atomic.LoadInt32(&rt.calls))
+		atomic.StoreInt32(&rt.calls, 0)
+	}
+
+	t.Run("direct", func(t *testing.T) {
+		d := DirectHandler{ProviderName: "direct", CredChecker: &mockCredsChecker{ok: true}, TokenService: tokenService,
+			L: logger.NoOp{}, AvatarSaver: saver, AvatarFetch: fetch}
+		rr := httptest.NewRecorder()
+		d.LoginHandler(rr, httptest.NewRequest("GET", "/login?user=myuser&passwd=pppp", http.NoBody))
+		checkLogin(t, rr)
+	})
+
+	t.Run("verify", func(t *testing.T) {
+		e := VerifyHandler{ProviderName: "email", TokenService: tokenService, L: logger.NoOp{}, AvatarSaver: saver,
+			AvatarFetch: fetch}
+		tkn, err := tokenService.Token(tokentest.ConfirmClaims("email", "myuser", "blah@user.com", ""))
+		require.NoError(t, err)
+		rr := httptest.NewRecorder()
+		e.LoginHandler(rr, httptest.NewRequest("GET", "/login?token="+tkn, http.NoBody))
+		checkLogin(t, rr)
+	})
+
+	t.Run("telegram", func(t *testing.T) {
+		tg := &TelegramHandler{ProviderName: "telegram", L: logger.NoOp{}, TokenService: tokenService,
+			AvatarSaver: saver, AvatarFetch: fetch,
+			Telegram: &TelegramAPIMock{
+				AvatarFunc:  func(context.Context, int) (string, error) { return "https://example.com/p.jpg", nil },
+				SendFunc:    func(ctx context.Context, id int, text string) error { return nil },
+				BotInfoFunc: botInfoFunc,
+			},
+		}
+		require.NoError(t, tg.ProcessUpdate(context.Background(), `{"result":[]}`))
+		require.NoError(t, tg.addToken("token", time.Now().Add(time.Minute)))
+		require.NoError(t, tg.ProcessUpdate(context.Background(), fmt.Sprintf(getUpdatesResp, "token")))
+		rr := httptest.NewRecorder()
+		tg.LoginHandler(rr, httptest.NewRequest("GET", "/login?token=token", http.NoBody))
+		checkLogin(t, rr)
+	})
+
+	t.Run("oauth2", func(t *testing.T) {
+		oauthSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			switch r.URL.Path {
+			case "/token":
+				_, _ = w.Write([]byte(`{"access_token":"MTQ0NjJkZmQ5","token_type":"bearer","expires_in":3600}`))
+			case "/user":
+				_, _ = w.Write([]byte(`{"id":"myuser","name":"blah","picture":"http://example.com/pic.png"}`))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		defer oauthSrv.Close()
+
+		p := initOauth2Handler(Params{URL: "http://example.com", Cid: "cid", Csecret: "csecret", JwtService: tokenService,
+			L: logger.NoOp{}, AvatarSaver: saver, AvatarFetch: fetch},
+			Oauth2Handler{
+				name:     "mock",
+				endpoint: oauth2.Endpoint{AuthURL: oauthSrv.URL + "/auth", TokenURL: oauthSrv.URL + "/token"},
+				infoURL:  oauthSrv.URL + "/user",
+				mapUser: func(data UserData, _ []byte) token.User {
+					return token.User{ID: "mock_" + data.Value("id"), Name: data.Value("name"), Picture: data.Value("picture")}
+				},
+			})
+
+		rr := httptest.NewRecorder()
+		p.LoginHandler(rr, httptest.NewRequest("GET", "/login?site=remark", http.NoBody))
+		require.Equal(t, http.StatusFound, rr.Code, rr.Body.String())
+		loc, err := url.Parse(rr.Header().Get("Location"))
+		require.NoError(t, err)
+
+		req := httptest.NewRequest("GET", "/callback?code=abc&state="+loc.Query().Get("state"), http.NoBody)
+		for _, c := range rr.Result().Cookies() {
+			req.AddCookie(c)
+		}
+		rr = httptest.NewRecorder()
+		p.AuthHandler(rr, req)
+		checkLogin(t, rr)
+	})
+}
+
+func TestAvatarFetch_client(t *testing.T) {
+	c := AvatarFetch{}.client(nil)
+	assert.Equal(t, 5*time.Second, c.Timeout, "default timeout")
+
+	tr := &countingRoundTripper{}
+	c = AvatarFetch{Transport: tr}.client(nil)
+	assert.Same(t, tr, c.Transport, "default client with Transport")
+
+	base := &http.Client{Transport: &countingRoundTripper{}, Timeout: time.Minute}
+	c = AvatarFetch{Client: base, Timeout: time.Second}.client(nil)
+	assert.Equal(t, time.Second, c.Timeout)
+	assert.Same(t, base.Transport, c.Transport, "no retries and limit, the same transport")
+	assert.Equal(t, time.Minute, base.Timeout, "injected client not changed")
+
+	c = AvatarFetch{Client: base}.client(nil)
+	assert.Equal(t, time.Minute, c.Timeout, "timeout of injected client kept")
+	base.Timeout = 0
+	c = AvatarFetch{Client: base}.client(nil)
+	assert.Equal(t, time.Duration(0), c.Timeout, "no default timeout for injected client")
+
+	oauthBase := &http.Client{Transport: base.Transport}
+	c = AvatarFetch{Client: &http.Client{Timeout: time.Minute}}.client(oauthBase)
+	assert.Equal(t, time.Minute, c.Timeout, "oauth2 client over injected one keeps its timeout")
+	c = AvatarFetch{}.client(oauthBase)
+	assert.Equal(t, 5*time.Second, c.Timeout, "oauth2 client over default one")
+}
+
+func TestAvatarFetch_PublicOnly(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("png"))
+	}))
+	defer ts.Close()
+
+	resp, err := AvatarFetch{}.client(nil).Get(ts.URL)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+
+	_, err = AvatarFetch{PublicOnly: true, Retries: 1}.client(nil).Get(ts.URL)
+	assert.True(t, errors.Is(err, httpclient.ErrNotPublic), err)
+
+	oauthClient := oauth2.NewClient(context.Background(), oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "tkn"}))
+	_, err = AvatarFetch{PublicOnly: true}.client(oauthClient).Get(ts.URL)
+	assert.True(t, errors.Is(err, httpclient.ErrNotPublic), err)
+}
@@ -0,0 +1,117 @@
+package provider
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// TrustedProxies keeps IPs and CIDRs of reverse proxies trusted to report client ip with X-Forwarded-For and
+// X-Real-IP headers. Made by NewTrustedProxies, empty one ignores forwarded headers.
+type TrustedProxies struct {
+	nets []*net.IPNet
+}
+
+// defaultProxies used by ClientIP function and handlers without TrustedProxies
+var defaultProxies = struct {
+	sync.RWMutex
+	tp *TrustedProxies
+}{tp: &TrustedProxies{}}
+
+// NewTrustedProxies makes TrustedProxies from IPs and CIDRs, i.e. "10.0.0.0/8" or "192.168.1.1"
+func NewTrustedProxies(proxies []string) (*TrustedProxies, error) {
+	nets := make([]*net.IPNet, 0, len(proxies))
+	for _, p := range proxies {
+		p = strings.TrimSpace(p)
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", p)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			p = fmt.Sprintf("%s/%d", p, bits)
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", p, err)
+		}
+		nets = append(nets, n)
+	}
+	return &TrustedProxies{nets: nets}, nil
+}
+
+// SetTrustedProxies sets default trusted proxies, used by ClientIP function and by handlers made without
+// TrustedProxies. Handlers made by auth.Service get proxies of the service instead. On error defaults kept.
+func SetTrustedProxies(proxies []string) error {
+	tp, err := NewTrustedProxies(proxies)
+	if err != nil {
+		return err
+	}
+	defaultProxies.Lock()
+	defaultProxies.tp = tp
+	defaultProxies.Unlock()
+	return nil
+}
+
+// ClientIP returns ip of the client made the request with default trusted proxies, see TrustedProxies.ClientIP
+func ClientIP(r *http.Request) string {
+	var tp *TrustedProxies
+	return tp.ClientIP(r)
+}
+
+// ClientIP returns ip of the client made the request. Forwarded headers honored only if the request came from
+// trusted proxy, then the rightmost X-Forwarded-For address not of trusted proxy returned, as the ones to the left
+// of it can be spoofed by the client, or X-Real-IP without X-Forwarded-For. Otherwise ip of RemoteAddr returned.
+// Nil TrustedProxies uses default ones, set by SetTrustedProxies.
+func (tp *TrustedProxies) ClientIP(r *http.Request) string {
+	if tp == nil {
+		defaultProxies.RLock()
+		tp = defaultProxies.tp
+		defaultProxies.RUnlock()
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !tp.trusted(ip) {
+		return ip
+	}
+
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		addrs := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(addrs) - 1; i >= 0; i-- {
+			addr := strings.TrimSpace(addrs[i])
+			if net.ParseIP(addr) == nil {
+				return ip // malformed chain, don't trust anything left of it
+			}
+			ip = addr
+			if !tp.trusted(addr) {
+				return addr
+			}
+		}
+		return ip // all trusted, the leftmost one
+	}
+	if real := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(real) != nil {
+		return real
+	}
+	return ip
+}
+
+func (tp *TrustedProxies) trusted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range tp.nets {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package provider
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientIP(t *testing.T) {
+	defer func() { require.NoError(t, SetTrustedProxies(nil)) }()
+
+	req := func(remote, xff, realIP string) *http.Request {
+		r := httptest.NewRequest("GET", "/", http.NoBody)
+		r.RemoteAddr = remote
+		if xff != "" {
+			r.Header.Set("X-Forwarded-For", xff)
+		}
+		if realIP != "" {
+			r.Header.Set("X-Real-IP", realIP)
+		}
+		return r
+	}
+
+	assert.Equal(t, "10.0.0.1", ClientIP(req("10.0.0.1:1234", "1.2.3.4", "5.6.7.8")), "no trusted proxies by default")
+	assert.Equal(t, "bad-addr", ClientIP(req("bad-addr", "", "")))
+
+	require.NoError(t, SetTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "::1"}))
+	tbl := []struct {
+		remote, xff, realIP string
+		res                 string
+	}{
+		{"10.0.0.1:1234", "1.2.3.4", "", "1.2.3.4"},
+		{"10.0.0.1:1234", "", "5.6.7.8", "5.6.7.8"},
+		{"10.0.0.1:1234", "1.2.3.4", "5.6.7.8", "1.2.3.4"},
+		{"10.0.0.1:1234", "6.6.6.6, 1.2.3.4, 10.1.1.1", "", "1.2.3.4"},
+		{"10.0.0.1:1234", "10.2.2.2, 192.168.1.1", "", "10.2.2.2"},
+		{"10.0.0.1:1234", "1.2.3.4, junk", "", "10.0.0.1"},
+		{"10.0.0.1:1234", "", "junk", "10.0.0.1"},
+		{"[::1]:1234", "2001:db8::1", "", "2001:db8::1"},
+		{"192.168.1.1:1234", "1.2.3.4", "", "1.2.3.4"},
+		{"192.168.1.2:1234", "1.2.3.4", "5.6.7.8", "192.168.1.2"},
+		{"8.8.8.8:1234", "1.2.3.4", "", "8.8.8.8"},
+	}
+	for i, tt := range tbl {
+		assert.Equal(t, tt.res, ClientIP(req(tt.remote, tt.xff, tt.realIP)), "case #%d", i)
+	}
+
+	r := req("10.0.0.1:1234", "6.6.6.6", "")
+	r.Header.Add("X-Forwarded-For", "1.2.3.4")
+	assert.Equal(t, "1.2.3.4", ClientIP(r), "multiple headers joined")
+
+	assert.EqualError(t, SetTrustedProxies([]string{"10.0.0.1", "proxy.local"}), `invalid trusted proxy "proxy.local"`)
+	assert.Error(t, SetTrustedProxies([]string{"10.0.0.0/33"}))
+	assert.Equal(t, "1.2.3.4", ClientIP(req("10.0.0.1:1234", "1.2.3.4", "")), "previous proxies kept on error")
+}
+
+func TestTrustedProxies_ClientIP(t *testing.T) {
+	defer func() { require.NoError(t, SetTrustedProxies(nil)) }()
+	r := httptest.NewRequest("GET", "/", http.NoBody)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "1.2.3.4")
+
+	tp, err := NewTrustedProxies([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.3.4", tp.ClientIP(r))
+	empty, err := NewTrustedProxies(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.1", empty.ClientIP(r))
+
+	var nilProxies *TrustedProxies
+	assert.Equal(t, "10.0.0.1", nilProxies.ClientIP(r), "no default proxies")
+	require.NoError(t, SetTrustedProxies([]string{"10.0.0.1"}))
+	assert.Equal(t, "1.2.3.4", nilProxies.ClientIP(r), "default proxies used for nil")
+	assert.Equal(t, "10.0.0.1", empty.ClientIP(r), "defaults not used for empty")
+
+	_, err = NewTrustedProxies([]string{"10.0.0.0/8", "proxy.local"})
+	assert.EqualError(t, err, `invalid trusted proxy "proxy.local"`)
+}
@@ -0,0 +1,22 @@
+package provider
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// oauth2DeprecatedParams maps deprecated query parameters of oauth2 login to their replacements
+var oauth2DeprecatedParams = map[string]string{"site": "aud"}
+
+// warnDeprecated sets Deprecation and Warning headers for each deprecated parameter of the request, by params
+// mapping old name to the new one. Old names still work, headers give clients the migration signal.
+func warnDeprecated(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	q := r.URL.Query()
+	for old, replacement := range params {
+		if _, ok := q[old]; !ok {
+			continue
+		}
+		w.Header().Set("Deprecation", "true")
+		w.Header().Add("Warning", fmt.Sprintf("299 - %q", "parameter "+old+" is deprecated, use "+replacement))
+	}
+}
@@ -100,7 +100,8 @@ func (d *DevAuthServer) Run(ctx context.Context) { // nolint (gocyclo)
 				}
 
 			case strings.HasPrefix(r.URL.Path, "/user"):
-				ava := fmt.Sprintf("http://%s:%d/avatar?user=%s", d.Provider.Host, d.Provider.Port, d.username)
+				ava := fmt.Sprintf("%s://%s:%d/avatar?user=%s", d.Provider.DevTLS.scheme(), d.Provider.Host, d.Provider.Port,
+					d.username)
 				res := fmt.Sprintf(`{
 					"id": "%s",
 					"name":"%s",
@@ -148,7 +149,11 @@ func (d *DevAuthServer) Run(ctx context.Context) { // nolint (gocyclo)
 		d.Shutdown()
 	}()
 
-	err = d.httpServer.ListenAndServe()
+	if d.Provider.DevTLS.enabled() {
+		err = d.httpServer.ListenAndServeTLS(d.Provider.DevTLS.CertFile, d.Provider.DevTLS.KeyFile)
+	} else {
+		err = d.httpServer.ListenAndServe()
+	}
 	d.Warn("[WARN] dev oauth2 server terminated, %s", err)
 }
 
@@ -175,14 +180,29 @@ func NewDev(p Params) Oauth2Handler {
 	if p.Host == "" {
 		p.Host = defDevAuthHost
 	}
+	var tlsClient *http.Client
+	if p.DevTLS.enabled() {
+		var err error
+		if tlsClient, err = p.DevTLS.setup(p.Host); err != nil {
+			if p.L != nil {
+				p.Logf("[WARN] can't setup dev oauth2 tls, plain http used, %v", err)
+			}
+			p.DevTLS = DevTLS{}
+		}
+		if tlsClient != nil && p.AvatarFetch.Client == nil {
+			p.AvatarFetch.Transport = tlsClient.Transport // dev avatars served over https too
+		}
+	}
+	base := fmt.Sprintf("%s://%s:%d", p.DevTLS.scheme(), p.Host, p.Port)
 	oh := initOauth2Handler(p, Oauth2Handler{
 		name: "dev",
 		endpoint: oauth2.Endpoint{
-			AuthURL:  fmt.Sprintf("http://%s:%d/login/oauth/authorize", p.Host, p.Port),
-			TokenURL: fmt.Sprintf("http://%s:%d/login/oauth/access_token", p.Host, p.Port),
+			AuthURL:  base + "/login/oauth/authorize",
+			TokenURL: base + "/login/oauth/access_token",
 		},
-		scopes:  []string{"user:email"},
-		infoURL: fmt.Sprintf("http://%s:%d/user", p.Host, p.Port),
+		scopes:     []string{"user:email"},
+		infoURL:    base + "/user",
+		httpClient: tlsClient,
 		mapUser: func(data UserData, _ []byte) token.User {
 			userInfo := token.User{
 				ID:      data.Value("id"),
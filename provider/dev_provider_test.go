@@ -2,10 +2,14 @@ package provider
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/cookiejar"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -109,3 +113,71 @@ func TestDevProviderCancel(t *testing.T) {
 	case <-done:
 	}
 }
+
+func TestDevProviderTLS(t *testing.T) {
+	dir := t.TempDir()
+	params := Params{Cid: "cid", Csecret: "csecret", URL: "http://127.0.0.1:18086", L: logger.NoOp{}, Port: 18087,
+		DevTLS: DevTLS{Generate: true, Dir: dir},
+		JwtService: token.NewService(token.Opts{
+			SecretReader:   token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+			TokenDuration:  time.Hour,
+			CookieDuration: time.Hour * 24 * 31,
+			SecureCookies:  true,
+			SameSite:       http.SameSiteNoneMode,
+		}),
+	}
+
+	devProvider := NewDev(params)
+	assert.Equal(t, filepath.Join(dir, "ca.pem"), devProvider.DevTLS.CAFile)
+	assert.Equal(t, "https://127.0.0.1:18087/login/oauth/authorize", devProvider.conf.Endpoint.AuthURL)
+	assert.Equal(t, "https://127.0.0.1:18087/user", devProvider.infoURL)
+
+	s := Service{Provider: devProvider}
+	devOauth2Srv := DevAuthServer{Provider: devProvider, Automatic: true, username: "dev_user", L: logger.NoOp{}}
+	router := http.NewServeMux()
+	router.Handle("/auth/dev/", http.HandlerFunc(s.Handler))
+	ts := &http.Server{Addr: "127.0.0.1:18086", Handler: router, ReadHeaderTimeout: time.Second}
+	go devOauth2Srv.Run(context.Background())
+	go func() { _ = ts.ListenAndServe() }()
+	defer func() {
+		devOauth2Srv.Shutdown()
+		_ = ts.Shutdown(context.Background())
+	}()
+
+	// browser trusting generated CA only
+	caPEM, err := os.ReadFile(filepath.Join(dir, "ca.pem"))
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	require.True(t, pool.AppendCertsFromPEM(caPEM))
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	client := &http.Client{Jar: jar, Timeout: 5 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}}}
+
+	require.Eventually(t, func() bool {
+		resp, e := client.Get("https://127.0.0.1:18087/avatar?user=dev_user")
+		if e != nil {
+			return false
+		}
+		_ = resp.Body.Close()
+		return true
+	}, 2*time.Second, 10*time.Millisecond, "dev server verified with generated CA")
+
+	_, err = http.Get("https://127.0.0.1:18087/avatar?user=dev_user")
+	require.Error(t, err, "not trusted without generated CA")
+
+	resp, err := client.Get("http://127.0.0.1:18086/auth/dev/login?site=my-test-site")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+	require.Equal(t, 2, len(resp.Cookies()))
+	assert.True(t, resp.Cookies()[0].Secure)
+	assert.Equal(t, http.SameSiteNoneMode, resp.Cookies()[0].SameSite)
+
+	claims, err := params.JwtService.Parse(resp.Cookies()[0].Value)
+	require.NoError(t, err)
+	assert.Equal(t, "dev_user", claims.User.Name)
+	assert.Equal(t, "https://127.0.0.1:18087/avatar?user=dev_user", claims.User.Picture)
+}
@@ -0,0 +1,154 @@
+package provider
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-pkgz/auth/httpclient"
+)
+
+// DevTLS makes dev oauth2 server serve https, i.e. to test SameSite=None and Secure cookies locally.
+// With Generate self-signed CA and certificate for the dev server's host made on provider creation and written
+// to Dir as ca.pem, cert.pem and key.pem, CertFile, KeyFile and CAFile set to them, so browsers and test
+// harnesses can trust CAFile. Otherwise CertFile and KeyFile used, with CAFile, if set, trusted by the provider.
+// Zero DevTLS keeps plain http.
+type DevTLS struct {
+	Generate bool   // generate CA and certificate
+	Dir      string // directory for generated files, new temporary one if empty
+	CertFile string // certificate of the server, generated one with Generate
+	KeyFile  string // private key of the certificate, generated one with Generate
+	CAFile   string // CA signed the certificate, trusted by the provider in addition to system ones
+}
+
+func (t DevTLS) enabled() bool {
+	return t.Generate || (t.CertFile != "" && t.KeyFile != "")
+}
+
+// scheme returns scheme of dev server's urls
+func (t DevTLS) scheme() string {
+	if t.enabled() {
+		return "https"
+	}
+	return "http"
+}
+
+// setup generates certificate with Generate and returns client trusting CAFile, or the certificate itself
+// for provided self-signed one without CAFile
+func (t *DevTLS) setup(host string) (*http.Client, error) {
+	if t.Generate {
+		if err := t.generate(host); err != nil {
+			return nil, err
+		}
+	}
+	trusted := t.CAFile
+	if trusted == "" {
+		trusted = t.CertFile
+	}
+	pemData, err := os.ReadFile(trusted) // nolint gosec // path is set by the app
+	if err != nil {
+		return nil, fmt.Errorf("can't read dev CA: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pemData) {
+		return nil, fmt.Errorf("no certificates in %s", trusted)
+	}
+	tr := httpclient.NewTransport()
+	tr.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	return &http.Client{Transport: tr}, nil
+}
+
+// generate makes CA and certificate for host, 127.0.0.1 and localhost, valid for a year, and writes them to Dir
+func (t *DevTLS) generate(host string) error {
+	if t.Dir == "" {
+		dir, err := os.MkdirTemp("", "dev-auth-tls-")
+		if err != nil {
+			return fmt.Errorf("can't make dir for dev certificates: %w", err)
+		}
+		t.Dir = dir
+	}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("can't make CA key: %w", err)
+	}
+	now := time.Now()
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "go-pkgz/auth dev CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		return fmt.Errorf("can't make CA certificate: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("can't make key: %w", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+	} else if host != "localhost" {
+		tmpl.DNSNames = append(tmpl.DNSNames, host)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return fmt.Errorf("can't parse CA certificate: %w", err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return fmt.Errorf("can't make certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("can't marshal key: %w", err)
+	}
+
+	t.CAFile, t.CertFile, t.KeyFile = filepath.Join(t.Dir, "ca.pem"), filepath.Join(t.Dir, "cert.pem"),
+		filepath.Join(t.Dir, "key.pem")
+	files := []struct {
+		path, kind string
+		der        []byte
+		perm       os.FileMode
+	}{
+		{t.CAFile, "CERTIFICATE", caDER, 0o644},
+		{t.CertFile, "CERTIFICATE", der, 0o644},
+		{t.KeyFile, "EC PRIVATE KEY", keyDER, 0o600},
+	}
+	for _, f := range files {
+		data := pem.EncodeToMemory(&pem.Block{Type: f.kind, Bytes: f.der})
+		if err := os.WriteFile(f.path, data, f.perm); err != nil {
+			return fmt.Errorf("can't write %s: %w", f.path, err)
+		}
+	}
+	return nil
+}
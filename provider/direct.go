@@ -1,8 +1,10 @@
 package provider
 
 import (
+	"context"
 	"crypto/sha1" //nolint
 	"encoding/json"
+	"errors"
 	"fmt"
 	"mime"
 	"net/http"
@@ -16,7 +18,7 @@ import (
 )
 
 const (
-	// MaxHTTPBodySize defines max http body size
+	// MaxHTTPBodySize defines default max http body size, handlers' MaxBodySize overrides it
 	MaxHTTPBodySize = 1024 * 1024
 )
 
@@ -24,19 +26,92 @@ const (
 // with users and hashes
 type DirectHandler struct {
 	logger.L
-	CredChecker  CredChecker
-	ProviderName string
-	TokenService TokenService
-	Issuer       string
-	AvatarSaver  AvatarSaver
-	UserIDFunc   UserIDFunc
+	CredChecker   CredChecker
+	ProviderName  string
+	TokenService  TokenService
+	Issuer        string
+	IssuerFunc    IssuerFunc // optional issuer of tokens by request, Issuer used if not set or empty
+	AvatarSaver   AvatarSaver
+	AvatarFetch   AvatarFetch   // client and policy of avatar downloads
+	PictureUpdate PictureUpdate // update of existing user's picture on login, saved on every login by default
+	UserIDFunc    UserIDFunc
+	Lockout       *Lockout  // optional brute-force protection
+	Audit         AuditFunc // optional receiver of audit events, like failed logins and lockouts
+
+	TrustedProxies *TrustedProxies // proxies trusted to pass client ip for lockout and audit, default ones if nil
+
+	CredCheckerCtx  CredCheckerCtx // optional context-aware checker, used instead of CredChecker if defined
+	CheckTimeout    time.Duration  // timeout of credentials check, default 10s
+	NoStoreIDPrefix bool           // use user ID returned by UserCredChecker or CredCheckerCtx as-is, without provider name prefix
+
+	BasicAuthChallenge bool  // respond to failed login with 401 and WWW-Authenticate, disabled to avoid browser popups
+	FailedStatus       int   // status of failed login response, default 403
+	MaxBodySize        int64 // max size of request body, default MaxHTTPBodySize
+
+	PasswordReset  *PasswordReset     // optional password reset flow, adds /reset-request and /reset routes
+	PasswordSetter PasswordSetter     // optional, enables /password route changing password of the logged-in user
+	PasswordPolicy PasswordPolicy     // optional strength policy for new passwords
+	Invalidator    SessionInvalidator // optional, invalidates user's sessions on password reset or change
+	TOTP           *TOTP              // optional TOTP second factor, adds /totp and /totp/enroll routes
+	PersistentID   *PersistentID      // optional, user ID kept in the browser's cookie instead of one derived from the name
 }
 
+// ErrCredStoreUnavailable should be wrapped by checkers into errors of unreachable credentials store,
+// DirectHandler responds to them with 502 to tell it from incorrect credentials
+var ErrCredStoreUnavailable = errors.New("credentials store unavailable")
+
 // CredChecker defines interface to check credentials
 type CredChecker interface {
 	Check(user, password string) (ok bool, err error)
 }
 
+// UserCredChecker defines extended interface to check credentials and get user info from the store.
+// Non-empty fields of returned user (ID, Name, Email, Picture, Role, Attributes) are used in the token.
+// DirectHandler uses it instead of Check if CredChecker implements this interface.
+type UserCredChecker interface {
+	CredChecker
+	CheckUser(user, password string) (ok bool, u token.User, err error)
+}
+
+// UserCredCheckerFunc type is an adapter to allow the use of ordinary functions as UserCredChecker.
+type UserCredCheckerFunc func(user, password string) (ok bool, u token.User, err error)
+
+// CheckUser calls f(user,passwd)
+func (f UserCredCheckerFunc) CheckUser(user, password string) (ok bool, u token.User, err error) {
+	return f(user, password)
+}
+
+// Check calls f(user,passwd) and ignores returned user
+func (f UserCredCheckerFunc) Check(user, password string) (ok bool, err error) {
+	ok, _, err = f(user, password)
+	return ok, err
+}
+
+// CredCheckerCtx defines interface to check credentials with request's context and metadata, i.e. for remote stores
+// needing client's IP or deadline. Non-empty fields of returned user are used in the token, like with UserCredChecker.
+type CredCheckerCtx interface {
+	Check(ctx context.Context, req CredRequest) (ok bool, u token.User, err error)
+}
+
+// CredRequest holds credentials with request metadata passed to CredCheckerCtx
+type CredRequest struct {
+	User      string
+	Password  string
+	IP        string
+	UserAgent string
+	Audience  string
+}
+
+// CredCheckerCtxFunc type is an adapter to allow the use of ordinary functions as CredCheckerCtx.
+type CredCheckerCtxFunc func(ctx context.Context, req CredRequest) (ok bool, u token.User, err error)
+
+// Check calls f(ctx, req)
+func (f CredCheckerCtxFunc) Check(ctx context.Context, req CredRequest) (ok bool, u token.User, err error) {
+	return f(ctx, req)
+}
+
+const defaultCheckTimeout = 10 * time.Second
+
 // UserIDFunc allows to provide custom func making userID instead of the default based on user's name hash
 type UserIDFunc func(user string, r *http.Request) string
 
@@ -53,6 +128,19 @@ type credentials struct {
 	User     string `json:"user"`
 	Password string `json:"passwd"`
 	Audience string `json:"aud"`
+
+	basic bool // credentials from Authorization: Basic header
+}
+
+// tokenMaker is implemented by token services able to make token string from claims
+type tokenMaker interface {
+	Token(claims token.Claims) (string, error)
+}
+
+// basicLoginResponse is login response for clients using basic auth, has token in addition to user info
+type basicLoginResponse struct {
+	token.User
+	Token string `json:"token,omitempty"`
 }
 
 // Name of the handler
@@ -64,6 +152,9 @@ func (p DirectHandler) Name() string {
 //
 // GET /something?user=name&passwd=xyz&aud=bar&sess=[0|1]
 //
+// GET /something?aud=bar&sess=[0|1] with Authorization: Basic header, used if no credentials in query or body.
+// For such requests response has the token in "token" field in addition to the cookie.
+//
 // POST /something?sess[0|1]
 // Accepts application/x-www-form-urlencoded or application/json encoded requests.
 //
@@ -80,38 +171,108 @@ func (p DirectHandler) Name() string {
 func (p DirectHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	creds, err := p.getCredentials(w, r)
 	if err != nil {
-		rest.SendErrorJSON(w, r, p.L, http.StatusBadRequest, err, "failed to parse credentials")
+		sendParseError(w, r, p.L, err, "failed to parse credentials")
 		return
 	}
 	sessOnly := r.URL.Query().Get("sess") == "1"
-	if p.CredChecker == nil {
+	if p.CredChecker == nil && p.CredCheckerCtx == nil {
 		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError,
 			fmt.Errorf("no credential checker"), "no credential checker")
 		return
 	}
-	ok, err := p.CredChecker.Check(creds.User, creds.Password)
+
+	ip := p.TrustedProxies.ClientIP(r)
+	auditEvent := AuditEvent{Provider: p.ProviderName, User: creds.User, IP: ip}
+	if p.Lockout != nil {
+		// checked before credentials, so locked response doesn't depend on user's existence
+		if retryAfter, locked := p.Lockout.locked(p.L, p.ProviderName, creds.User, ip); locked {
+			auditEvent.Type = AuditLockedLogin
+			p.Audit.send(auditEvent)
+			p.Lockout.sendLocked(w, retryAfter)
+			return
+		}
+	}
+
+	ok, checkedUser, err := p.checkCredentials(r, creds)
+	if errors.Is(err, context.DeadlineExceeded) {
+		rest.SendErrorJSON(w, r, p.L, http.StatusGatewayTimeout, err, "credentials check timed out")
+		return
+	}
+	var nameErr *NameError
+	if errors.As(err, &nameErr) {
+		p.Logf("[DEBUG] name %q rejected, %s", creds.User, nameErr.Code)
+		renderJSONWithStatus(w, rest.JSON{"error": nameErr.Reason, "code": nameErr.Code}, http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, ErrCredStoreUnavailable) {
+		rest.SendErrorJSON(w, r, p.L, http.StatusBadGateway, err, "credentials store unavailable")
+		return
+	}
 	if err != nil {
 		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to check user credentials")
 		return
 	}
 	if !ok {
-		rest.SendErrorJSON(w, r, p.L, http.StatusForbidden, nil, "incorrect user or password")
+		auditEvent.Type = AuditLoginFailed
+		p.Audit.send(auditEvent)
+		if p.Lockout != nil && p.Lockout.failed(r.Context(), p.L, p.ProviderName, creds.User, ip) {
+			auditEvent.Type = AuditLockout
+			p.Audit.send(auditEvent)
+		}
+		if p.BasicAuthChallenge {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", p.ProviderName))
+			rest.SendErrorJSON(w, r, p.L, http.StatusUnauthorized, nil, "incorrect user or password")
+			return
+		}
+		status := http.StatusForbidden
+		if p.FailedStatus != 0 {
+			status = p.FailedStatus
+		}
+		rest.SendErrorJSON(w, r, p.L, status, nil, "incorrect user or password")
 		return
 	}
+	if p.Lockout != nil {
+		p.Lockout.succeeded(p.L, p.ProviderName, creds.User)
+	}
 
-	userID := p.ProviderName + "_" + token.HashID(sha1.New(), creds.User)
-	if p.UserIDFunc != nil {
-		userID = p.ProviderName + "_" + token.HashID(sha1.New(), p.UserIDFunc(creds.User, r))
+	u := checkedUser
+	u.ID = p.userID(creds.User, u.ID, r)
+	if p.PersistentID != nil {
+		if u.ID, err = p.PersistentID.userID(w, r, p.ProviderName); err != nil {
+			rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to make user id")
+			return
+		}
+	}
+	if u.Name == "" {
+		u.Name = creds.User
+	}
+	if u.Name != creds.User {
+		u.SetStrAttr(loginAttr, creds.User) // keep login name for password change
 	}
 
-	u := token.User{
-		Name: creds.User,
-		ID:   userID,
+	if p.TOTP != nil && p.TOTP.Store != nil {
+		p.TOTP.init()
+		_, enrolled, e := p.TOTP.Store.TOTPSecret(u.ID)
+		if e != nil {
+			rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, e, "failed to check second factor")
+			return
+		}
+		if enrolled {
+			p.sendTOTPRequired(w, r, u, creds.Audience, sessOnly)
+			return
+		}
 	}
-	u, err = setAvatar(p.AvatarSaver, u, &http.Client{Timeout: 5 * time.Second})
-	if err != nil {
-		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to save avatar to proxy")
-		return
+	p.issueToken(w, r, u, creds.Audience, sessOnly, creds.basic)
+}
+
+// issueToken sets session token for the user and responds with user info, adds the token itself if withToken set
+func (p DirectHandler) issueToken(w http.ResponseWriter, r *http.Request, u token.User, aud string, sessOnly, withToken bool) {
+	if !p.AvatarFetch.Skip {
+		var err error
+		if u, err = p.PictureUpdate.setAvatar(p.L, p.AvatarSaver, u, p.AvatarFetch.client(nil)); err != nil {
+			rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to save avatar to proxy")
+			return
+		}
 	}
 
 	cid, err := randToken()
@@ -124,21 +285,119 @@ func (p DirectHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 		User: &u,
 		StandardClaims: jwt.StandardClaims{
 			Id:       cid,
-			Issuer:   p.Issuer,
-			Audience: creds.Audience,
+			Issuer:   p.IssuerFunc.get(r, p.Issuer),
+			Audience: aud,
 		},
 		SessionOnly: sessOnly,
+		Provider:    p.ProviderName,
 	}
 
-	if _, err = p.TokenService.Set(w, claims); err != nil {
+	if claims, err = p.TokenService.Set(w, claims); err != nil {
 		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to set token")
 		return
 	}
+
+	if withToken { // non-browser clients get the token in the body as well
+		resp := basicLoginResponse{User: *claims.User}
+		if tm, ok := p.TokenService.(tokenMaker); ok {
+			if resp.Token, err = tm.Token(claims); err != nil {
+				rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to make token")
+				return
+			}
+		}
+		rest.RenderJSON(w, resp)
+		return
+	}
 	rest.RenderJSON(w, claims.User)
 }
 
-// getCredentials extracts user and password from request
+// userID makes token's user id. Id from the store used as-is (prefixed with provider name unless NoStoreIDPrefix set),
+// otherwise it is a hash of UserIDFunc result or user name
+func (p DirectHandler) userID(user, storeID string, r *http.Request) string {
+	if storeID != "" && p.NoStoreIDPrefix {
+		return storeID
+	}
+	if storeID != "" {
+		return p.ProviderName + "_" + storeID
+	}
+	if p.UserIDFunc != nil {
+		return p.ProviderName + "_" + token.HashID(sha1.New(), p.UserIDFunc(user, r))
+	}
+	return p.ProviderName + "_" + token.HashID(sha1.New(), user)
+}
+
+// checkCredentials checks credentials with CredCheckerCtx if defined, with UserCredChecker if implemented,
+// or with plain CredChecker otherwise
+func (p DirectHandler) checkCredentials(r *http.Request, creds credentials) (ok bool, u token.User, err error) {
+	if p.CredCheckerCtx != nil {
+		return p.checkCredentialsCtx(r, creds)
+	}
+	if uc, isUserChecker := p.CredChecker.(UserCredChecker); isUserChecker {
+		return uc.CheckUser(creds.User, creds.Password)
+	}
+	ok, err = p.CredChecker.Check(creds.User, creds.Password)
+	return ok, token.User{}, err
+}
+
+// checkCredentialsCtx checks credentials with CredCheckerCtx limited by CheckTimeout.
+// Returns context.DeadlineExceeded error on timeout even if the checker ignores the context.
+func (p DirectHandler) checkCredentialsCtx(r *http.Request, creds credentials) (ok bool, u token.User, err error) {
+	timeout := p.CheckTimeout
+	if timeout == 0 {
+		timeout = defaultCheckTimeout
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	req := CredRequest{
+		User:      creds.User,
+		Password:  creds.Password,
+		IP:        p.TrustedProxies.ClientIP(r),
+		UserAgent: r.UserAgent(),
+		Audience:  creds.Audience,
+	}
+
+	type result struct {
+		ok  bool
+		u   token.User
+		err error
+	}
+	resCh := make(chan result, 1) // buffered, so abandoned checker won't leak
+	go func() {
+		res := result{}
+		res.ok, res.u, res.err = p.CredCheckerCtx.Check(ctx, req)
+		resCh <- res
+	}()
+
+	select {
+	case res := <-resCh:
+		return res.ok, res.u, res.err
+	case <-ctx.Done():
+		return false, token.User{}, fmt.Errorf("check credentials for %s: %w", creds.User, ctx.Err())
+	}
+}
+
+// getCredentials extracts user and password from request query or body,
+// falls back to Authorization: Basic header if neither has credentials
 func (p DirectHandler) getCredentials(w http.ResponseWriter, r *http.Request) (credentials, error) {
+	creds, err := p.parseCredentials(w, r)
+	if err != nil {
+		return credentials{}, err
+	}
+	if creds.User != "" || creds.Password != "" {
+		return creds, nil
+	}
+	if user, passwd, ok := r.BasicAuth(); ok {
+		creds.User, creds.Password, creds.basic = user, passwd, true
+		if creds.Audience == "" {
+			creds.Audience = r.URL.Query().Get("aud")
+		}
+	}
+	return creds, nil
+}
+
+// parseCredentials extracts user and password from request query or body
+func (p DirectHandler) parseCredentials(w http.ResponseWriter, r *http.Request) (credentials, error) {
 	// GET /something?user=name&passwd=xyz&aud=bar
 	if r.Method == "GET" {
 		return credentials{
@@ -152,9 +411,7 @@ func (p DirectHandler) getCredentials(w http.ResponseWriter, r *http.Request) (c
 		return credentials{}, fmt.Errorf("method %s not supported", r.Method)
 	}
 
-	if r.Body != nil {
-		r.Body = http.MaxBytesReader(w, r.Body, MaxHTTPBodySize)
-	}
+	limitBody(w, r, p.MaxBodySize)
 	contentType := r.Header.Get("Content-Type")
 	if contentType != "" {
 		mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
@@ -1,6 +1,9 @@
 package provider
 
 import (
+	"context"
+	"crypto/sha1" //nolint
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -94,6 +97,7 @@ func TestDirect_LoginHandler(t *testing.T) {
 			assert.Equal(t, "iss-test", claims.Issuer)
 			assert.True(t, claims.ExpiresAt > time.Now().Unix())
 			assert.Equal(t, "myuser", claims.User.Name)
+			assert.Equal(t, "test", claims.Provider)
 		})
 	}
 }
@@ -275,3 +279,514 @@ type mockCredsChecker struct {
 }
 
 func (m *mockCredsChecker) Check(string, string) (ok bool, err error) { return m.ok, m.err }
+
+func TestDirect_LoginHandlerLockout(t *testing.T) {
+	checker := &countingCredsChecker{}
+	var events []AuditEvent
+	d := DirectHandler{
+		ProviderName: "test",
+		CredChecker:  checker,
+		TokenService: token.NewService(token.Opts{
+			SecretReader:   token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+			TokenDuration:  time.Hour,
+			CookieDuration: time.Hour * 24 * 31,
+		}),
+		Issuer:  "iss-test",
+		L:       logger.Std{},
+		Lockout: &Lockout{DelayAfter: 100, LockAfter: 3, LockDuration: time.Minute},
+		Audit:   func(ev AuditEvent) { events = append(events, ev) },
+	}
+	handler := http.HandlerFunc(d.LoginHandler)
+
+	login := func(user, passwd, ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/login?user="+user+"&passwd="+passwd, http.NoBody)
+		req.RemoteAddr = ip + ":1234"
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// failures below the limit, then success resets the user's counter
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, http.StatusForbidden, login("myuser", "bad", "10.0.0.1").Code)
+	}
+	assert.Equal(t, http.StatusOK, login("myuser", "good", "10.0.0.1").Code)
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, http.StatusForbidden, login("myuser", "bad", "10.0.0.2").Code)
+	}
+	assert.Equal(t, http.StatusOK, login("myuser", "good", "10.0.0.2").Code, "not locked after reset")
+
+	// success doesn't reset ip counter
+	assert.Equal(t, http.StatusForbidden, login("someuser", "bad", "10.0.0.1").Code)
+	assert.Equal(t, http.StatusTooManyRequests, login("myuser", "good", "10.0.0.1").Code, "ip still locked")
+
+	// lock by user, different ips
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusForbidden, login("myuser", "bad", fmt.Sprintf("10.0.1.%d", i)).Code)
+	}
+	calls := checker.calls
+	rr := login("myuser", "good", "10.0.2.1")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "60", rr.Header().Get("Retry-After"))
+	assert.JSONEq(t, `{"error":"too many failed login attempts","code":"login_locked"}`, rr.Body.String())
+	assert.Equal(t, calls, checker.calls, "checker not called for locked user")
+
+	// non-existing user locked by ip gets identical response
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusForbidden, login(fmt.Sprintf("nouser%d", i), "bad", "10.0.3.1").Code)
+	}
+	rr2 := login("otheruser", "good", "10.0.3.1")
+	assert.Equal(t, http.StatusTooManyRequests, rr2.Code)
+	assert.Equal(t, rr.Body.String(), rr2.Body.String())
+	assert.Equal(t, http.StatusOK, login("otheruser", "good", "10.0.3.2").Code)
+
+	types := map[string]int{}
+	for _, ev := range events {
+		types[ev.Type]++
+	}
+	assert.Equal(t, 3, types[AuditLockout])
+	assert.Equal(t, 3, types[AuditLockedLogin])
+	assert.Equal(t, 11, types[AuditLoginFailed])
+
+	// other provider sharing the store counts failures separately
+	other := d
+	other.ProviderName = "ldap"
+	other.Lockout = &Lockout{Store: d.Lockout.Store, DelayAfter: 100, LockAfter: 3, LockDuration: time.Minute}
+	req := httptest.NewRequest("GET", "/login?user=myuser&passwd=good", http.NoBody)
+	req.RemoteAddr = "10.0.3.1:1234"
+	rr = httptest.NewRecorder()
+	other.LoginHandler(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code, "user and ip locked with another provider only")
+	count, _, err := d.Lockout.Store.Get("test:user:myuser")
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+}
+
+func TestDirect_LoginHandlerLockoutTimingSafe(t *testing.T) {
+	lockout := &Lockout{DelayAfter: 1, Delay: 100 * time.Millisecond, MaxDelay: 100 * time.Millisecond, LockAfter: 3,
+		LockDuration: time.Minute}
+	d := DirectHandler{
+		ProviderName: "test",
+		CredChecker: CredCheckerFunc(func(user, password string) (bool, error) {
+			return user == "myuser" && password == "good", nil
+		}),
+		TokenService: token.NewService(token.Opts{
+			SecretReader:   token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+			TokenDuration:  time.Hour,
+			CookieDuration: time.Hour * 24 * 31,
+		}),
+		Issuer:  "iss-test",
+		L:       logger.Std{},
+		Lockout: lockout,
+	}
+	handler := http.HandlerFunc(d.LoginHandler)
+
+	type result struct {
+		code    int
+		body    string
+		elapsed time.Duration
+	}
+	login := func(user, ip string) result {
+		req := httptest.NewRequest("GET", "/login?user="+user+"&passwd=bad", http.NoBody)
+		req.RemoteAddr = ip + ":1234"
+		rr := httptest.NewRecorder()
+		st := time.Now()
+		handler.ServeHTTP(rr, req)
+		return result{code: rr.Code, body: rr.Body.String(), elapsed: time.Since(st)}
+	}
+
+	var existing, unknown []result
+	for i := 0; i < 3; i++ {
+		existing = append(existing, login("myuser", "10.0.0.1"))
+		unknown = append(unknown, login("nouser", "10.0.0.2"))
+	}
+
+	for i := range existing {
+		assert.Equal(t, existing[i].code, unknown[i].code, "attempt %d", i)
+		assert.Equal(t, existing[i].body, unknown[i].body, "attempt %d", i)
+	}
+	assert.Less(t, existing[0].elapsed, lockout.Delay, "not throttled yet")
+	assert.Less(t, unknown[0].elapsed, lockout.Delay, "not throttled yet")
+	for i := 1; i < 3; i++ { // throttled, i.e. delayed
+		assert.Equal(t, http.StatusForbidden, existing[i].code)
+		assert.GreaterOrEqual(t, existing[i].elapsed, lockout.Delay, "attempt %d", i)
+		assert.GreaterOrEqual(t, unknown[i].elapsed, lockout.Delay, "attempt %d", i)
+		assert.InDelta(t, existing[i].elapsed, unknown[i].elapsed, float64(lockout.Delay), "attempt %d", i)
+	}
+
+	// locked, same response without delay
+	rrExisting, rrUnknown := login("myuser", "10.0.0.3"), login("nouser", "10.0.0.4")
+	assert.Equal(t, http.StatusTooManyRequests, rrExisting.code)
+	assert.Equal(t, rrExisting.code, rrUnknown.code)
+	assert.Equal(t, rrExisting.body, rrUnknown.body)
+}
+
+func TestDirect_LoginHandlerUserCredChecker(t *testing.T) {
+	d := DirectHandler{
+		ProviderName: "test",
+		CredChecker: UserCredCheckerFunc(func(user, password string) (ok bool, u token.User, err error) {
+			u = token.User{Name: "John Doe", ID: "12345", Picture: "http://example.com/pic.png", Role: "admin"}
+			u.SetBoolAttr("paid", true)
+			return password == "pppp", u, nil
+		}),
+		TokenService: token.NewService(token.Opts{
+			SecretReader:   token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+			TokenDuration:  time.Hour,
+			CookieDuration: time.Hour * 24 * 31,
+		}),
+		Issuer: "iss-test",
+		L:      logger.Std{},
+	}
+
+	handler := http.HandlerFunc(d.LoginHandler)
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/login?user=myuser&passwd=pppp&aud=xyz123", http.NoBody)
+	require.NoError(t, err)
+	handler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, `{"name":"John Doe","id":"test_12345","picture":"http://example.com/pic.png","attrs":{"login":"myuser","paid":true},"role":"admin"}`+"\n",
+		rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/login?user=myuser&passwd=bad&aud=xyz123", http.NoBody)
+	require.NoError(t, err)
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	ok, err := d.CredChecker.Check("myuser", "pppp")
+	require.NoError(t, err)
+	assert.True(t, ok, "legacy Check works for UserCredCheckerFunc")
+}
+
+func TestDirect_userID(t *testing.T) {
+	r := httptest.NewRequest("GET", "/login", http.NoBody)
+	tbl := []struct {
+		name     string
+		handler  DirectHandler
+		user, id string
+		res      string
+	}{
+		{"hash of name", DirectHandler{ProviderName: "test"}, "myuser", "",
+			"test_" + token.HashID(sha1.New(), "myuser")},
+		{"hash of name, prefix disabled", DirectHandler{ProviderName: "test", NoStoreIDPrefix: true}, "myuser", "",
+			"test_" + token.HashID(sha1.New(), "myuser")},
+		{"hash of user id func", DirectHandler{ProviderName: "test", UserIDFunc: func(user string, _ *http.Request) string {
+			return user + "_custom"
+		}}, "myuser", "", "test_" + token.HashID(sha1.New(), "myuser_custom")},
+		{"store id", DirectHandler{ProviderName: "test"}, "myuser", "12345", "test_12345"},
+		{"store id, prefix disabled", DirectHandler{ProviderName: "test", NoStoreIDPrefix: true}, "myuser", "12345", "12345"},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.res, tt.handler.userID(tt.user, tt.id, r))
+		})
+	}
+}
+
+func TestDirect_LoginHandlerNoStoreIDPrefix(t *testing.T) {
+	d := DirectHandler{
+		ProviderName: "test",
+		CredChecker: UserCredCheckerFunc(func(user, password string) (ok bool, u token.User, err error) {
+			return password == "pppp", token.User{ID: "db-" + user}, nil
+		}),
+		NoStoreIDPrefix: true,
+		TokenService: token.NewService(token.Opts{
+			SecretReader:   token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+			TokenDuration:  time.Hour,
+			CookieDuration: time.Hour * 24 * 31,
+		}),
+		Issuer: "iss-test",
+		L:      logger.Std{},
+	}
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/login?user=myuser&passwd=pppp&aud=xyz123", http.NoBody)
+	require.NoError(t, err)
+	http.HandlerFunc(d.LoginHandler).ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, `{"name":"myuser","id":"db-myuser","picture":""}`+"\n", rr.Body.String())
+}
+
+func TestDirect_LoginHandlerCredCheckerCtx(t *testing.T) {
+	var got CredRequest
+	d := DirectHandler{
+		ProviderName: "test",
+		CredChecker:  &mockCredsChecker{ok: false}, // ignored if CredCheckerCtx defined
+		CredCheckerCtx: CredCheckerCtxFunc(func(ctx context.Context, req CredRequest) (ok bool, u token.User, err error) {
+			_, hasDeadline := ctx.Deadline()
+			assert.True(t, hasDeadline)
+			got = req
+			return req.Password == "pppp", token.User{Role: "user"}, nil
+		}),
+		TokenService: token.NewService(token.Opts{
+			SecretReader:   token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+			TokenDuration:  time.Hour,
+			CookieDuration: time.Hour * 24 * 31,
+		}),
+		Issuer: "iss-test",
+		L:      logger.Std{},
+	}
+
+	handler := http.HandlerFunc(d.LoginHandler)
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/login?user=myuser&passwd=pppp&aud=xyz123", http.NoBody)
+	require.NoError(t, err)
+	req.RemoteAddr = "10.0.0.1:12345"
+	req.Header.Set("User-Agent", "test-agent")
+	handler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, `{"name":"myuser","id":"test_ed6307123e30cc7682328522d1d090d9c7525b32","picture":"","role":"user"}`+"\n", rr.Body.String())
+	assert.Equal(t, CredRequest{User: "myuser", Password: "pppp", IP: "10.0.0.1", UserAgent: "test-agent", Audience: "xyz123"}, got)
+
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/login?user=myuser&passwd=bad&aud=xyz123", http.NoBody)
+	require.NoError(t, err)
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+func TestDirect_LoginHandlerCredCheckerCtxTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	tbl := []struct {
+		name    string
+		checker CredCheckerCtxFunc
+	}{
+		{"respects context", func(ctx context.Context, req CredRequest) (ok bool, u token.User, err error) {
+			select {
+			case <-ctx.Done():
+				return false, token.User{}, ctx.Err()
+			case <-release:
+				return true, token.User{}, nil
+			}
+		}},
+		{"ignores context", func(ctx context.Context, req CredRequest) (ok bool, u token.User, err error) {
+			<-release
+			return true, token.User{}, nil
+		}},
+	}
+
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			d := DirectHandler{
+				ProviderName:   "test",
+				CredCheckerCtx: tt.checker,
+				CheckTimeout:   50 * time.Millisecond,
+				TokenService: token.NewService(token.Opts{
+					SecretReader:   token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+					TokenDuration:  time.Hour,
+					CookieDuration: time.Hour * 24 * 31,
+				}),
+				Issuer: "iss-test",
+				L:      logger.Std{},
+			}
+			rr := httptest.NewRecorder()
+			req, err := http.NewRequest("GET", "/login?user=myuser&passwd=pppp&aud=xyz123", http.NoBody)
+			require.NoError(t, err)
+			st := time.Now()
+			http.HandlerFunc(d.LoginHandler).ServeHTTP(rr, req)
+			assert.Less(t, time.Since(st), time.Second, "login doesn't hang")
+			assert.Equal(t, http.StatusGatewayTimeout, rr.Code)
+			assert.Equal(t, `{"error":"credentials check timed out"}`+"\n", rr.Body.String())
+			assert.Empty(t, rr.Result().Cookies(), "no token set")
+		})
+	}
+}
+
+func TestDirect_LoginHandlerBasicAuth(t *testing.T) {
+	d := DirectHandler{
+		ProviderName: "test",
+		CredChecker: CredCheckerFunc(func(user, password string) (ok bool, err error) {
+			return user == "myuser" && password == "pppp", nil
+		}),
+		TokenService: token.NewService(token.Opts{
+			SecretReader:   token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+			TokenDuration:  time.Hour,
+			CookieDuration: time.Hour * 24 * 31,
+		}),
+		Issuer: "iss-test",
+		L:      logger.Std{},
+	}
+
+	t.Run("basic header", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/login?aud=xyz123", http.NoBody)
+		req.SetBasicAuth("myuser", "pppp")
+		http.HandlerFunc(d.LoginHandler).ServeHTTP(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+		var resp struct {
+			Name  string `json:"name"`
+			Token string `json:"token"`
+		}
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+		assert.Equal(t, "myuser", resp.Name)
+		claims, err := d.TokenService.Parse(resp.Token)
+		require.NoError(t, err)
+		assert.Equal(t, "xyz123", claims.Audience)
+		assert.Equal(t, "myuser", claims.User.Name)
+
+		request := &http.Request{Header: http.Header{"Cookie": rr.Header()["Set-Cookie"]}}
+		c, err := request.Cookie("JWT")
+		require.NoError(t, err)
+		assert.NotEmpty(t, c.Value, "token set as cookie as well")
+	})
+
+	t.Run("query credentials take precedence", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/login?user=myuser&passwd=bad", http.NoBody)
+		req.SetBasicAuth("myuser", "pppp")
+		http.HandlerFunc(d.LoginHandler).ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+	})
+
+	t.Run("body credentials take precedence", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/login", strings.NewReader(`{"user":"myuser","passwd":"pppp"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.SetBasicAuth("myuser", "bad")
+		http.HandlerFunc(d.LoginHandler).ServeHTTP(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code)
+		assert.NotContains(t, rr.Body.String(), `"token"`, "no token in body for non-basic login")
+	})
+
+	t.Run("no challenge by default", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/login", http.NoBody)
+		req.SetBasicAuth("myuser", "bad")
+		http.HandlerFunc(d.LoginHandler).ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+		assert.Empty(t, rr.Header().Get("WWW-Authenticate"))
+	})
+
+	t.Run("challenge enabled", func(t *testing.T) {
+		dc := d
+		dc.BasicAuthChallenge = true
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/login", http.NoBody)
+		req.SetBasicAuth("myuser", "bad")
+		http.HandlerFunc(dc.LoginHandler).ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		assert.Equal(t, `Basic realm="test"`, rr.Header().Get("WWW-Authenticate"))
+	})
+}
+
+func TestDirect_LoginHandlerMaxBodySize(t *testing.T) {
+	d := DirectHandler{
+		ProviderName: "test",
+		CredChecker:  &mockCredsChecker{ok: true},
+		TokenService: token.NewService(token.Opts{
+			SecretReader:   token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+			TokenDuration:  time.Hour,
+			CookieDuration: time.Hour * 24 * 31,
+		}),
+		Issuer: "iss-test",
+		L:      logger.NoOp{},
+	}
+	// body makes json body of exactly size bytes
+	body := func(size int) string {
+		prefix, suffix := `{"user":"myuser","passwd":"pppp","pad":"`, `"}`
+		return prefix + strings.Repeat("x", size-len(prefix)-len(suffix)) + suffix
+	}
+	login := func(d DirectHandler, body, contentType string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/login", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		d.LoginHandler(rr, req)
+		return rr
+	}
+
+	tbl := []struct {
+		name     string
+		maxSize  int64
+		bodySize int
+		code     int
+	}{
+		{"default, at limit", 0, MaxHTTPBodySize, http.StatusOK},
+		{"default, over limit", 0, MaxHTTPBodySize + 1, http.StatusRequestEntityTooLarge},
+		{"lowered, at limit", 100, 100, http.StatusOK},
+		{"lowered, over limit", 100, 101, http.StatusRequestEntityTooLarge},
+		{"raised, at limit", 4 * MaxHTTPBodySize, 4 * MaxHTTPBodySize, http.StatusOK},
+		{"raised, over limit", 4 * MaxHTTPBodySize, 4*MaxHTTPBodySize + 1, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			dh := d
+			dh.MaxBodySize = tt.maxSize
+			rr := login(dh, body(tt.bodySize), "application/json")
+			require.Equal(t, tt.code, rr.Code, rr.Body.String())
+			if tt.code == http.StatusRequestEntityTooLarge {
+				assert.Equal(t, `{"error":"request body too large"}`+"\n", rr.Body.String())
+			}
+		})
+	}
+
+	// form body over the limit
+	dh := d
+	dh.MaxBodySize = 100
+	form := url.Values{"user": {"myuser"}, "passwd": {"pppp"}, "pad": {strings.Repeat("x", 100)}}
+	rr := login(dh, form.Encode(), "application/x-www-form-urlencoded")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code, rr.Body.String())
+
+	// other parse errors are still 400
+	rr = login(dh, `{"user":`, "application/json")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, `{"error":"failed to parse credentials"}`+"\n", rr.Body.String())
+}
+
+func TestLockout_Keys(t *testing.T) {
+	l := &Lockout{}
+	assert.Equal(t, []string{"direct:user:myuser", "direct:ip:10.0.0.1"}, l.keys("direct", "myuser", "10.0.0.1"))
+	assert.Equal(t, []string{"ldap:user:myuser"}, l.keys("ldap", "myuser", ""))
+}
+
+func TestLockout_Delay(t *testing.T) {
+	l := &Lockout{}
+	l.init()
+	assert.Equal(t, time.Duration(0), l.delay(3))
+	assert.Equal(t, 500*time.Millisecond, l.delay(4))
+	assert.Equal(t, time.Second, l.delay(5))
+	assert.Equal(t, 4*time.Second, l.delay(7))
+	assert.Equal(t, 5*time.Second, l.delay(8))
+	assert.Equal(t, 5*time.Second, l.delay(100))
+}
+
+type countingCredsChecker struct {
+	calls int
+}
+
+func (c *countingCredsChecker) Check(_, password string) (ok bool, err error) {
+	c.calls++
+	return password == "good", nil
+}
+
+func TestDirect_LoginHandlerIssuerFunc(t *testing.T) {
+	tokenService := token.NewService(token.Opts{
+		SecretReader:   token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+		TokenDuration:  time.Hour,
+		CookieDuration: time.Hour * 24 * 31,
+		Issuer:         "iss-test",
+		AllowedIssuers: []string{"brand-a", "brand-b"},
+	})
+	d := DirectHandler{ProviderName: "test", CredChecker: &mockCredsChecker{ok: true}, TokenService: tokenService,
+		Issuer: "iss-test", L: logger.NoOp{},
+		IssuerFunc: func(r *http.Request) string {
+			if strings.HasPrefix(r.Host, "brand-") {
+				return strings.TrimSuffix(r.Host, ".example.com")
+			}
+			return ""
+		},
+	}
+
+	for host, iss := range map[string]string{"brand-a.example.com": "brand-a", "brand-b.example.com": "brand-b",
+		"example.com": "iss-test"} {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "http://"+host+"/login?user=myuser&passwd=pppp", http.NoBody)
+		d.LoginHandler(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		claims, err := tokenService.Parse(rr.Result().Cookies()[0].Value)
+		require.NoError(t, err, host)
+		assert.Equal(t, iss, claims.Issuer, host)
+	}
+}
@@ -0,0 +1,121 @@
+package provider
+
+import (
+	"bufio"
+	"context"
+	_ "embed" // embedded list of disposable domains
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// AddressDisposable is the code of confirmation request rejected for disposable email domain, sent with 400
+const AddressDisposable = "disposable_domain"
+
+//go:embed disposable_domains.txt
+var disposableDomains string
+
+// DomainBlocklist checks email addresses against blocked domains, built-in list of common disposable ones and
+// added by Load, LoadFile and LoadURL. Subdomains of blocked domains blocked too, allowed domains (and their
+// subdomains) never blocked. Safe for concurrent use.
+type DomainBlocklist struct {
+	lock    sync.RWMutex
+	blocked map[string]bool
+	allowed map[string]bool
+}
+
+// NewDomainBlocklist makes blocklist with built-in disposable domains and extra ones, allowed domains override blocks
+func NewDomainBlocklist(extra, allowed []string) *DomainBlocklist {
+	res := &DomainBlocklist{blocked: map[string]bool{}, allowed: map[string]bool{}}
+	_ = res.Load(strings.NewReader(disposableDomains))
+	for _, d := range extra {
+		res.blocked[normDomain(d)] = true
+	}
+	for _, d := range allowed {
+		res.allowed[normDomain(d)] = true
+	}
+	return res
+}
+
+// Load adds blocked domains read from r, one per line, empty lines and lines starting with # ignored
+func (b *DomainBlocklist) Load(r io.Reader) error {
+	domains := []string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		domains = append(domains, normDomain(line))
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("can't read domains: %w", err)
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, d := range domains {
+		b.blocked[d] = true
+	}
+	return nil
+}
+
+// LoadFile adds blocked domains from the file, i.e. updated list of disposable domains
+func (b *DomainBlocklist) LoadFile(path string) error {
+	fh, err := os.Open(path) // nolint gosec // path is set by the app
+	if err != nil {
+		return fmt.Errorf("can't open domains file: %w", err)
+	}
+	defer fh.Close() // nolint
+	return b.Load(fh)
+}
+
+// LoadURL adds blocked domains downloaded from url, http.DefaultClient used if client is nil
+func (b *DomainBlocklist) LoadURL(ctx context.Context, client *http.Client, url string) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, http.NoBody)
+	if err != nil {
+		return fmt.Errorf("can't make domains request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("can't get domains: %w", err)
+	}
+	defer resp.Body.Close() // nolint
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("can't get domains, status %s", resp.Status)
+	}
+	return b.Load(resp.Body)
+}
+
+// Blocked reports if domain of the address or any of its parent domains is blocked and none of them allowed
+func (b *DomainBlocklist) Blocked(address string) bool {
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return false
+	}
+	domain := normDomain(address[at+1:])
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	blocked := false
+	for d := domain; d != ""; {
+		if b.allowed[d] {
+			return false
+		}
+		blocked = blocked || b.blocked[d]
+		dot := strings.Index(d, ".")
+		if dot < 0 {
+			break
+		}
+		d = d[dot+1:]
+	}
+	return blocked
+}
+
+func normDomain(d string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(d)), ".")
+}
@@ -0,0 +1,125 @@
+package provider
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/auth/logger"
+	"github.com/go-pkgz/auth/token"
+)
+
+func TestDomainBlocklist(t *testing.T) {
+	b := NewDomainBlocklist([]string{"Spam.Example. "}, []string{"good.mailinator.com"})
+
+	tbl := []struct {
+		address string
+		blocked bool
+	}{
+		{"user@mailinator.com", true},
+		{"user@MAILINATOR.COM.", true},
+		{"user@foo.mailinator.com", true},
+		{"user@a.b.mailinator.com", true},
+		{"user@notmailinator.com", false},
+		{"user@good.mailinator.com", false},
+		{"user@x.good.mailinator.com", false},
+		{"user@spam.example", true},
+		{"user@sub.spam.example", true},
+		{"user@example", false},
+		{"user@gmail.com", false},
+		{"not-an-email", false},
+	}
+	for _, tt := range tbl {
+		assert.Equal(t, tt.blocked, b.Blocked(tt.address), tt.address)
+	}
+
+	require.NoError(t, b.Load(strings.NewReader("# comment\n\nnew-spam.com\n")))
+	assert.True(t, b.Blocked("user@new-spam.com"))
+	assert.False(t, b.Blocked("user@comment"))
+
+	file := filepath.Join(t.TempDir(), "domains.txt")
+	require.NoError(t, os.WriteFile(file, []byte("file-spam.com\n"), 0o600))
+	require.NoError(t, b.LoadFile(file))
+	assert.True(t, b.Blocked("user@file-spam.com"))
+	assert.Error(t, b.LoadFile("/no/such/file"))
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/list" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte("url-spam.com\n"))
+	}))
+	defer ts.Close()
+	require.NoError(t, b.LoadURL(context.Background(), nil, ts.URL+"/list"))
+	assert.True(t, b.Blocked("user@url-spam.com"))
+	assert.EqualError(t, b.LoadURL(context.Background(), nil, ts.URL+"/bad"), "can't get domains, status 404 Not Found")
+}
+
+func TestVerifyHandler_DomainBlocklist(t *testing.T) {
+	emailer := mockSender{}
+	e := VerifyHandler{
+		ProviderName: "test",
+		TokenService: token.NewService(token.Opts{
+			SecretReader:   token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+			TokenDuration:  time.Hour,
+			CookieDuration: time.Hour * 24 * 31,
+		}),
+		L:               logger.NoOp{},
+		Sender:          SenderFunc(emailer.Send),
+		Template:        template.Must(template.New("confirm").Parse("token {{.Token}}")),
+		DomainBlocklist: NewDomainBlocklist(nil, []string{"ok.yopmail.com"}),
+	}
+	send := func(address string) *httptest.ResponseRecorder {
+		emailer.to = ""
+		rr := httptest.NewRecorder()
+		e.LoginHandler(rr, httptest.NewRequest("GET", "/login?user=test123&address="+address, http.NoBody))
+		return rr
+	}
+
+	rr := send("blah@foo.mailinator.com")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, `{"code":"disposable_domain","error":"email domain is not allowed"}`+"\n", rr.Body.String())
+	assert.Equal(t, "", emailer.to, "not sent")
+
+	rr = send("blah@ok.yopmail.com")
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, "blah@ok.yopmail.com", emailer.to, "allowed domain")
+
+	// blocked domain reported with other invalid fields
+	e.CollectAllErrors = true
+	rr = httptest.NewRecorder()
+	e.LoginHandler(rr, httptest.NewRequest("GET", "/login?address=blah@yopmail.com", http.NoBody))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.JSONEq(t, `{"errors":{"user":"user is required","address":"email domain is not allowed"}}`, rr.Body.String())
+	rr = send("blah@yopmail.com")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.JSONEq(t, `{"errors":{"address":"email domain is not allowed"}}`, rr.Body.String())
+	assert.Equal(t, "", emailer.to, "not sent")
+	e.CollectAllErrors = false
+
+	e.BlockSilently = true
+	rr = send("blah@yopmail.com")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `{"address":"blah@yopmail.com","user":"test123"}`+"\n", rr.Body.String())
+	assert.Equal(t, "", emailer.to, "pretended sent")
+
+	// silently blocked address not reported with other invalid fields
+	e.CollectAllErrors = true
+	rr = httptest.NewRecorder()
+	e.LoginHandler(rr, httptest.NewRequest("GET", "/login?address=blah@yopmail.com", http.NoBody))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.JSONEq(t, `{"errors":{"user":"user is required"}}`, rr.Body.String())
+	rr = send("blah@yopmail.com")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "", emailer.to, "pretended sent")
+}
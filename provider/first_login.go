@@ -0,0 +1,114 @@
+package provider
+
+import (
+	"sync"
+
+	"github.com/go-pkgz/auth/token"
+)
+
+// FirstLoginStore keeps user fields sent by provider only on the first login, i.e. name of Apple user,
+// to fill them on next logins. Get returns nil without error for unknown user.
+type FirstLoginStore interface {
+	Put(userID string, fields map[string]string) error
+	Get(userID string) (map[string]string, error)
+}
+
+// firstLogin saves non-empty fields of the user listed in names to FirstLoginStore and fills empty ones from it.
+// Names are "name", "email", "picture" or string attribute. Store errors are logged and ignored.
+func (p Params) firstLogin(u *token.User, names []string) {
+	if p.FirstLoginStore == nil || len(names) == 0 || u.ID == "" {
+		return
+	}
+	stored, err := p.FirstLoginStore.Get(u.ID)
+	if err != nil {
+		p.Logf("[WARN] can't get first login fields of %s, %v", u.ID, err)
+		return
+	}
+
+	fields := make(map[string]string, len(stored))
+	for k, v := range stored {
+		fields[k] = v
+	}
+	changed := false
+	for _, name := range names {
+		if val := userField(u, name); val != "" {
+			changed = changed || fields[name] != val
+			fields[name] = val
+			continue
+		}
+		if val := fields[name]; val != "" {
+			p.Logf("[DEBUG] %s of %s filled from first login", name, u.ID)
+			setUserField(u, name, val)
+		}
+	}
+
+	if changed {
+		if err = p.FirstLoginStore.Put(u.ID, fields); err != nil {
+			p.Logf("[WARN] can't save first login fields of %s, %v", u.ID, err)
+		}
+	}
+}
+
+func userField(u *token.User, name string) string {
+	switch name {
+	case "name":
+		return u.Name
+	case "email":
+		return u.Email
+	case "picture":
+		return u.Picture
+	}
+	return u.StrAttr(name)
+}
+
+func setUserField(u *token.User, name, val string) {
+	switch name {
+	case "name":
+		u.Name = val
+	case "email":
+		u.Email = val
+	case "picture":
+		u.Picture = val
+	default:
+		u.SetStrAttr(name, val)
+	}
+}
+
+// MemFirstLoginStore implements FirstLoginStore with in-memory map, for single instance and tests.
+// Fields are lost on restart, persistent store needed to keep them for good.
+type MemFirstLoginStore struct {
+	lock sync.RWMutex
+	data map[string]map[string]string
+}
+
+// NewMemFirstLoginStore makes in-memory first login store
+func NewMemFirstLoginStore() *MemFirstLoginStore {
+	return &MemFirstLoginStore{data: map[string]map[string]string{}}
+}
+
+// Put saves fields of the user, replacing previous ones
+func (m *MemFirstLoginStore) Put(userID string, fields map[string]string) error {
+	res := make(map[string]string, len(fields))
+	for k, v := range fields {
+		res[k] = v
+	}
+	m.lock.Lock()
+	m.data[userID] = res
+	m.lock.Unlock()
+	return nil
+}
+
+// Get returns copy of fields saved for the user
+func (m *MemFirstLoginStore) Get(userID string) (map[string]string, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	fields, ok := m.data[userID]
+	if !ok {
+		return nil, nil
+	}
+	res := make(map[string]string, len(fields))
+	for k, v := range fields {
+		res[k] = v
+	}
+	return res, nil
+}
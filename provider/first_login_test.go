@@ -0,0 +1,73 @@
+package provider
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/auth/logger"
+	"github.com/go-pkgz/auth/token"
+)
+
+func TestParams_FirstLogin(t *testing.T) {
+	store := NewMemFirstLoginStore()
+	p := Params{L: logger.NoOp{}, FirstLoginStore: store}
+	fields := []string{"name", "email", "employee_id"}
+
+	// first login, fields saved
+	u := token.User{ID: "corp_123", Name: "John", Email: "john@example.com"}
+	u.SetStrAttr("employee_id", "e-1")
+	p.firstLogin(&u, fields)
+	stored, err := store.Get("corp_123")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"name": "John", "email": "john@example.com", "employee_id": "e-1"}, stored)
+
+	// next login, empty fields filled, sent ones kept as is
+	u = token.User{ID: "corp_123", Email: "john@corp.example.com", Picture: "http://example.com/pic.png"}
+	p.firstLogin(&u, fields)
+	assert.Equal(t, "John", u.Name)
+	assert.Equal(t, "john@corp.example.com", u.Email)
+	assert.Equal(t, "e-1", u.StrAttr("employee_id"))
+	assert.Equal(t, "http://example.com/pic.png", u.Picture, "not listed field untouched")
+	stored, err = store.Get("corp_123")
+	require.NoError(t, err)
+	assert.Equal(t, "john@corp.example.com", stored["email"], "changed field updated")
+
+	// other user not affected
+	u = token.User{ID: "corp_456"}
+	p.firstLogin(&u, fields)
+	assert.Equal(t, token.User{ID: "corp_456"}, u)
+
+	// store failure ignored
+	p.FirstLoginStore = failingFirstLoginStore{}
+	u = token.User{ID: "corp_123"}
+	p.firstLogin(&u, fields)
+	assert.Equal(t, token.User{ID: "corp_123"}, u)
+}
+
+func TestMemFirstLoginStore(t *testing.T) {
+	store := NewMemFirstLoginStore()
+	res, err := store.Get("u1")
+	require.NoError(t, err)
+	assert.Nil(t, res)
+
+	fields := map[string]string{"name": "John"}
+	require.NoError(t, store.Put("u1", fields))
+	fields["name"] = "changed"
+	res, err = store.Get("u1")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"name": "John"}, res, "saved copy")
+	res["name"] = "changed"
+	res, err = store.Get("u1")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"name": "John"}, res, "returned copy")
+}
+
+type failingFirstLoginStore struct{}
+
+func (failingFirstLoginStore) Put(string, map[string]string) error { return errors.New("failed") }
+func (failingFirstLoginStore) Get(string) (map[string]string, error) {
+	return nil, errors.New("failed")
+}
@@ -0,0 +1,305 @@
+package provider
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-ldap/ldap/v3"
+
+	"github.com/go-pkgz/auth/logger"
+	"github.com/go-pkgz/auth/token"
+)
+
+const (
+	defaultLDAPUserFilter   = "(&(objectClass=person)(|(sAMAccountName=%s)(uid=%s)))"
+	defaultLDAPNameAttr     = "displayName"
+	defaultLDAPEmailAttr    = "mail"
+	defaultLDAPPhotoAttr    = "thumbnailPhoto"
+	defaultLDAPGroupAttr    = "memberOf"
+	defaultLDAPPoolSize     = 4
+	defaultLDAPTimeout      = 10 * time.Second
+	defaultLDAPMaxPhotoSize = 100 * 1024
+	ldapMaxGroupDepth       = 10
+)
+
+// LDAPGroupRole maps directory group to user's role
+type LDAPGroupRole struct {
+	Group string // group DN, compared case-insensitively
+	Role  string
+}
+
+// LDAPCredChecker checks credentials against LDAP or Active Directory with search-then-bind: service account
+// searches the user by login, then the found DN is bound with the supplied password. Implements CredCheckerCtx.
+// Failures to reach or query the directory returned as ErrCredStoreUnavailable. Zero values replaced by defaults.
+type LDAPCredChecker struct {
+	logger.L
+	URL           string      // ldaps://host:636 or ldap://host:389, required
+	StartTLS      bool        // upgrade ldap:// connection with StartTLS
+	TLSConfig     *tls.Config // optional config for ldaps and StartTLS
+	AllowInsecure bool        // allow ldap:// without StartTLS, passwords sent in clear text, for tests only
+	BindDN        string      // service account DN used for searches, required
+	BindPassword  string      // service account password
+	BaseDN        string      // base DN of users and groups search, required
+
+	UserFilter   string // search filter, %s replaced by escaped login, default matches sAMAccountName or uid of a person
+	NameAttr     string // attribute with user name, default displayName, login used if empty
+	EmailAttr    string // attribute with email, default mail
+	PhotoAttr    string // attribute with jpeg photo, default thumbnailPhoto
+	IDAttr       string // optional attribute with stable user id, i.e. objectGUID or entryUUID, default is login hash
+	MaxPhotoSize int    // larger photos ignored, default 100KB
+
+	GroupRoles   []LDAPGroupRole // group to role mapping by priority, the first group of the user sets Role, all in "roles" attr
+	GroupAttr    string          // attribute with groups of user or group, default memberOf
+	NestedGroups bool            // resolve groups of groups as well
+
+	PoolSize int           // max idle connections kept, default 4
+	Timeout  time.Duration // dial and request timeout, default 10s
+
+	once sync.Once
+	pool chan *ldap.Conn
+}
+
+func (c *LDAPCredChecker) init() {
+	c.once.Do(func() {
+		if c.L == nil {
+			c.L = logger.NoOp{}
+		}
+		if c.UserFilter == "" {
+			c.UserFilter = defaultLDAPUserFilter
+		}
+		if c.NameAttr == "" {
+			c.NameAttr = defaultLDAPNameAttr
+		}
+		if c.EmailAttr == "" {
+			c.EmailAttr = defaultLDAPEmailAttr
+		}
+		if c.PhotoAttr == "" {
+			c.PhotoAttr = defaultLDAPPhotoAttr
+		}
+		if c.GroupAttr == "" {
+			c.GroupAttr = defaultLDAPGroupAttr
+		}
+		if c.MaxPhotoSize == 0 {
+			c.MaxPhotoSize = defaultLDAPMaxPhotoSize
+		}
+		if c.PoolSize == 0 {
+			c.PoolSize = defaultLDAPPoolSize
+		}
+		if c.Timeout == 0 {
+			c.Timeout = defaultLDAPTimeout
+		}
+		c.pool = make(chan *ldap.Conn, c.PoolSize)
+	})
+}
+
+// Check searches the user by login and binds as it with the password. Returns user with name, email,
+// photo as data url, id and role from the directory.
+func (c *LDAPCredChecker) Check(ctx context.Context, req CredRequest) (ok bool, u token.User, err error) {
+	c.init()
+	if req.User == "" || req.Password == "" {
+		return false, token.User{}, nil // empty password makes unauthenticated bind, accepted by servers
+	}
+
+	conn, pooled, err := c.conn(ctx)
+	if err != nil {
+		return false, token.User{}, err
+	}
+	healthy := false
+	defer func() { c.release(conn, healthy && pooled) }()
+
+	if err = conn.Bind(c.BindDN, c.BindPassword); err != nil {
+		return false, token.User{}, fmt.Errorf("%w: service account bind failed: %v", ErrCredStoreUnavailable, err)
+	}
+
+	attrs := []string{c.NameAttr, c.EmailAttr, c.PhotoAttr, c.GroupAttr}
+	if c.IDAttr != "" {
+		attrs = append(attrs, c.IDAttr)
+	}
+	filter := strings.ReplaceAll(c.UserFilter, "%s", ldap.EscapeFilter(req.User))
+	res, err := conn.Search(ldap.NewSearchRequest(c.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		filter, attrs, nil))
+	if err != nil {
+		return false, token.User{}, fmt.Errorf("%w: user search failed: %v", ErrCredStoreUnavailable, err)
+	}
+	if len(res.Entries) != 1 {
+		c.Logf("[DEBUG] ldap user %q not found or ambiguous, %d entries", req.User, len(res.Entries))
+		healthy = true
+		return false, token.User{}, nil
+	}
+	entry := res.Entries[0]
+
+	if err = conn.Bind(entry.DN, req.Password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			healthy = true
+			return false, token.User{}, nil
+		}
+		return false, token.User{}, fmt.Errorf("%w: user bind failed: %v", ErrCredStoreUnavailable, err)
+	}
+
+	u = c.user(entry)
+	if len(c.GroupRoles) > 0 {
+		// groups read with service account, user may have no rights to read them
+		if err = conn.Bind(c.BindDN, c.BindPassword); err != nil {
+			return false, token.User{}, fmt.Errorf("%w: service account bind failed: %v", ErrCredStoreUnavailable, err)
+		}
+		groups := entry.GetAttributeValues(c.GroupAttr)
+		if c.NestedGroups {
+			if groups, err = c.nestedGroups(conn, groups); err != nil {
+				return false, token.User{}, fmt.Errorf("%w: groups search failed: %v", ErrCredStoreUnavailable, err)
+			}
+		}
+		c.setRoles(&u, groups)
+	}
+	healthy = true
+	return true, u, nil
+}
+
+// Close closes idle connections
+func (c *LDAPCredChecker) Close() {
+	c.init()
+	for {
+		select {
+		case conn := <-c.pool:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// user makes user from the directory entry
+func (c *LDAPCredChecker) user(entry *ldap.Entry) token.User {
+	u := token.User{
+		Name:  entry.GetAttributeValue(c.NameAttr),
+		Email: entry.GetAttributeValue(c.EmailAttr),
+	}
+	if c.IDAttr != "" {
+		if id := entry.GetRawAttributeValue(c.IDAttr); len(id) > 0 {
+			u.ID = string(id)
+			if !utf8.Valid(id) || strings.ContainsAny(u.ID, "\x00") {
+				u.ID = hex.EncodeToString(id) // binary, like objectGUID
+			}
+		}
+	}
+	if photo := entry.GetRawAttributeValue(c.PhotoAttr); len(photo) > 0 && len(photo) <= c.MaxPhotoSize {
+		u.Picture = "data:" + http.DetectContentType(photo) + ";base64," + base64.StdEncoding.EncodeToString(photo)
+	}
+	return u
+}
+
+// nestedGroups returns groups with all groups they are members of, recursively
+func (c *LDAPCredChecker) nestedGroups(conn *ldap.Conn, groups []string) ([]string, error) {
+	seen := map[string]bool{}
+	res := []string{}
+	queue := groups
+	for depth := 0; len(queue) > 0 && depth < ldapMaxGroupDepth; depth++ {
+		next := []string{}
+		for _, g := range queue {
+			if seen[strings.ToLower(g)] {
+				continue
+			}
+			seen[strings.ToLower(g)] = true
+			res = append(res, g)
+			sr, err := conn.Search(ldap.NewSearchRequest(g, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, 0, false,
+				"(objectClass=*)", []string{c.GroupAttr}, nil))
+			if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range sr.Entries {
+				next = append(next, e.GetAttributeValues(c.GroupAttr)...)
+			}
+		}
+		queue = next
+	}
+	return res, nil
+}
+
+// setRoles sets Role by the first matching group of GroupRoles and "roles" attribute with all matching roles
+func (c *LDAPCredChecker) setRoles(u *token.User, groups []string) {
+	member := map[string]bool{}
+	for _, g := range groups {
+		member[strings.ToLower(g)] = true
+	}
+	roles := []string{}
+	for _, gr := range c.GroupRoles {
+		if !member[strings.ToLower(gr.Group)] {
+			continue
+		}
+		if u.Role == "" {
+			u.Role = gr.Role
+		}
+		roles = append(roles, gr.Role)
+	}
+	if len(roles) > 0 {
+		if u.Attributes == nil {
+			u.Attributes = map[string]interface{}{}
+		}
+		u.Attributes["roles"] = roles
+	}
+}
+
+// conn returns idle connection from the pool or dials a new one with request timeout set once, as the reader of
+// the connection uses it concurrently. With ctx deadline sooner than Timeout the connection dialed with request
+// timeout to the deadline, it is not shared and returned with pooled=false, to be closed after use.
+func (c *LDAPCredChecker) conn(ctx context.Context) (conn *ldap.Conn, pooled bool, err error) {
+	timeout, pooled := c.Timeout, true
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout, pooled = time.Until(deadline), false
+		if timeout <= 0 {
+			return nil, false, fmt.Errorf("%w: %v", ErrCredStoreUnavailable, context.DeadlineExceeded)
+		}
+	}
+
+	for idle := pooled; idle; {
+		select {
+		case conn = <-c.pool:
+			if !conn.IsClosing() {
+				return conn, true, nil
+			}
+			conn.Close()
+		default:
+			idle = false
+		}
+	}
+
+	if !strings.HasPrefix(c.URL, "ldaps://") && !c.StartTLS && !c.AllowInsecure {
+		return nil, false, fmt.Errorf("ldap connection without tls is not allowed, use ldaps, StartTLS or AllowInsecure")
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err = ldap.DialURL(c.URL, ldap.DialWithDialer(dialer), ldap.DialWithTLSConfig(c.TLSConfig))
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: %v", ErrCredStoreUnavailable, err)
+	}
+	conn.SetTimeout(timeout)
+	if c.StartTLS {
+		if err = conn.StartTLS(c.TLSConfig); err != nil {
+			conn.Close()
+			return nil, false, fmt.Errorf("%w: starttls failed: %v", ErrCredStoreUnavailable, err)
+		}
+	}
+	return conn, pooled, nil
+}
+
+// release returns healthy connection to the pool, closes it otherwise or if the pool is full
+func (c *LDAPCredChecker) release(conn *ldap.Conn, healthy bool) {
+	if healthy && !conn.IsClosing() {
+		select {
+		case c.pool <- conn:
+			return
+		default:
+		}
+	}
+	conn.Close()
+}
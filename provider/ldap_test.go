@@ -0,0 +1,346 @@
+package provider
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/auth/logger"
+	"github.com/go-pkgz/auth/token"
+)
+
+type ldapTestEntry struct {
+	dn       string
+	password string
+	attrs    map[string][]string
+}
+
+// ldapTestServer is a minimal LDAP server supporting simple bind, search by sAMAccountName or by DN and unbind
+type ldapTestServer struct {
+	ln      net.Listener
+	entries []ldapTestEntry
+	conns   int32
+
+	lock    sync.Mutex
+	filters []string
+}
+
+var ldapTestUserRe = regexp.MustCompile(`sAMAccountName=([^)]*)`)
+
+func newLDAPTestServer(t *testing.T, tlsConfig *tls.Config) *ldapTestServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	s := &ldapTestServer{ln: ln, entries: []ldapTestEntry{
+		{dn: "cn=svc,dc=example,dc=com", password: "svc-secret"},
+		{dn: "cn=John Doe,ou=users,dc=example,dc=com", password: "passwd", attrs: map[string][]string{
+			"sAMAccountName": {"jdoe"},
+			"displayName":    {"John Doe"},
+			"mail":           {"jdoe@example.com"},
+			"thumbnailPhoto": {"\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR"},
+			"objectGUID":     {"\x01\x02\x00\xff"},
+			"memberOf":       {"cn=devs,ou=groups,dc=example,dc=com"},
+		}},
+		{dn: "cn=devs,ou=groups,dc=example,dc=com", attrs: map[string][]string{
+			"memberOf": {"cn=staff,ou=groups,dc=example,dc=com"},
+		}},
+		{dn: "cn=staff,ou=groups,dc=example,dc=com", attrs: map[string][]string{
+			"memberOf": {"cn=devs,ou=groups,dc=example,dc=com"}, // loop
+		}},
+		{dn: "cn=dup1,ou=users,dc=example,dc=com", password: "passwd", attrs: map[string][]string{"sAMAccountName": {"dup"}}},
+		{dn: "cn=dup2,ou=users,dc=example,dc=com", password: "passwd", attrs: map[string][]string{"sAMAccountName": {"dup"}}},
+	}}
+	go s.serve()
+	t.Cleanup(func() { _ = ln.Close() })
+	return s
+}
+
+func (s *ldapTestServer) url() string {
+	return "ldap://" + s.ln.Addr().String()
+}
+
+func (s *ldapTestServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(&s.conns, 1)
+		go s.handle(conn)
+	}
+}
+
+func (s *ldapTestServer) handle(conn net.Conn) {
+	defer conn.Close()
+	for {
+		p, err := ber.ReadPacket(conn)
+		if err != nil || len(p.Children) < 2 {
+			return
+		}
+		id := p.Children[0].Value.(int64)
+		op := p.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn, passwd := op.Children[1].Data.String(), op.Children[2].Data.String()
+			code := uint16(ldap.LDAPResultInvalidCredentials)
+			for _, e := range s.entries {
+				if e.dn == dn && e.password != "" && e.password == passwd {
+					code = ldap.LDAPResultSuccess
+				}
+			}
+			_, _ = conn.Write(ldapTestResult(id, ldap.ApplicationBindResponse, code).Bytes())
+		case ldap.ApplicationSearchRequest:
+			base, scope := op.Children[0].Data.String(), op.Children[1].Value.(int64)
+			filter, _ := ldap.DecompileFilter(op.Children[6])
+			s.lock.Lock()
+			s.filters = append(s.filters, filter)
+			s.lock.Unlock()
+			found, code := s.search(base, scope, filter)
+			for _, e := range found {
+				_, _ = conn.Write(ldapTestEntryPacket(id, e).Bytes())
+			}
+			_, _ = conn.Write(ldapTestResult(id, ldap.ApplicationSearchResultDone, code).Bytes())
+		case ldap.ApplicationUnbindRequest:
+			return
+		}
+	}
+}
+
+func (s *ldapTestServer) search(base string, scope int64, filter string) ([]ldapTestEntry, uint16) {
+	if scope == ldap.ScopeBaseObject {
+		for _, e := range s.entries {
+			if e.dn == base {
+				return []ldapTestEntry{e}, ldap.LDAPResultSuccess
+			}
+		}
+		return nil, ldap.LDAPResultNoSuchObject
+	}
+	res := []ldapTestEntry{}
+	m := ldapTestUserRe.FindStringSubmatch(filter)
+	for _, e := range s.entries {
+		if m != nil && len(e.attrs["sAMAccountName"]) > 0 && e.attrs["sAMAccountName"][0] == m[1] {
+			res = append(res, e)
+		}
+	}
+	return res, ldap.LDAPResultSuccess
+}
+
+func ldapTestMessage(id int64, op *ber.Packet) *ber.Packet {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "message")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "id"))
+	p.AppendChild(op)
+	return p
+}
+
+func ldapTestResult(id int64, tag ber.Tag, code uint16) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "result")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "code"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matched dn"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "message"))
+	return ldapTestMessage(id, op)
+}
+
+func ldapTestEntryPacket(id int64, e ldapTestEntry) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "entry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, "dn"))
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attributes")
+	for name, values := range e.attrs {
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attribute")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "type"))
+		vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "values")
+		for _, v := range values {
+			vals.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "value"))
+		}
+		attr.AppendChild(vals)
+		attrs.AppendChild(attr)
+	}
+	op.AppendChild(attrs)
+	return ldapTestMessage(id, op)
+}
+
+func newTestLDAPChecker(s *ldapTestServer) *LDAPCredChecker {
+	return &LDAPCredChecker{
+		URL:           s.url(),
+		AllowInsecure: true,
+		BindDN:        "cn=svc,dc=example,dc=com",
+		BindPassword:  "svc-secret",
+		BaseDN:        "dc=example,dc=com",
+		Timeout:       time.Second,
+	}
+}
+
+func TestLDAPCredChecker_Check(t *testing.T) {
+	s := newLDAPTestServer(t, nil)
+	c := newTestLDAPChecker(s)
+	c.IDAttr = "objectGUID"
+	defer c.Close()
+
+	ok, u, err := c.Check(context.Background(), CredRequest{User: "jdoe", Password: "passwd"})
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "John Doe", u.Name)
+	assert.Equal(t, "jdoe@example.com", u.Email)
+	assert.Equal(t, "010200ff", u.ID)
+	assert.Equal(t, "data:image/png;base64,iVBORw0KGgoAAAANSUhEUg==", u.Picture)
+	assert.Equal(t, "", u.Role, "no group roles defined")
+
+	ok, _, err = c.Check(context.Background(), CredRequest{User: "jdoe", Password: "bad"})
+	require.NoError(t, err)
+	assert.False(t, ok, "bad password")
+
+	ok, _, err = c.Check(context.Background(), CredRequest{User: "jdoe", Password: ""})
+	require.NoError(t, err)
+	assert.False(t, ok, "empty password rejected without bind")
+
+	ok, _, err = c.Check(context.Background(), CredRequest{User: "unknown", Password: "passwd"})
+	require.NoError(t, err)
+	assert.False(t, ok, "unknown user")
+
+	ok, _, err = c.Check(context.Background(), CredRequest{User: "dup", Password: "passwd"})
+	require.NoError(t, err)
+	assert.False(t, ok, "ambiguous user")
+
+	ok, _, err = c.Check(context.Background(), CredRequest{User: "jdoe*)(uid=*", Password: "passwd"})
+	require.NoError(t, err)
+	assert.False(t, ok)
+	s.lock.Lock()
+	assert.Contains(t, s.filters[len(s.filters)-1], `(sAMAccountName=jdoe\2a\29\28uid=\2a)`, "login escaped")
+	s.lock.Unlock()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&s.conns), "connection reused")
+
+	// ctx deadline sooner than Timeout gets own connection, pooled one left as is
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	ok, _, err = c.Check(ctx, CredRequest{User: "jdoe", Password: "passwd"})
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&s.conns), "dedicated connection")
+	assert.Len(t, c.pool, 1, "dedicated connection not pooled")
+	ok, _, err = c.Check(context.Background(), CredRequest{User: "jdoe", Password: "passwd"})
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&s.conns), "pooled connection reused")
+
+	expired, cancelExpired := context.WithTimeout(context.Background(), -time.Second)
+	defer cancelExpired()
+	_, _, err = c.Check(expired, CredRequest{User: "jdoe", Password: "passwd"})
+	assert.ErrorIs(t, err, ErrCredStoreUnavailable)
+}
+
+func TestLDAPCredChecker_Groups(t *testing.T) {
+	s := newLDAPTestServer(t, nil)
+	c := newTestLDAPChecker(s)
+	c.GroupRoles = []LDAPGroupRole{
+		{Group: "cn=admins,ou=groups,dc=example,dc=com", Role: "admin"},
+		{Group: "cn=Staff,ou=groups,dc=example,dc=com", Role: "staff"},
+		{Group: "cn=devs,ou=groups,dc=example,dc=com", Role: "developer"},
+	}
+	defer c.Close()
+
+	ok, u, err := c.Check(context.Background(), CredRequest{User: "jdoe", Password: "passwd"})
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "developer", u.Role, "direct groups only")
+	assert.Equal(t, []string{"developer"}, u.Attributes["roles"])
+
+	c.NestedGroups = true
+	ok, u, err = c.Check(context.Background(), CredRequest{User: "jdoe", Password: "passwd"})
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "staff", u.Role, "nested group has priority")
+	assert.Equal(t, []string{"staff", "developer"}, u.Attributes["roles"])
+}
+
+func TestLDAPCredChecker_Unavailable(t *testing.T) {
+	s := newLDAPTestServer(t, nil)
+	c := newTestLDAPChecker(s)
+	c.BindPassword = "bad"
+	_, _, err := c.Check(context.Background(), CredRequest{User: "jdoe", Password: "passwd"})
+	assert.ErrorIs(t, err, ErrCredStoreUnavailable, "service account rejected")
+
+	c = newTestLDAPChecker(s)
+	_ = s.ln.Close()
+	_, _, err = c.Check(context.Background(), CredRequest{User: "jdoe", Password: "passwd"})
+	assert.ErrorIs(t, err, ErrCredStoreUnavailable, "server down")
+
+	c = newTestLDAPChecker(s)
+	c.AllowInsecure = false
+	_, _, err = c.Check(context.Background(), CredRequest{User: "jdoe", Password: "passwd"})
+	assert.EqualError(t, err, "ldap connection without tls is not allowed, use ldaps, StartTLS or AllowInsecure")
+}
+
+func TestLDAPCredChecker_LDAPS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	ts.Close()
+	s := newLDAPTestServer(t, &tls.Config{Certificates: ts.TLS.Certificates, MinVersion: tls.VersionTLS12})
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+
+	c := newTestLDAPChecker(s)
+	c.URL = strings.Replace(c.URL, "ldap://", "ldaps://", 1)
+	c.AllowInsecure = false
+	c.TLSConfig = &tls.Config{RootCAs: roots, ServerName: "example.com", MinVersion: tls.VersionTLS12}
+	defer c.Close()
+	ok, u, err := c.Check(context.Background(), CredRequest{User: "jdoe", Password: "passwd"})
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "John Doe", u.Name)
+
+	c = newTestLDAPChecker(s)
+	c.URL = strings.Replace(c.URL, "ldap://", "ldaps://", 1)
+	_, _, err = c.Check(context.Background(), CredRequest{User: "jdoe", Password: "passwd"})
+	assert.ErrorIs(t, err, ErrCredStoreUnavailable, "untrusted certificate")
+}
+
+func TestLDAPCredChecker_LoginHandler(t *testing.T) {
+	s := newLDAPTestServer(t, nil)
+	c := newTestLDAPChecker(s)
+	defer c.Close()
+	d := DirectHandler{
+		ProviderName:   "ldap",
+		CredCheckerCtx: c,
+		FailedStatus:   http.StatusUnauthorized,
+		TokenService: token.NewService(token.Opts{
+			SecretReader:   token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+			TokenDuration:  time.Hour,
+			CookieDuration: time.Hour * 24 * 31,
+		}),
+		Issuer: "iss-test",
+		L:      logger.NoOp{},
+	}
+
+	rr := httptest.NewRecorder()
+	d.LoginHandler(rr, httptest.NewRequest("GET", "/login?user=jdoe&passwd=passwd", http.NoBody))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Contains(t, rr.Body.String(), `"name":"John Doe"`)
+	assert.NotContains(t, rr.Body.String(), "data:", "inline picture dropped without avatar saver")
+
+	rr = httptest.NewRecorder()
+	d.LoginHandler(rr, httptest.NewRequest("GET", "/login?user=jdoe&passwd=bad", http.NoBody))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Equal(t, `{"error":"incorrect user or password"}`+"\n", rr.Body.String())
+
+	_ = s.ln.Close()
+	c.Close()
+	rr = httptest.NewRecorder()
+	d.LoginHandler(rr, httptest.NewRequest("GET", "/login?user=jdoe&passwd=passwd", http.NoBody))
+	assert.Equal(t, http.StatusBadGateway, rr.Code)
+	assert.Equal(t, `{"error":"credentials store unavailable"}`+"\n", rr.Body.String())
+}
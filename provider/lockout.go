@@ -0,0 +1,225 @@
+package provider
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-pkgz/auth/logger"
+)
+
+// Lockout implements brute-force protection for password based providers.
+// It tracks consecutive failures per user name and per client IP independently, delays responses
+// progressively after DelayAfter failures and locks the user (or IP) for LockDuration after LockAfter failures.
+// Zero values replaced by defaults, nil Store replaced by in-memory store.
+type Lockout struct {
+	Store        LockoutStore  // failures counter store, default is in-memory
+	DelayAfter   int           // number of failures before responses delayed, default 3
+	Delay        time.Duration // initial delay, doubled on each following failure, default 500ms
+	MaxDelay     time.Duration // max delay, default 5s
+	LockAfter    int           // number of failures locking user or IP, default 10
+	LockDuration time.Duration // lock cooldown, counted from the last failure, default 15m
+
+	once sync.Once
+}
+
+// LockoutStore defines interface keeping failures counters with ttl
+type LockoutStore interface {
+	Incr(key string, ttl time.Duration) (count int, err error) // increment counter for key and set its ttl
+	Get(key string) (count int, ttl time.Duration, err error)  // get counter and remaining ttl for key
+	Reset(key string) error                                    // remove counter for key
+}
+
+const (
+	defaultLockoutDelayAfter   = 3
+	defaultLockoutDelay        = 500 * time.Millisecond
+	defaultLockoutMaxDelay     = 5 * time.Second
+	defaultLockoutLockAfter    = 10
+	defaultLockoutLockDuration = 15 * time.Minute
+)
+
+func (l *Lockout) init() {
+	l.once.Do(func() {
+		if l.Store == nil {
+			l.Store = NewMemLockoutStore()
+		}
+		if l.DelayAfter == 0 {
+			l.DelayAfter = defaultLockoutDelayAfter
+		}
+		if l.Delay == 0 {
+			l.Delay = defaultLockoutDelay
+		}
+		if l.MaxDelay == 0 {
+			l.MaxDelay = defaultLockoutMaxDelay
+		}
+		if l.LockAfter == 0 {
+			l.LockAfter = defaultLockoutLockAfter
+		}
+		if l.LockDuration == 0 {
+			l.LockDuration = defaultLockoutLockDuration
+		}
+	})
+}
+
+// locked checks if user or ip locked with provider and returns time left till unlock.
+// store errors are logged and ignored, i.e. lockout fails open.
+func (l *Lockout) locked(lg logger.L, provider, user, ip string) (retryAfter time.Duration, ok bool) {
+	l.init()
+	for _, key := range l.keys(provider, user, ip) {
+		count, ttl, err := l.Store.Get(key)
+		if err != nil {
+			lg.Warn("[WARN] can't get lockout counter for %s, %v", key, err)
+			continue
+		}
+		if count >= l.LockAfter && ttl > retryAfter {
+			retryAfter = ttl
+		}
+	}
+	return retryAfter, retryAfter > 0
+}
+
+// failed registers failed attempt for user and ip with provider, and delays response progressively.
+// returns true if this failure locked user or ip.
+func (l *Lockout) failed(ctx context.Context, lg logger.L, provider, user, ip string) (lockedNow bool) {
+	l.init()
+	maxCount := 0
+	for _, key := range l.keys(provider, user, ip) {
+		count, err := l.Store.Incr(key, l.LockDuration)
+		if err != nil {
+			lg.Warn("[WARN] can't increment lockout counter for %s, %v", key, err)
+			continue
+		}
+		if count == l.LockAfter {
+			lockedNow = true
+		}
+		if count > maxCount {
+			maxCount = count
+		}
+	}
+
+	if delay := l.delay(maxCount); delay > 0 {
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+	}
+	return lockedNow
+}
+
+// succeeded resets failures counter for user. IP counter is not reset, it expires by LockDuration, otherwise
+// attacker with valid credentials of some account could reset it between guesses on other accounts.
+func (l *Lockout) succeeded(lg logger.L, provider, user string) {
+	l.init()
+	key := l.keys(provider, user, "")[0]
+	if err := l.Store.Reset(key); err != nil {
+		lg.Warn("[WARN] can't reset lockout counter for %s, %v", key, err)
+	}
+}
+
+// delay returns progressive delay for given number of failures
+func (l *Lockout) delay(failures int) time.Duration {
+	if failures <= l.DelayAfter {
+		return 0
+	}
+	d := l.Delay
+	for i := l.DelayAfter + 1; i < failures && d < l.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > l.MaxDelay {
+		d = l.MaxDelay
+	}
+	return d
+}
+
+// keys returns counter keys of user and ip, prefixed with provider name, so providers sharing the store,
+// i.e. direct and LDAP ones, count failures separately
+func (l *Lockout) keys(provider, user, ip string) []string {
+	res := []string{provider + ":user:" + user}
+	if ip != "" {
+		res = append(res, provider+":ip:"+ip)
+	}
+	return res
+}
+
+// sendLocked responds with 429 and Retry-After. The response is the same for existing and non-existing users.
+func (l *Lockout) sendLocked(w http.ResponseWriter, retryAfter time.Duration) {
+	secs := int(retryAfter.Round(time.Second) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	renderJSONWithStatus(w, map[string]string{"error": "too many failed login attempts", "code": "login_locked"},
+		http.StatusTooManyRequests)
+}
+
+// MemLockoutStore implements LockoutStore with in-memory map. Expired counters removed on access.
+type MemLockoutStore struct {
+	lock        sync.Mutex
+	data        map[string]memLockoutRec
+	lastCleanup time.Time
+}
+
+type memLockoutRec struct {
+	count   int
+	expires time.Time
+}
+
+// NewMemLockoutStore makes in-memory lockout store
+func NewMemLockoutStore() *MemLockoutStore {
+	return &MemLockoutStore{data: map[string]memLockoutRec{}}
+}
+
+// Incr increments counter for key and sets its ttl
+func (m *MemLockoutStore) Incr(key string, ttl time.Duration) (int, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := time.Now()
+	m.cleanup(now)
+	rec := m.data[key]
+	if !now.Before(rec.expires) {
+		rec.count = 0 // expired, not cleaned up yet
+	}
+	rec.count++
+	rec.expires = now.Add(ttl)
+	m.data[key] = rec
+	return rec.count, nil
+}
+
+// Get returns counter and remaining ttl for key
+func (m *MemLockoutStore) Get(key string) (count int, ttl time.Duration, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	rec, ok := m.data[key]
+	if !ok {
+		return 0, 0, nil
+	}
+	now := time.Now()
+	if !now.Before(rec.expires) {
+		delete(m.data, key)
+		return 0, 0, nil
+	}
+	return rec.count, rec.expires.Sub(now), nil
+}
+
+// Reset removes counter for key
+func (m *MemLockoutStore) Reset(key string) error {
+	m.lock.Lock()
+	delete(m.data, key)
+	m.lock.Unlock()
+	return nil
+}
+
+// cleanup removes expired counters, not more often than once a minute
+func (m *MemLockoutStore) cleanup(now time.Time) {
+	if now.Sub(m.lastCleanup) < time.Minute {
+		return
+	}
+	m.lastCleanup = now
+	for k, rec := range m.data {
+		if !now.Before(rec.expires) {
+			delete(m.data, k)
+		}
+	}
+}
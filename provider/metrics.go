@@ -0,0 +1,80 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Metrics defines interface to record delivery metrics. Can be implemented with prometheus, expvar or anything else.
+type Metrics interface {
+	SendResult(channel string, err error, latency time.Duration) // called once per Send with its outcome
+}
+
+// MetricsFunc type is an adapter to allow the use of ordinary functions as Metrics.
+type MetricsFunc func(channel string, err error, latency time.Duration)
+
+// SendResult calls f(channel, err, latency)
+func (f MetricsFunc) SendResult(channel string, err error, latency time.Duration) {
+	f(channel, err, latency)
+}
+
+// ChannelNamer can be implemented by Sender to report channel name (i.e. "email", "slack") for metrics.
+// Senders without it reported by their type name.
+type ChannelNamer interface {
+	Channel() string
+}
+
+// instrumentedSender wraps Sender and reports each Send to Metrics
+type instrumentedSender struct {
+	inner   Sender
+	metrics Metrics
+	channel string
+}
+
+// InstrumentedSender wraps inner sender with timing and outcome reporting to m, regardless of the sender's type.
+func InstrumentedSender(inner Sender, m Metrics) Sender {
+	return &instrumentedSender{inner: inner, metrics: m, channel: senderChannel(inner)}
+}
+
+// Send passes address and text to the inner sender and reports the result
+func (s *instrumentedSender) Send(address, text string) error {
+	st := time.Now()
+	err := s.inner.Send(address, text)
+	if s.metrics != nil {
+		s.metrics.SendResult(s.channel, err, time.Since(st))
+	}
+	return err
+}
+
+// SendContext passes ctx to the inner sender if it is SenderWithContext and reports the result
+func (s *instrumentedSender) SendContext(ctx context.Context, address, text string) error {
+	st := time.Now()
+	err := sendContext(ctx, s.inner, address, text)
+	if s.metrics != nil {
+		s.metrics.SendResult(s.channel, err, time.Since(st))
+	}
+	return err
+}
+
+// Channel returns channel name of the inner sender
+func (s *instrumentedSender) Channel() string {
+	return s.channel
+}
+
+// Drain drains the inner sender if it is Drainer
+func (s *instrumentedSender) Drain(ctx context.Context) (int, error) {
+	if d, ok := s.inner.(Drainer); ok {
+		return d.Drain(ctx)
+	}
+	return 0, nil
+}
+
+// senderChannel returns channel name for sender
+func senderChannel(s Sender) string {
+	if cn, ok := s.(ChannelNamer); ok {
+		return cn.Channel()
+	}
+	return strings.TrimPrefix(fmt.Sprintf("%T", s), "*")
+}
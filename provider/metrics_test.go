@@ -0,0 +1,54 @@
+package provider
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstrumentedSender(t *testing.T) {
+	type rec struct {
+		channel string
+		err     error
+		latency time.Duration
+	}
+	var recs []rec
+	m := MetricsFunc(func(channel string, err error, latency time.Duration) {
+		recs = append(recs, rec{channel: channel, err: err, latency: latency})
+	})
+
+	inner := &mockSender{}
+	s := InstrumentedSender(inner, m)
+	assert.NoError(t, s.Send("blah@user.com", "text"))
+	assert.Equal(t, "blah@user.com", inner.to)
+
+	inner.err = errors.New("some err")
+	assert.EqualError(t, s.Send("blah@user.com", "text"), "some err")
+
+	slow := SenderFunc(func(address, text string) error {
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	})
+	assert.NoError(t, InstrumentedSender(slow, m).Send("addr", "text"))
+
+	assert.Equal(t, 3, len(recs))
+	assert.Equal(t, "provider.mockSender", recs[0].channel)
+	assert.NoError(t, recs[0].err)
+	assert.EqualError(t, recs[1].err, "some err")
+	assert.Equal(t, "provider.SenderFunc", recs[2].channel)
+	assert.True(t, recs[2].latency >= 10*time.Millisecond, recs[2].latency)
+
+	named := InstrumentedSender(namedSender{}, m)
+	assert.NoError(t, named.Send("addr", "text"))
+	assert.Equal(t, "slack", recs[3].channel)
+	assert.Equal(t, "slack", senderChannel(named), "wrapper keeps channel name")
+
+	assert.NoError(t, InstrumentedSender(namedSender{}, nil).Send("addr", "text"), "nil metrics ignored")
+}
+
+type namedSender struct{}
+
+func (namedSender) Send(string, string) error { return nil }
+func (namedSender) Channel() string           { return "slack" }
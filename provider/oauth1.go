@@ -58,7 +58,7 @@ func (h Oauth1Handler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 		StandardClaims: jwt.StandardClaims{
 			Id:        cid,
 			Audience:  r.URL.Query().Get("site"),
-			ExpiresAt: time.Now().Add(30 * time.Minute).Unix(),
+			ExpiresAt: h.stateExpiresAt(),
 			NotBefore: time.Now().Add(-1 * time.Minute).Unix(),
 		},
 	}
@@ -85,6 +85,9 @@ func (h Oauth1Handler) AuthHandler(w http.ResponseWriter, r *http.Request) {
 		rest.SendErrorJSON(w, r, h.L, http.StatusInternalServerError, err, "failed to get token")
 		return
 	}
+	if h.stateExpired(w, oauthClaims) {
+		return
+	}
 
 	requestToken, verifier, err := oauth1.ParseAuthorizationCallback(r)
 	if err != nil {
@@ -127,16 +130,18 @@ func (h Oauth1Handler) AuthHandler(w http.ResponseWriter, r *http.Request) {
 	h.Debug("[DEBUG] got raw user info %+v", jData)
 
 	u := h.mapUser(jData, data)
-	u, err = setAvatar(h.AvatarSaver, u, &http.Client{Timeout: 5 * time.Second})
-	if err != nil {
-		rest.SendErrorJSON(w, r, h.L, http.StatusInternalServerError, err, "failed to save avatar to proxy")
-		return
+	if !h.AvatarFetch.Skip {
+		u, err = h.PictureUpdate.setAvatar(h.L, h.AvatarSaver, u, h.AvatarFetch.client(nil))
+		if err != nil {
+			rest.SendErrorJSON(w, r, h.L, http.StatusInternalServerError, err, "failed to save avatar to proxy")
+			return
+		}
 	}
 
 	if h.UserSaver != nil {
 		err = h.UserSaver(u)
 		if err != nil {
-			rest.SendErrorJSON(w, r, h.L, http.StatusInternalServerError, err, "failed to save user")
+			sendSaveUserError(w, r, h.L, err)
 			return
 		}
 	}
@@ -149,11 +154,12 @@ func (h Oauth1Handler) AuthHandler(w http.ResponseWriter, r *http.Request) {
 	claims := token.Claims{
 		User: &u,
 		StandardClaims: jwt.StandardClaims{
-			Issuer:   h.Issuer,
+			Issuer:   h.IssuerFunc.get(r, h.Issuer),
 			Id:       cid,
 			Audience: oauthClaims.Audience,
 		},
 		SessionOnly: oauthClaims.SessionOnly,
+		Provider:    h.name,
 	}
 
 	if _, err = h.JwtService.Set(w, claims); err != nil {
@@ -165,7 +171,7 @@ func (h Oauth1Handler) AuthHandler(w http.ResponseWriter, r *http.Request) {
 
 	// redirect to back url if presented in login query params
 	if oauthClaims.Handshake != nil && oauthClaims.Handshake.From != "" {
-		http.Redirect(w, r, oauthClaims.Handshake.From, http.StatusTemporaryRedirect)
+		redirectBack(w, r, oauthClaims.Handshake.From, h.RedirectStatus)
 		return
 	}
 	rest.RenderJSON(w, &u)
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
@@ -29,21 +30,39 @@ type Oauth2Handler struct {
 	mapUser         func(UserData, []byte) token.User // map info from InfoURL to User
 	bearerTokenHook BearerTokenHook                   // a way to get a Bearer token received from oauth2-provider
 	conf            oauth2.Config
+	httpClient      *http.Client // client of token exchange and user info requests, default one if nil
 }
 
 // Params to make initialized and ready to use provider
 type Params struct {
 	logger.L
-	URL         string
-	JwtService  TokenService
-	Cid         string
-	Csecret     string
-	Issuer      string
-	UserSaver   func(token.User) error
-	AvatarSaver AvatarSaver
+	URL              string
+	JwtService       TokenService
+	Cid              string
+	Csecret          string
+	Issuer           string
+	IssuerFunc       IssuerFunc // optional issuer of tokens by request, i.e. by brand, Issuer used if not set or empty
+	UserSaver        func(token.User) error
+	AvatarSaver      AvatarSaver
+	AvatarFetch      AvatarFetch     // client and policy of avatar downloads
+	PictureUpdate    PictureUpdate   // update of existing user's picture on login, saved on every login by default
+	OAuthRetry       OAuthRetry      // retries of token exchange and user info requests, disabled by default
+	StateTTL         time.Duration   // validity of login state, time to complete login on provider's side, default 30m
+	FormPost         bool            // ask provider to post callback data as form (response_mode=form_post), oauth2 only
+	FirstLoginStore  FirstLoginStore // keeps fields sent by provider only on first login, to fill them on next logins
+	FirstLoginFields []string        // fields sent only on first login, "name", "email", "picture" or attribute
+	RedirectStatus   int             // status of redirect to back url after login, default 307, 303 for posted callback
+	MaxPendingLogins int             // login flows in progress kept per browser, i.e. in several tabs, oauth2 only, latest one if < 2
+	MaxBodySize      int64           // max size of posted callback form, default MaxHTTPBodySize
+
+	// Transport of token exchange, user info and other requests to provider, i.e. with egress proxy,
+	// default one if nil. Avatar downloads use AvatarFetch.
+	Transport http.RoundTripper
 
 	Port int    // relevant for providers supporting port customization, for example dev oauth2
 	Host string // relevant for providers supporting host customization, for example dev oauth2
+
+	DevTLS DevTLS // relevant for dev oauth2 only, serve it over https
 }
 
 // UserData is type for user information returned from oauth2 providers /info API method
@@ -58,6 +77,46 @@ func (u UserData) Value(key string) string {
 	return ""
 }
 
+// FormUserKey is the key of user data with extra user json posted to form_post callback, i.e. by apple
+const FormUserKey = "form_user"
+
+// StateExpired is the code of 403 response to oauth callback with login state older than StateTTL
+const StateExpired = "state_expired"
+
+const defaultStateTTL = 30 * time.Minute
+
+// stateExpiresAt returns expiration of login state started now
+func (p Params) stateExpiresAt() int64 {
+	ttl := p.StateTTL
+	if ttl <= 0 {
+		ttl = defaultStateTTL
+	}
+	return time.Now().Add(ttl).Unix()
+}
+
+// stateExpired responds with 403 and StateExpired code if login state is expired, suggesting to start login again
+func (p Params) stateExpired(w http.ResponseWriter, claims token.Claims) bool {
+	if claims.ExpiresAt == 0 || time.Now().Unix() <= claims.ExpiresAt {
+		return false
+	}
+	p.Logf("[DEBUG] login state expired at %s", time.Unix(claims.ExpiresAt, 0).Format(time.RFC3339))
+	renderJSONWithStatus(w, rest.JSON{"error": "login session expired, please start login again", "code": StateExpired},
+		http.StatusForbidden)
+	return true
+}
+
+// redirectBack redirects to back url after login with given status, default used if it is not 3xx.
+// Default is 307, and 303 for posted requests, not to repost form with code or password to back url.
+func redirectBack(w http.ResponseWriter, r *http.Request, from string, status int) {
+	if status < 300 || status > 399 {
+		status = http.StatusTemporaryRedirect
+		if r.Method == http.MethodPost {
+			status = http.StatusSeeOther
+		}
+	}
+	http.Redirect(w, r, from, status)
+}
+
 // BearerTokenHook accepts provider name, user and token, received during oauth2 authentication
 type BearerTokenHook func(provider string, user token.User, token oauth2.Token)
 
@@ -68,6 +127,9 @@ func initOauth2Handler(p Params, service Oauth2Handler) Oauth2Handler {
 	}
 	p.Logf("[INFO] init oauth2 service %s", service.name)
 	service.Params = p
+	if service.httpClient == nil && p.Transport != nil {
+		service.httpClient = &http.Client{Transport: p.Transport}
+	}
 	service.conf = oauth2.Config{
 		ClientID:     service.Cid,
 		ClientSecret: service.Csecret,
@@ -99,6 +161,7 @@ func (p Oauth2Handler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	warnDeprecated(w, r, oauth2DeprecatedParams)
 	aud := r.URL.Query().Get("site") // legacy, for back compat
 	if aud == "" {
 		aud = r.URL.Query().Get("aud")
@@ -113,7 +176,7 @@ func (p Oauth2Handler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 		StandardClaims: jwt.StandardClaims{
 			Id:        cid,
 			Audience:  aud,
-			ExpiresAt: time.Now().Add(30 * time.Minute).Unix(),
+			ExpiresAt: p.stateExpiresAt(),
 			NotBefore: time.Now().Add(-1 * time.Minute).Unix(),
 		},
 		NoAva: r.URL.Query().Get("noava") == "1",
@@ -123,34 +186,54 @@ func (p Oauth2Handler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to set token")
 		return
 	}
+	p.addPendingLogin(w, r, claims)
 
 	// setting RedirectURL to rootURL/routingPath/provider/callback
 	// e.g. http://localhost:8080/auth/github/callback
 	p.conf.RedirectURL = p.makeRedirURL(r.URL.Path)
 
 	// return login url
-	loginURL := p.conf.AuthCodeURL(state)
+	var opts []oauth2.AuthCodeOption
+	if p.FormPost {
+		opts = append(opts, oauth2.SetAuthURLParam("response_mode", "form_post"))
+	}
+	loginURL := p.conf.AuthCodeURL(state, opts...)
 	p.Debug("[DEBUG] login url %s, claims=%+v", loginURL, claims)
 
 	http.Redirect(w, r, loginURL, http.StatusFound)
 }
 
 // AuthHandler fills user info and redirects to "from" url. This is callback url redirected locally by browser
-// GET /callback
+// GET /callback, or POST /callback with form data for FormPost provider
 func (p Oauth2Handler) AuthHandler(w http.ResponseWriter, r *http.Request) {
-	oauthClaims, _, err := p.JwtService.Get(r)
+	cb, err := p.callbackValues(w, r)
 	if err != nil {
-		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to get token")
+		sendParseError(w, r, p.L, err, "failed to parse callback form")
 		return
 	}
 
+	// login started in another tab of the browser completed with the state of pending flow, not the latest one
+	oauthClaims, pending := p.takePendingLogin(w, r, cb.Get("state"))
+	if !pending {
+		if oauthClaims, _, err = p.JwtService.Get(r); err != nil {
+			if r.Method == http.MethodPost {
+				p.Warn("[WARN] no login state on %s form_post callback, cross-site POST needs SameSite=None cookie", p.Name())
+			}
+			rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to get token")
+			return
+		}
+	}
+
 	if oauthClaims.Handshake == nil {
 		rest.SendErrorJSON(w, r, p.L, http.StatusForbidden, nil, "invalid handshake token")
 		return
 	}
+	if p.stateExpired(w, oauthClaims) {
+		return
+	}
 
 	retrievedState := oauthClaims.Handshake.State
-	if retrievedState == "" || retrievedState != r.URL.Query().Get("state") {
+	if retrievedState == "" || retrievedState != cb.Get("state") {
 		rest.SendErrorJSON(w, r, p.L, http.StatusForbidden, nil, "unexpected state")
 		return
 	}
@@ -158,14 +241,37 @@ func (p Oauth2Handler) AuthHandler(w http.ResponseWriter, r *http.Request) {
 	p.conf.RedirectURL = p.makeRedirURL(r.URL.Path)
 
 	p.Debug("[DEBUG] token with state %s", retrievedState)
-	tok, err := p.conf.Exchange(context.Background(), r.URL.Query().Get("code"))
+	ctx, cancel := p.OAuthRetry.context(context.Background())
+	defer cancel()
+	if p.httpClient != nil {
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, p.httpClient)
+	}
+	var tok *oauth2.Token
+	err = p.OAuthRetry.do(ctx, p.L, p.Name(), "exchange", func() (e error) {
+		tok, e = p.conf.Exchange(ctx, cb.Get("code"))
+		return e
+	})
 	if err != nil {
 		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "exchange failed")
 		return
 	}
 
-	client := p.conf.Client(context.Background(), tok)
-	uinfo, err := client.Get(p.infoURL)
+	client := p.conf.Client(ctx, tok)
+	var uinfo *http.Response
+	err = p.OAuthRetry.do(ctx, p.L, p.Name(), "user info", func() (e error) {
+		req, e := http.NewRequestWithContext(ctx, "GET", p.infoURL, http.NoBody)
+		if e != nil {
+			return e
+		}
+		if uinfo, e = client.Do(req); e != nil {
+			return e
+		}
+		if uinfo.StatusCode >= 500 {
+			_ = uinfo.Body.Close()
+			return errStatus5xx{status: uinfo.Status}
+		}
+		return nil
+	})
 	if err != nil {
 		rest.SendErrorJSON(w, r, p.L, http.StatusServiceUnavailable, err, "failed to get client info")
 		return
@@ -189,21 +295,32 @@ func (p Oauth2Handler) AuthHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	p.Debug("[DEBUG] got raw user info %+v", jData)
+	if fu := cb.Get("user"); fu != "" {
+		// extra user json posted by some providers, i.e. name of apple user, not verified by provider's signature
+		formUser := map[string]interface{}{}
+		if e := json.Unmarshal([]byte(fu), &formUser); e == nil {
+			jData[FormUserKey] = formUser
+		}
+	}
 
 	u := p.mapUser(jData, data)
+	p.firstLogin(&u, p.FirstLoginFields)
 	if oauthClaims.NoAva {
 		u.Picture = "" // reset picture on no avatar request
 	}
-	u, err = setAvatar(p.AvatarSaver, u, client)
-	if err != nil {
-		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to save avatar to proxy")
-		return
+	if !p.AvatarFetch.Skip {
+		avaClient := p.AvatarFetch.client(p.conf.Client(p.AvatarFetch.oauth2Context(context.Background()), tok))
+		u, err = p.PictureUpdate.setAvatar(p.L, p.AvatarSaver, u, avaClient)
+		if err != nil {
+			rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to save avatar to proxy")
+			return
+		}
 	}
 
 	if p.UserSaver != nil {
 		err = p.UserSaver(u)
 		if err != nil {
-			rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to save user")
+			sendSaveUserError(w, r, p.L, err)
 			return
 		}
 	}
@@ -216,12 +333,13 @@ func (p Oauth2Handler) AuthHandler(w http.ResponseWriter, r *http.Request) {
 	claims := token.Claims{
 		User: &u,
 		StandardClaims: jwt.StandardClaims{
-			Issuer:   p.Issuer,
+			Issuer:   p.IssuerFunc.get(r, p.Issuer),
 			Id:       cid,
 			Audience: oauthClaims.Audience,
 		},
 		SessionOnly: oauthClaims.SessionOnly,
 		NoAva:       oauthClaims.NoAva,
+		Provider:    p.name,
 	}
 
 	if _, err = p.JwtService.Set(w, claims); err != nil {
@@ -238,12 +356,24 @@ func (p Oauth2Handler) AuthHandler(w http.ResponseWriter, r *http.Request) {
 
 	// redirect to back url if presented in login query params
 	if oauthClaims.Handshake != nil && oauthClaims.Handshake.From != "" {
-		http.Redirect(w, r, oauthClaims.Handshake.From, http.StatusTemporaryRedirect)
+		redirectBack(w, r, oauthClaims.Handshake.From, p.RedirectStatus)
 		return
 	}
 	rest.RenderJSON(w, &u)
 }
 
+// callbackValues returns callback params, from posted form for FormPost provider, from query otherwise
+func (p Oauth2Handler) callbackValues(w http.ResponseWriter, r *http.Request) (url.Values, error) {
+	if !p.FormPost || r.Method != http.MethodPost {
+		return r.URL.Query(), nil
+	}
+	limitBody(w, r, p.MaxBodySize)
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	return r.PostForm, nil
+}
+
 // LogoutHandler - GET /logout
 func (p Oauth2Handler) LogoutHandler(w http.ResponseWriter, r *http.Request) {
 	if _, _, err := p.JwtService.Get(r); err != nil {
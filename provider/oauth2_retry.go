@@ -0,0 +1,91 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/url"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/go-pkgz/auth/logger"
+)
+
+const (
+	defaultOAuthRetryDelay   = 200 * time.Millisecond
+	defaultOAuthRetryMaxTime = 10 * time.Second
+)
+
+// OAuthRetry defines retries of token exchange and user info requests of oauth2 providers failed with 5xx or
+// connection errors, 4xx responses never retried. Zero value makes a single attempt.
+type OAuthRetry struct {
+	Attempts int                                  // max attempts including the first one, retries disabled if < 2
+	Delay    time.Duration                        // delay before the first retry, doubled for each next one with jitter, default 200ms
+	MaxTime  time.Duration                        // cap of total time of attempts and delays, default 10s
+	OnRetry  func(provider, op string, err error) // called on each retry, i.e. to count retries in metrics
+}
+
+// context returns context capping total time of attempts, ctx as-is with retries disabled
+func (o OAuthRetry) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if o.Attempts < 2 {
+		return ctx, func() {}
+	}
+	maxTime := o.MaxTime
+	if maxTime == 0 {
+		maxTime = defaultOAuthRetryMaxTime
+	}
+	return context.WithTimeout(ctx, maxTime)
+}
+
+// do calls fn until it succeeds, fails with not transient error or attempts exhausted.
+// Retries stop if the next delay doesn't fit into ctx deadline.
+func (o OAuthRetry) do(ctx context.Context, l logger.L, provider, op string, fn func() error) error {
+	delay := o.Delay
+	if delay == 0 {
+		delay = defaultOAuthRetryDelay
+	}
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= o.Attempts || !transientErr(err) {
+			return err
+		}
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay))) //nolint gosec // jitter doesn't need crypto rand
+		if dl, ok := ctx.Deadline(); ok && time.Until(dl) < wait {
+			return err
+		}
+		l.Logf("[DEBUG] %s %s failed, retry %d in %v, %v", provider, op, attempt, wait, err)
+		if o.OnRetry != nil {
+			o.OnRetry(provider, op, err)
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		delay *= 2
+	}
+}
+
+// errStatus5xx reported for 5xx responses to user info and token requests
+type errStatus5xx struct {
+	status string
+}
+
+func (e errStatus5xx) Error() string {
+	return "server error, " + e.status
+}
+
+// transientErr checks err is connection error or 5xx response worth retry, not cancellation of the request
+func transientErr(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var rerr *oauth2.RetrieveError
+	if errors.As(err, &rerr) {
+		return rerr.Response != nil && rerr.Response.StatusCode >= 500
+	}
+	var serr errStatus5xx
+	var uerr *url.Error
+	return errors.As(err, &serr) || errors.As(err, &uerr)
+}
@@ -0,0 +1,191 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+
+	"github.com/go-pkgz/auth/logger"
+	"github.com/go-pkgz/auth/token"
+)
+
+// flakyOauthServer fails requests to token and user endpoints with configured responses before succeeding
+type flakyOauthServer struct {
+	*httptest.Server
+	tokenCalls, userCalls int32
+	tokenFails, userFails int32 // number of failed responses before success
+	failStatus            int   // status of failed responses, 0 drops the connection
+}
+
+func newFlakyOauthServer(t *testing.T) *flakyOauthServer {
+	s := &flakyOauthServer{failStatus: http.StatusServiceUnavailable}
+	fail := func(w http.ResponseWriter) {
+		if s.failStatus == 0 {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			require.NoError(t, err)
+			_ = conn.Close()
+			return
+		}
+		w.WriteHeader(s.failStatus)
+		_, _ = w.Write([]byte(`{"error":"failed"}`))
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/token":
+			if atomic.AddInt32(&s.tokenCalls, 1) <= atomic.LoadInt32(&s.tokenFails) {
+				fail(w)
+				return
+			}
+			_, _ = w.Write([]byte(`{"access_token":"MTQ0NjJkZmQ5","token_type":"bearer","expires_in":3600}`))
+		case "/user":
+			if atomic.AddInt32(&s.userCalls, 1) <= atomic.LoadInt32(&s.userFails) {
+				fail(w)
+				return
+			}
+			_, _ = w.Write([]byte(`{"id":"myuser","name":"blah"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *flakyOauthServer) reset(tokenFails, userFails int32, status int) {
+	atomic.StoreInt32(&s.tokenCalls, 0)
+	atomic.StoreInt32(&s.userCalls, 0)
+	atomic.StoreInt32(&s.tokenFails, tokenFails)
+	atomic.StoreInt32(&s.userFails, userFails)
+	s.failStatus = status
+}
+
+func TestOauth2Retry(t *testing.T) {
+	srv := newFlakyOauthServer(t)
+	var retries []string
+	var mu sync.Mutex
+	retry := OAuthRetry{Attempts: 3, Delay: time.Millisecond, OnRetry: func(provider, op string, err error) {
+		mu.Lock()
+		retries = append(retries, provider+":"+op)
+		mu.Unlock()
+	}}
+
+	p := initOauth2Handler(Params{URL: "http://example.com", Cid: "cid", Csecret: "csecret", L: logger.NoOp{},
+		JwtService: token.NewService(token.Opts{SecretReader: token.SecretFunc(mockKeyStore), TokenDuration: time.Hour,
+			CookieDuration: days31}),
+		OAuthRetry: retry},
+		Oauth2Handler{
+			name:     "mock",
+			endpoint: oauth2.Endpoint{AuthURL: srv.URL + "/auth", TokenURL: srv.URL + "/token"},
+			infoURL:  srv.URL + "/user",
+			mapUser: func(data UserData, _ []byte) token.User {
+				return token.User{ID: "mock_" + data.Value("id"), Name: data.Value("name")}
+			},
+		})
+
+	auth := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		p.LoginHandler(rr, httptest.NewRequest("GET", "/login?site=remark", http.NoBody))
+		require.Equal(t, http.StatusFound, rr.Code, rr.Body.String())
+		loc, err := url.Parse(rr.Header().Get("Location"))
+		require.NoError(t, err)
+		req := httptest.NewRequest("GET", "/callback?code=abc&state="+loc.Query().Get("state"), http.NoBody)
+		for _, c := range rr.Result().Cookies() {
+			req.AddCookie(c)
+		}
+		rr = httptest.NewRecorder()
+		p.AuthHandler(rr, req)
+		return rr
+	}
+
+	tbl := []struct {
+		name                  string
+		tokenFails, userFails int32
+		status                int
+		code                  int
+		tokenCalls, userCalls int32
+	}{
+		{"no failures", 0, 0, 503, http.StatusOK, 1, 1},
+		{"exchange 503 retried", 2, 0, 503, http.StatusOK, 3, 1},
+		{"user info 502 retried", 0, 1, 502, http.StatusOK, 1, 2},
+		{"connection reset retried", 1, 1, 0, http.StatusOK, 2, 2},
+		{"attempts exhausted", 3, 0, 503, http.StatusInternalServerError, 3, 0},
+		{"user info attempts exhausted", 0, 5, 503, http.StatusServiceUnavailable, 1, 3},
+		{"no retry on 400", 1, 0, 400, http.StatusInternalServerError, 1, 0},
+		{"no retry of user info 401", 0, 1, 401, 0, 1, 1}, // response code not checked, 4xx user info parsed as before
+	}
+	for _, tt := range tbl {
+		srv.reset(tt.tokenFails, tt.userFails, tt.status)
+		rr := auth()
+		if tt.code != 0 {
+			assert.Equal(t, tt.code, rr.Code, tt.name+": "+rr.Body.String())
+		}
+		assert.Equal(t, tt.tokenCalls, atomic.LoadInt32(&srv.tokenCalls), tt.name)
+		assert.Equal(t, tt.userCalls, atomic.LoadInt32(&srv.userCalls), tt.name)
+	}
+
+	// retries reported
+	mu.Lock()
+	retries = nil
+	mu.Unlock()
+	srv.reset(2, 1, 503)
+	rr := auth()
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"mock:exchange", "mock:exchange", "mock:user info"}, retries)
+}
+
+func TestOAuthRetry_do(t *testing.T) {
+	failing := func(calls *int) func() error {
+		return func() error {
+			*calls++
+			return &url.Error{Op: "Get", URL: "http://example.com", Err: errors.New("connection reset by peer")}
+		}
+	}
+
+	// disabled by default
+	calls := 0
+	assert.Error(t, OAuthRetry{}.do(context.Background(), logger.NoOp{}, "p", "op", failing(&calls)))
+	assert.Equal(t, 1, calls)
+
+	// total time capped, retries stop when delay doesn't fit
+	o := OAuthRetry{Attempts: 10, Delay: 40 * time.Millisecond, MaxTime: 100 * time.Millisecond}
+	ctx, cancel := o.context(context.Background())
+	defer cancel()
+	calls = 0
+	st := time.Now()
+	assert.Error(t, o.do(ctx, logger.NoOp{}, "p", "op", failing(&calls)))
+	assert.Less(t, time.Since(st), 100*time.Millisecond)
+	assert.Less(t, calls, 4)
+
+	// not transient error not retried
+	calls = 0
+	err := OAuthRetry{Attempts: 3}.do(context.Background(), logger.NoOp{}, "p", "op", func() error {
+		calls++
+		return fmt.Errorf("bad response")
+	})
+	assert.EqualError(t, err, "bad response")
+	assert.Equal(t, 1, calls)
+}
+
+func TestTransientErr(t *testing.T) {
+	resp := func(code int) *http.Response { return &http.Response{StatusCode: code} }
+	assert.True(t, transientErr(&oauth2.RetrieveError{Response: resp(502)}))
+	assert.False(t, transientErr(&oauth2.RetrieveError{Response: resp(400)}))
+	assert.True(t, transientErr(errStatus5xx{status: "503 Service Unavailable"}))
+	assert.True(t, transientErr(&url.Error{Op: "Post", Err: errors.New("EOF")}))
+	assert.False(t, transientErr(&url.Error{Op: "Post", Err: context.DeadlineExceeded}))
+	assert.False(t, transientErr(errors.New("some error")))
+}
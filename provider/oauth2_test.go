@@ -7,6 +7,8 @@ import (
 	"log"
 	"net/http"
 	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 	"time"
@@ -74,6 +76,7 @@ func TestOauth2Login(t *testing.T) {
 	t.Log(claims)
 	assert.Equal(t, "remark42", claims.Issuer)
 	assert.Equal(t, "remark", claims.Audience)
+	assert.Equal(t, "mock", claims.Provider)
 
 	// check admin user
 	resp, err = client.Get("http://localhost:8981/login?site=remark")
@@ -225,6 +228,13 @@ func TestOauth2InitProvider(t *testing.T) {
 	assert.Equal(t, "csecret", res.conf.ClientSecret)
 	assert.Equal(t, "test", res.name)
 	assert.Equal(t, "app-test", res.Issuer)
+	assert.Nil(t, res.httpClient, "default client")
+
+	tr := &countingRoundTripper{}
+	params.Transport = tr
+	res = initOauth2Handler(params, provider)
+	require.NotNil(t, res.httpClient)
+	assert.Same(t, tr, res.httpClient.Transport)
 }
 
 func TestOauth2InvalidHandler(t *testing.T) {
@@ -369,3 +379,250 @@ func (m *mockAvatarSaver) Put(u token.User, _ *http.Client) (avatarURL string, e
 	return "http://example.com/fake.png", nil
 
 }
+
+func TestOauth2UserRejected(t *testing.T) {
+	oauthSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/token":
+			_, _ = w.Write([]byte(`{"access_token":"MTQ0NjJkZmQ5","token_type":"bearer","expires_in":3600}`))
+		case "/user":
+			_, _ = w.Write([]byte(`{"id":"myuser","name":"blah"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer oauthSrv.Close()
+
+	var saverErr error
+	tokenService := token.NewService(token.Opts{SecretReader: token.SecretFunc(mockKeyStore), TokenDuration: time.Hour,
+		CookieDuration: days31})
+	p := initOauth2Handler(Params{URL: "http://example.com", Cid: "cid", Csecret: "csecret", JwtService: tokenService,
+		L: logger.NoOp{}, UserSaver: func(token.User) error { return saverErr }},
+		Oauth2Handler{
+			name:     "mock",
+			endpoint: oauth2.Endpoint{AuthURL: oauthSrv.URL + "/auth", TokenURL: oauthSrv.URL + "/token"},
+			infoURL:  oauthSrv.URL + "/user",
+			mapUser: func(data UserData, _ []byte) token.User {
+				return token.User{ID: "mock_" + data.Value("id"), Name: data.Value("name")}
+			},
+		})
+
+	auth := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		p.LoginHandler(rr, httptest.NewRequest("GET", "/login?site=remark", http.NoBody))
+		require.Equal(t, http.StatusFound, rr.Code, rr.Body.String())
+		loc, err := url.Parse(rr.Header().Get("Location"))
+		require.NoError(t, err)
+		req := httptest.NewRequest("GET", "/callback?code=abc&state="+loc.Query().Get("state"), http.NoBody)
+		for _, c := range rr.Result().Cookies() {
+			req.AddCookie(c)
+		}
+		rr = httptest.NewRecorder()
+		p.AuthHandler(rr, req)
+		return rr
+	}
+
+	saverErr = &ErrUserRejected{Msg: "signups disabled"}
+	rr := auth()
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Equal(t, `{"error":"signups disabled"}`+"\n", rr.Body.String())
+
+	saverErr = fmt.Errorf("db connection refused")
+	rr = auth()
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	assert.Equal(t, `{"error":"failed to save user"}`+"\n", rr.Body.String())
+}
+
+func TestOauth2StateTTL(t *testing.T) {
+	srv := newFlakyOauthServer(t)
+	tokenService := token.NewService(token.Opts{SecretReader: token.SecretFunc(mockKeyStore), TokenDuration: time.Hour,
+		CookieDuration: days31})
+	p := initOauth2Handler(Params{URL: "http://example.com", Cid: "cid", Csecret: "csecret", L: logger.NoOp{},
+		JwtService: tokenService, StateTTL: 10 * time.Minute},
+		Oauth2Handler{
+			name:     "mock",
+			endpoint: oauth2.Endpoint{AuthURL: srv.URL + "/auth", TokenURL: srv.URL + "/token"},
+			infoURL:  srv.URL + "/user",
+			mapUser: func(data UserData, _ []byte) token.User {
+				return token.User{ID: "mock_" + data.Value("id"), Name: data.Value("name")}
+			},
+		})
+
+	// callback checks login started ago, with state token re-signed as if issued then
+	callback := func(ago time.Duration) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		p.LoginHandler(rr, httptest.NewRequest("GET", "/login?site=remark", http.NoBody))
+		require.Equal(t, http.StatusFound, rr.Code, rr.Body.String())
+		claims, err := tokenService.Parse(rr.Result().Cookies()[0].Value)
+		require.NoError(t, err)
+		assert.InDelta(t, time.Now().Add(10*time.Minute).Unix(), claims.ExpiresAt, 1, "configured ttl")
+
+		claims.ExpiresAt -= int64(ago.Seconds())
+		claims.NotBefore -= int64(ago.Seconds())
+		tkn, err := tokenService.Token(claims)
+		require.NoError(t, err)
+		req := httptest.NewRequest("GET", "/callback?code=abc&state="+claims.Handshake.State, http.NoBody)
+		req.AddCookie(&http.Cookie{Name: "JWT", Value: tkn})
+		rr = httptest.NewRecorder()
+		p.AuthHandler(rr, req)
+		return rr
+	}
+
+	rr := callback(10*time.Minute - 2*time.Second)
+	assert.Equal(t, http.StatusOK, rr.Code, "just inside, %s", rr.Body.String())
+
+	rr = callback(10*time.Minute + 2*time.Second)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Equal(t, `{"code":"state_expired","error":"login session expired, please start login again"}`+"\n",
+		rr.Body.String())
+
+	// default ttl
+	p.StateTTL = 0
+	rr = httptest.NewRecorder()
+	p.LoginHandler(rr, httptest.NewRequest("GET", "/login?site=remark", http.NoBody))
+	claims, err := tokenService.Parse(rr.Result().Cookies()[0].Value)
+	require.NoError(t, err)
+	assert.InDelta(t, time.Now().Add(30*time.Minute).Unix(), claims.ExpiresAt, 1)
+}
+
+func TestOauth2FormPost(t *testing.T) {
+	srv := newFlakyOauthServer(t)
+	var formUser interface{}
+	p := initOauth2Handler(Params{URL: "http://example.com", Cid: "cid", Csecret: "csecret", L: logger.NoOp{},
+		JwtService: token.NewService(token.Opts{SecretReader: token.SecretFunc(mockKeyStore), TokenDuration: time.Hour,
+			CookieDuration: days31}),
+		FormPost: true},
+		Oauth2Handler{
+			name:     "mock",
+			endpoint: oauth2.Endpoint{AuthURL: srv.URL + "/auth", TokenURL: srv.URL + "/token"},
+			infoURL:  srv.URL + "/user",
+			mapUser: func(data UserData, _ []byte) token.User {
+				formUser = data[FormUserKey]
+				return token.User{ID: "mock_" + data.Value("id"), Name: data.Value("name")}
+			},
+		})
+
+	// login returns state, cookies of the login session and response_mode in authorize url
+	login := func(query string) (string, []*http.Cookie) {
+		rr := httptest.NewRecorder()
+		p.LoginHandler(rr, httptest.NewRequest("GET", "/login?site=remark"+query, http.NoBody))
+		require.Equal(t, http.StatusFound, rr.Code, rr.Body.String())
+		loc, err := url.Parse(rr.Header().Get("Location"))
+		require.NoError(t, err)
+		assert.Equal(t, p.FormPost, loc.Query().Get("response_mode") == "form_post")
+		return loc.Query().Get("state"), rr.Result().Cookies()
+	}
+	callback := func(method, target string, form url.Values, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rr := httptest.NewRecorder()
+		p.AuthHandler(rr, req)
+		return rr
+	}
+
+	state, cookies := login("")
+	rr := callback("POST", "/callback", url.Values{"code": {"abc"}, "state": {state},
+		"user": {`{"name":{"firstName":"John","lastName":"Doe"},"email":"john@example.com"}`}}, cookies)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	u := token.User{}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &u))
+	assert.Equal(t, "mock_myuser", u.ID)
+	assert.Equal(t, map[string]interface{}{"email": "john@example.com",
+		"name": map[string]interface{}{"firstName": "John", "lastName": "Doe"}}, formUser)
+
+	// back url redirected with GET
+	state, cookies = login("&from=http://example.com/page")
+	rr = callback("POST", "/callback", url.Values{"code": {"abc"}, "state": {state}}, cookies)
+	assert.Equal(t, http.StatusSeeOther, rr.Code, rr.Body.String())
+	assert.Equal(t, "http://example.com/page", rr.Header().Get("Location"))
+
+	// configured redirect status
+	p.RedirectStatus = http.StatusFound
+	state, cookies = login("&from=http://example.com/page")
+	rr = callback("GET", "/callback?code=abc&state="+state, nil, cookies)
+	assert.Equal(t, http.StatusFound, rr.Code, rr.Body.String())
+	p.RedirectStatus = 0
+
+	// query callback still accepted
+	state, cookies = login("")
+	rr = callback("GET", "/callback?code=abc&state="+state, nil, cookies)
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	// forged cross-site form with attacker's code and state, posted from victim's browser with victim's login session
+	_, victimCookies := login("")
+	attackerState, _ := login("")
+	srv.reset(0, 0, 503)
+	rr = callback("POST", "/callback", url.Values{"code": {"attacker-code"}, "state": {attackerState}}, victimCookies)
+	assert.Equal(t, http.StatusForbidden, rr.Code, rr.Body.String())
+	assert.Equal(t, int32(0), srv.tokenCalls, "code not exchanged")
+
+	// forged form without login session, i.e. SameSite cookie not sent
+	rr = callback("POST", "/callback", url.Values{"code": {"attacker-code"}, "state": {attackerState}}, nil)
+	assert.Equal(t, http.StatusInternalServerError, rr.Code, rr.Body.String())
+
+	// state of posted callback taken from the form only
+	state, cookies = login("")
+	rr = callback("POST", "/callback?state="+state, url.Values{"code": {"abc"}}, cookies)
+	assert.Equal(t, http.StatusForbidden, rr.Code, rr.Body.String())
+	assert.Equal(t, int32(0), srv.tokenCalls, "code not exchanged")
+
+	// posted form limited by MaxBodySize
+	p.MaxBodySize = 64
+	state, cookies = login("")
+	rr = callback("POST", "/callback", url.Values{"code": {"abc"}, "state": {state}, "user": {strings.Repeat("x", 64)}}, cookies)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code, rr.Body.String())
+	p.MaxBodySize = 0
+
+	// provider without FormPost ignores posted form
+	p.FormPost = false
+	state, cookies = login("")
+	rr = callback("POST", "/callback", url.Values{"code": {"abc"}, "state": {state}}, cookies)
+	assert.Equal(t, http.StatusForbidden, rr.Code, rr.Body.String())
+}
+
+func TestRedirectBack(t *testing.T) {
+	tbl := []struct {
+		method string
+		status int
+		res    int
+	}{
+		{"GET", 0, http.StatusTemporaryRedirect},
+		{"POST", 0, http.StatusSeeOther},
+		{"GET", http.StatusSeeOther, http.StatusSeeOther},
+		{"GET", http.StatusFound, http.StatusFound},
+		{"POST", http.StatusTemporaryRedirect, http.StatusTemporaryRedirect},
+		{"GET", http.StatusOK, http.StatusTemporaryRedirect},
+	}
+	for _, tt := range tbl {
+		rr := httptest.NewRecorder()
+		redirectBack(rr, httptest.NewRequest(tt.method, "/callback", http.NoBody), "http://example.com/page", tt.status)
+		assert.Equal(t, tt.res, rr.Code, "%s %d", tt.method, tt.status)
+		assert.Equal(t, "http://example.com/page", rr.Header().Get("Location"))
+	}
+}
+
+func TestOauth2LoginDeprecatedParams(t *testing.T) {
+	p := initOauth2Handler(Params{URL: "http://example.com", Cid: "cid", Csecret: "csecret", L: logger.NoOp{},
+		JwtService: token.NewService(token.Opts{SecretReader: token.SecretFunc(mockKeyStore), TokenDuration: time.Hour,
+			CookieDuration: days31})},
+		Oauth2Handler{name: "mock", endpoint: oauth2.Endpoint{AuthURL: "http://example.com/auth"}})
+
+	rr := httptest.NewRecorder()
+	p.LoginHandler(rr, httptest.NewRequest("GET", "/login?site=remark", http.NoBody))
+	require.Equal(t, http.StatusFound, rr.Code, rr.Body.String())
+	assert.Equal(t, "true", rr.Header().Get("Deprecation"))
+	assert.Equal(t, []string{`299 - "parameter site is deprecated, use aud"`}, rr.Header().Values("Warning"))
+	claims, err := p.JwtService.Parse(rr.Result().Cookies()[0].Value)
+	require.NoError(t, err)
+	assert.Equal(t, "remark", claims.Audience, "old name still works")
+
+	rr = httptest.NewRecorder()
+	p.LoginHandler(rr, httptest.NewRequest("GET", "/login?aud=remark", http.NoBody))
+	require.Equal(t, http.StatusFound, rr.Code, rr.Body.String())
+	assert.Empty(t, rr.Header().Get("Deprecation"))
+	assert.Empty(t, rr.Header().Values("Warning"))
+}
@@ -0,0 +1,169 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-pkgz/rest"
+	"github.com/golang-jwt/jwt"
+
+	"github.com/go-pkgz/auth/token"
+)
+
+const urlPasswordSuffix = "/password"
+
+// checkPassword checks new password with policy, empty passwords are always rejected
+func (p DirectHandler) checkPassword(user, password string) error {
+	if password == "" {
+		return fmt.Errorf("password required")
+	}
+	if p.PasswordPolicy == nil {
+		return nil
+	}
+	return p.PasswordPolicy.Validate(password, PasswordUserContext{User: user})
+}
+
+// loginAttr is user's attribute keeping login name if it differs from user's name
+const loginAttr = "login"
+
+// loginName returns name used by the user to login
+func loginName(u token.User) string {
+	if login := u.StrAttr(loginAttr); login != "" {
+		return login
+	}
+	return u.Name
+}
+
+// sessionClaims returns claims of the valid session of this provider's user, responds with error otherwise
+func (p DirectHandler) sessionClaims(w http.ResponseWriter, r *http.Request) (token.Claims, bool) {
+	claims, tkn, err := p.TokenService.Get(r)
+	if err != nil || claims.User == nil || claims.Handshake != nil {
+		rest.SendErrorJSON(w, r, p.L, http.StatusUnauthorized, err, "not authorized")
+		return token.Claims{}, false
+	}
+	if !p.NoStoreIDPrefix && !strings.HasPrefix(claims.User.ID, p.ProviderName+"_") {
+		rest.SendErrorJSON(w, r, p.L, http.StatusForbidden, fmt.Errorf("user %s", claims.User.ID), "not a user of this provider")
+		return token.Claims{}, false
+	}
+	if v, ok := p.Invalidator.(token.Validator); ok && !v.Validate(tkn, claims) {
+		rest.SendErrorJSON(w, r, p.L, http.StatusUnauthorized, fmt.Errorf("session invalidated"), "not authorized")
+		return token.Claims{}, false
+	}
+	return claims, true
+}
+
+// PasswordHandler changes password of the logged-in user and re-issues the session token.
+// Requires valid session (and XSRF header for cookie sessions). By default all other sessions of the user
+// invalidated, "keep_sessions" allows to keep them.
+//
+// POST /password with {"old":"old password","new":"new password","keep_sessions":false}
+func (p DirectHandler) PasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if p.PasswordSetter == nil {
+		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, fmt.Errorf("password change not configured"),
+			"password change not configured")
+		return
+	}
+	if r.Method != "POST" {
+		rest.SendErrorJSON(w, r, p.L, http.StatusMethodNotAllowed, fmt.Errorf("method %s", r.Method), "POST required")
+		return
+	}
+
+	claims, ok := p.sessionClaims(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Old          string `json:"old"`
+		New          string `json:"new"`
+		KeepSessions bool   `json:"keep_sessions"`
+	}
+	limitBody(w, r, p.MaxBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendParseError(w, r, p.L, err, "failed to parse request")
+		return
+	}
+
+	user := loginName(*claims.User)
+	ip := p.TrustedProxies.ClientIP(r)
+	auditEvent := AuditEvent{Provider: p.ProviderName, User: user, IP: ip}
+	if p.Lockout != nil {
+		// old password guessing with stolen session counted and locked the same way as logins
+		if retryAfter, locked := p.Lockout.locked(p.L, p.ProviderName, user, ip); locked {
+			auditEvent.Type = AuditLockedLogin
+			p.Audit.send(auditEvent)
+			p.Lockout.sendLocked(w, retryAfter)
+			return
+		}
+	}
+
+	ok, storeUser, err := p.checkCredentials(r, credentials{User: user, Password: req.Old})
+	if errors.Is(err, context.DeadlineExceeded) {
+		rest.SendErrorJSON(w, r, p.L, http.StatusGatewayTimeout, err, "credentials check timed out")
+		return
+	}
+	if err != nil {
+		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to check user credentials")
+		return
+	}
+	if !ok {
+		auditEvent.Type = AuditLoginFailed
+		p.Audit.send(auditEvent)
+		if p.Lockout != nil && p.Lockout.failed(r.Context(), p.L, p.ProviderName, user, ip) {
+			auditEvent.Type = AuditLockout
+			p.Audit.send(auditEvent)
+		}
+		rest.SendErrorJSON(w, r, p.L, http.StatusForbidden, nil, "incorrect old password")
+		return
+	}
+	if p.Lockout != nil {
+		p.Lockout.succeeded(p.L, p.ProviderName, user)
+	}
+	if p.NoStoreIDPrefix && p.userID(user, storeUser.ID, r) != claims.User.ID {
+		// ids without prefix can't tell the provider, so the user should be the same as in the store
+		rest.SendErrorJSON(w, r, p.L, http.StatusForbidden, fmt.Errorf("user %s", claims.User.ID), "not a user of this provider")
+		return
+	}
+
+	if err = p.checkPassword(user, req.New); err != nil {
+		rest.SendErrorJSON(w, r, p.L, http.StatusBadRequest, err, err.Error())
+		return
+	}
+
+	if err = p.PasswordSetter.SetPassword(user, req.New); err != nil {
+		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to set password")
+		return
+	}
+
+	if !req.KeepSessions && p.Invalidator != nil {
+		if err = p.Invalidator.InvalidateUser(claims.User.ID); err != nil {
+			rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to invalidate sessions")
+			return
+		}
+	}
+
+	cid, err := randToken()
+	if err != nil {
+		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "can't make token id")
+		return
+	}
+	newClaims := token.Claims{
+		User: claims.User,
+		StandardClaims: jwt.StandardClaims{
+			Id:       cid,
+			Issuer:   p.IssuerFunc.get(r, p.Issuer),
+			Audience: claims.Audience,
+		},
+		SessionOnly: claims.SessionOnly,
+		Provider:    claims.Provider,
+	}
+	if _, err = p.TokenService.Set(w, newClaims); err != nil {
+		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to set token")
+		return
+	}
+	rest.RenderJSON(w, rest.JSON{"status": "password changed"})
+}
@@ -0,0 +1,159 @@
+package provider
+
+import (
+	"bufio"
+	"crypto/sha1" //nolint
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-pkgz/auth/httpclient"
+)
+
+// PasswordPolicy defines interface checking the new password, i.e. its strength.
+// Returned error message is sent to the client as-is.
+type PasswordPolicy interface {
+	Validate(password string, uc PasswordUserContext) error
+}
+
+// PasswordUserContext describes the user setting the password
+type PasswordUserContext struct {
+	User  string // user name (login)
+	Email string // user's email or other address, optional
+}
+
+// PasswordPolicyFunc type is an adapter to allow the use of ordinary functions as PasswordPolicy.
+type PasswordPolicyFunc func(password string, uc PasswordUserContext) error
+
+// Validate calls f(password, uc)
+func (f PasswordPolicyFunc) Validate(password string, uc PasswordUserContext) error {
+	return f(password, uc)
+}
+
+const (
+	defaultPasswordMinLength = 8
+	defaultPasswordMaxLength = 64
+	defaultPwnedRangeURL     = "https://api.pwnedpasswords.com/range/"
+)
+
+// DefaultPasswordPolicy implements NIST-style PasswordPolicy. It checks password length, rejects passwords
+// containing user name or email, and optionally checks the password against HaveIBeenPwned breached passwords
+// with k-anonymity range API, i.e. only the first 5 chars of password's sha1 sent out.
+// Zero values replaced by defaults.
+type DefaultPasswordPolicy struct {
+	MinLength int // min length in characters, default 8
+	MaxLength int // max length in characters, default 64
+
+	CheckBreached      bool         // check password against breached passwords
+	BreachedFailClosed bool         // reject password if breach check failed, default is to accept it (fail open)
+	BreachedURL        string       // range API url, default https://api.pwnedpasswords.com/range/
+	HTTPClient         *http.Client // client for breach check, default with 5s timeout
+
+	// OnBreachCheckError receives error of failed breach check, i.e. to log or alert, before the password
+	// accepted, or rejected with BreachedFailClosed. Failed checks are silent if not set.
+	OnBreachCheckError func(err error)
+}
+
+// Validate checks the password against the policy
+func (p DefaultPasswordPolicy) Validate(password string, uc PasswordUserContext) error {
+	minLen, maxLen := p.MinLength, p.MaxLength
+	if minLen == 0 {
+		minLen = defaultPasswordMinLength
+	}
+	if maxLen == 0 {
+		maxLen = defaultPasswordMaxLength
+	}
+
+	pl := len([]rune(password))
+	if pl < minLen {
+		return fmt.Errorf("password should be at least %d characters long", minLen)
+	}
+	if pl > maxLen {
+		return fmt.Errorf("password should be at most %d characters long", maxLen)
+	}
+
+	lp := strings.ToLower(password)
+	for _, s := range userParts(uc) {
+		if strings.Contains(lp, s) {
+			return fmt.Errorf("password should not contain user name or email")
+		}
+	}
+
+	if !p.CheckBreached {
+		return nil
+	}
+	breached, err := p.breached(password)
+	if err != nil {
+		if p.OnBreachCheckError != nil {
+			p.OnBreachCheckError(err)
+		}
+		if p.BreachedFailClosed {
+			return fmt.Errorf("can't check password, try again later")
+		}
+		return nil
+	}
+	if breached {
+		return fmt.Errorf("password found in data breaches, choose another one")
+	}
+	return nil
+}
+
+// userParts returns lowercase user name, email and email's local part, ignoring too short ones
+func userParts(uc PasswordUserContext) (res []string) {
+	parts := []string{uc.User, uc.Email}
+	if i := strings.Index(uc.Email, "@"); i > 0 {
+		parts = append(parts, uc.Email[:i])
+	}
+	for _, s := range parts {
+		if len(s) >= 3 {
+			res = append(res, strings.ToLower(s))
+		}
+	}
+	return res
+}
+
+// breached checks password with HaveIBeenPwned range API
+func (p DefaultPasswordPolicy) breached(password string) (bool, error) {
+	hash := strings.ToUpper(fmt.Sprintf("%x", sha1.Sum([]byte(password)))) //nolint:gosec // required by the range API
+	prefix, suffix := hash[:5], hash[5:]
+
+	client := p.HTTPClient
+	if client == nil {
+		client = httpclient.New(5 * time.Second)
+	}
+	url := p.BreachedURL
+	if url == "" {
+		url = defaultPwnedRangeURL
+	}
+
+	req, err := http.NewRequest("GET", url+prefix, http.NoBody)
+	if err != nil {
+		return false, fmt.Errorf("failed to make range request: %w", err)
+	}
+	req.Header.Set("Add-Padding", "true")
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to get range: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("failed to get range, status %d", resp.StatusCode)
+	}
+
+	// response lines are "SUFFIX:COUNT", padding entries have zero count
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		elems := strings.SplitN(strings.TrimSpace(scanner.Text()), ":", 2)
+		if len(elems) != 2 || !strings.EqualFold(elems[0], suffix) {
+			continue
+		}
+		count, err := strconv.Atoi(elems[1])
+		return err == nil && count > 0, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return false, fmt.Errorf("failed to read range: %w", err)
+	}
+	return false, nil
+}
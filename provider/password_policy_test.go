@@ -0,0 +1,84 @@
+package provider
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultPasswordPolicy(t *testing.T) {
+	p := DefaultPasswordPolicy{}
+	uc := PasswordUserContext{User: "john", Email: "jdoe@example.com"}
+
+	tbl := []struct {
+		passwd string
+		err    string
+	}{
+		{"correct horse battery", ""},
+		{"short", "password should be at least 8 characters long"},
+		{strings.Repeat("x", 65), "password should be at most 64 characters long"},
+		{"my-John-password", "password should not contain user name or email"},
+		{"secret-JDOE-123", "password should not contain user name or email"},
+		{"пароль-пароль", ""},
+	}
+	for i, tt := range tbl {
+		err := p.Validate(tt.passwd, uc)
+		if tt.err == "" {
+			assert.NoError(t, err, "case #%d", i)
+			continue
+		}
+		assert.EqualError(t, err, tt.err, "case #%d", i)
+	}
+
+	p = DefaultPasswordPolicy{MinLength: 4, MaxLength: 6}
+	assert.NoError(t, p.Validate("abcd", uc))
+	assert.Error(t, p.Validate("abcdefg", uc))
+	assert.NoError(t, p.Validate("abcd", PasswordUserContext{User: "ab"}), "too short user name ignored")
+}
+
+func TestDefaultPasswordPolicy_Breached(t *testing.T) {
+	// sha1("password") = 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8
+	var requested []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.Path)
+		assert.Equal(t, "true", r.Header.Get("Add-Padding"))
+		if r.URL.Path != "/range/5BAA6" {
+			_, _ = w.Write([]byte("0018A45C4D1DEF81644B54AB7F969B88D65:1\r\n"))
+			return
+		}
+		_, _ = w.Write([]byte("003D68EB55068C33ACE09247EE4C639306B:3\r\n" +
+			"1E4C9B93F3F0682250B6CF8331B7EE68FD8:3730471\r\n" +
+			"1E4C9B93F3F0682250B6CF8331B7EE68FD9:0\r\n"))
+	}))
+	defer ts.Close()
+
+	p := DefaultPasswordPolicy{CheckBreached: true, BreachedURL: ts.URL + "/range/", HTTPClient: ts.Client()}
+	assert.EqualError(t, p.Validate("password", PasswordUserContext{}), "password found in data breaches, choose another one")
+	assert.NoError(t, p.Validate("not-breached-password", PasswordUserContext{}), "miss")
+	require.Equal(t, 2, len(requested))
+	assert.Equal(t, "/range/5BAA6", requested[0], "only hash prefix sent")
+}
+
+func TestDefaultPasswordPolicy_BreachedCheckFailed(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	p := DefaultPasswordPolicy{CheckBreached: true, BreachedURL: ts.URL + "/range/", HTTPClient: ts.Client()}
+	assert.NoError(t, p.Validate("password", PasswordUserContext{}), "fail open by default")
+
+	var errs []error
+	p.OnBreachCheckError = func(err error) { errs = append(errs, err) }
+	assert.NoError(t, p.Validate("password", PasswordUserContext{}), "fail open reported")
+	require.Len(t, errs, 1)
+	assert.EqualError(t, errs[0], "failed to get range, status 503")
+
+	p.BreachedFailClosed = true
+	assert.EqualError(t, p.Validate("password", PasswordUserContext{}), "can't check password, try again later")
+	assert.Len(t, errs, 2)
+}
@@ -0,0 +1,197 @@
+package provider
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/auth/logger"
+	"github.com/go-pkgz/auth/token"
+)
+
+func TestDirect_PasswordHandler(t *testing.T) {
+	store := &mockResetStore{passwords: map[string]string{"myuser": "old-pass"}}
+	inv := &mockInvalidator{}
+	d := DirectHandler{
+		ProviderName: "test",
+		CredChecker: CredCheckerFunc(func(user, password string) (ok bool, err error) {
+			return store.passwords[user] == password, nil
+		}),
+		TokenService: token.NewService(token.Opts{
+			SecretReader:   token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+			TokenDuration:  time.Hour,
+			CookieDuration: time.Hour * 24 * 31,
+			DisableXSRF:    true,
+		}),
+		Issuer:         "iss-test",
+		L:              logger.NoOp{},
+		PasswordSetter: store,
+		PasswordPolicy: DefaultPasswordPolicy{MinLength: 8},
+		Invalidator:    inv,
+	}
+	svc := NewService(d)
+	tkn, err := d.TokenService.(tokenMaker).Token(token.Claims{
+		User:           &token.User{Name: "myuser", ID: "test_12345"},
+		StandardClaims: jwt.StandardClaims{Id: "id1", Audience: "xyz123", ExpiresAt: time.Now().Add(time.Hour).Unix()},
+	})
+	require.NoError(t, err)
+
+	change := func(tkn, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/auth/test/password", strings.NewReader(body))
+		if tkn != "" {
+			req.Header.Set("X-JWT", tkn)
+		}
+		svc.Handler(rr, req)
+		return rr
+	}
+
+	rr := change("", `{"old":"old-pass","new":"new-password"}`)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	rr = change(tkn, `{"old":"bad-pass","new":"new-password"}`)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Equal(t, `{"error":"incorrect old password"}`+"\n", rr.Body.String())
+
+	rr = change(tkn, `{"old":"old-pass","new":"short"}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, `{"error":"password should be at least 8 characters long"}`+"\n", rr.Body.String())
+	assert.Equal(t, "old-pass", store.passwords["myuser"])
+
+	rr = change(tkn, `{"old":"old-pass","new":"new-password","keep_sessions":true}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, "new-password", store.passwords["myuser"])
+	assert.Empty(t, inv.users, "sessions kept")
+
+	rr = change(tkn, `{"old":"new-password","new":"newer-password"}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, []string{"test_12345"}, inv.users, "other sessions invalidated")
+	request := &http.Request{Header: http.Header{"Cookie": rr.Header()["Set-Cookie"]}}
+	c, err := request.Cookie("JWT")
+	require.NoError(t, err)
+	claims, err := d.TokenService.Parse(c.Value)
+	require.NoError(t, err)
+	assert.Equal(t, "test_12345", claims.User.ID, "session re-issued")
+	assert.Equal(t, "xyz123", claims.Audience)
+	assert.NotEqual(t, "id1", claims.Id)
+
+	otherTkn, err := d.TokenService.(tokenMaker).Token(token.Claims{
+		User:           &token.User{Name: "myuser", ID: "other_12345"},
+		StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Hour).Unix()},
+	})
+	require.NoError(t, err)
+	rr = change(otherTkn, `{"old":"newer-password","new":"newest-password"}`)
+	assert.Equal(t, http.StatusForbidden, rr.Code, "user of other provider rejected")
+}
+
+func TestDirect_PasswordHandlerLockout(t *testing.T) {
+	store := &mockResetStore{passwords: map[string]string{"myuser": "old-pass"}}
+	var events []AuditEvent
+	d := DirectHandler{
+		ProviderName: "test",
+		CredChecker: CredCheckerFunc(func(user, password string) (ok bool, err error) {
+			return store.passwords[user] == password, nil
+		}),
+		TokenService: token.NewService(token.Opts{
+			SecretReader:   token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+			TokenDuration:  time.Hour,
+			CookieDuration: time.Hour * 24 * 31,
+			DisableXSRF:    true,
+		}),
+		Issuer:         "iss-test",
+		L:              logger.NoOp{},
+		PasswordSetter: store,
+		Lockout:        &Lockout{DelayAfter: 100, LockAfter: 3, LockDuration: time.Minute},
+		Audit:          func(ev AuditEvent) { events = append(events, ev) },
+	}
+	svc := NewService(d)
+	tkn, err := d.TokenService.(tokenMaker).Token(token.Claims{
+		User:           &token.User{Name: "myuser", ID: "test_12345"},
+		StandardClaims: jwt.StandardClaims{Id: "id1", ExpiresAt: time.Now().Add(time.Hour).Unix()},
+	})
+	require.NoError(t, err)
+
+	change := func(body, ip string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/auth/test/password", strings.NewReader(body))
+		req.Header.Set("X-JWT", tkn)
+		req.RemoteAddr = ip + ":1234"
+		svc.Handler(rr, req)
+		return rr
+	}
+
+	for i := 0; i < 3; i++ {
+		rr := change(`{"old":"bad-pass","new":"new-password"}`, fmt.Sprintf("10.0.0.%d", i))
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+	}
+	rr := change(`{"old":"old-pass","new":"new-password"}`, "10.0.1.1")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code, "locked even with correct old password")
+	assert.Equal(t, "60", rr.Header().Get("Retry-After"))
+	assert.JSONEq(t, `{"error":"too many failed login attempts","code":"login_locked"}`, rr.Body.String())
+	assert.Equal(t, "old-pass", store.passwords["myuser"])
+
+	// login of the same user locked too, counters shared with LoginHandler
+	lr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/login?user=myuser&passwd=old-pass", http.NoBody)
+	req.RemoteAddr = "10.0.1.2:1234"
+	d.LoginHandler(lr, req)
+	assert.Equal(t, http.StatusTooManyRequests, lr.Code)
+
+	types := map[string]int{}
+	for _, ev := range events {
+		types[ev.Type]++
+	}
+	assert.Equal(t, 3, types[AuditLoginFailed])
+	assert.Equal(t, 1, types[AuditLockout])
+	assert.Equal(t, 2, types[AuditLockedLogin])
+}
+
+func TestDirect_PasswordHandlerNoStoreIDPrefix(t *testing.T) {
+	store := &mockResetStore{passwords: map[string]string{"myuser": "old-pass"}}
+	d := DirectHandler{
+		ProviderName: "test",
+		CredChecker: UserCredCheckerFunc(func(user, password string) (ok bool, u token.User, err error) {
+			return store.passwords[user] == password, token.User{ID: "db-" + user}, nil
+		}),
+		NoStoreIDPrefix: true,
+		TokenService: token.NewService(token.Opts{
+			SecretReader:   token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+			TokenDuration:  time.Hour,
+			CookieDuration: time.Hour * 24 * 31,
+			DisableXSRF:    true,
+		}),
+		Issuer:         "iss-test",
+		L:              logger.NoOp{},
+		PasswordSetter: store,
+	}
+	svc := NewService(d)
+
+	change := func(userID string) *httptest.ResponseRecorder {
+		tkn, err := d.TokenService.(tokenMaker).Token(token.Claims{
+			User:           &token.User{Name: "myuser", ID: userID},
+			StandardClaims: jwt.StandardClaims{Id: "id1", ExpiresAt: time.Now().Add(time.Hour).Unix()},
+		})
+		require.NoError(t, err)
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/auth/test/password", strings.NewReader(`{"old":"old-pass","new":"new-password"}`))
+		req.Header.Set("X-JWT", tkn)
+		svc.Handler(rr, req)
+		return rr
+	}
+
+	rr := change("github_12345") // the same name, but another provider's user
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Equal(t, `{"error":"not a user of this provider"}`+"\n", rr.Body.String())
+	assert.Equal(t, "old-pass", store.passwords["myuser"])
+
+	rr = change("db-myuser")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, "new-password", store.passwords["myuser"])
+}
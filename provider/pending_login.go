@@ -0,0 +1,124 @@
+package provider
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+
+	"github.com/go-pkgz/auth/token"
+)
+
+// PendingLoginsCookieName is the cookie with login flows in progress kept with MaxPendingLogins
+const PendingLoginsCookieName = "PENDING-LOGINS"
+
+// addPendingLogin keeps login flow started with claims in the cookie, along with up to MaxPendingLogins-1
+// latest flows started before in the same browser. Failures are logged, the flow works as the only one then.
+func (p Params) addPendingLogin(w http.ResponseWriter, r *http.Request, claims token.Claims) {
+	if p.MaxPendingLogins < 2 || claims.Handshake == nil {
+		return
+	}
+	var pending []token.PendingLogin
+	for _, pl := range p.pendingLogins(r) {
+		if time.Now().Unix() <= pl.ExpiresAt {
+			pending = append(pending, pl)
+		}
+	}
+	pending = append(pending, token.PendingLogin{
+		State:       claims.Handshake.State,
+		From:        claims.Handshake.From,
+		Audience:    claims.Audience,
+		SessionOnly: claims.SessionOnly,
+		NoAva:       claims.NoAva,
+		ExpiresAt:   claims.ExpiresAt,
+	})
+	if len(pending) > p.MaxPendingLogins {
+		pending = pending[len(pending)-p.MaxPendingLogins:] // oldest evicted
+	}
+	p.setPendingLogins(w, r, pending)
+}
+
+// takePendingLogin returns handshake claims of the login flow in progress with the state and removes it from
+// the cookie, so the state can't be used twice. Expired flows returned too, to be rejected as expired.
+func (p Params) takePendingLogin(w http.ResponseWriter, r *http.Request, state string) (token.Claims, bool) {
+	if p.MaxPendingLogins < 2 || state == "" {
+		return token.Claims{}, false
+	}
+	all := p.pendingLogins(r)
+
+	var res *token.PendingLogin
+	rest := make([]token.PendingLogin, 0, len(all))
+	for i, pl := range all {
+		if pl.State == state && res == nil {
+			res = &all[i]
+			continue
+		}
+		if time.Now().Unix() <= pl.ExpiresAt {
+			rest = append(rest, pl)
+		}
+	}
+	if res == nil {
+		return token.Claims{}, false
+	}
+	p.setPendingLogins(w, r, rest)
+
+	return token.Claims{
+		Handshake:   &token.Handshake{State: res.State, From: res.From},
+		SessionOnly: res.SessionOnly,
+		NoAva:       res.NoAva,
+		StandardClaims: jwt.StandardClaims{
+			Audience:  res.Audience,
+			ExpiresAt: res.ExpiresAt,
+		},
+	}, true
+}
+
+// pendingLogins returns login flows kept in the cookie, nil if no cookie or it is invalid
+func (p Params) pendingLogins(r *http.Request) []token.PendingLogin {
+	c, err := r.Cookie(PendingLoginsCookieName)
+	if err != nil {
+		return nil
+	}
+	claims, err := p.JwtService.Parse(c.Value)
+	if err != nil || claims.Handshake == nil {
+		p.Logf("[DEBUG] invalid pending logins cookie, %v", err)
+		return nil
+	}
+	return claims.Handshake.Pending
+}
+
+// setPendingLogins signs login flows into the cookie, removes the cookie if no flows left
+func (p Params) setPendingLogins(w http.ResponseWriter, r *http.Request, pending []token.PendingLogin) {
+	// form_post callback is cross-site POST, the cookie should be sent with it
+	sameSite, secure := http.SameSiteLaxMode, r.TLS != nil
+	if p.FormPost {
+		sameSite, secure = http.SameSiteNoneMode, true
+	}
+	if len(pending) == 0 {
+		http.SetCookie(w, &http.Cookie{Name: PendingLoginsCookieName, Value: "", Path: "/", HttpOnly: true,
+			MaxAge: -1, Expires: time.Unix(0, 0), Secure: secure, SameSite: sameSite})
+		return
+	}
+
+	tm, ok := p.JwtService.(tokenMaker)
+	if !ok {
+		p.Logf("[WARN] token service can't make tokens, pending logins not kept")
+		return
+	}
+	var expiresAt int64
+	for _, pl := range pending {
+		if pl.ExpiresAt > expiresAt {
+			expiresAt = pl.ExpiresAt
+		}
+	}
+	tkn, err := tm.Token(token.Claims{
+		Handshake:      &token.Handshake{Pending: pending},
+		StandardClaims: jwt.StandardClaims{ExpiresAt: expiresAt, NotBefore: time.Now().Add(-1 * time.Minute).Unix()},
+	})
+	if err != nil {
+		p.Logf("[WARN] can't make pending logins token, %v", err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: PendingLoginsCookieName, Value: tkn, Path: "/", HttpOnly: true,
+		MaxAge: int(time.Until(time.Unix(expiresAt, 0)).Seconds()), Secure: secure, SameSite: sameSite})
+}
@@ -0,0 +1,130 @@
+package provider
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+
+	"github.com/go-pkgz/auth/logger"
+	"github.com/go-pkgz/auth/token"
+)
+
+func TestOauth2PendingLogins(t *testing.T) {
+	srv := newFlakyOauthServer(t)
+	makeHandler := func(maxPending int) Oauth2Handler {
+		return initOauth2Handler(Params{URL: "http://example.com", Cid: "cid", Csecret: "csecret", L: logger.NoOp{},
+			JwtService: token.NewService(token.Opts{SecretReader: token.SecretFunc(mockKeyStore), TokenDuration: time.Hour,
+				CookieDuration: days31}),
+			MaxPendingLogins: maxPending},
+			Oauth2Handler{
+				name:     "mock",
+				endpoint: oauth2.Endpoint{AuthURL: srv.URL + "/auth", TokenURL: srv.URL + "/token"},
+				infoURL:  srv.URL + "/user",
+				mapUser: func(data UserData, _ []byte) token.User {
+					return token.User{ID: "mock_" + data.Value("id"), Name: data.Value("name")}
+				},
+			})
+	}
+
+	// browser keeps cookies set by responses, like the one with several tabs open
+	type browser map[string]*http.Cookie
+	keep := func(b browser, rr *httptest.ResponseRecorder) {
+		for _, c := range rr.Result().Cookies() {
+			if c.MaxAge < 0 {
+				delete(b, c.Name)
+				continue
+			}
+			b[c.Name] = c
+		}
+	}
+	login := func(p Oauth2Handler, b browser, from string) (state string) {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/login?site=remark&from="+url.QueryEscape(from), http.NoBody)
+		for _, c := range b {
+			req.AddCookie(c)
+		}
+		p.LoginHandler(rr, req)
+		require.Equal(t, http.StatusFound, rr.Code, rr.Body.String())
+		keep(b, rr)
+		loc, err := url.Parse(rr.Header().Get("Location"))
+		require.NoError(t, err)
+		return loc.Query().Get("state")
+	}
+	callback := func(p Oauth2Handler, b browser, state string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/callback?code=abc&state="+state, http.NoBody)
+		for _, c := range b {
+			req.AddCookie(c)
+		}
+		p.AuthHandler(rr, req)
+		keep(b, rr)
+		return rr
+	}
+
+	t.Run("two tabs completed in reverse order", func(t *testing.T) {
+		p, b := makeHandler(3), browser{}
+		state1 := login(p, b, "http://example.com/tab1")
+		state2 := login(p, b, "http://example.com/tab2")
+		require.NotEqual(t, state1, state2)
+
+		rr := callback(p, b, state2)
+		require.Equal(t, http.StatusTemporaryRedirect, rr.Code, rr.Body.String())
+		assert.Equal(t, "http://example.com/tab2", rr.Header().Get("Location"))
+
+		rr = callback(p, b, state1)
+		require.Equal(t, http.StatusTemporaryRedirect, rr.Code, rr.Body.String())
+		assert.Equal(t, "http://example.com/tab1", rr.Header().Get("Location"))
+		claims, err := p.JwtService.Parse(b["JWT"].Value)
+		require.NoError(t, err)
+		assert.Equal(t, "mock_myuser", claims.User.ID)
+		assert.Equal(t, "remark", claims.Audience)
+		assert.Nil(t, claims.Handshake)
+		assert.NotContains(t, b, PendingLoginsCookieName, "removed with the last flow completed")
+
+		// completed state can't be used again
+		assert.Equal(t, http.StatusForbidden, callback(p, b, state1).Code)
+	})
+
+	t.Run("oldest flow evicted", func(t *testing.T) {
+		p, b := makeHandler(2), browser{}
+		states := []string{login(p, b, ""), login(p, b, ""), login(p, b, "")}
+		assert.Equal(t, http.StatusForbidden, callback(p, b, states[0]).Code)
+		assert.Equal(t, http.StatusOK, callback(p, b, states[1]).Code)
+		assert.Equal(t, http.StatusOK, callback(p, b, states[2]).Code)
+	})
+
+	t.Run("expired flow", func(t *testing.T) {
+		p, b := makeHandler(2), browser{}
+		state1 := login(p, b, "")
+		p.StateTTL = time.Second
+		state2 := login(p, b, "")
+		time.Sleep(2 * time.Second) // expiration has seconds precision
+		rr := callback(p, b, state2)
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+		assert.Contains(t, rr.Body.String(), StateExpired)
+		assert.Equal(t, http.StatusOK, callback(p, b, state1).Code)
+	})
+
+	t.Run("forged cookie", func(t *testing.T) {
+		p, b := makeHandler(2), browser{}
+		state1 := login(p, b, "")
+		login(p, b, "")
+		b[PendingLoginsCookieName].Value += "x"
+		assert.Equal(t, http.StatusForbidden, callback(p, b, state1).Code)
+	})
+
+	t.Run("latest flow only by default", func(t *testing.T) {
+		p, b := makeHandler(0), browser{}
+		state1 := login(p, b, "")
+		state2 := login(p, b, "")
+		assert.NotContains(t, b, PendingLoginsCookieName)
+		assert.Equal(t, http.StatusOK, callback(p, b, state2).Code)
+		assert.Equal(t, http.StatusForbidden, callback(p, b, state1).Code)
+	})
+}
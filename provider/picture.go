@@ -0,0 +1,64 @@
+package provider
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/go-pkgz/auth/logger"
+	"github.com/go-pkgz/auth/token"
+)
+
+// PicturePolicy defines update of user's picture on repeat logins
+type PicturePolicy int
+
+const (
+	PictureAlways    PicturePolicy = iota // save provider's picture on every login, default
+	PictureNever                          // keep picture of existing user, provider's one saved for new users only
+	PictureIfChanged                      // save provider's picture only if its url changed since the last login
+)
+
+// PictureSourceAttr is the user attribute with provider's url of the picture, set with PictureIfChanged
+const PictureSourceAttr = "picture_src"
+
+// PictureUpdate defines how the picture of existing user is updated on login. Existing user is the one returned
+// by GetExistingUser, i.e. saved by UserSaver on the previous login. Without GetExistingUser every login
+// saves provider's picture, as with PictureAlways.
+type PictureUpdate struct {
+	Policy          PicturePolicy
+	GetExistingUser func(id string) (u token.User, found bool, err error)
+}
+
+// setAvatar saves avatar of the user with setAvatar unless the policy keeps picture of existing user.
+// Failed lookup of existing user is logged and the picture saved as usual.
+func (pu PictureUpdate) setAvatar(l logger.L, ava AvatarSaver, u token.User, client *http.Client) (token.User, error) {
+	if pu.Policy == PictureAlways || pu.GetExistingUser == nil {
+		return setAvatar(ava, u, client)
+	}
+
+	src := u.Picture
+	if pu.Policy == PictureIfChanged && !strings.HasPrefix(src, "data:") { // inline pictures too large for attribute
+		u.SetStrAttr(PictureSourceAttr, src)
+	}
+
+	existing, found, err := pu.GetExistingUser(u.ID)
+	if err != nil {
+		l.Logf("[WARN] can't get existing user %s, picture updated, %v", u.ID, err)
+		return setAvatar(ava, u, client)
+	}
+	if !found || existing.Picture == "" {
+		return setAvatar(ava, u, client)
+	}
+
+	switch pu.Policy {
+	case PictureNever:
+		u.Picture = existing.Picture
+		return u, nil
+	case PictureIfChanged:
+		if prev := existing.StrAttr(PictureSourceAttr); prev == src && !strings.HasPrefix(src, "data:") {
+			u.Picture = existing.Picture
+			return u, nil
+		}
+		l.Logf("[DEBUG] picture of %s changed, updated", u.ID)
+	}
+	return setAvatar(ava, u, client)
+}
@@ -0,0 +1,178 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/auth/logger"
+	"github.com/go-pkgz/auth/token"
+)
+
+func TestPictureUpdate_DevProvider(t *testing.T) {
+	var lock sync.Mutex
+	users := map[string]token.User{} // users saved by the app
+	puts := 0                        // avatars saved by the proxy
+	version := 1                     // version of provider's picture
+
+	var handler http.HandlerFunc
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		h := handler
+		lock.Unlock()
+		h(w, r)
+	}))
+	defer ts.Close()
+
+	params := Params{Cid: "cid", Csecret: "csecret", URL: ts.URL, L: logger.NoOp{}, Port: 18094,
+		JwtService: token.NewService(token.Opts{
+			SecretReader:   token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+			TokenDuration:  time.Hour,
+			CookieDuration: time.Hour * 24 * 31,
+		}),
+		AvatarSaver: avatarSaverFunc(func(u token.User, _ *http.Client) (string, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			puts++
+			return fmt.Sprintf("http://app/avatar/%s/%d", u.ID, puts), nil
+		}),
+		UserSaver: func(u token.User) error {
+			lock.Lock()
+			defer lock.Unlock()
+			users[u.ID] = u
+			return nil
+		},
+	}
+	getExistingUser := func(id string) (token.User, bool, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		u, ok := users[id]
+		return u, ok, nil
+	}
+
+	devProvider := NewDev(params)
+	mapUser := devProvider.mapUser
+	devProvider.mapUser = func(data UserData, b []byte) token.User {
+		u := mapUser(data, b)
+		lock.Lock()
+		u.Picture += fmt.Sprintf("&v=%d", version)
+		lock.Unlock()
+		return u
+	}
+	devOauth2Srv := DevAuthServer{Provider: devProvider, Automatic: true, username: "dev_user", L: logger.NoOp{}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go devOauth2Srv.Run(ctx)
+	time.Sleep(100 * time.Millisecond)
+
+	login := func(pu PictureUpdate) string {
+		p := devProvider
+		p.PictureUpdate = pu
+		lock.Lock()
+		handler = Service{Provider: p}.Handler
+		lock.Unlock()
+		jar, err := cookiejar.New(nil)
+		require.NoError(t, err)
+		client := &http.Client{Jar: jar, Timeout: 5 * time.Second}
+		resp, err := client.Get(ts.URL + "/auth/dev/login?site=my-test-site")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		lock.Lock()
+		defer lock.Unlock()
+		return users["dev_user"].Picture
+	}
+	reset := func() {
+		lock.Lock()
+		users, puts, version = map[string]token.User{}, 0, 1
+		lock.Unlock()
+	}
+	pictureSrc := func() string {
+		lock.Lock()
+		defer lock.Unlock()
+		u := users["dev_user"]
+		return u.StrAttr(PictureSourceAttr)
+	}
+	setVersion := func(v int) {
+		lock.Lock()
+		version = v
+		lock.Unlock()
+	}
+
+	t.Run("always", func(t *testing.T) {
+		reset()
+		pu := PictureUpdate{Policy: PictureAlways, GetExistingUser: getExistingUser}
+		assert.Equal(t, "http://app/avatar/dev_user/1", login(pu))
+		assert.Equal(t, "http://app/avatar/dev_user/2", login(pu), "saved on repeat login")
+	})
+
+	t.Run("never", func(t *testing.T) {
+		reset()
+		pu := PictureUpdate{Policy: PictureNever, GetExistingUser: getExistingUser}
+		assert.Equal(t, "http://app/avatar/dev_user/1", login(pu), "saved for new user")
+		lock.Lock()
+		u := users["dev_user"]
+		u.Picture = "http://app/custom.png" // customized in the app
+		users["dev_user"] = u
+		lock.Unlock()
+		setVersion(2)
+		assert.Equal(t, "http://app/custom.png", login(pu), "customized picture kept")
+		assert.Equal(t, 1, puts)
+	})
+
+	t.Run("if changed", func(t *testing.T) {
+		reset()
+		pu := PictureUpdate{Policy: PictureIfChanged, GetExistingUser: getExistingUser}
+		assert.Equal(t, "http://app/avatar/dev_user/1", login(pu))
+		assert.Equal(t, "http://127.0.0.1:18094/avatar?user=dev_user&v=1", pictureSrc())
+		assert.Equal(t, "http://app/avatar/dev_user/1", login(pu), "same url, not refetched")
+		assert.Equal(t, 1, puts)
+		setVersion(2)
+		assert.Equal(t, "http://app/avatar/dev_user/2", login(pu), "changed url refetched")
+		assert.Equal(t, "http://127.0.0.1:18094/avatar?user=dev_user&v=2", pictureSrc())
+	})
+}
+
+func TestPictureUpdate_setAvatar(t *testing.T) {
+	ava := avatarSaverFunc(func(u token.User, _ *http.Client) (string, error) { return "http://app/avatar/new", nil })
+	existing := token.User{ID: "u1", Picture: "http://app/avatar/old"}
+	existing.SetStrAttr(PictureSourceAttr, "http://example.com/pic.png")
+	var lookupErr error
+	pu := PictureUpdate{Policy: PictureNever, GetExistingUser: func(id string) (token.User, bool, error) {
+		return existing, id == "u1", lookupErr
+	}}
+
+	u, err := pu.setAvatar(logger.NoOp{}, ava, token.User{ID: "u2", Picture: "http://example.com/pic.png"}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "http://app/avatar/new", u.Picture, "new user")
+
+	lookupErr = errors.New("db failed")
+	u, err = pu.setAvatar(logger.NoOp{}, ava, token.User{ID: "u1", Picture: "http://example.com/pic.png"}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "http://app/avatar/new", u.Picture, "lookup failure, saved as usual")
+
+	lookupErr = nil
+	pu.Policy = PictureIfChanged
+	u, err = pu.setAvatar(logger.NoOp{}, ava, token.User{ID: "u1", Picture: "data:image/png;base64,AAAA"}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "http://app/avatar/new", u.Picture, "inline picture always saved")
+	assert.Empty(t, u.StrAttr(PictureSourceAttr))
+
+	pu.GetExistingUser = nil
+	u, err = pu.setAvatar(logger.NoOp{}, ava, token.User{ID: "u1", Picture: "http://example.com/pic.png"}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "http://app/avatar/new", u.Picture, "no lookup, saved as usual")
+}
+
+type avatarSaverFunc func(u token.User, client *http.Client) (string, error)
+
+func (f avatarSaverFunc) Put(u token.User, client *http.Client) (string, error) { return f(u, client) }
@@ -0,0 +1,32 @@
+package provider
+
+import (
+	"net/url"
+	"path"
+	"strings"
+)
+
+// redirectAllowed checks absolute back url matches one of allowed origins, i.e. "https://example.com", or url
+// prefixes, i.e. "https://example.com/app/". Prefix matches whole path segments, "/app" allows "/app/x" but
+// not "/apps", and dot segments of the url resolved before the match. Relative urls never match.
+func redirectAllowed(from string, allowed []string) bool {
+	u, err := url.Parse(from)
+	if err != nil || u.Scheme == "" || u.Host == "" || u.User != nil {
+		return false
+	}
+	fromPath := path.Clean("/" + u.Path)
+	for _, a := range allowed {
+		au, err := url.Parse(a)
+		if err != nil || au.Host == "" {
+			continue
+		}
+		if !strings.EqualFold(u.Scheme, au.Scheme) || !strings.EqualFold(u.Host, au.Host) {
+			continue
+		}
+		prefix := strings.TrimSuffix(au.Path, "/")
+		if prefix == "" || fromPath == prefix || strings.HasPrefix(fromPath, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
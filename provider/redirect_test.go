@@ -0,0 +1,51 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedirectAllowed(t *testing.T) {
+	allowed := []string{"https://example.com", "https://app.example.com/dash/", "http://localhost:8080/app"}
+	tbl := []struct {
+		from string
+		ok   bool
+	}{
+		{"https://example.com", true},
+		{"https://example.com/", true},
+		{"https://example.com/any/page?x=1#top", true},
+		{"https://EXAMPLE.com/page", true},
+		{"https://app.example.com/dash/", true},
+		{"https://app.example.com/dash", true},
+		{"https://app.example.com/dash/reports?id=1", true},
+		{"http://localhost:8080/app/page", true},
+		{"http://localhost:8080/app", true},
+
+		{"https://app.example.com/", false},
+		{"https://app.example.com/dashboard", false},
+		{"https://app.example.com/dash/../admin", false},
+		{"https://app.example.com/dash/%2e%2e/admin", false},
+		{"http://localhost:8080/apps", false},
+		{"http://localhost:8081/app/page", false},
+		{"http://localhost/app/page", false},
+		{"http://example.com/page", false},
+		{"https://evil.com/page", false},
+		{"https://example.com.evil.com/page", false},
+		{"https://sub.example.com/page", false},
+		{"https://example.com@evil.com/page", false},
+		{"https://user@example.com/page", false},
+		{"//evil.com/page", false},
+		{"/page", false},
+		{"page", false},
+		{"javascript:alert(1)", false},
+		{`https:\\evil.com`, false},
+		{"https://exa mple.com/", false},
+		{"", false},
+	}
+	for _, tt := range tbl {
+		assert.Equal(t, tt.ok, redirectAllowed(tt.from, allowed), tt.from)
+	}
+	assert.False(t, redirectAllowed("https://example.com/", nil))
+	assert.False(t, redirectAllowed("https://example.com/", []string{"example.com", "::bad"}), "entries without host ignored")
+}
@@ -0,0 +1,354 @@
+package provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-pkgz/rest"
+	"github.com/golang-jwt/jwt"
+
+	"github.com/go-pkgz/auth/logger"
+	"github.com/go-pkgz/auth/token"
+)
+
+const (
+	urlResetRequestSuffix = "/reset-request"
+	urlResetSuffix        = "/reset"
+
+	resetState = "reset"
+)
+
+// PasswordReset implements password reset flow for direct provider users.
+// POST /reset-request with user or email sends short-lived single-use reset token via Sender,
+// POST /reset with this token and new password changes the password with Store and invalidates user's sessions.
+// Zero values replaced by defaults.
+type PasswordReset struct {
+	Store         PasswordResetStore // user store, required
+	Sender        Sender             // sender for reset messages, required
+	Template      *template.Template // message template, can use {{.User}}, {{.Address}}, {{.Token}} and {{.Site}}
+	TokenTTL      time.Duration      // reset token lifetime, default 15m
+	RequestLimit  int                // max reset requests per user and per IP in RequestWindow, default 3
+	RequestWindow time.Duration      // rate limit window, default 1h
+	LimitStore    LockoutStore       // rate limit counters store, default is in-memory
+	// UsedStore keeps ids of used reset tokens, default is in-memory, suits a single instance only,
+	// with several instances a shared store should be set, otherwise a token can be used on each of them
+	UsedStore UsedTokenStore
+
+	once    sync.Once
+	sending sync.WaitGroup // reset messages sent in background
+}
+
+// PasswordSetter defines interface of the user store changing user's password
+type PasswordSetter interface {
+	SetPassword(user, password string) error
+}
+
+// PasswordResetStore defines user store methods used by password reset
+type PasswordResetStore interface {
+	PasswordSetter
+	// FindUser finds user by name or email and returns address to send reset token to.
+	// User's ID, if set, is used as-is (prefixed with provider name) for sessions invalidation.
+	FindUser(userOrEmail string) (user token.User, address string, found bool, err error)
+}
+
+// SessionInvalidator defines interface invalidating all existing sessions of the user
+type SessionInvalidator interface {
+	InvalidateUser(userID string) error
+}
+
+const (
+	defaultResetTokenTTL      = 15 * time.Minute
+	defaultResetRequestLimit  = 3
+	defaultResetRequestWindow = time.Hour
+)
+
+var defaultResetTemplate = template.Must(template.New("reset").Parse(
+	"Password reset requested for {{.User}}. Reset token: {{.Token}}"))
+
+func (pr *PasswordReset) init() {
+	pr.once.Do(func() {
+		if pr.TokenTTL == 0 {
+			pr.TokenTTL = defaultResetTokenTTL
+		}
+		if pr.RequestLimit == 0 {
+			pr.RequestLimit = defaultResetRequestLimit
+		}
+		if pr.RequestWindow == 0 {
+			pr.RequestWindow = defaultResetRequestWindow
+		}
+		if pr.LimitStore == nil {
+			pr.LimitStore = NewMemLockoutStore()
+		}
+		if pr.Template == nil {
+			pr.Template = defaultResetTemplate
+		}
+		if pr.UsedStore == nil {
+			pr.UsedStore = NewMemUsedTokenStore()
+		}
+	})
+}
+
+// limited increments request counter for key and reports if limit exceeded
+func (pr *PasswordReset) limited(p DirectHandler, key string) bool {
+	count, err := pr.LimitStore.Incr(key, pr.RequestWindow)
+	if err != nil {
+		p.Logf("[WARN] can't increment reset limit counter for %s, %v", key, err)
+		return false
+	}
+	return count > pr.RequestLimit
+}
+
+// ExtraRoutes returns password reset routes if PasswordReset defined, password change route if PasswordSetter defined
+// and TOTP routes if TOTP defined
+func (p DirectHandler) ExtraRoutes() map[string]http.HandlerFunc {
+	res := map[string]http.HandlerFunc{}
+	if p.PasswordReset != nil {
+		res[urlResetRequestSuffix] = p.ResetRequestHandler
+		res[urlResetSuffix] = p.ResetHandler
+	}
+	if p.PasswordSetter != nil {
+		res[urlPasswordSuffix] = p.PasswordHandler
+	}
+	if p.TOTP != nil {
+		res[urlTOTPSuffix] = p.TOTPHandler
+		res[urlTOTPEnrollSuffix] = p.TOTPEnrollHandler
+	}
+	return res
+}
+
+// ResetRequestHandler sends reset token to the user. Response doesn't depend on user's existence.
+//
+// POST /reset-request?site=site with {"user":"name"} or {"email":"someone@example.com"}, json or form encoded
+func (p DirectHandler) ResetRequestHandler(w http.ResponseWriter, r *http.Request) {
+	pr := p.PasswordReset
+	if pr == nil || pr.Store == nil || pr.Sender == nil {
+		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, fmt.Errorf("password reset not configured"),
+			"password reset not configured")
+		return
+	}
+	pr.init()
+
+	vals, err := requestValues(w, r, p.MaxBodySize)
+	if err != nil {
+		sendParseError(w, r, p.L, err, "failed to parse request")
+		return
+	}
+	userOrEmail := vals.Get("user")
+	if userOrEmail == "" {
+		userOrEmail = vals.Get("email")
+	}
+	if userOrEmail == "" {
+		rest.SendErrorJSON(w, r, p.L, http.StatusBadRequest, fmt.Errorf("no user"), "user or email required")
+		return
+	}
+
+	if pr.limited(p, "reset-ip:"+p.TrustedProxies.ClientIP(r)) {
+		renderJSONWithStatus(w, rest.JSON{"error": "too many reset requests"}, http.StatusTooManyRequests)
+		return
+	}
+
+	resp := rest.JSON{"status": "reset requested"} // the same for existing and non-existing users
+	if pr.limited(p, "reset-user:"+userOrEmail) {
+		p.Logf("[WARN] too many reset requests for %q", userOrEmail)
+		rest.RenderJSON(w, resp)
+		return
+	}
+
+	if err = p.sendReset(r, userOrEmail, vals.Get("site")); err != nil {
+		p.Logf("[WARN] failed to send password reset for %q, %v", userOrEmail, err)
+	}
+	rest.RenderJSON(w, resp)
+}
+
+// sendReset makes reset token for the user, if found, and sends it in background,
+// so response time doesn't reveal user's existence
+func (p DirectHandler) sendReset(r *http.Request, userOrEmail, site string) error {
+	pr := p.PasswordReset
+	u, address, found, err := pr.Store.FindUser(userOrEmail)
+	if err != nil {
+		return fmt.Errorf("can't find user: %w", err)
+	}
+	if !found {
+		p.Logf("[DEBUG] password reset for unknown user %q", userOrEmail)
+		return nil
+	}
+
+	tm, ok := p.TokenService.(tokenMaker)
+	if !ok {
+		return fmt.Errorf("token service can't make tokens")
+	}
+	cid, err := randToken()
+	if err != nil {
+		return fmt.Errorf("can't make token id: %w", err)
+	}
+	claims := token.Claims{
+		Handshake: &token.Handshake{State: resetState, ID: u.Name},
+		User:      &token.User{Name: u.Name, ID: p.userID(u.Name, u.ID, r)},
+		StandardClaims: jwt.StandardClaims{
+			Id:        cid,
+			Audience:  site,
+			ExpiresAt: time.Now().Add(pr.TokenTTL).Unix(),
+			NotBefore: time.Now().Add(-1 * time.Minute).Unix(),
+			Issuer:    p.IssuerFunc.get(r, p.Issuer),
+		},
+	}
+	tkn, err := tm.Token(claims)
+	if err != nil {
+		return fmt.Errorf("can't make reset token: %w", err)
+	}
+
+	buf := bytes.Buffer{}
+	tmplData := struct {
+		User    string
+		Address string
+		Token   string
+		Site    string
+	}{User: u.Name, Address: address, Token: tkn, Site: site}
+	if err = pr.Template.Execute(&buf, tmplData); err != nil {
+		return fmt.Errorf("can't execute reset template: %w", err)
+	}
+	pr.sending.Add(1)
+	go func() {
+		defer pr.sending.Done()
+		if e := pr.Sender.Send(address, buf.String()); e != nil {
+			p.Logf("[WARN] failed to send password reset for %q, %v", userOrEmail, e)
+		}
+	}()
+	return nil
+}
+
+// ResetHandler sets new password for the user from reset token and invalidates user's sessions.
+//
+// POST /reset with {"token":"reset-token","passwd":"new password"}, json or form encoded
+// GET /reset?token=reset-token&passwd=new-password
+func (p DirectHandler) ResetHandler(w http.ResponseWriter, r *http.Request) {
+	pr := p.PasswordReset
+	if pr == nil || pr.Store == nil {
+		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, fmt.Errorf("password reset not configured"),
+			"password reset not configured")
+		return
+	}
+	pr.init()
+
+	vals, err := requestValues(w, r, p.MaxBodySize)
+	if err != nil {
+		sendParseError(w, r, p.L, err, "failed to parse request")
+		return
+	}
+	passwd := vals.Get("passwd")
+	if passwd == "" {
+		rest.SendErrorJSON(w, r, p.L, http.StatusBadRequest, fmt.Errorf("empty password"), "password required")
+		return
+	}
+
+	claims, err := p.TokenService.Parse(vals.Get("token"))
+	if err != nil {
+		rest.SendErrorJSON(w, r, p.L, http.StatusForbidden, err, "invalid reset token")
+		return
+	}
+	if claims.Handshake == nil || claims.Handshake.State != resetState || claims.User == nil || claims.Id == "" {
+		rest.SendErrorJSON(w, r, p.L, http.StatusForbidden, fmt.Errorf("not a reset token"), "invalid reset token")
+		return
+	}
+	expires := time.Unix(claims.ExpiresAt, 0)
+	if time.Now().After(expires) {
+		rest.SendErrorJSON(w, r, p.L, http.StatusForbidden, fmt.Errorf("expired"), "invalid reset token")
+		return
+	}
+	used, err := pr.UsedStore.Exists("reset:" + claims.Id)
+	if err != nil {
+		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to check reset token")
+		return
+	}
+	if used {
+		rest.SendErrorJSON(w, r, p.L, http.StatusForbidden, fmt.Errorf("used"), "invalid reset token")
+		return
+	}
+	if err = p.checkPassword(claims.Handshake.ID, passwd); err != nil {
+		rest.SendErrorJSON(w, r, p.L, http.StatusBadRequest, err, err.Error())
+		return
+	}
+
+	if err = pr.Store.SetPassword(claims.Handshake.ID, passwd); err != nil {
+		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to set password")
+		return
+	}
+	// consumed only once the password is set, failed attempt can be retried with the same token
+	if err = pr.UsedStore.Set("reset:"+claims.Id, time.Until(expires)+usedTokenGrace); err != nil {
+		p.Logf("[WARN] can't mark reset token of %s used, %v", claims.Handshake.ID, err)
+	}
+
+	if p.Invalidator != nil {
+		if err = p.Invalidator.InvalidateUser(claims.User.ID); err != nil {
+			rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to invalidate sessions")
+			return
+		}
+	}
+	rest.RenderJSON(w, rest.JSON{"status": "password changed"})
+}
+
+// requestValues extracts params from query for GET or from json or form body for POST,
+// body limited to maxSize, MaxHTTPBodySize if 0
+func requestValues(w http.ResponseWriter, r *http.Request, maxSize int64) (url.Values, error) {
+	if r.Method == "GET" {
+		return r.URL.Query(), nil
+	}
+	if r.Method != "POST" {
+		return nil, fmt.Errorf("method %s not supported", r.Method)
+	}
+
+	limitBody(w, r, maxSize)
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "" {
+		mt, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return nil, err
+		}
+		contentType = mt
+	}
+
+	if contentType == "application/json" {
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return nil, fmt.Errorf("failed to parse request body: %w", err)
+		}
+		res := r.URL.Query()
+		for k, v := range body {
+			res.Set(k, v)
+		}
+		return res, nil
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return nil, fmt.Errorf("failed to parse request: %w", err)
+	}
+	return r.Form, nil
+}
+
+// limitBody limits request body to maxSize, MaxHTTPBodySize if 0
+func limitBody(w http.ResponseWriter, r *http.Request, maxSize int64) {
+	if r.Body == nil {
+		return
+	}
+	if maxSize <= 0 {
+		maxSize = MaxHTTPBodySize
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+}
+
+// sendParseError responds with 413 if request body exceeded the limit, with 400 and msg otherwise
+func sendParseError(w http.ResponseWriter, r *http.Request, l logger.L, err error, msg string) {
+	if strings.Contains(err.Error(), "http: request body too large") { // http.MaxBytesError, not available in go 1.18
+		rest.SendErrorJSON(w, r, l, http.StatusRequestEntityTooLarge, err, "request body too large")
+		return
+	}
+	rest.SendErrorJSON(w, r, l, http.StatusBadRequest, err, msg)
+}
@@ -0,0 +1,265 @@
+package provider
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/auth/logger"
+	"github.com/go-pkgz/auth/token"
+)
+
+func TestDirect_PasswordReset(t *testing.T) {
+	d, store, emailer, inv := prepResetHandler()
+	svc := NewService(d)
+
+	// request reset by email
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/auth/test/reset-request?site=xyz123",
+		strings.NewReader(`{"email":"myuser@example.com"}`))
+	req.Header.Set("Content-Type", "application/json")
+	svc.Handler(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, `{"status":"reset requested"}`+"\n", rr.Body.String())
+	d.PasswordReset.sending.Wait()
+	assert.Equal(t, "myuser@example.com", emailer.to)
+	require.Contains(t, emailer.text, "token:")
+	resetToken := strings.TrimSpace(strings.Split(emailer.text, "token:")[1])
+
+	claims, err := d.TokenService.Parse(resetToken)
+	require.NoError(t, err)
+	assert.Equal(t, "xyz123", claims.Audience)
+	assert.True(t, claims.ExpiresAt <= time.Now().Add(15*time.Minute).Unix())
+
+	// reset password
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/auth/test/reset",
+		strings.NewReader(`{"token":"`+resetToken+`","passwd":"new-pass"}`))
+	req.Header.Set("Content-Type", "application/json")
+	svc.Handler(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, "new-pass", store.passwords["myuser"])
+	assert.Equal(t, []string{"test_12345"}, inv.users, "sessions invalidated")
+
+	// token is single-use
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/auth/test/reset?token="+resetToken+"&passwd=other-pass", http.NoBody)
+	svc.Handler(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Equal(t, `{"error":"invalid reset token"}`+"\n", rr.Body.String())
+	assert.Equal(t, "new-pass", store.passwords["myuser"])
+	assert.Equal(t, 1, len(inv.users))
+}
+
+func TestDirect_PasswordResetUnknownUser(t *testing.T) {
+	d, _, emailer, _ := prepResetHandler()
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/reset-request", strings.NewReader(`{"user":"myuser"}`))
+	req.Header.Set("Content-Type", "application/json")
+	d.ResetRequestHandler(rr, req)
+	d.PasswordReset.sending.Wait()
+	require.Equal(t, http.StatusOK, rr.Code)
+	existing := rr.Body.String()
+	assert.Equal(t, "myuser@example.com", emailer.to)
+
+	emailer.to = ""
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/reset-request", strings.NewReader(`{"user":"nobody"}`))
+	req.Header.Set("Content-Type", "application/json")
+	d.ResetRequestHandler(rr, req)
+	d.PasswordReset.sending.Wait()
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, existing, rr.Body.String(), "response doesn't reveal user existence")
+	assert.Equal(t, "", emailer.to, "nothing sent")
+
+	emailer.err = errors.New("send failed")
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/reset-request", strings.NewReader(`{"user":"myuser"}`))
+	req.Header.Set("Content-Type", "application/json")
+	d.ResetRequestHandler(rr, req)
+	d.PasswordReset.sending.Wait()
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, existing, rr.Body.String(), "send failure not revealed")
+}
+
+func TestDirect_PasswordResetRateLimit(t *testing.T) {
+	d, _, emailer, _ := prepResetHandler()
+	d.PasswordReset.RequestLimit = 2
+
+	send := func(user, ip string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/reset-request?user="+user, http.NoBody)
+		req.RemoteAddr = ip + ":1234"
+		emailer.to = ""
+		d.ResetRequestHandler(rr, req)
+		d.PasswordReset.sending.Wait()
+		return rr
+	}
+
+	// per user limit, silent
+	assert.Equal(t, http.StatusOK, send("myuser", "10.0.0.1").Code)
+	assert.Equal(t, "myuser@example.com", emailer.to)
+	assert.Equal(t, http.StatusOK, send("myuser", "10.0.0.2").Code)
+	assert.Equal(t, "myuser@example.com", emailer.to)
+	assert.Equal(t, http.StatusOK, send("myuser", "10.0.0.3").Code)
+	assert.Equal(t, "", emailer.to, "user limit reached, not sent")
+
+	// per ip limit
+	assert.Equal(t, http.StatusOK, send("nobody1", "10.0.1.1").Code)
+	assert.Equal(t, http.StatusOK, send("nobody2", "10.0.1.1").Code)
+	assert.Equal(t, http.StatusTooManyRequests, send("nobody3", "10.0.1.1").Code)
+}
+
+func TestDirect_PasswordResetBadTokens(t *testing.T) {
+	d, store, _, inv := prepResetHandler()
+	tm := d.TokenService.(tokenMaker)
+
+	makeToken := func(state string, exp time.Time) string {
+		tkn, err := tm.Token(token.Claims{
+			Handshake:      &token.Handshake{State: state, ID: "myuser"},
+			User:           &token.User{Name: "myuser", ID: "test_12345"},
+			StandardClaims: jwt.StandardClaims{Id: "some-id", ExpiresAt: exp.Unix()},
+		})
+		require.NoError(t, err)
+		return tkn
+	}
+
+	tbl := []struct {
+		tkn, passwd string
+		code        int
+	}{
+		{"bad", "new-pass", http.StatusForbidden},
+		{makeToken("confirm", time.Now().Add(time.Minute)), "new-pass", http.StatusForbidden},
+		{makeToken(resetState, time.Now().Add(-time.Minute)), "new-pass", http.StatusForbidden},
+		{makeToken(resetState, time.Now().Add(time.Minute)), "", http.StatusBadRequest},
+	}
+	for i, tt := range tbl {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/reset?token="+tt.tkn+"&passwd="+tt.passwd, http.NoBody)
+		d.ResetHandler(rr, req)
+		assert.Equal(t, tt.code, rr.Code, "case #%d", i)
+	}
+	assert.Equal(t, "old-pass", store.passwords["myuser"])
+	assert.Empty(t, inv.users)
+}
+
+func TestDirect_PasswordResetBackgroundSend(t *testing.T) {
+	d, _, _, _ := prepResetHandler()
+	release := make(chan struct{})
+	sent := make(chan string, 1)
+	d.PasswordReset.Sender = SenderFunc(func(_, text string) error {
+		<-release // slow sender doesn't delay the response
+		sent <- text
+		return nil
+	})
+
+	rr := httptest.NewRecorder()
+	d.ResetRequestHandler(rr, httptest.NewRequest("GET", "/reset-request?user=myuser", http.NoBody))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `{"status":"reset requested"}`+"\n", rr.Body.String())
+	assert.Empty(t, sent, "not sent yet")
+	close(release)
+	d.PasswordReset.sending.Wait()
+	assert.Contains(t, <-sent, "Reset token:")
+}
+
+func TestDirect_PasswordResetFailedWrite(t *testing.T) {
+	d, store, _, inv := prepResetHandler()
+	tm := d.TokenService.(tokenMaker)
+	tkn, err := tm.Token(token.Claims{
+		Handshake:      &token.Handshake{State: resetState, ID: "myuser"},
+		User:           &token.User{Name: "myuser", ID: "test_12345"},
+		StandardClaims: jwt.StandardClaims{Id: "some-id", ExpiresAt: time.Now().Add(time.Minute).Unix()},
+	})
+	require.NoError(t, err)
+	reset := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		d.ResetHandler(rr, httptest.NewRequest("GET", "/reset?token="+tkn+"&passwd=new-pass", http.NoBody))
+		return rr
+	}
+
+	store.err = errors.New("db failed")
+	assert.Equal(t, http.StatusInternalServerError, reset().Code)
+	assert.Empty(t, inv.users)
+
+	store.err = nil
+	assert.Equal(t, http.StatusOK, reset().Code, "token not consumed by failed write")
+	assert.Equal(t, "new-pass", store.passwords["myuser"])
+	assert.Equal(t, http.StatusForbidden, reset().Code, "consumed by successful one")
+
+	// used tokens kept by the shared store
+	d2, _, _, _ := prepResetHandler()
+	d2.PasswordReset.UsedStore = d.PasswordReset.UsedStore
+	rr := httptest.NewRecorder()
+	d2.ResetHandler(rr, httptest.NewRequest("GET", "/reset?token="+tkn+"&passwd=other-pass", http.NoBody))
+	assert.Equal(t, http.StatusForbidden, rr.Code, "used on another instance")
+}
+
+func TestDirect_PasswordResetNotConfigured(t *testing.T) {
+	d, _, _, _ := prepResetHandler()
+	d.PasswordReset = nil
+	assert.Empty(t, d.ExtraRoutes())
+
+	rr := httptest.NewRecorder()
+	NewService(d).Handler(rr, httptest.NewRequest("POST", "/auth/test/reset-request", http.NoBody))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func prepResetHandler() (DirectHandler, *mockResetStore, *mockSender, *mockInvalidator) {
+	store := &mockResetStore{passwords: map[string]string{"myuser": "old-pass"}}
+	emailer := &mockSender{}
+	inv := &mockInvalidator{}
+	d := DirectHandler{
+		ProviderName: "test",
+		CredChecker: CredCheckerFunc(func(user, password string) (ok bool, err error) {
+			return store.passwords[user] == password, nil
+		}),
+		TokenService: token.NewService(token.Opts{
+			SecretReader:   token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+			TokenDuration:  time.Hour,
+			CookieDuration: time.Hour * 24 * 31,
+		}),
+		Issuer:        "iss-test",
+		L:             logger.NoOp{},
+		PasswordReset: &PasswordReset{Store: store, Sender: emailer},
+		Invalidator:   inv,
+	}
+	return d, store, emailer, inv
+}
+
+type mockResetStore struct {
+	passwords map[string]string
+	err       error
+}
+
+func (m *mockResetStore) FindUser(userOrEmail string) (user token.User, address string, found bool, err error) {
+	if userOrEmail == "myuser" || userOrEmail == "myuser@example.com" {
+		return token.User{Name: "myuser", ID: "12345"}, "myuser@example.com", true, nil
+	}
+	return token.User{}, "", false, nil
+}
+
+func (m *mockResetStore) SetPassword(user, password string) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.passwords[user] = password
+	return nil
+}
+
+type mockInvalidator struct {
+	users []string
+}
+
+func (m *mockInvalidator) InvalidateUser(userID string) error {
+	m.users = append(m.users, userID)
+	return nil
+}
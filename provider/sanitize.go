@@ -0,0 +1,52 @@
+package provider
+
+import (
+	"html/template"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/microcosm-cc/bluemonday"
+)
+
+const defaultSanitizeMaxLen = 128
+
+// ugcPolicy is made once, policy is safe for concurrent use and making it on each call is expensive
+var ugcPolicy = bluemonday.UGCPolicy()
+
+// SanitizeOpts defines options of Sanitize
+type SanitizeOpts struct {
+	MaxLen       int  // max length of the result in bytes, default 128
+	KeepNewlines bool // keep "\n" in the result, for multi-line fields, "\r" is removed anyway
+}
+
+// Sanitize cleans user-provided input, like user name, address or site, used by VerifyHandler. It does, in order:
+//   - removes "\r", so the result can't inject headers into the message, even with newlines kept
+//   - strips unsafe HTML with bluemonday's UGC policy, i.e. <script> removed with its content, "<x" treated as a tag
+//   - escapes the result as HTML, so allowed tags become text, i.e. "<b>" turns into "&lt;b&gt;"
+//   - unescapes "&amp;", "&#34;" and "&#39;" back, so quotes kept as-is, while "&" stays "&amp;" as escaped by bluemonday
+//   - removes "\n" unless KeepNewlines set and trims leading and trailing spaces, other control chars kept, NUL replaced by U+FFFD
+//   - truncates the result to MaxLen bytes on rune boundary, so multibyte chars are never cut
+func Sanitize(input string, opts SanitizeOpts) string {
+	maxLen := opts.MaxLen
+	if maxLen == 0 {
+		maxLen = defaultSanitizeMaxLen
+	}
+
+	res := strings.ReplaceAll(input, "\r", "")
+	res = ugcPolicy.Sanitize(res)
+	res = template.HTMLEscapeString(res)
+	res = strings.ReplaceAll(res, "&amp;", "&")
+	res = strings.ReplaceAll(res, "&#34;", "\"")
+	res = strings.ReplaceAll(res, "&#39;", "'")
+	if !opts.KeepNewlines {
+		res = strings.ReplaceAll(res, "\n", "")
+	}
+	res = strings.TrimSpace(res)
+	if len(res) <= maxLen {
+		return res
+	}
+	for maxLen > 0 && !utf8.RuneStart(res[maxLen]) {
+		maxLen--
+	}
+	return res[:maxLen]
+}
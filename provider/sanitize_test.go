@@ -0,0 +1,72 @@
+package provider
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSanitize(t *testing.T) {
+	tbl := []struct {
+		name string
+		inp  string
+		opts SanitizeOpts
+		res  string
+	}{
+		{"plain", "john", SanitizeOpts{}, "john"},
+		{"spaces trimmed", "  john  ", SanitizeOpts{}, "john"},
+		{"allowed tags escaped", "<b>john</b>", SanitizeOpts{}, "&lt;b&gt;john&lt;/b&gt;"},
+		{"script removed", "<script>alert(1)</script>john", SanitizeOpts{}, "john"},
+		{"unsafe link removed", `<a href="javascript:x">j</a>`, SanitizeOpts{}, "j"},
+		{"unsafe attr removed", "<img src=x onerror=alert(1)>", SanitizeOpts{}, `&lt;img src="x"&gt;`},
+		{"lt starts a tag", "x<y", SanitizeOpts{}, "x"},
+		{"gt escaped", "a>b", SanitizeOpts{}, "a&gt;b"},
+		{"ampersand escaped once", "tom & jerry", SanitizeOpts{}, "tom &amp; jerry"},
+		{"entities kept", "&lt;b&gt; &amp;", SanitizeOpts{}, "&lt;b&gt; &amp;"},
+		{"quotes unescaped", `o'brien "x"`, SanitizeOpts{}, `o'brien "x"`},
+		{"quote entity unescaped", "&#39;", SanitizeOpts{}, "'"},
+		{"new line removed", "a\nb", SanitizeOpts{}, "ab"},
+		{"cr removed, tab kept", "a\r\tb", SanitizeOpts{}, "a\tb"},
+		{"control chars trimmed", "\tjohn\r\n", SanitizeOpts{}, "john"},
+		{"new lines kept", "line1\nline2\r\nline3", SanitizeOpts{KeepNewlines: true}, "line1\nline2\nline3"},
+		{"lone cr removed with new lines kept", "a\rBcc: x@example.com", SanitizeOpts{KeepNewlines: true},
+			"aBcc: x@example.com"},
+		{"new lines inside kept, trimmed at ends", "\nnote\n\n", SanitizeOpts{KeepNewlines: true}, "note"},
+		{"nul replaced", "a\x00b", SanitizeOpts{}, "a�b"},
+		{"unicode", "привет", SanitizeOpts{}, "привет"},
+		{"truncated to 128", strings.Repeat("a", 200), SanitizeOpts{}, strings.Repeat("a", 128)},
+		{"truncated after escaping", strings.Repeat(">", 50), SanitizeOpts{}, strings.Repeat("&gt;", 32)},
+		{"custom max len", "john doe", SanitizeOpts{MaxLen: 4}, "john"},
+		{"max len in bytes, cut on rune boundary", "абв", SanitizeOpts{MaxLen: 3}, "а"},
+		{"multibyte fits max len", "абв", SanitizeOpts{MaxLen: 4}, "аб"},
+		{"emoji not split", "ab😀", SanitizeOpts{MaxLen: 5}, "ab"},
+		{"max len shorter than rune", "😀", SanitizeOpts{MaxLen: 2}, ""},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			res := Sanitize(tt.inp, tt.opts)
+			assert.Equal(t, tt.res, res)
+			assert.True(t, utf8.ValidString(res))
+		})
+	}
+}
+
+func BenchmarkSanitize(b *testing.B) {
+	inp := `John <b>Doe</b> <script>alert(1)</script> & "friends"`
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Sanitize(inp, SanitizeOpts{})
+	}
+}
+
+// BenchmarkSanitize_PolicyPerCall makes bluemonday policy on each call, as Sanitize did before, for comparison
+func BenchmarkSanitize_PolicyPerCall(b *testing.B) {
+	inp := `John <b>Doe</b> <script>alert(1)</script> & "friends"`
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		bluemonday.UGCPolicy().Sanitize(inp)
+	}
+}
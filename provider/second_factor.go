@@ -0,0 +1,318 @@
+package provider
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-pkgz/rest"
+
+	"github.com/go-pkgz/auth/logger"
+	"github.com/go-pkgz/auth/token"
+)
+
+const (
+	urlSecondFactorEnrollSuffix   = "/enroll"
+	urlSecondFactorRecoverySuffix = "/recovery-codes"
+
+	recoveryCodesCount = 10
+)
+
+var recoveryEncoding = base32.NewEncoding("abcdefghijkmnpqrstuvwxyz23456789").WithPadding(base32.NoPadding)
+
+// SecondFactorHandler is a provider adding TOTP second factor to sessions made by any other provider, i.e. oauth2.
+// The logged-in user enrolls with POST /enroll and confirms the session with POST /login and the code, then the
+// session token re-issued with second factor verification time, checked by StepUp middleware.
+// With Recovery store the enrollment makes single-use recovery codes, accepted by /login instead of the code.
+type SecondFactorHandler struct {
+	logger.L
+	ProviderName string
+	TokenService TokenService
+	Issuer       string
+	IssuerFunc   IssuerFunc        // optional issuer of tokens by request, Issuer used if not set or empty
+	TOTP         *TOTP             // TOTP settings and secrets store, can be shared with direct provider, required
+	Recovery     RecoveryCodeStore // optional store of recovery codes
+	Audit        AuditFunc         // optional receiver of audit events, like failed codes
+	MaxBodySize  int64             // max size of request body, default MaxHTTPBodySize
+
+	TrustedProxies *TrustedProxies // proxies trusted to pass client ip for audit events, default ones if nil
+}
+
+// RecoveryCodeStore keeps hashes of single-use recovery codes of the users
+type RecoveryCodeStore interface {
+	SetRecoveryCodes(userID string, hashes []string) error    // replaces all codes of the user
+	UseRecoveryCode(userID, hash string) (ok bool, err error) // removes the code, false if the user has no such code
+}
+
+// Name of the handler
+func (h SecondFactorHandler) Name() string { return h.ProviderName }
+
+// ExtraRoutes returns enrollment and recovery codes routes
+func (h SecondFactorHandler) ExtraRoutes() map[string]http.HandlerFunc {
+	routes := map[string]http.HandlerFunc{urlSecondFactorEnrollSuffix: h.EnrollHandler}
+	if h.Recovery != nil {
+		routes[urlSecondFactorRecoverySuffix] = h.RecoveryCodesHandler
+	}
+	return routes
+}
+
+// LoginHandler reports second factor state of the session or verifies the code and re-issues the session token
+// with second factor verification time. Failed attempts limited by TOTP.MaxAttempts per TOTP.TokenTTL.
+//
+// GET /login returns {"enrolled":true,"verified_at":"2006-01-02T15:04:05Z"}
+// POST /login with {"code":"123456"} or {"recovery_code":"abcde-fghij"}, json or form encoded
+func (h SecondFactorHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := h.sessionClaims(w, r)
+	if !ok {
+		return
+	}
+	u := *claims.User
+
+	_, enrolled, err := h.TOTP.Store.TOTPSecret(u.ID)
+	if err != nil {
+		rest.SendErrorJSON(w, r, h.L, http.StatusInternalServerError, err, "failed to get totp secret")
+		return
+	}
+
+	if r.Method == "GET" {
+		resp := rest.JSON{"enrolled": enrolled, "verified_at": nil}
+		if at := u.SecondFactorAt(); !at.IsZero() {
+			resp["verified_at"] = at
+		}
+		rest.RenderJSON(w, resp)
+		return
+	}
+	if r.Method != "POST" {
+		rest.SendErrorJSON(w, r, h.L, http.StatusMethodNotAllowed, fmt.Errorf("method %s", r.Method), "GET or POST required")
+		return
+	}
+	if !enrolled {
+		rest.SendErrorJSON(w, r, h.L, http.StatusConflict, fmt.Errorf("user %s not enrolled", u.ID), "not enrolled")
+		return
+	}
+
+	vals, err := requestValues(w, r, h.MaxBodySize)
+	if err != nil {
+		sendParseError(w, r, h.L, err, "failed to parse request")
+		return
+	}
+
+	key := "2fa:" + h.ProviderName + ":" + u.ID
+	count, err := h.TOTP.Attempts.Incr(key, h.TOTP.TokenTTL)
+	if err != nil {
+		rest.SendErrorJSON(w, r, h.L, http.StatusInternalServerError, err, "failed to count attempts")
+		return
+	}
+	if count > h.TOTP.MaxAttempts {
+		rest.SendErrorJSON(w, r, h.L, http.StatusTooManyRequests, fmt.Errorf("%d attempts", count), "too many attempts")
+		return
+	}
+
+	verified, err := h.verify(u.ID, vals.Get("code"), vals.Get("recovery_code"))
+	if err != nil {
+		rest.SendErrorJSON(w, r, h.L, http.StatusInternalServerError, err, "failed to check code")
+		return
+	}
+	if !verified {
+		h.Audit.send(AuditEvent{Type: AuditSecondFactorFailed, Provider: h.ProviderName, User: loginName(u),
+			IP: h.TrustedProxies.ClientIP(r)})
+		rest.SendErrorJSON(w, r, h.L, http.StatusForbidden, nil, "invalid code")
+		return
+	}
+	if err = h.TOTP.Attempts.Reset(key); err != nil {
+		h.Logf("[WARN] can't reset second factor attempts of %s, %v", u.ID, err)
+	}
+
+	h.setVerified(w, r, claims, rest.JSON{"status": "verified"})
+}
+
+// verify checks TOTP code or, if not set, recovery code of the user. Recovery code is burned on use.
+func (h SecondFactorHandler) verify(userID, code, recoveryCode string) (bool, error) {
+	if code != "" {
+		secret, _, err := h.TOTP.Store.TOTPSecret(userID)
+		if err != nil {
+			return false, fmt.Errorf("failed to get totp secret: %w", err)
+		}
+		return h.TOTP.accept(userID, secret, code)
+	}
+	if recoveryCode == "" || h.Recovery == nil {
+		return false, nil
+	}
+	ok, err := h.Recovery.UseRecoveryCode(userID, RecoveryCodeHash(recoveryCode))
+	if err != nil {
+		return false, fmt.Errorf("failed to use recovery code: %w", err)
+	}
+	if ok {
+		h.Logf("[INFO] recovery code used by %s", userID)
+	}
+	return ok, nil
+}
+
+// EnrollHandler enrolls logged-in user to TOTP. The first request makes a new secret and returns it with
+// otpauth:// URI, to be shown as QR code for authenticator apps. The second request with the code from the app
+// confirms enrollment, saves the secret and re-issues the session token with second factor time. With Recovery store
+// the response to confirmation has new recovery codes, shown to the user once.
+//
+// POST /enroll
+// POST /enroll with {"code":"123456"}, json or form encoded
+func (h SecondFactorHandler) EnrollHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		rest.SendErrorJSON(w, r, h.L, http.StatusMethodNotAllowed, fmt.Errorf("method %s", r.Method), "POST required")
+		return
+	}
+	claims, ok := h.sessionClaims(w, r)
+	if !ok {
+		return
+	}
+	userID := claims.User.ID
+
+	vals, err := requestValues(w, r, h.MaxBodySize)
+	if err != nil {
+		sendParseError(w, r, h.L, err, "failed to parse request")
+		return
+	}
+
+	_, enrolled, err := h.TOTP.Store.TOTPSecret(userID)
+	if err != nil {
+		rest.SendErrorJSON(w, r, h.L, http.StatusInternalServerError, err, "failed to get totp secret")
+		return
+	}
+	if enrolled {
+		rest.SendErrorJSON(w, r, h.L, http.StatusConflict, fmt.Errorf("user %s enrolled", userID), "already enrolled")
+		return
+	}
+
+	code := vals.Get("code")
+	if code == "" { // start enrollment
+		secret, e := newTOTPSecret()
+		if e != nil {
+			rest.SendErrorJSON(w, r, h.L, http.StatusInternalServerError, e, "can't make totp secret")
+			return
+		}
+		h.TOTP.setPending(userID, secret)
+		rest.RenderJSON(w, h.TOTP.enrollment(h.IssuerFunc.get(r, h.Issuer), loginName(*claims.User), secret))
+		return
+	}
+
+	secret, ok := h.TOTP.getPending(userID)
+	if !ok {
+		rest.SendErrorJSON(w, r, h.L, http.StatusBadRequest, fmt.Errorf("no pending enrollment"), "no pending enrollment")
+		return
+	}
+	accepted, err := h.TOTP.accept(userID, secret, code)
+	if err != nil {
+		rest.SendErrorJSON(w, r, h.L, http.StatusInternalServerError, err, "failed to check code")
+		return
+	}
+	if !accepted {
+		rest.SendErrorJSON(w, r, h.L, http.StatusForbidden, nil, "invalid code")
+		return
+	}
+
+	resp := rest.JSON{"status": "enrolled"}
+	if h.Recovery != nil {
+		codes, e := h.newRecoveryCodes(userID)
+		if e != nil {
+			rest.SendErrorJSON(w, r, h.L, http.StatusInternalServerError, e, "failed to make recovery codes")
+			return
+		}
+		resp["recovery_codes"] = codes
+	}
+	if err = h.TOTP.Store.SetTOTPSecret(userID, secret); err != nil {
+		rest.SendErrorJSON(w, r, h.L, http.StatusInternalServerError, err, "failed to save totp secret")
+		return
+	}
+	h.TOTP.removePending(userID)
+	h.setVerified(w, r, claims, resp)
+}
+
+// RecoveryCodesHandler replaces recovery codes of the user with new ones. Requires session with second factor
+// verified within TOTP.TokenTTL.
+//
+// POST /recovery-codes
+func (h SecondFactorHandler) RecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		rest.SendErrorJSON(w, r, h.L, http.StatusMethodNotAllowed, fmt.Errorf("method %s", r.Method), "POST required")
+		return
+	}
+	claims, ok := h.sessionClaims(w, r)
+	if !ok {
+		return
+	}
+	if at := claims.User.SecondFactorAt(); at.IsZero() || h.TOTP.now().Sub(at) > h.TOTP.TokenTTL {
+		rest.SendErrorJSON(w, r, h.L, http.StatusForbidden, fmt.Errorf("second factor verified at %v", at),
+			"second factor required")
+		return
+	}
+	codes, err := h.newRecoveryCodes(claims.User.ID)
+	if err != nil {
+		rest.SendErrorJSON(w, r, h.L, http.StatusInternalServerError, err, "failed to make recovery codes")
+		return
+	}
+	rest.RenderJSON(w, rest.JSON{"recovery_codes": codes})
+}
+
+// AuthHandler doesn't do anything for second factor provider
+func (h SecondFactorHandler) AuthHandler(http.ResponseWriter, *http.Request) {}
+
+// LogoutHandler - GET /logout
+func (h SecondFactorHandler) LogoutHandler(w http.ResponseWriter, _ *http.Request) {
+	h.TokenService.Reset(w)
+}
+
+// sessionClaims returns claims of the session made by any provider, responds with error if there is no session
+// or the handler is not configured
+func (h SecondFactorHandler) sessionClaims(w http.ResponseWriter, r *http.Request) (token.Claims, bool) {
+	if h.TOTP == nil || h.TOTP.Store == nil {
+		rest.SendErrorJSON(w, r, h.L, http.StatusInternalServerError, fmt.Errorf("totp not configured"), "totp not configured")
+		return token.Claims{}, false
+	}
+	h.TOTP.init()
+	claims, _, err := h.TokenService.Get(r)
+	if err != nil || claims.User == nil || claims.Handshake != nil {
+		rest.SendErrorJSON(w, r, h.L, http.StatusUnauthorized, err, "not authorized")
+		return token.Claims{}, false
+	}
+	return claims, true
+}
+
+// setVerified re-issues the session token with second factor verification time and responds with resp
+func (h SecondFactorHandler) setVerified(w http.ResponseWriter, r *http.Request, claims token.Claims, resp rest.JSON) {
+	claims.User.SetSecondFactor(h.TOTP.now())
+	claims.ExpiresAt = 0 // re-issued with the regular duration
+	if _, err := h.TokenService.Set(w, claims); err != nil {
+		rest.SendErrorJSON(w, r, h.L, http.StatusInternalServerError, err, "failed to set token")
+		return
+	}
+	rest.RenderJSON(w, resp)
+}
+
+// newRecoveryCodes makes recovery codes, saves their hashes to the store and returns the codes
+func (h SecondFactorHandler) newRecoveryCodes(userID string) ([]string, error) {
+	codes := make([]string, recoveryCodesCount)
+	hashes := make([]string, recoveryCodesCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, fmt.Errorf("can't get random: %w", err)
+		}
+		c := recoveryEncoding.EncodeToString(b)[:10]
+		codes[i] = c[:5] + "-" + c[5:]
+		hashes[i] = RecoveryCodeHash(codes[i])
+	}
+	if err := h.Recovery.SetRecoveryCodes(userID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// RecoveryCodeHash returns hash of the recovery code kept by RecoveryCodeStore. Case, spaces and dashes are ignored.
+func RecoveryCodeHash(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
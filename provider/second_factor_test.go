@@ -0,0 +1,201 @@
+package provider
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/auth/logger"
+	"github.com/go-pkgz/auth/token"
+)
+
+type mockRecoveryStore struct {
+	lock  sync.Mutex
+	codes map[string]map[string]bool
+}
+
+func (m *mockRecoveryStore) SetRecoveryCodes(userID string, hashes []string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.codes[userID] = map[string]bool{}
+	for _, h := range hashes {
+		m.codes[userID][h] = true
+	}
+	return nil
+}
+
+func (m *mockRecoveryStore) UseRecoveryCode(userID, hash string) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.codes[userID][hash] {
+		return false, nil
+	}
+	delete(m.codes[userID], hash)
+	return true, nil
+}
+
+func TestSecondFactorHandler(t *testing.T) {
+	clock := time.Now()
+	store := &mockTOTPStore{secrets: map[string]string{}}
+	recovery := &mockRecoveryStore{codes: map[string]map[string]bool{}}
+	var events []AuditEvent
+	h := SecondFactorHandler{
+		ProviderName: "2fa",
+		TokenService: token.NewService(token.Opts{
+			SecretReader:   token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+			TokenDuration:  time.Hour,
+			CookieDuration: time.Hour * 24 * 31,
+			DisableXSRF:    true,
+		}),
+		Issuer:   "iss-test",
+		L:        logger.NoOp{},
+		TOTP:     &TOTP{Store: store, MaxAttempts: 3, now: func() time.Time { return clock }},
+		Recovery: recovery,
+		Audit:    func(ev AuditEvent) { events = append(events, ev) },
+	}
+	svc := NewService(h)
+
+	sessTkn, err := h.TokenService.(tokenMaker).Token(token.Claims{
+		User:           &token.User{Name: "admin", ID: "github_123"},
+		StandardClaims: jwt.StandardClaims{Id: "sess1", Audience: "xyz123", ExpiresAt: time.Now().Add(time.Hour).Unix()},
+	})
+	require.NoError(t, err)
+
+	request := func(method, path, tkn string, body url.Values) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tkn != "" {
+			req.Header.Set("X-JWT", tkn)
+		}
+		svc.Handler(rr, req)
+		return rr
+	}
+	sessionClaims := func(rr *httptest.ResponseRecorder) token.Claims {
+		req := &http.Request{Header: http.Header{"Cookie": rr.Header()["Set-Cookie"]}}
+		c, err := req.Cookie("JWT")
+		require.NoError(t, err)
+		claims, err := h.TokenService.Parse(c.Value)
+		require.NoError(t, err)
+		return claims
+	}
+	codeFor := func(secret string, ts time.Time) string {
+		key, err := totpEncoding.DecodeString(secret)
+		require.NoError(t, err)
+		return totpCode(key, ts.Unix()/totpPeriod)
+	}
+
+	rr := request("GET", "/auth/2fa/login", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code, "session required")
+	rr = request("GET", "/auth/2fa/login", sessTkn, nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, `{"enrolled":false,"verified_at":null}`+"\n", rr.Body.String())
+	rr = request("POST", "/auth/2fa/login", sessTkn, url.Values{"code": {"000000"}})
+	assert.Equal(t, http.StatusConflict, rr.Code, "not enrolled")
+
+	// enroll
+	rr = request("POST", "/auth/2fa/enroll", sessTkn, nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	enrollResp := struct {
+		Secret  string `json:"secret"`
+		Issuer  string `json:"issuer"`
+		Account string `json:"account"`
+	}{}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &enrollResp))
+	assert.Equal(t, "iss-test", enrollResp.Issuer)
+	assert.Equal(t, "admin", enrollResp.Account)
+
+	rr = request("POST", "/auth/2fa/enroll", sessTkn, url.Values{"code": {codeFor(enrollResp.Secret, clock)}})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	confirmResp := struct {
+		Status        string   `json:"status"`
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &confirmResp))
+	assert.Equal(t, "enrolled", confirmResp.Status)
+	require.Equal(t, 10, len(confirmResp.RecoveryCodes))
+	assert.Regexp(t, `^[a-z2-9]{5}-[a-z2-9]{5}$`, confirmResp.RecoveryCodes[0])
+	assert.Equal(t, 10, len(recovery.codes["github_123"]), "hashes saved")
+	assert.Equal(t, enrollResp.Secret, store.secrets["github_123"])
+	claims := sessionClaims(rr)
+	assert.Equal(t, clock.Unix(), claims.User.SecondFactorAt().Unix(), "enrollment verifies session")
+	assert.Equal(t, "sess1", claims.Id)
+
+	// verify with code
+	clock = clock.Add(time.Minute)
+	rr = request("POST", "/auth/2fa/login", sessTkn, url.Values{"code": {"000000"}})
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Equal(t, `{"error":"invalid code"}`+"\n", rr.Body.String())
+	require.Equal(t, 1, len(events))
+	assert.Equal(t, AuditSecondFactorFailed, events[0].Type)
+	assert.Equal(t, "2fa", events[0].Provider)
+
+	rr = request("POST", "/auth/2fa/login", sessTkn, url.Values{"code": {codeFor(enrollResp.Secret, clock)}})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, `{"status":"verified"}`+"\n", rr.Body.String())
+	claims = sessionClaims(rr)
+	assert.Equal(t, clock.Unix(), claims.User.SecondFactorAt().Unix())
+	assert.Equal(t, "github_123", claims.User.ID)
+	assert.Equal(t, "xyz123", claims.Audience)
+
+	rr = request("POST", "/auth/2fa/login", sessTkn, url.Values{"code": {codeFor(enrollResp.Secret, clock)}})
+	assert.Equal(t, http.StatusForbidden, rr.Code, "code reuse rejected")
+
+	// verify with recovery code, burned on use
+	rr = request("POST", "/auth/2fa/login", sessTkn, url.Values{"recovery_code": {strings.ToUpper(confirmResp.RecoveryCodes[3])}})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, 9, len(recovery.codes["github_123"]))
+	rr = request("POST", "/auth/2fa/login", sessTkn, url.Values{"recovery_code": {confirmResp.RecoveryCodes[3]}})
+	assert.Equal(t, http.StatusForbidden, rr.Code, "recovery code is single-use")
+
+	// attempts limited
+	for i := 0; i < 2; i++ {
+		rr = request("POST", "/auth/2fa/login", sessTkn, url.Values{"code": {"000000"}})
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+	}
+	rr = request("POST", "/auth/2fa/login", sessTkn, url.Values{"recovery_code": {confirmResp.RecoveryCodes[4]}})
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, 9, len(recovery.codes["github_123"]), "not used when locked")
+
+	// new recovery codes require fresh second factor
+	rr = request("POST", "/auth/2fa/recovery-codes", sessTkn, nil)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	verifiedTkn, err := h.TokenService.(tokenMaker).Token(token.Claims{
+		User: &token.User{Name: "admin", ID: "github_123",
+			Attributes: map[string]interface{}{"2fa_at": clock.Add(-time.Minute).Format(time.RFC3339)}},
+		StandardClaims: jwt.StandardClaims{Id: "sess1", ExpiresAt: time.Now().Add(time.Hour).Unix()},
+	})
+	require.NoError(t, err)
+	rr = request("POST", "/auth/2fa/recovery-codes", verifiedTkn, nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, 10, len(recovery.codes["github_123"]))
+	assert.NotContains(t, rr.Body.String(), confirmResp.RecoveryCodes[0])
+}
+
+func TestSecondFactorHandler_NotConfigured(t *testing.T) {
+	h := SecondFactorHandler{ProviderName: "2fa", L: logger.NoOp{}}
+	rr := httptest.NewRecorder()
+	h.LoginHandler(rr, httptest.NewRequest("GET", "/login", http.NoBody))
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	assert.Equal(t, []string{"/enroll"}, func() (res []string) {
+		for k := range h.ExtraRoutes() {
+			res = append(res, k)
+		}
+		return res
+	}(), "no recovery codes route without store")
+}
+
+func TestRecoveryCodeHash(t *testing.T) {
+	assert.Equal(t, RecoveryCodeHash("abcde-fghij"), RecoveryCodeHash(" ABCDE FGHIJ"))
+	assert.NotEqual(t, RecoveryCodeHash("abcde-fghij"), RecoveryCodeHash("abcde-fghik"))
+	assert.Equal(t, 64, len(RecoveryCodeHash("abcde-fghij")))
+}
@@ -0,0 +1,36 @@
+package provider
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrPermanentSend marks delivery errors retry can't fix, i.e. invalid or unknown address. Senders wrap their errors
+// with it, i.e. fmt.Errorf("%w: %v", ErrPermanentSend, err), and VerifyHandler responds with 400.
+var ErrPermanentSend = errors.New("permanent send failure")
+
+// ErrTransientSend marks delivery errors which may pass on retry, i.e. unreachable or rate limiting server.
+// VerifyHandler responds to them with 502.
+var ErrTransientSend = errors.New("transient send failure")
+
+// sendErr marks error of built-in senders with ErrPermanentSend or ErrTransientSend, keeps its message
+type sendErr struct {
+	err  error
+	kind error
+}
+
+func (e *sendErr) Error() string { return e.err.Error() }
+
+// Unwrap returns the marked error
+func (e *sendErr) Unwrap() error { return e.err }
+
+// Is reports the kind of the error
+func (e *sendErr) Is(target error) bool { return target == e.kind }
+
+// sendContext delivers text with SendContext of SenderWithContext, or with Send of other senders
+func sendContext(ctx context.Context, s Sender, address, text string) error {
+	if cs, ok := s.(SenderWithContext); ok {
+		return cs.SendContext(ctx, address, text)
+	}
+	return s.Send(address, text)
+}
@@ -83,3 +83,8 @@ func (e *Email) Send(to, text string) error {
 		Subject: e.Subject,
 	})
 }
+
+// Channel returns channel name for delivery metrics
+func (e *Email) Channel() string {
+	return "email"
+}
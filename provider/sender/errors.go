@@ -0,0 +1,28 @@
+package sender
+
+import (
+	"fmt"
+	"time"
+)
+
+// RetryAfterError is implemented by errors of rate-limited senders, i.e. on 429 response.
+// Callers can check it with errors.As and retry the delivery after RetryAfter duration.
+type RetryAfterError interface {
+	error
+	RetryAfter() time.Duration
+}
+
+// retryAfterErr implements RetryAfterError
+type retryAfterErr struct {
+	channel string
+	after   time.Duration
+}
+
+func (e *retryAfterErr) Error() string {
+	return fmt.Sprintf("%s rate limited, retry after %v", e.channel, e.after)
+}
+
+// RetryAfter returns duration to wait before the next attempt
+func (e *retryAfterErr) RetryAfter() time.Duration {
+	return e.after
+}
@@ -0,0 +1,100 @@
+package sender
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-pkgz/auth/httpclient"
+	"github.com/go-pkgz/auth/logger"
+)
+
+const defaultSlackAPI = "https://slack.com/api/"
+
+// SlackSender implements sender interface for VerifyHandler with Slack's chat.postMessage.
+// Address is Slack user or channel ID, message is sent by the bot.
+type SlackSender struct {
+	SlackParams
+	logger.L
+}
+
+// SlackParams with all needed to make new SlackSender
+type SlackParams struct {
+	Token      string        // bot token, xoxb-...
+	APIURL     string        // Slack API url, default https://slack.com/api/
+	HTTPClient *http.Client  // http client, default one made with TimeOut
+	TimeOut    time.Duration // request timeout for default client, default 10s
+}
+
+// NewSlackSender creates Slack sender
+func NewSlackSender(params SlackParams, l logger.L) *SlackSender {
+	if params.APIURL == "" {
+		params.APIURL = defaultSlackAPI
+	}
+	if params.TimeOut == 0 {
+		params.TimeOut = 10 * time.Second
+	}
+	if params.HTTPClient == nil {
+		params.HTTPClient = httpclient.New(params.TimeOut)
+	}
+	if l == nil {
+		l = logger.NoOp{}
+	}
+	return &SlackSender{SlackParams: params, L: l}
+}
+
+// Send posts text to Slack user or channel. Rate limited requests return RetryAfterError.
+func (s *SlackSender) Send(to, text string) error {
+	s.Debug("[DEBUG] send %q to slack %s", text, to)
+	body, err := json.Marshal(struct {
+		Channel string `json:"channel"`
+		Text    string `json:"text"`
+	}{Channel: to, Text: text})
+	if err != nil {
+		return fmt.Errorf("failed to marshal slack message: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", s.APIURL+"chat.postMessage", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to make slack request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Authorization", "Bearer "+s.Token)
+
+	resp, err := s.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send slack message: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		after := time.Second // Slack always sets Retry-After, one second is a fallback
+		if secs, e := strconv.Atoi(resp.Header.Get("Retry-After")); e == nil && secs > 0 {
+			after = time.Duration(secs) * time.Second
+		}
+		return &retryAfterErr{channel: "slack", after: after}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("slack responded with status %d", resp.StatusCode)
+	}
+
+	var res struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return fmt.Errorf("failed to decode slack response: %w", err)
+	}
+	if !res.OK {
+		return fmt.Errorf("slack error: %s", res.Error)
+	}
+	return nil
+}
+
+// Channel returns channel name for delivery metrics
+func (s *SlackSender) Channel() string {
+	return "slack"
+}
@@ -0,0 +1,66 @@
+package sender
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/auth/logger"
+)
+
+func TestSlackSender_Send(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "/api/chat.postMessage", r.URL.Path)
+		assert.Equal(t, "Bearer xoxb-123", r.Header.Get("Authorization"))
+		var msg struct {
+			Channel string `json:"channel"`
+			Text    string `json:"text"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&msg))
+		switch msg.Channel {
+		case "U12345":
+			assert.Equal(t, "confirmation token", msg.Text)
+			_, _ = w.Write([]byte(`{"ok":true,"channel":"D12345","ts":"1503435956.000247"}`))
+		case "limited":
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case "broken":
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			_, _ = w.Write([]byte(`{"ok":false,"error":"channel_not_found"}`))
+		}
+	}))
+	defer ts.Close()
+
+	s := NewSlackSender(SlackParams{Token: "xoxb-123", APIURL: ts.URL + "/api/"}, logger.Std{})
+	assert.Equal(t, "slack", s.Channel())
+
+	require.NoError(t, s.Send("U12345", "confirmation token"))
+
+	err := s.Send("C999", "some text")
+	assert.EqualError(t, err, "slack error: channel_not_found")
+
+	err = s.Send("broken", "some text")
+	assert.EqualError(t, err, "slack responded with status 502")
+
+	err = s.Send("limited", "some text")
+	require.Error(t, err)
+	var raErr RetryAfterError
+	require.True(t, errors.As(err, &raErr), "rate limit error implements RetryAfterError")
+	assert.Equal(t, 30*time.Second, raErr.RetryAfter())
+	assert.EqualError(t, err, "slack rate limited, retry after 30s")
+}
+
+func TestSlackSender_Defaults(t *testing.T) {
+	s := NewSlackSender(SlackParams{Token: "xoxb-123"}, nil)
+	assert.Equal(t, "https://slack.com/api/", s.APIURL)
+	assert.Equal(t, 10*time.Second, s.HTTPClient.Timeout)
+	assert.NotNil(t, s.L)
+}
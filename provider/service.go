@@ -1,12 +1,19 @@
 package provider
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/sha1"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
 
+	"github.com/go-pkgz/rest"
+
+	"github.com/go-pkgz/auth/logger"
 	"github.com/go-pkgz/auth/token"
 )
 
@@ -16,9 +23,25 @@ const (
 	urlLogoutSuffix   = "/logout"
 )
 
+// IssuerFunc returns issuer of tokens made for the request, i.e. by host or site in multi-brand setup
+type IssuerFunc func(r *http.Request) string
+
+// get returns issuer for the request, def if the func not set or returns empty string
+func (f IssuerFunc) get(r *http.Request, def string) string {
+	if f == nil {
+		return def
+	}
+	if iss := f(r); iss != "" {
+		return iss
+	}
+	return def
+}
+
 // Service represents oauth2 provider. Adds Handler method multiplexing login, auth and logout requests
 type Service struct {
 	Provider
+	ProviderInfo bool           // add provider_name and provider_type to JSON object responses, existing fields kept
+	Signer       ResponseSigner // optional, signs successful JSON responses with token.SignatureHeader
 }
 
 // NewService makes service for given provider
@@ -47,8 +70,53 @@ type Provider interface {
 	LogoutHandler(w http.ResponseWriter, r *http.Request)
 }
 
+// ExtraRoutesProvider can be implemented by provider serving routes in addition to login, callback and logout.
+// Keys of returned map are url suffixes, like "/reset".
+type ExtraRoutesProvider interface {
+	ExtraRoutes() map[string]http.HandlerFunc
+}
+
+// TypedProvider can be implemented by custom provider to report its type, "custom" used otherwise
+type TypedProvider interface {
+	Type() string
+}
+
+// ProviderType returns stable type of the provider, i.e. "oauth2" or "verify", not depending on its name
+func ProviderType(p Provider) string {
+	switch h := p.(type) {
+	case TypedProvider:
+		return h.Type()
+	case Oauth2Handler, *Oauth2Handler:
+		return "oauth2"
+	case Oauth1Handler, *Oauth1Handler:
+		return "oauth1"
+	case DirectHandler, *DirectHandler:
+		return "direct"
+	case VerifyHandler, *VerifyHandler:
+		return "verify"
+	case *TelegramHandler:
+		return "telegram"
+	case *AppleHandler:
+		return "apple"
+	}
+	return "custom"
+}
+
 // Handler returns auth routes for given provider
 func (p Service) Handler(w http.ResponseWriter, r *http.Request) {
+	if p.Signer != nil { // outer writer, signs the final body
+		sw := &signingWriter{ResponseWriter: w, signer: p.Signer, l: logger.NoOp{}}
+		if l, ok := p.Provider.(logger.L); ok && l != nil {
+			sw.l = l
+		}
+		defer sw.flush()
+		w = sw
+	}
+	if p.ProviderInfo {
+		iw := &providerInfoWriter{ResponseWriter: w, name: p.Name(), typ: ProviderType(p.Provider)}
+		defer iw.flush()
+		w = iw
+	}
 	if r.Method != http.MethodGet && r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
@@ -65,11 +133,102 @@ func (p Service) Handler(w http.ResponseWriter, r *http.Request) {
 		p.LogoutHandler(w, r)
 		return
 	}
+	if ep, ok := p.Provider.(ExtraRoutesProvider); ok {
+		for suffix, h := range ep.ExtraRoutes() {
+			if strings.HasSuffix(r.URL.Path, suffix) {
+				h(w, r)
+				return
+			}
+		}
+	}
 	w.WriteHeader(http.StatusNotFound)
 }
 
-// setAvatar saves avatar and puts proxied URL to u.Picture
+// providerInfoWriter buffers the response and adds provider info to JSON object body on flush
+type providerInfoWriter struct {
+	http.ResponseWriter
+	name, typ string
+	status    int
+	buf       bytes.Buffer
+}
+
+func (pw *providerInfoWriter) WriteHeader(code int) {
+	if pw.status == 0 {
+		pw.status = code
+	}
+}
+
+func (pw *providerInfoWriter) Write(b []byte) (int, error) {
+	if pw.status == 0 {
+		pw.status = http.StatusOK
+	}
+	return pw.buf.Write(b)
+}
+
+// flush writes buffered response, body of JSON object gets provider_name and provider_type if not set already
+func (pw *providerInfoWriter) flush() {
+	body := pw.buf.Bytes()
+	ct := pw.Header().Get("Content-Type")
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")) && (ct == "" || strings.Contains(ct, "json")) {
+		obj := map[string]json.RawMessage{}
+		if err := json.Unmarshal(body, &obj); err == nil {
+			for k, v := range map[string]string{"provider_name": pw.name, "provider_type": pw.typ} {
+				if _, ok := obj[k]; !ok {
+					obj[k], _ = json.Marshal(v)
+				}
+			}
+			if res, err := json.Marshal(obj); err == nil {
+				body = append(res, '\n')
+				pw.Header().Del("Content-Length")
+			}
+		}
+	}
+	if pw.status != 0 {
+		pw.ResponseWriter.WriteHeader(pw.status)
+	}
+	if len(body) > 0 {
+		_, _ = pw.ResponseWriter.Write(body)
+	}
+}
+
+// ErrUserRejected returned (or wrapped) by UserSaver rejecting the login on purpose, i.e. banned user or disabled
+// signups. Providers respond to it with 403 and Msg, shown to the user, other errors are 500 "failed to save user".
+type ErrUserRejected struct {
+	Msg string // user-safe reason of the rejection
+}
+
+func (e *ErrUserRejected) Error() string {
+	return "user rejected: " + e.Msg
+}
+
+// RejectUser makes ErrUserRejected error with the message shown to the user
+func RejectUser(msg string) error {
+	return &ErrUserRejected{Msg: msg}
+}
+
+// sendSaveUserError responds to UserSaver error, 403 with the message of ErrUserRejected and 500 to others
+func sendSaveUserError(w http.ResponseWriter, r *http.Request, l logger.L, err error) {
+	var rejected *ErrUserRejected
+	if errors.As(err, &rejected) {
+		msg := rejected.Msg
+		if msg == "" {
+			msg = "user rejected"
+		}
+		rest.SendErrorJSON(w, r, l, http.StatusForbidden, err, msg)
+		return
+	}
+	rest.SendErrorJSON(w, r, l, http.StatusInternalServerError, err, "failed to save user")
+}
+
+// setAvatar saves avatar and puts proxied URL to u.Picture. Inline data url picture dropped without AvatarSaver,
+// as it is too large for the token.
 func setAvatar(ava AvatarSaver, u token.User, client *http.Client) (token.User, error) {
+	if ava == nil && strings.HasPrefix(u.Picture, "data:") {
+		u.Picture = ""
+	}
+	if !allowedPicture(u.Picture) {
+		u.Picture = "" // never fetched nor passed to clients, saver makes identicon instead
+	}
 	if ava != nil {
 		avatarURL, e := ava.Put(u, client)
 		if e != nil {
@@ -81,6 +240,19 @@ func setAvatar(ava AvatarSaver, u token.User, client *http.Client) (token.User,
 	return u, nil // empty AvatarSaver ok, just skipped
 }
 
+// allowedPicture checks picture is http(s) url with host or inline data url. Picture may come from external source
+// and avatar saver fetches it on the server side, so other schemes, like file:// or gopher://, rejected.
+func allowedPicture(picture string) bool {
+	if picture == "" || strings.HasPrefix(picture, "data:") {
+		return true
+	}
+	u, err := url.Parse(picture)
+	if err != nil {
+		return false
+	}
+	return (strings.EqualFold(u.Scheme, "http") || strings.EqualFold(u.Scheme, "https")) && u.Host != ""
+}
+
 func randToken() (string, error) {
 	b := make([]byte, 32)
 	if _, err := rand.Read(b); err != nil {
@@ -92,3 +264,12 @@ func randToken() (string, error) {
 	}
 	return fmt.Sprintf("%x", s.Sum(nil)), nil
 }
+
+// renderJSONWithStatus sends data as json with given status code
+func renderJSONWithStatus(w http.ResponseWriter, data interface{}, code int) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		_, _ = fmt.Fprintf(w, "%v", err)
+	}
+}
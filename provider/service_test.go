@@ -1,15 +1,18 @@
 package provider
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 	"time"
 
+	"github.com/go-pkgz/rest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/go-pkgz/auth/logger"
 	"github.com/go-pkgz/auth/token"
 )
 
@@ -72,6 +75,28 @@ func TestSetAvatar(t *testing.T) {
 	assert.Error(t, err, "some error")
 }
 
+func TestSetAvatarScheme(t *testing.T) {
+	tbl := []struct {
+		picture, res string
+	}{
+		{"http://example.com/pic1.png", "http://example.com/pic1.png"},
+		{"HTTPS://example.com/pic1.png", "HTTPS://example.com/pic1.png"},
+		{"", ""},
+		{"file:///etc/passwd", ""},
+		{"gopher://169.254.169.254/", ""},
+		{"ftp://example.com/pic1.png", ""},
+		{"javascript:alert(1)", ""},
+		{"//example.com/pic1.png", ""},
+		{"http:///pic1.png", ""},
+		{"http://exa mple.com/%zz", ""},
+	}
+	for _, tt := range tbl {
+		u, err := setAvatar(nil, token.User{Picture: tt.picture}, nil)
+		require.NoError(t, err)
+		assert.Equal(t, tt.res, u.Picture, tt.picture)
+	}
+}
+
 type mockAva struct {
 	ok  bool
 	res string
@@ -96,3 +121,133 @@ func (n *mockHandler) AuthHandler(w http.ResponseWriter, _ *http.Request) {
 func (n *mockHandler) LogoutHandler(w http.ResponseWriter, _ *http.Request) {
 	_, _ = w.Write([]byte("logout"))
 }
+
+func TestHandler_ProviderInfo(t *testing.T) {
+	d := DirectHandler{
+		ProviderName: "test",
+		CredChecker:  &mockCredsChecker{ok: true},
+		TokenService: token.NewService(token.Opts{
+			SecretReader:   token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+			TokenDuration:  time.Hour,
+			CookieDuration: time.Hour * 24 * 31,
+		}),
+		Issuer: "iss-test",
+		L:      logger.NoOp{},
+	}
+	svc := NewService(d)
+	svc.ProviderInfo = true
+
+	// success, user object extended
+	rr := httptest.NewRecorder()
+	svc.Handler(rr, httptest.NewRequest("GET", "/auth/test/login?user=myuser&passwd=pppp", http.NoBody))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, "application/json; charset=utf-8", rr.Header().Get("Content-Type"))
+	u := struct {
+		token.User
+		ProviderName string `json:"provider_name"`
+		ProviderType string `json:"provider_type"`
+	}{}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &u))
+	assert.Equal(t, "myuser", u.Name)
+	assert.Equal(t, "test", u.ProviderName)
+	assert.Equal(t, "direct", u.ProviderType)
+	assert.NotEmpty(t, rr.Result().Cookies(), "headers kept")
+
+	// error
+	d.CredChecker = &mockCredsChecker{ok: false}
+	svc = Service{Provider: d, ProviderInfo: true}
+	rr = httptest.NewRecorder()
+	svc.Handler(rr, httptest.NewRequest("GET", "/auth/test/login?user=myuser&passwd=bad", http.NoBody))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Equal(t, `{"error":"incorrect user or password","provider_name":"test","provider_type":"direct"}`+"\n",
+		rr.Body.String())
+
+	// non-json and non-object responses as-is
+	svc = Service{Provider: &mockHandler{}, ProviderInfo: true}
+	rr = httptest.NewRecorder()
+	svc.Handler(rr, httptest.NewRequest("GET", "/login", http.NoBody))
+	assert.Equal(t, "login", rr.Body.String())
+	rr = httptest.NewRecorder()
+	svc.Handler(rr, httptest.NewRequest("GET", "/blah", http.NoBody))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Empty(t, rr.Body.String())
+
+	// existing fields not overwritten
+	svc = Service{Provider: &mockJSONHandler{}, ProviderInfo: true}
+	rr = httptest.NewRecorder()
+	svc.Handler(rr, httptest.NewRequest("GET", "/login", http.NoBody))
+	assert.Equal(t, `{"provider_name":"own","provider_type":"mock"}`+"\n", rr.Body.String())
+	rr = httptest.NewRecorder()
+	svc.Handler(rr, httptest.NewRequest("GET", "/logout", http.NoBody))
+	assert.Equal(t, `["a","b"]`+"\n", rr.Body.String())
+
+	// disabled by default
+	rr = httptest.NewRecorder()
+	NewService(d).Handler(rr, httptest.NewRequest("GET", "/auth/test/login?user=myuser&passwd=bad", http.NoBody))
+	assert.Equal(t, `{"error":"incorrect user or password"}`+"\n", rr.Body.String())
+}
+
+func TestProviderType(t *testing.T) {
+	assert.Equal(t, "oauth2", ProviderType(NewGithub(Params{})))
+	assert.Equal(t, "oauth2", ProviderType(NewDev(Params{})))
+	assert.Equal(t, "oauth1", ProviderType(NewTwitter(Params{})))
+	assert.Equal(t, "direct", ProviderType(DirectHandler{}))
+	assert.Equal(t, "verify", ProviderType(VerifyHandler{}))
+	assert.Equal(t, "telegram", ProviderType(&TelegramHandler{}))
+	assert.Equal(t, "apple", ProviderType(&AppleHandler{}))
+	assert.Equal(t, "mock", ProviderType(&mockJSONHandler{}))
+	assert.Equal(t, "custom", ProviderType(&mockHandler{}))
+}
+
+type mockJSONHandler struct{ mockHandler }
+
+func (n *mockJSONHandler) Type() string { return "mock" }
+func (n *mockJSONHandler) LoginHandler(w http.ResponseWriter, _ *http.Request) {
+	rest.RenderJSON(w, rest.JSON{"provider_name": "own"})
+}
+func (n *mockJSONHandler) LogoutHandler(w http.ResponseWriter, _ *http.Request) {
+	rest.RenderJSON(w, []string{"a", "b"})
+}
+
+func TestHandler_Signer(t *testing.T) {
+	tokenService := token.NewService(token.Opts{
+		SecretReader:   token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+		TokenDuration:  time.Hour,
+		CookieDuration: time.Hour * 24 * 31,
+	})
+	d := DirectHandler{ProviderName: "test", CredChecker: &mockCredsChecker{ok: true}, TokenService: tokenService,
+		Issuer: "iss-test", L: logger.NoOp{}}
+	svc := Service{Provider: d, Signer: tokenService, ProviderInfo: true}
+
+	// success signed, with provider info
+	rr := httptest.NewRecorder()
+	svc.Handler(rr, httptest.NewRequest("GET", "/auth/test/login?user=myuser&passwd=pppp", http.NoBody))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Contains(t, rr.Body.String(), `"provider_name":"test"`)
+	assert.NotEmpty(t, rr.Result().Cookies(), "headers kept")
+	sig := rr.Header().Get(token.SignatureHeader)
+	require.NotEmpty(t, sig)
+	assert.NoError(t, token.VerifyResponse(token.ResponseKey("secret"), sig, rr.Body.Bytes(), time.Minute))
+
+	// error not signed
+	d.CredChecker = &mockCredsChecker{ok: false}
+	svc.Provider = d
+	rr = httptest.NewRecorder()
+	svc.Handler(rr, httptest.NewRequest("GET", "/auth/test/login?user=myuser&passwd=bad", http.NoBody))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Empty(t, rr.Header().Get(token.SignatureHeader))
+
+	// non-json not signed
+	svc = Service{Provider: &mockHandler{}, Signer: tokenService}
+	rr = httptest.NewRecorder()
+	svc.Handler(rr, httptest.NewRequest("GET", "/login", http.NoBody))
+	assert.Equal(t, "login", rr.Body.String())
+	assert.Empty(t, rr.Header().Get(token.SignatureHeader))
+}
+
+func TestIssuerFunc(t *testing.T) {
+	r := httptest.NewRequest("GET", "/login?site=brand", http.NoBody)
+	assert.Equal(t, "def", IssuerFunc(nil).get(r, "def"))
+	assert.Equal(t, "def", IssuerFunc(func(*http.Request) string { return "" }).get(r, "def"))
+	assert.Equal(t, "brand", IssuerFunc(func(r *http.Request) string { return r.URL.Query().Get("site") }).get(r, "def"))
+}
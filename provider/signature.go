@@ -0,0 +1,57 @@
+package provider
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+
+	"github.com/go-pkgz/auth/logger"
+	"github.com/go-pkgz/auth/token"
+)
+
+// ResponseSigner makes detached signature of the response body, implemented by token.Service
+type ResponseSigner interface {
+	SignResponse(h http.Header, body []byte) (string, error)
+}
+
+// signingWriter buffers the response and adds signature header to successful JSON responses on flush
+type signingWriter struct {
+	http.ResponseWriter
+	signer ResponseSigner
+	l      logger.L
+	status int
+	buf    bytes.Buffer
+}
+
+func (sw *signingWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+	}
+}
+
+func (sw *signingWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.buf.Write(b)
+}
+
+// flush signs 2xx JSON response and writes it. Response sent unsigned if signing failed, clients reject it.
+func (sw *signingWriter) flush() {
+	body := sw.buf.Bytes()
+	ok := sw.status >= 200 && sw.status < 300
+	if ok && len(body) > 0 && strings.Contains(sw.Header().Get("Content-Type"), "json") {
+		sig, err := sw.signer.SignResponse(sw.Header(), body)
+		if err != nil {
+			sw.l.Logf("[WARN] can't sign response, %v", err)
+		} else {
+			sw.Header().Set(token.SignatureHeader, sig)
+		}
+	}
+	if sw.status != 0 {
+		sw.ResponseWriter.WriteHeader(sw.status)
+	}
+	if len(body) > 0 {
+		_, _ = sw.ResponseWriter.Write(body)
+	}
+}
@@ -0,0 +1,455 @@
+package provider
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1" //nolint gosec
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/go-pkgz/rest"
+	"github.com/golang-jwt/jwt"
+
+	"github.com/go-pkgz/auth/logger"
+	"github.com/go-pkgz/auth/token"
+)
+
+const (
+	smsCodeDigits = 6
+
+	defaultSMSCodeTTL        = 5 * time.Minute
+	defaultSMSSendInterval   = time.Minute
+	defaultSMSSendWindow     = time.Hour
+	defaultSMSMaxPerNumber   = 5
+	defaultSMSMaxPerIP       = 20
+	defaultSMSMaxAttempts    = 5
+	defaultSMSLockDuration   = 15 * time.Minute
+	defaultSMSMessage        = "{{.Code}} is your verification code"
+	smsPhoneAttr             = "phone"
+	smsLockedCode            = "phone_locked"
+	smsRateLimitedCode       = "rate_limited"
+	smsInvalidPhoneCode      = "phone_invalid"
+	smsCodeInvalidOrExpired  = "code_invalid"
+	smsMaxNormalizedPhoneLen = 16 // + and 15 digits
+)
+
+var (
+	rePhoneSeparators = regexp.MustCompile(`[\s\-.()/]`)
+	reE164            = regexp.MustCompile(`^\+[1-9][0-9]{7,14}$`)
+
+	defaultSMSCodeStore  = NewMemSMSCodeStore()
+	defaultSMSLimitStore = NewMemLockoutStore()
+)
+
+// SMSHandler implements provider authorizing users by phone number with one-time code sent in SMS.
+// The first request with the phone sends the code, the second one with the phone and the code logs in.
+// Sends are limited per number and per client IP, wrong codes lock the number after MaxAttempts.
+// Zero values replaced by defaults.
+type SMSHandler struct {
+	logger.L
+	ProviderName string
+	TokenService VerifTokenService
+	Issuer       string
+	IssuerFunc   IssuerFunc         // optional issuer of tokens by request, Issuer used if not set or empty
+	Sender       Sender             // SMS sender, gets normalized number as address
+	Template     *template.Template // message template with {{.Code}} and {{.Site}}, default "{{.Code}} is your verification code"
+	CountryCode  string             // calling code for numbers without it, i.e. "1" or "44", such numbers rejected if empty
+
+	CodeStore    SMSCodeStore  // hashed codes, shared one allows several instances, default in-memory
+	LimitStore   LockoutStore  // rate limits and attempts counters, default in-memory
+	CodeTTL      time.Duration // code lifetime, default 5m
+	SendInterval time.Duration // min interval between codes sent to the same number, default 1m
+	SendWindow   time.Duration // window of MaxPerNumber and MaxPerIP limits, default 1h
+	MaxPerNumber int           // max codes sent to the same number within SendWindow, default 5
+	MaxPerIP     int           // max codes requested from the same IP within SendWindow, default 20
+	MaxAttempts  int           // wrong codes before the number locked, default 5
+	LockDuration time.Duration // lock of the number after MaxAttempts wrong codes, default 15m
+
+	IDSalt string           // salt of user id hash, keeps numbers from being guessed by ids
+	IDHash func() hash.Hash // hash of user id, default sha1
+
+	MaxBodySize int64 // max size of request body, default MaxHTTPBodySize
+
+	TrustedProxies *TrustedProxies // proxies trusted to pass client ip for MaxPerIP, default ones if nil
+}
+
+// SMSCode is a sent code kept by SMSCodeStore, with hash of the code only
+type SMSCode struct {
+	Hash    string    // hex sha256 of salt, number and code
+	Salt    string    // random salt
+	Site    string    // site (audience) the code requested for
+	Expires time.Time // code expiration
+}
+
+// SMSCodeStore keeps sent codes by normalized number. Store is responsible for removal of expired codes.
+type SMSCodeStore interface {
+	Set(phone string, code SMSCode) error
+	Get(phone string) (code SMSCode, found bool, err error)
+	Delete(phone string) error
+}
+
+// Name of the handler
+func (h SMSHandler) Name() string { return h.ProviderName }
+
+// LoginHandler sends the code to the phone, or, with code, checks it and issues the token.
+// The token returned in the response body as well, for mobile apps.
+//
+// GET or POST /login?phone=+15551234567&site=site
+// POST /login with {"phone":"+15551234567","code":"123456","sess":"1"}, json or form encoded
+func (h SMSHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	vals, err := requestValues(w, r, h.MaxBodySize)
+	if err != nil {
+		sendParseError(w, r, h.L, err, "failed to parse request")
+		return
+	}
+	phone, err := NormalizePhone(vals.Get("phone"), h.CountryCode)
+	if err != nil {
+		renderJSONWithStatus(w, rest.JSON{"error": err.Error(), "code": smsInvalidPhoneCode}, http.StatusBadRequest)
+		return
+	}
+	if retryAfter, locked := h.locked(phone); locked {
+		h.rejectLimited(w, retryAfter, "too many attempts", smsLockedCode)
+		return
+	}
+
+	if vals.Get("code") == "" {
+		h.sendCode(w, r, phone, vals.Get("site"))
+		return
+	}
+	if r.Method != "POST" { // keep codes out of urls and logs
+		rest.SendErrorJSON(w, r, h.L, http.StatusMethodNotAllowed, fmt.Errorf("method %s", r.Method), "POST required")
+		return
+	}
+	h.checkCode(w, r, phone, vals.Get("code"), vals.Get("sess") == "1")
+}
+
+// sendCode makes a new code, keeps its hash and sends it to the phone
+func (h SMSHandler) sendCode(w http.ResponseWriter, r *http.Request, phone, site string) {
+	site = Sanitize(site, SanitizeOpts{})
+	if retryAfter, limited := h.limited("sms-ip:"+h.TrustedProxies.ClientIP(r), h.maxPerIP(), h.sendWindow()); limited {
+		h.rejectLimited(w, retryAfter, "too many requests", smsRateLimitedCode)
+		return
+	}
+	if retryAfter, limited := h.limited("sms-interval:"+phone, 1, h.sendInterval()); limited {
+		h.rejectLimited(w, retryAfter, "too many requests", smsRateLimitedCode)
+		return
+	}
+	if retryAfter, limited := h.limited("sms-number:"+phone, h.maxPerNumber(), h.sendWindow()); limited {
+		h.rejectLimited(w, retryAfter, "too many requests", smsRateLimitedCode)
+		return
+	}
+
+	code, err := randomDigits(smsCodeDigits)
+	if err != nil {
+		rest.SendErrorJSON(w, r, h.L, http.StatusInternalServerError, err, "can't make code")
+		return
+	}
+	salt, err := randToken()
+	if err != nil {
+		rest.SendErrorJSON(w, r, h.L, http.StatusInternalServerError, err, "can't make code")
+		return
+	}
+	rec := SMSCode{Hash: smsCodeHash(salt, phone, code), Salt: salt, Site: site, Expires: time.Now().Add(h.codeTTL())}
+	if err = h.codeStore().Set(h.key(phone), rec); err != nil {
+		rest.SendErrorJSON(w, r, h.L, http.StatusInternalServerError, err, "failed to save code")
+		return
+	}
+
+	tmpl := h.Template
+	if tmpl == nil {
+		tmpl = template.Must(template.New("sms").Parse(defaultSMSMessage))
+	}
+	buf := bytes.Buffer{}
+	if err = tmpl.Execute(&buf, struct{ Code, Site string }{Code: code, Site: site}); err != nil {
+		rest.SendErrorJSON(w, r, h.L, http.StatusInternalServerError, err, "can't execute sms template")
+		return
+	}
+	if err = h.Sender.Send(phone, buf.String()); err != nil {
+		rest.SendErrorJSON(w, r, h.L, http.StatusInternalServerError, err, "failed to send code")
+		return
+	}
+	rest.RenderJSON(w, rest.JSON{"phone": phone})
+}
+
+// checkCode checks the code sent to the phone and issues the token. Wrong codes counted, the number is locked
+// after MaxAttempts of them and the code removed.
+func (h SMSHandler) checkCode(w http.ResponseWriter, r *http.Request, phone, code string, sessOnly bool) {
+	rec, found, err := h.codeStore().Get(h.key(phone))
+	if err != nil {
+		rest.SendErrorJSON(w, r, h.L, http.StatusInternalServerError, err, "failed to get code")
+		return
+	}
+	valid := found && time.Now().Before(rec.Expires) &&
+		subtle.ConstantTimeCompare([]byte(smsCodeHash(rec.Salt, phone, code)), []byte(rec.Hash)) == 1
+	if !valid {
+		attempts, e := h.limitStore().Incr(h.attemptsKey(phone), h.lockDuration())
+		if e != nil {
+			h.Logf("[WARN] can't count sms code attempts for %s, %v", phone, e)
+		}
+		if attempts >= h.maxAttempts() {
+			h.Logf("[WARN] %s locked after %d wrong codes", phone, attempts)
+			if e = h.codeStore().Delete(h.key(phone)); e != nil {
+				h.Logf("[WARN] can't delete sms code for %s, %v", phone, e)
+			}
+		}
+		renderJSONWithStatus(w, rest.JSON{"error": "invalid or expired code", "code": smsCodeInvalidOrExpired},
+			http.StatusForbidden)
+		return
+	}
+	if err = h.codeStore().Delete(h.key(phone)); err != nil {
+		rest.SendErrorJSON(w, r, h.L, http.StatusInternalServerError, err, "failed to delete code")
+		return
+	}
+	if err = h.limitStore().Reset(h.attemptsKey(phone)); err != nil {
+		h.Logf("[WARN] can't reset sms code attempts for %s, %v", phone, err)
+	}
+
+	u := token.User{Name: maskPhone(phone), ID: h.userID(phone)}
+	u.SetStrAttr(smsPhoneAttr, phone)
+	cid, err := randToken()
+	if err != nil {
+		rest.SendErrorJSON(w, r, h.L, http.StatusInternalServerError, err, "can't make token id")
+		return
+	}
+	claims := token.Claims{
+		User:           &u,
+		StandardClaims: jwt.StandardClaims{Id: cid, Issuer: h.IssuerFunc.get(r, h.Issuer), Audience: rec.Site},
+		SessionOnly:    sessOnly,
+		Provider:       h.ProviderName,
+	}
+	if claims, err = h.TokenService.Set(w, claims); err != nil {
+		rest.SendErrorJSON(w, r, h.L, http.StatusInternalServerError, err, "failed to set token")
+		return
+	}
+	resp := basicLoginResponse{User: *claims.User}
+	if resp.Token, err = h.TokenService.Token(claims); err != nil {
+		rest.SendErrorJSON(w, r, h.L, http.StatusInternalServerError, err, "failed to make token")
+		return
+	}
+	rest.RenderJSON(w, resp)
+}
+
+// AuthHandler doesn't do anything for sms provider
+func (h SMSHandler) AuthHandler(http.ResponseWriter, *http.Request) {}
+
+// LogoutHandler - GET /logout
+func (h SMSHandler) LogoutHandler(w http.ResponseWriter, _ *http.Request) {
+	h.TokenService.Reset(w)
+}
+
+// limited counts request for key and reports if it exceeds max within window, with time left till the window end.
+// Store errors logged and ignored.
+func (h SMSHandler) limited(key string, max int, window time.Duration) (retryAfter time.Duration, limited bool) {
+	key = key + ":" + h.ProviderName
+	count, err := h.limitStore().Incr(key, window)
+	if err != nil {
+		h.Logf("[WARN] can't increment sms limit counter %s, %v", key, err)
+		return 0, false
+	}
+	if count <= max {
+		return 0, false
+	}
+	if _, ttl, err := h.limitStore().Get(key); err == nil && ttl > 0 {
+		return ttl, true
+	}
+	return window, true
+}
+
+// locked reports if the number is locked after too many wrong codes
+func (h SMSHandler) locked(phone string) (retryAfter time.Duration, locked bool) {
+	count, ttl, err := h.limitStore().Get(h.attemptsKey(phone))
+	if err != nil {
+		h.Logf("[WARN] can't get sms code attempts for %s, %v", phone, err)
+		return 0, false
+	}
+	return ttl, count >= h.maxAttempts()
+}
+
+// rejectLimited responds with 429 and Retry-After header
+func (h SMSHandler) rejectLimited(w http.ResponseWriter, retryAfter time.Duration, msg, code string) {
+	secs := int(retryAfter.Round(time.Second) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	renderJSONWithStatus(w, rest.JSON{"error": msg, "code": code}, http.StatusTooManyRequests)
+}
+
+// userID makes user id as salted hash of the number
+func (h SMSHandler) userID(phone string) string {
+	hf := h.IDHash
+	if hf == nil {
+		hf = sha1.New
+	}
+	return h.ProviderName + "_" + token.HashID(hf(), h.IDSalt+phone)
+}
+
+// key returns code store key of the number
+func (h SMSHandler) key(phone string) string {
+	return h.ProviderName + ":" + phone
+}
+
+// attemptsKey returns limits store key of wrong codes counter
+func (h SMSHandler) attemptsKey(phone string) string {
+	return "sms-attempts:" + h.ProviderName + ":" + phone
+}
+
+func (h SMSHandler) codeStore() SMSCodeStore {
+	if h.CodeStore == nil {
+		return defaultSMSCodeStore
+	}
+	return h.CodeStore
+}
+
+func (h SMSHandler) limitStore() LockoutStore {
+	if h.LimitStore == nil {
+		return defaultSMSLimitStore
+	}
+	return h.LimitStore
+}
+
+func (h SMSHandler) codeTTL() time.Duration {
+	return durationOr(h.CodeTTL, defaultSMSCodeTTL)
+}
+
+func (h SMSHandler) sendInterval() time.Duration {
+	return durationOr(h.SendInterval, defaultSMSSendInterval)
+}
+
+func (h SMSHandler) sendWindow() time.Duration {
+	return durationOr(h.SendWindow, defaultSMSSendWindow)
+}
+
+func (h SMSHandler) lockDuration() time.Duration {
+	return durationOr(h.LockDuration, defaultSMSLockDuration)
+}
+
+func (h SMSHandler) maxPerNumber() int {
+	return intOr(h.MaxPerNumber, defaultSMSMaxPerNumber)
+}
+
+func (h SMSHandler) maxPerIP() int {
+	return intOr(h.MaxPerIP, defaultSMSMaxPerIP)
+}
+
+func (h SMSHandler) maxAttempts() int {
+	return intOr(h.MaxAttempts, defaultSMSMaxAttempts)
+}
+
+func durationOr(v, def time.Duration) time.Duration {
+	if v == 0 {
+		return def
+	}
+	return v
+}
+
+func intOr(v, def int) int {
+	if v == 0 {
+		return def
+	}
+	return v
+}
+
+// NormalizePhone converts phone number to E.164 format, i.e. "+15551234567". Spaces, dashes, dots and
+// parentheses are removed and "00" international prefix replaced with "+". Numbers without country code get
+// countryCode after the trunk "0" removed, and rejected if countryCode is empty.
+func NormalizePhone(phone, countryCode string) (string, error) {
+	if len(phone) > 32 {
+		return "", fmt.Errorf("phone number is too long")
+	}
+	p := rePhoneSeparators.ReplaceAllString(strings.TrimSpace(phone), "")
+	switch {
+	case p == "":
+		return "", fmt.Errorf("phone number is required")
+	case strings.HasPrefix(p, "+"):
+	case strings.HasPrefix(p, "00"):
+		p = "+" + p[2:]
+	case countryCode != "":
+		p = "+" + strings.TrimPrefix(countryCode, "+") + strings.TrimPrefix(p, "0")
+	default:
+		return "", fmt.Errorf("phone number without country code")
+	}
+	if len(p) > smsMaxNormalizedPhoneLen || !reE164.MatchString(p) {
+		return "", fmt.Errorf("invalid phone number")
+	}
+	return p, nil
+}
+
+// maskPhone hides middle digits of the number, i.e. "+1555***4567"
+func maskPhone(phone string) string {
+	if len(phone) < 9 {
+		return phone
+	}
+	return phone[:len(phone)-7] + "***" + phone[len(phone)-4:]
+}
+
+// smsCodeHash returns hex sha256 of salt, number and code
+func smsCodeHash(salt, phone, code string) string {
+	sum := sha256.Sum256([]byte(salt + ":" + phone + ":" + code))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomDigits returns random string of n digits
+func randomDigits(n int) (string, error) {
+	max := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+	v, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", fmt.Errorf("can't get random: %w", err)
+	}
+	return fmt.Sprintf("%0*d", n, v), nil
+}
+
+// MemSMSCodeStore implements SMSCodeStore with in-memory map. Expired codes removed on access.
+type MemSMSCodeStore struct {
+	lock  sync.Mutex
+	codes map[string]SMSCode
+}
+
+// NewMemSMSCodeStore makes in-memory codes store
+func NewMemSMSCodeStore() *MemSMSCodeStore {
+	return &MemSMSCodeStore{codes: map[string]SMSCode{}}
+}
+
+// Set saves the code for the number
+func (m *MemSMSCodeStore) Set(phone string, code SMSCode) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := time.Now()
+	for k, c := range m.codes {
+		if now.After(c.Expires) {
+			delete(m.codes, k)
+		}
+	}
+	m.codes[phone] = code
+	return nil
+}
+
+// Get returns not expired code of the number
+func (m *MemSMSCodeStore) Get(phone string) (SMSCode, bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	c, ok := m.codes[phone]
+	if !ok || time.Now().After(c.Expires) {
+		return SMSCode{}, false, nil
+	}
+	return c, true, nil
+}
+
+// Delete removes code of the number
+func (m *MemSMSCodeStore) Delete(phone string) error {
+	m.lock.Lock()
+	delete(m.codes, phone)
+	m.lock.Unlock()
+	return nil
+}
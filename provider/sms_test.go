@@ -0,0 +1,243 @@
+package provider
+
+import (
+	"crypto/sha1" //nolint gosec
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/auth/logger"
+	"github.com/go-pkgz/auth/token"
+)
+
+var reSMSCode = regexp.MustCompile(`\d{6}`)
+
+func newTestSMSHandler(sender *mockSender) SMSHandler {
+	return SMSHandler{
+		ProviderName: "sms",
+		TokenService: token.NewService(token.Opts{
+			SecretReader:   token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+			TokenDuration:  time.Hour,
+			CookieDuration: time.Hour * 24 * 31,
+		}),
+		Issuer:      "iss-test",
+		L:           logger.NoOp{},
+		Sender:      SenderFunc(sender.Send),
+		CountryCode: "44",
+		CodeStore:   NewMemSMSCodeStore(),
+		LimitStore:  NewMemLockoutStore(),
+		IDSalt:      "salt",
+	}
+}
+
+func smsRequest(h SMSHandler, method, ip string, vals url.Values) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	var req *http.Request
+	if method == "GET" {
+		req = httptest.NewRequest("GET", "/login?"+vals.Encode(), http.NoBody)
+	} else {
+		req = httptest.NewRequest(method, "/login", strings.NewReader(vals.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	req.RemoteAddr = ip + ":1234"
+	h.LoginHandler(rr, req)
+	return rr
+}
+
+func TestSMSHandler_Login(t *testing.T) {
+	sender := &mockSender{}
+	h := newTestSMSHandler(sender)
+
+	rr := smsRequest(h, "POST", "127.0.0.1", url.Values{"phone": {"+44 (20) 7946-0958"}, "site": {"remark"}})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, `{"phone":"+442079460958"}`+"\n", rr.Body.String())
+	assert.Equal(t, "+442079460958", sender.to)
+	code := reSMSCode.FindString(sender.text)
+	require.NotEmpty(t, code)
+	assert.Equal(t, code+" is your verification code", sender.text)
+
+	stored, found, err := h.CodeStore.Get("sms:+442079460958")
+	require.NoError(t, err)
+	require.True(t, found)
+	assert.NotContains(t, stored.Hash, code, "only hash kept")
+	assert.Equal(t, "remark", stored.Site)
+
+	rr = smsRequest(h, "GET", "127.0.0.1", url.Values{"phone": {"+442079460958"}, "code": {code}})
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code, "code not accepted in url")
+
+	// local form of the same number accepted for the code
+	rr = smsRequest(h, "POST", "127.0.0.2", url.Values{"phone": {"020 7946 0958"}, "code": {code}})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	resp := struct {
+		token.User
+		Token string `json:"token"`
+	}{}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	assert.Equal(t, "+44207***0958", resp.Name)
+	assert.Equal(t, "sms_"+token.HashID(sha1.New(), "salt+442079460958"), resp.ID)
+	assert.Equal(t, "+442079460958", resp.StrAttr("phone"))
+
+	cookies := rr.Result().Cookies()
+	require.Equal(t, 2, len(cookies))
+	assert.Equal(t, "JWT", cookies[0].Name)
+	assert.Equal(t, resp.Token, cookies[0].Value, "same token in cookie and body")
+	claims, err := h.TokenService.Parse(resp.Token)
+	require.NoError(t, err)
+	assert.Equal(t, "remark", claims.Audience)
+	assert.Equal(t, "iss-test", claims.Issuer)
+
+	rr = smsRequest(h, "POST", "127.0.0.1", url.Values{"phone": {"+442079460958"}, "code": {code}})
+	assert.Equal(t, http.StatusForbidden, rr.Code, "code is single-use")
+	assert.Equal(t, `{"code":"code_invalid","error":"invalid or expired code"}`+"\n", rr.Body.String())
+}
+
+func TestSMSHandler_UserIDSameForEquivalentNumbers(t *testing.T) {
+	h := newTestSMSHandler(&mockSender{})
+	ids := map[string]bool{}
+	for _, p := range []string{"+44 20 7946 0958", "0044 20 7946 0958", "020-7946-0958", "(020) 7946.0958"} {
+		phone, err := NormalizePhone(p, h.CountryCode)
+		require.NoError(t, err, p)
+		ids[h.userID(phone)] = true
+	}
+	assert.Equal(t, 1, len(ids))
+
+	h2 := h
+	h2.IDSalt = "other"
+	assert.NotEqual(t, h.userID("+442079460958"), h2.userID("+442079460958"), "salt changes id")
+}
+
+func TestSMSHandler_SendLimits(t *testing.T) {
+	sender := &mockSender{}
+	h := newTestSMSHandler(sender)
+	h.MaxPerNumber = 2
+	h.MaxPerIP = 3
+	h.SendInterval = time.Millisecond
+
+	rr := smsRequest(h, "POST", "127.0.0.1", url.Values{"phone": {"+442079460958"}})
+	require.Equal(t, http.StatusOK, rr.Code)
+	time.Sleep(5 * time.Millisecond)
+	rr = smsRequest(h, "POST", "127.0.0.1", url.Values{"phone": {"02079460958"}})
+	require.Equal(t, http.StatusOK, rr.Code)
+	time.Sleep(5 * time.Millisecond)
+
+	sender.to = ""
+	rr = smsRequest(h, "POST", "127.0.0.2", url.Values{"phone": {"+442079460958"}})
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code, "per number limit, any ip")
+	assert.Equal(t, `{"code":"rate_limited","error":"too many requests"}`+"\n", rr.Body.String())
+	assert.Equal(t, "3600", rr.Header().Get("Retry-After"))
+	assert.Empty(t, sender.to, "not sent")
+
+	rr = smsRequest(h, "POST", "127.0.0.1", url.Values{"phone": {"+442079460959"}})
+	require.Equal(t, http.StatusOK, rr.Code, "ip has one more")
+	rr = smsRequest(h, "POST", "127.0.0.1", url.Values{"phone": {"+442079460960"}})
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code, "per ip limit")
+	rr = smsRequest(h, "POST", "127.0.0.3", url.Values{"phone": {"+442079460960"}})
+	assert.Equal(t, http.StatusOK, rr.Code, "other ip allowed")
+}
+
+func TestSMSHandler_SendInterval(t *testing.T) {
+	h := newTestSMSHandler(&mockSender{})
+	rr := smsRequest(h, "POST", "127.0.0.1", url.Values{"phone": {"+442079460958"}})
+	require.Equal(t, http.StatusOK, rr.Code)
+	rr = smsRequest(h, "POST", "127.0.0.2", url.Values{"phone": {"+442079460958"}})
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "60", rr.Header().Get("Retry-After"))
+}
+
+func TestSMSHandler_AttemptsExhausted(t *testing.T) {
+	sender := &mockSender{}
+	h := newTestSMSHandler(sender)
+	h.MaxAttempts = 3
+
+	rr := smsRequest(h, "POST", "127.0.0.1", url.Values{"phone": {"+442079460958"}})
+	require.Equal(t, http.StatusOK, rr.Code)
+	code := reSMSCode.FindString(sender.text)
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+
+	for i := 0; i < 3; i++ {
+		rr = smsRequest(h, "POST", "127.0.0.1", url.Values{"phone": {"+442079460958"}, "code": {wrong}})
+		assert.Equal(t, http.StatusForbidden, rr.Code, "attempt %d", i)
+	}
+	rr = smsRequest(h, "POST", "127.0.0.1", url.Values{"phone": {"+442079460958"}, "code": {code}})
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code, "locked, right code rejected")
+	assert.Equal(t, `{"code":"phone_locked","error":"too many attempts"}`+"\n", rr.Body.String())
+	assert.Equal(t, "900", rr.Header().Get("Retry-After"))
+	rr = smsRequest(h, "POST", "127.0.0.2", url.Values{"phone": {"02079460958"}})
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code, "no new code while locked")
+
+	_, found, err := h.CodeStore.Get("sms:+442079460958")
+	require.NoError(t, err)
+	assert.False(t, found, "code removed on lock")
+
+	// lock expired, but the code is gone
+	require.NoError(t, h.LimitStore.Reset(h.attemptsKey("+442079460958")))
+	rr = smsRequest(h, "POST", "127.0.0.1", url.Values{"phone": {"+442079460958"}, "code": {code}})
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+func TestSMSHandler_Expired(t *testing.T) {
+	sender := &mockSender{}
+	h := newTestSMSHandler(sender)
+	h.CodeTTL = time.Millisecond
+	rr := smsRequest(h, "POST", "127.0.0.1", url.Values{"phone": {"+442079460958"}})
+	require.Equal(t, http.StatusOK, rr.Code)
+	time.Sleep(5 * time.Millisecond)
+	rr = smsRequest(h, "POST", "127.0.0.1", url.Values{"phone": {"+442079460958"}, "code": {reSMSCode.FindString(sender.text)}})
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+func TestSMSHandler_Errors(t *testing.T) {
+	sender := &mockSender{}
+	h := newTestSMSHandler(sender)
+
+	rr := smsRequest(h, "POST", "127.0.0.1", url.Values{"phone": {"12345"}})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, `{"code":"phone_invalid","error":"invalid phone number"}`+"\n", rr.Body.String())
+
+	sender.err = errors.New("gateway error")
+	rr = smsRequest(h, "POST", "127.0.0.1", url.Values{"phone": {"+442079460958"}})
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	assert.Equal(t, `{"error":"failed to send code"}`+"\n", rr.Body.String())
+}
+
+func TestNormalizePhone(t *testing.T) {
+	tbl := []struct {
+		inp, cc, res string
+		err          bool
+	}{
+		{"+1 (555) 123-4567", "", "+15551234567", false},
+		{"001-555-123-4567", "", "+15551234567", false},
+		{"555.123.4567", "1", "+15551234567", false},
+		{"020 7946 0958", "44", "+442079460958", false},
+		{"020 7946 0958", "+44", "+442079460958", false},
+		{" +44/20/7946/0958 ", "", "+442079460958", false},
+		{"020 7946 0958", "", "", true},
+		{"", "1", "", true},
+		{"+0 555 1234567", "", "", true},
+		{"+1555", "", "", true},
+		{"+1234567890123456", "", "", true},
+		{"+1 555 abc 4567", "", "", true},
+		{"++15551234567", "", "", true},
+	}
+	for _, tt := range tbl {
+		res, err := NormalizePhone(tt.inp, tt.cc)
+		if tt.err {
+			assert.Error(t, err, tt.inp)
+			continue
+		}
+		require.NoError(t, err, tt.inp)
+		assert.Equal(t, tt.res, res, tt.inp)
+	}
+}
@@ -0,0 +1,238 @@
+package provider
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSMTPDialTimeout = 10 * time.Second
+	defaultSMTPSendTimeout = time.Minute
+	defaultSMTPContentType = "text/plain; charset=UTF-8"
+)
+
+// SMTP delivery stages reported by SMTPError
+const (
+	SMTPStageConnect  = "connect"  // dial, greeting, hello or TLS handshake
+	SMTPStageAuth     = "auth"     // authentication with Username and Password
+	SMTPStageDelivery = "delivery" // sender, recipient or message rejected
+)
+
+// SMTPSender implements Sender delivering the text as the body of the email by SMTP.
+// Zero values replaced by defaults.
+type SMTPSender struct {
+	Host        string
+	Port        int    // default 465 with TLS, 587 with StartTLS, 25 otherwise
+	Username    string // authenticate with PLAIN if set, allowed over TLS or to localhost only
+	Password    string
+	From        string // sender address, i.e. "Example <noreply@example.com>"
+	Subject     string
+	ContentType string // content type of the text, default "text/plain; charset=UTF-8"
+
+	TLS         bool          // implicit TLS, i.e. port 465
+	StartTLS    bool          // upgrade plain connection with STARTTLS, i.e. port 587, fails if server doesn't offer it
+	TLSConfig   *tls.Config   // optional TLS config, i.e. with custom root CAs, ServerName set to Host if empty
+	DialTimeout time.Duration // timeout of connection to the server, default 10s
+	SendTimeout time.Duration // timeout of the whole delivery after connection, default 1m
+}
+
+// SMTPError is an error of SMTPSender with the stage it failed on, SMTPStageConnect, SMTPStageAuth or
+// SMTPStageDelivery. Callers can check it with errors.As, i.e. to retry connection failures only.
+type SMTPError struct {
+	Stage string
+	Err   error
+}
+
+func (e *SMTPError) Error() string {
+	return fmt.Sprintf("smtp %s failed: %v", e.Stage, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *SMTPError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports SMTPError as ErrTransientSend if connection failed or server replied with 4xx, and as ErrPermanentSend
+// if the message rejected with 5xx
+func (e *SMTPError) Is(target error) bool {
+	var tpErr *textproto.Error
+	code := 0
+	if errors.As(e.Err, &tpErr) {
+		code = tpErr.Code
+	}
+	switch target {
+	case ErrTransientSend:
+		return e.Stage == SMTPStageConnect || code >= 400 && code < 500
+	case ErrPermanentSend:
+		return e.Stage == SMTPStageDelivery && code >= 500
+	}
+	return false
+}
+
+// Send delivers the text to address
+func (s *SMTPSender) Send(address, text string) error {
+	from, err := mail.ParseAddress(s.From)
+	if err != nil {
+		return fmt.Errorf("invalid from address %q: %w", s.From, err)
+	}
+	msg, err := s.message(from, address, text)
+	if err != nil {
+		return err
+	}
+
+	client, err := s.connect()
+	if err != nil {
+		return &SMTPError{Stage: SMTPStageConnect, Err: err}
+	}
+	defer client.Close() // nolint
+
+	if s.Username != "" {
+		if err = client.Auth(smtp.PlainAuth("", s.Username, s.Password, s.Host)); err != nil {
+			return &SMTPError{Stage: SMTPStageAuth, Err: err}
+		}
+	}
+
+	if err = s.deliver(client, from.Address, address, msg); err != nil {
+		return &SMTPError{Stage: SMTPStageDelivery, Err: err}
+	}
+	_ = client.Quit() // message accepted already, failed quit doesn't matter
+	return nil
+}
+
+// connect dials the server, with implicit TLS or STARTTLS, and returns client ready for auth
+func (s *SMTPSender) connect() (*smtp.Client, error) {
+	dialTimeout := s.DialTimeout
+	if dialTimeout <= 0 {
+		dialTimeout = defaultSMTPDialTimeout
+	}
+	sendTimeout := s.SendTimeout
+	if sendTimeout <= 0 {
+		sendTimeout = defaultSMTPSendTimeout
+	}
+
+	addr := net.JoinHostPort(s.Host, strconv.Itoa(s.port()))
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	var conn net.Conn
+	var err error
+	if s.TLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, s.tlsConfig())
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = conn.SetDeadline(time.Now().Add(sendTimeout)); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	client, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if s.StartTLS && !s.TLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			_ = client.Close()
+			return nil, errors.New("server doesn't support STARTTLS")
+		}
+		if err = client.StartTLS(s.tlsConfig()); err != nil {
+			_ = client.Close()
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// deliver sends envelope and the message
+func (s *SMTPSender) deliver(client *smtp.Client, from, address string, msg []byte) error {
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	if err := client.Rcpt(address); err != nil {
+		return err
+	}
+	wr, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = wr.Write(msg); err != nil {
+		_ = wr.Close()
+		return err
+	}
+	return wr.Close()
+}
+
+// message makes RFC 5322 message with the text as quoted-printable body
+func (s *SMTPSender) message(from *mail.Address, address, text string) ([]byte, error) {
+	if strings.ContainsAny(address, "\r\n") {
+		return nil, errors.New("address with line breaks")
+	}
+	contentType := s.ContentType
+	if contentType == "" {
+		contentType = defaultSMTPContentType
+	}
+
+	buf := bytes.Buffer{}
+	headers := [][2]string{
+		{"From", from.String()},
+		{"To", address},
+		{"Subject", mime.QEncoding.Encode("utf-8", strings.NewReplacer("\r", "", "\n", " ").Replace(s.Subject))},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", contentType},
+		{"Content-Transfer-Encoding", "quoted-printable"},
+	}
+	if id, err := randToken(); err == nil {
+		domain := from.Address[strings.LastIndex(from.Address, "@")+1:]
+		headers = append(headers, [2]string{"Message-ID", "<" + id + "@" + domain + ">"})
+	}
+	for _, h := range headers {
+		buf.WriteString(h[0] + ": " + h[1] + "\r\n")
+	}
+	buf.WriteString("\r\n")
+
+	qp := quotedprintable.NewWriter(&buf)
+	if _, err := qp.Write([]byte(text)); err != nil {
+		return nil, fmt.Errorf("can't encode message: %w", err)
+	}
+	if err := qp.Close(); err != nil {
+		return nil, fmt.Errorf("can't encode message: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *SMTPSender) port() int {
+	switch {
+	case s.Port != 0:
+		return s.Port
+	case s.TLS:
+		return 465
+	case s.StartTLS:
+		return 587
+	}
+	return 25
+}
+
+func (s *SMTPSender) tlsConfig() *tls.Config {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12} // nolint gosec
+	if s.TLSConfig != nil {
+		cfg = s.TLSConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = s.Host
+	}
+	return cfg
+}
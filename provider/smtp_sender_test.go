@@ -0,0 +1,293 @@
+package provider
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSMTPSender_Send(t *testing.T) {
+	srv := newMockSMTPServer(t, mockSMTPOpts{})
+	s := SMTPSender{Host: "127.0.0.1", Port: srv.port, From: "Example <noreply@example.com>",
+		Subject: "Confirm your email, ünïcode"}
+	require.NoError(t, s.Send("user@example.com", "line1\nhttp://example.com/login?token="+strings.Repeat("x", 100)+"\n.\n"))
+
+	msgs := srv.messages()
+	require.Len(t, msgs, 1)
+	assert.Equal(t, "noreply@example.com", msgs[0].from)
+	assert.Equal(t, "user@example.com", msgs[0].to)
+	assert.Equal(t, "", msgs[0].auth)
+	assert.False(t, msgs[0].tls)
+
+	m, err := mail.ReadMessage(strings.NewReader(msgs[0].data))
+	require.NoError(t, err)
+	assert.Equal(t, `"Example" <noreply@example.com>`, m.Header.Get("From"))
+	assert.Equal(t, "user@example.com", m.Header.Get("To"))
+	subj, err := new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject"))
+	require.NoError(t, err)
+	assert.Equal(t, "Confirm your email, ünïcode", subj)
+	date, err := m.Header.Date()
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), date, time.Minute)
+	assert.True(t, strings.HasSuffix(m.Header.Get("Message-ID"), "@example.com>"))
+	assert.Equal(t, "text/plain; charset=UTF-8", m.Header.Get("Content-Type"))
+	body, err := io.ReadAll(quotedprintable.NewReader(m.Body))
+	require.NoError(t, err)
+	assert.Equal(t, "line1\r\nhttp://example.com/login?token="+strings.Repeat("x", 100)+"\r\n.\r\n", string(body))
+}
+
+func TestSMTPSender_TLS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	clientTLS := &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+
+	t.Run("implicit", func(t *testing.T) {
+		srv := newMockSMTPServer(t, mockSMTPOpts{tls: ts.TLS, implicitTLS: true})
+		s := SMTPSender{Host: "127.0.0.1", Port: srv.port, From: "noreply@example.com", TLS: true, TLSConfig: clientTLS,
+			Username: "user", Password: "passwd"}
+		require.NoError(t, s.Send("user@example.com", "text"))
+		msgs := srv.messages()
+		require.Len(t, msgs, 1)
+		assert.True(t, msgs[0].tls)
+		assert.Equal(t, "\x00user\x00passwd", msgs[0].auth)
+	})
+
+	t.Run("starttls", func(t *testing.T) {
+		srv := newMockSMTPServer(t, mockSMTPOpts{tls: ts.TLS})
+		s := SMTPSender{Host: "127.0.0.1", Port: srv.port, From: "noreply@example.com", StartTLS: true,
+			TLSConfig: clientTLS, Username: "user", Password: "passwd"}
+		require.NoError(t, s.Send("user@example.com", "text"))
+		msgs := srv.messages()
+		require.Len(t, msgs, 1)
+		assert.True(t, msgs[0].tls)
+		assert.Equal(t, "\x00user\x00passwd", msgs[0].auth)
+	})
+
+	t.Run("starttls not offered", func(t *testing.T) {
+		srv := newMockSMTPServer(t, mockSMTPOpts{})
+		s := SMTPSender{Host: "127.0.0.1", Port: srv.port, From: "noreply@example.com", StartTLS: true,
+			TLSConfig: clientTLS}
+		err := s.Send("user@example.com", "text")
+		assertSMTPStage(t, err, SMTPStageConnect)
+		assert.Contains(t, err.Error(), "STARTTLS")
+		assert.Empty(t, srv.messages())
+	})
+
+	t.Run("untrusted certificate", func(t *testing.T) {
+		srv := newMockSMTPServer(t, mockSMTPOpts{tls: ts.TLS, implicitTLS: true})
+		s := SMTPSender{Host: "127.0.0.1", Port: srv.port, From: "noreply@example.com", TLS: true}
+		assertSMTPStage(t, s.Send("user@example.com", "text"), SMTPStageConnect)
+	})
+}
+
+func TestSMTPSender_Errors(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	require.NoError(t, l.Close())
+	s := SMTPSender{Host: "127.0.0.1", Port: port, From: "noreply@example.com", DialTimeout: time.Second}
+	err = s.Send("user@example.com", "text")
+	assertSMTPStage(t, err, SMTPStageConnect)
+	assert.True(t, errors.Is(err, ErrTransientSend))
+
+	srv := newMockSMTPServer(t, mockSMTPOpts{rejectAuth: true})
+	s = SMTPSender{Host: "127.0.0.1", Port: srv.port, From: "noreply@example.com", Username: "user", Password: "bad"}
+	err = s.Send("user@example.com", "text")
+	assertSMTPStage(t, err, SMTPStageAuth)
+	assert.Contains(t, err.Error(), "535")
+	assert.False(t, errors.Is(err, ErrTransientSend) || errors.Is(err, ErrPermanentSend), "misconfigured sender")
+
+	srv = newMockSMTPServer(t, mockSMTPOpts{rejectRcpt: true})
+	s = SMTPSender{Host: "127.0.0.1", Port: srv.port, From: "noreply@example.com"}
+	err = s.Send("unknown@example.com", "text")
+	assertSMTPStage(t, err, SMTPStageDelivery)
+	assert.Contains(t, err.Error(), "550")
+	assert.True(t, errors.Is(err, ErrPermanentSend))
+	assert.False(t, errors.Is(err, ErrTransientSend))
+	assert.Empty(t, srv.messages())
+
+	// rejected before connection, not smtp errors
+	err = s.Send("user@example.com\r\nBcc: other@example.com", "text")
+	require.Error(t, err)
+	assert.False(t, errors.As(err, new(*SMTPError)))
+	s.From = "bad from"
+	err = s.Send("user@example.com", "text")
+	require.Error(t, err)
+	assert.False(t, errors.As(err, new(*SMTPError)))
+}
+
+func TestSMTPSender_SendTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		time.Sleep(time.Second) // never greets
+	}()
+	s := SMTPSender{Host: "127.0.0.1", Port: l.Addr().(*net.TCPAddr).Port, From: "noreply@example.com",
+		SendTimeout: 100 * time.Millisecond}
+	st := time.Now()
+	assertSMTPStage(t, s.Send("user@example.com", "text"), SMTPStageConnect)
+	assert.Less(t, time.Since(st), 900*time.Millisecond)
+}
+
+func TestSMTPSender_Port(t *testing.T) {
+	assert.Equal(t, 25, (&SMTPSender{}).port())
+	assert.Equal(t, 465, (&SMTPSender{TLS: true}).port())
+	assert.Equal(t, 587, (&SMTPSender{StartTLS: true}).port())
+	assert.Equal(t, 2525, (&SMTPSender{Port: 2525, TLS: true}).port())
+}
+
+func assertSMTPStage(t *testing.T, err error, stage string) {
+	t.Helper()
+	require.Error(t, err)
+	var smtpErr *SMTPError
+	require.True(t, errors.As(err, &smtpErr), "smtp error expected, got %v", err)
+	assert.Equal(t, stage, smtpErr.Stage, err.Error())
+}
+
+type mockSMTPOpts struct {
+	tls         *tls.Config // offers STARTTLS with it, or serves implicit TLS
+	implicitTLS bool
+	rejectAuth  bool
+	rejectRcpt  bool
+}
+
+type mockSMTPMessage struct {
+	from, to, auth, data string
+	tls                  bool
+}
+
+// mockSMTPServer speaks minimal SMTP, enough for net/smtp client, and keeps received messages
+type mockSMTPServer struct {
+	opts mockSMTPOpts
+	port int
+	lock sync.Mutex
+	msgs []mockSMTPMessage
+}
+
+func newMockSMTPServer(t *testing.T, opts mockSMTPOpts) *mockSMTPServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	if opts.implicitTLS {
+		l = tls.NewListener(l, opts.tls)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	srv := &mockSMTPServer{opts: opts, port: l.Addr().(*net.TCPAddr).Port}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(conn)
+		}
+	}()
+	return srv
+}
+
+func (m *mockSMTPServer) messages() []mockSMTPMessage {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]mockSMTPMessage{}, m.msgs...)
+}
+
+func (m *mockSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	msg := mockSMTPMessage{tls: m.opts.implicitTLS}
+	rd, wr := bufio.NewReader(conn), conn
+	reply := func(s string) { _, _ = io.WriteString(wr, s+"\r\n") }
+
+	reply("220 localhost ESMTP mock")
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch cmd {
+		case "EHLO", "HELO":
+			if m.opts.tls != nil && !msg.tls {
+				reply("250-localhost")
+				reply("250-STARTTLS")
+			} else {
+				reply("250-localhost")
+			}
+			reply("250 AUTH PLAIN")
+		case "STARTTLS":
+			reply("220 ready")
+			tlsConn := tls.Server(conn, m.opts.tls)
+			if err = tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, rd, wr = tlsConn, bufio.NewReader(tlsConn), tlsConn
+			msg.tls = true
+		case "AUTH":
+			parts := strings.Fields(line)
+			if len(parts) < 3 || m.opts.rejectAuth {
+				reply("535 authentication failed")
+				continue
+			}
+			creds, _ := base64.StdEncoding.DecodeString(parts[2])
+			msg.auth = string(creds)
+			reply("235 ok")
+		case "MAIL":
+			msg.from = strings.Trim(strings.TrimPrefix(line, "MAIL FROM:"), "<> ")
+			reply("250 ok")
+		case "RCPT":
+			if m.opts.rejectRcpt {
+				reply("550 no such user")
+				continue
+			}
+			msg.to = strings.Trim(strings.TrimPrefix(line, "RCPT TO:"), "<> ")
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			data := strings.Builder{}
+			for {
+				l, err := rd.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(l, ".")) // dot-stuffing
+			}
+			msg.data = data.String()
+			m.lock.Lock()
+			m.msgs = append(m.msgs, msg)
+			m.lock.Unlock()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"context"
 	"crypto/sha1"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -19,6 +20,7 @@ import (
 	"github.com/go-pkgz/rest"
 	"github.com/golang-jwt/jwt"
 
+	"github.com/go-pkgz/auth/httpclient"
 	"github.com/go-pkgz/auth/logger"
 	authtoken "github.com/go-pkgz/auth/token"
 )
@@ -30,10 +32,24 @@ type TelegramHandler struct {
 	ProviderName         string
 	ErrorMsg, SuccessMsg string
 
-	TokenService TokenService
-	UserSaver    func(authtoken.User) error
-	AvatarSaver  AvatarSaver
-	Telegram     TelegramAPI
+	TokenService  TokenService
+	IssuerFunc    IssuerFunc // optional issuer of tokens by request, provider name used if not set or empty
+	UserSaver     func(authtoken.User) error
+	AvatarSaver   AvatarSaver
+	AvatarFetch   AvatarFetch   // client and policy of avatar downloads
+	PictureUpdate PictureUpdate // update of existing user's picture on login, saved on every login by default
+	Telegram      TelegramAPI
+
+	PollInterval  time.Duration        // interval of updates polling, default 5s
+	Requests      TelegramRequestStore // optional store of pending login requests, default is in-memory
+	WebhookURL    string               // public url of webhook route, enables webhook mode instead of polling
+	WebhookSecret string               // secret token telegram sends with webhook updates, required in webhook mode
+	MaxBodySize   int64                // max size of webhook request body, default MaxHTTPBodySize
+
+	RequiredChats      []string      // chat ids or @channelnames, login allowed to members of any of them, default no check
+	MembershipFailOpen bool          // allow login if membership can't be checked, default rejects it
+	MembershipMsg      string        // bot reply to user not a member of required chats, default explains the requirement
+	MembershipCacheTTL time.Duration // how long membership check results cached, default 1m
 
 	run      int32  // non-zero if Run goroutine has started
 	username string // bot username
@@ -41,10 +57,15 @@ type TelegramHandler struct {
 		sync.RWMutex
 		data map[string]tgAuthRequest
 	}
+	membership struct {
+		sync.Mutex
+		data map[int]tgMembership
+	}
 }
 
 type tgAuthRequest struct {
 	confirmed bool // whether login request has been confirmed and user info set
+	rejected  bool // user is not a member of required chats
 	expires   time.Time
 	user      *authtoken.User
 }
@@ -76,7 +97,15 @@ func (th *TelegramHandler) Run(ctx context.Context) error {
 	th.requests.data = make(map[string]tgAuthRequest)
 	th.requests.Unlock()
 
-	processUpdatedTicker := time.NewTicker(apiPollInterval)
+	if th.WebhookURL != "" {
+		return th.runWebhook(ctx)
+	}
+
+	pollInterval := th.PollInterval
+	if pollInterval == 0 {
+		pollInterval = apiPollInterval
+	}
+	processUpdatedTicker := time.NewTicker(pollInterval)
 	cleanupTicker := time.NewTicker(expiredCleanupInterval)
 
 	for {
@@ -94,31 +123,27 @@ func (th *TelegramHandler) Run(ctx context.Context) error {
 			}
 			th.processUpdates(ctx, updates)
 		case <-cleanupTicker.C:
-			now := time.Now()
-			th.requests.Lock()
-			for key, req := range th.requests.data {
-				if now.After(req.expires) {
-					delete(th.requests.data, key)
-				}
-			}
-			th.requests.Unlock()
+			th.cleanup()
 		}
 	}
 }
 
 // telegramUpdate contains update information, which is used from whole telegram API response
 type telegramUpdate struct {
-	Result []struct {
-		UpdateID int `json:"update_id"`
-		Message  struct {
-			Chat struct {
-				ID   int    `json:"id"`
-				Name string `json:"first_name"`
-				Type string `json:"type"`
-			} `json:"chat"`
-			Text string `json:"text"`
-		} `json:"message"`
-	} `json:"result"`
+	Result []tgUpdate `json:"result"`
+}
+
+// tgUpdate is a single update, sent to webhook as-is
+type tgUpdate struct {
+	UpdateID int `json:"update_id"`
+	Message  struct {
+		Chat struct {
+			ID   int    `json:"id"`
+			Name string `json:"first_name"`
+			Type string `json:"type"`
+		} `json:"chat"`
+		Text string `json:"text"`
+	} `json:"message"`
 }
 
 // ProcessUpdate is alternative to Run, it processes provided plain text update from Telegram
@@ -127,24 +152,11 @@ func (th *TelegramHandler) ProcessUpdate(ctx context.Context, textUpdate string)
 	if atomic.LoadInt32(&th.run) != 0 {
 		return fmt.Errorf("Run goroutine should not be used with ProcessUpdate")
 	}
-	defer func() {
-		// as Run goroutine is not running, clean up old requests on each update
-		// even if we hit json decode error
-		now := time.Now()
-		th.requests.Lock()
-		for key, req := range th.requests.data {
-			if now.After(req.expires) {
-				delete(th.requests.data, key)
-			}
-		}
-		th.requests.Unlock()
-	}()
+	// as Run goroutine is not running, clean up old requests on each update
+	// even if we hit json decode error
+	defer th.cleanup()
 	// initialize requests.data as usually it's initialized in Run
-	th.requests.Lock()
-	if th.requests.data == nil {
-		th.requests.data = make(map[string]tgAuthRequest)
-	}
-	th.requests.Unlock()
+	th.initRequests()
 	var updates telegramUpdate
 	if err := json.Unmarshal([]byte(textUpdate), &updates); err != nil {
 		return fmt.Errorf("failed to decode provided telegram update: %w", err)
@@ -167,36 +179,53 @@ func (th *TelegramHandler) processUpdates(ctx context.Context, updates *telegram
 
 		token := strings.TrimPrefix(update.Message.Text, "/start ")
 
-		th.requests.RLock()
-		authRequest, ok := th.requests.data[token]
+		authRequest, ok, err := th.getRequest(token)
+		if err != nil {
+			th.Error("[ERROR] failed to get login request: %v", err)
+			continue
+		}
 		if !ok { // No such token
-			th.requests.RUnlock()
-			err := th.Telegram.Send(ctx, update.Message.Chat.ID, th.ErrorMsg)
+			err = th.Telegram.Send(ctx, update.Message.Chat.ID, th.ErrorMsg)
 			if err != nil {
 				th.Error("[ERROR] failed to notify telegram peer: %v", err)
 			}
 			continue
 		}
-		th.requests.RUnlock()
+
+		if !th.allowedMember(ctx, update.Message.Chat.ID) {
+			authRequest.rejected = true
+			if err = th.setRequest(token, authRequest); err != nil {
+				th.Error("[ERROR] failed to reject login request: %v", err)
+			}
+			msg := th.MembershipMsg
+			if msg == "" {
+				msg = defaultMembershipMsg
+			}
+			if err = th.Telegram.Send(ctx, update.Message.Chat.ID, msg); err != nil {
+				th.Error("[ERROR] failed to notify telegram peer: %v", err)
+			}
+			continue
+		}
 
 		avatarURL, err := th.Telegram.Avatar(ctx, update.Message.Chat.ID)
 		if err != nil {
-			th.Error("[ERROR] failed to get user avatar: %v", err)
-			continue
+			th.Logf("[WARN] failed to get user avatar, login without it: %v", err)
+			avatarURL = ""
 		}
 
 		id := th.ProviderName + "_" + authtoken.HashID(sha1.New(), fmt.Sprint(update.Message.Chat.ID))
 
-		authRequest.confirmed = true
+		authRequest.confirmed, authRequest.rejected = true, false
 		authRequest.user = &authtoken.User{
 			ID:      id,
 			Name:    update.Message.Chat.Name,
 			Picture: avatarURL,
 		}
 
-		th.requests.Lock()
-		th.requests.data[token] = authRequest
-		th.requests.Unlock()
+		if err = th.setRequest(token, authRequest); err != nil {
+			th.Error("[ERROR] failed to confirm login request: %v", err)
+			continue
+		}
 
 		err = th.Telegram.Send(ctx, update.Message.Chat.ID, th.SuccessMsg)
 		if err != nil {
@@ -207,6 +236,12 @@ func (th *TelegramHandler) processUpdates(ctx context.Context, updates *telegram
 
 // addToken adds token
 func (th *TelegramHandler) addToken(token string, expires time.Time) error {
+	if th.Requests != nil {
+		return th.setRequest(token, tgAuthRequest{expires: expires})
+	}
+	if th.WebhookURL != "" {
+		th.initRequests() // webhook mode doesn't need Run
+	}
 	th.requests.Lock()
 	if th.requests.data == nil {
 		th.requests.Unlock()
@@ -221,21 +256,26 @@ func (th *TelegramHandler) addToken(token string, expires time.Time) error {
 
 // checkToken verifies incoming token, returns the user address if it's confirmed and empty string otherwise
 func (th *TelegramHandler) checkToken(token string) (*authtoken.User, error) {
-	th.requests.RLock()
-	authRequest, ok := th.requests.data[token]
-	th.requests.RUnlock()
+	authRequest, ok, err := th.getRequest(token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get request: %w", err)
+	}
 
 	if !ok {
 		return nil, fmt.Errorf("request is not found")
 	}
 
 	if time.Now().After(authRequest.expires) {
-		th.requests.Lock()
-		delete(th.requests.data, token)
-		th.requests.Unlock()
+		if err = th.deleteRequest(token); err != nil {
+			th.Logf("[WARN] failed to delete expired request, %v", err)
+		}
 		return nil, fmt.Errorf("request expired")
 	}
 
+	if authRequest.rejected {
+		return nil, errTgNotMember
+	}
+
 	if !authRequest.confirmed {
 		return nil, fmt.Errorf("request is not verified yet")
 	}
@@ -290,21 +330,31 @@ func (th *TelegramHandler) LoginHandler(w http.ResponseWriter, r *http.Request)
 
 	// GET /login?token=blah
 	authUser, err := th.checkToken(queryToken)
+	if errors.Is(err, errTgNotMember) {
+		rest.SendErrorJSON(w, r, nil, http.StatusForbidden, err, err.Error())
+		return
+	}
 	if err != nil {
 		rest.SendErrorJSON(w, r, nil, http.StatusNotFound, err, err.Error())
 		return
 	}
 
-	u, err := setAvatar(th.AvatarSaver, *authUser, &http.Client{Timeout: 5 * time.Second})
-	if err != nil {
-		rest.SendErrorJSON(w, r, th.L, http.StatusInternalServerError, err, "failed to save avatar to proxy")
-		return
+	u := *authUser
+	if th.AvatarSaver == nil || th.AvatarFetch.Skip {
+		u.Picture = "" // telegram file url contains bot token, can't be exposed without avatar proxy
+	}
+	if !th.AvatarFetch.Skip {
+		u, err = th.PictureUpdate.setAvatar(th.L, th.AvatarSaver, u, th.AvatarFetch.client(nil))
+		if err != nil {
+			rest.SendErrorJSON(w, r, th.L, http.StatusInternalServerError, err, "failed to save avatar to proxy")
+			return
+		}
 	}
 
 	if th.UserSaver != nil {
 		err = th.UserSaver(u)
 		if err != nil {
-			rest.SendErrorJSON(w, r, th.L, http.StatusInternalServerError, err, "failed to save user")
+			sendSaveUserError(w, r, th.L, err)
 			return
 		}
 	}
@@ -314,11 +364,12 @@ func (th *TelegramHandler) LoginHandler(w http.ResponseWriter, r *http.Request)
 		StandardClaims: jwt.StandardClaims{
 			Audience:  r.URL.Query().Get("site"),
 			Id:        queryToken,
-			Issuer:    th.ProviderName,
+			Issuer:    th.IssuerFunc.get(r, th.ProviderName),
 			ExpiresAt: time.Now().Add(30 * time.Minute).Unix(),
 			NotBefore: time.Now().Add(-1 * time.Minute).Unix(),
 		},
 		SessionOnly: false, // TODO review?
+		Provider:    th.ProviderName,
 	}
 
 	if _, err := th.TokenService.Set(w, claims); err != nil {
@@ -329,9 +380,9 @@ func (th *TelegramHandler) LoginHandler(w http.ResponseWriter, r *http.Request)
 	rest.RenderJSON(w, claims.User)
 
 	// Delete request
-	th.requests.Lock()
-	defer th.requests.Unlock()
-	delete(th.requests.data, queryToken)
+	if err = th.deleteRequest(queryToken); err != nil {
+		th.Logf("[WARN] failed to delete confirmed request, %v", err)
+	}
 }
 
 // AuthHandler does nothing since we don't have any callbacks
@@ -342,11 +393,25 @@ func (th *TelegramHandler) LogoutHandler(w http.ResponseWriter, _ *http.Request)
 	th.TokenService.Reset(w)
 }
 
+// TelegramAPIOpts defines options of TelegramAPI, zero values replaced by defaults
+type TelegramAPIOpts struct {
+	Client          *http.Client  // http client for telegram api, default with RequestTimeout
+	RequestTimeout  time.Duration // timeout of a single api request, default 30s
+	LongPollTimeout time.Duration // long polling timeout of getUpdates, added to RequestTimeout. Default is short polling
+	MaxAvatarSize   int           // max size of avatar photo in bytes, the largest photo within it used, default 1MB
+}
+
+const (
+	defaultTgRequestTimeout = 30 * time.Second
+	defaultTgMaxAvatarSize  = 1024 * 1024
+)
+
 // tgAPI implements TelegramAPI
 type tgAPI struct {
 	logger.L
 	token  string
 	client *http.Client
+	opts   TelegramAPIOpts
 
 	// Identifier of the first update to be requested.
 	// Should be equal to LastSeenUpdateID + 1
@@ -356,9 +421,24 @@ type tgAPI struct {
 
 // NewTelegramAPI returns initialized TelegramAPI implementation
 func NewTelegramAPI(token string, client *http.Client) TelegramAPI {
+	return NewTelegramAPIWithOpts(token, TelegramAPIOpts{Client: client})
+}
+
+// NewTelegramAPIWithOpts returns initialized TelegramAPI implementation with options
+func NewTelegramAPIWithOpts(token string, opts TelegramAPIOpts) TelegramAPI {
+	if opts.RequestTimeout == 0 {
+		opts.RequestTimeout = defaultTgRequestTimeout
+	}
+	if opts.MaxAvatarSize == 0 {
+		opts.MaxAvatarSize = defaultTgMaxAvatarSize
+	}
+	if opts.Client == nil {
+		opts.Client = httpclient.New(opts.RequestTimeout + opts.LongPollTimeout)
+	}
 	return &tgAPI{
-		client: client,
+		client: opts.Client,
 		token:  token,
+		opts:   opts,
 	}
 }
 
@@ -368,10 +448,13 @@ func (tg *tgAPI) GetUpdates(ctx context.Context) (*telegramUpdate, error) {
 	if tg.updateOffset != 0 {
 		url += fmt.Sprintf("&offset=%d", tg.updateOffset)
 	}
+	if tg.opts.LongPollTimeout > 0 {
+		url += fmt.Sprintf("&timeout=%d", int(tg.opts.LongPollTimeout.Seconds()))
+	}
 
 	var result telegramUpdate
 
-	err := tg.request(ctx, url, &result)
+	err := tg.requestWithTimeout(ctx, url, &result, tg.opts.RequestTimeout+tg.opts.LongPollTimeout)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch updates: %w", err)
 	}
@@ -399,7 +482,8 @@ func (tg *tgAPI) Avatar(ctx context.Context, id int) (string, error) {
 	var profilePhotos = struct {
 		Result struct {
 			Photos [][]struct {
-				ID string `json:"file_id"`
+				ID   string `json:"file_id"`
+				Size int    `json:"file_size"`
 			} `json:"photos"`
 		} `json:"result"`
 	}{}
@@ -413,20 +497,31 @@ func (tg *tgAPI) Avatar(ctx context.Context, id int) (string, error) {
 		return "", nil
 	}
 
-	// Get max possible picture size
-	last := len(profilePhotos.Result.Photos[0]) - 1
-	fileID := profilePhotos.Result.Photos[0][last].ID
+	// Get max possible picture size within the limit, sizes ordered from the smallest one
+	fileID := ""
+	for _, p := range profilePhotos.Result.Photos[0] {
+		if p.Size <= tg.opts.MaxAvatarSize {
+			fileID = p.ID
+		}
+	}
+	if fileID == "" { // all photos are too large
+		return "", nil
+	}
 	url = fmt.Sprintf(`getFile?file_id=%s`, fileID)
 
 	var fileMetadata = struct {
 		Result struct {
 			Path string `json:"file_path"`
+			Size int    `json:"file_size"`
 		} `json:"result"`
 	}{}
 
 	if err := tg.request(ctx, url, &fileMetadata); err != nil {
 		return "", err
 	}
+	if fileMetadata.Result.Path == "" || fileMetadata.Result.Size > tg.opts.MaxAvatarSize {
+		return "", nil
+	}
 
 	avatarURL := fmt.Sprintf("https://api.telegram.org/file/bot%s/%s", tg.token, fileMetadata.Result.Path)
 
@@ -456,9 +551,16 @@ func (tg *tgAPI) BotInfo(ctx context.Context) (*botInfo, error) {
 }
 
 func (tg *tgAPI) request(ctx context.Context, method string, data interface{}) error {
+	return tg.requestWithTimeout(ctx, method, data, tg.opts.RequestTimeout)
+}
+
+// requestWithTimeout makes api request, each attempt limited by timeout
+func (tg *tgAPI) requestWithTimeout(ctx context.Context, method string, data interface{}, timeout time.Duration) error {
 	return repeater.NewDefault(3, time.Millisecond*50).Do(ctx, func() error {
 		url := fmt.Sprintf("https://api.telegram.org/bot%s/%s", tg.token, method)
 
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
 		req, err := http.NewRequestWithContext(ctx, "GET", url, http.NoBody)
 		if err != nil {
 			return fmt.Errorf("failed to create request: %w", err)
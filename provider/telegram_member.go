@@ -0,0 +1,110 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	neturl "net/url"
+	"time"
+)
+
+const (
+	defaultMembershipCacheTTL = time.Minute
+	defaultMembershipMsg      = "Login is allowed to members of the group only. Join it and try again."
+)
+
+// errTgNotMember returned by checkToken for requests rejected because the user is not a member of required chats
+var errTgNotMember = errors.New("not a member of required chat")
+
+// TelegramChatMemberGetter is implemented by TelegramAPI supporting membership checks
+type TelegramChatMemberGetter interface {
+	ChatMemberStatus(ctx context.Context, chatID string, userID int) (string, error)
+}
+
+type tgMembership struct {
+	member  bool
+	expires time.Time
+}
+
+// checkMembership reports if the user is a member of any of RequiredChats. Results cached for MembershipCacheTTL,
+// errors are not cached. Error returned only if none of the chats confirmed membership and some check failed.
+func (th *TelegramHandler) checkMembership(ctx context.Context, userID int) (bool, error) {
+	if len(th.RequiredChats) == 0 {
+		return true, nil
+	}
+
+	ttl := th.MembershipCacheTTL
+	if ttl == 0 {
+		ttl = defaultMembershipCacheTTL
+	}
+	now := time.Now()
+	th.membership.Lock()
+	if m, ok := th.membership.data[userID]; ok && now.Before(m.expires) {
+		th.membership.Unlock()
+		return m.member, nil
+	}
+	th.membership.Unlock()
+
+	getter, ok := th.Telegram.(TelegramChatMemberGetter)
+	if !ok {
+		return false, fmt.Errorf("telegram api doesn't support membership checks")
+	}
+
+	var lastErr error
+	member := false
+	for _, chat := range th.RequiredChats {
+		status, err := getter.ChatMemberStatus(ctx, chat, userID)
+		if err != nil {
+			lastErr = fmt.Errorf("failed to get membership in %s: %w", chat, err)
+			continue
+		}
+		if status == "member" || status == "administrator" || status == "creator" {
+			member = true
+			break
+		}
+	}
+	if !member && lastErr != nil {
+		return false, lastErr
+	}
+
+	th.membership.Lock()
+	if th.membership.data == nil {
+		th.membership.data = map[int]tgMembership{}
+	}
+	for k, m := range th.membership.data {
+		if now.After(m.expires) {
+			delete(th.membership.data, k)
+		}
+	}
+	th.membership.data[userID] = tgMembership{member: member, expires: now.Add(ttl)}
+	th.membership.Unlock()
+	return member, nil
+}
+
+// allowedMember checks membership of the user, applies MembershipFailOpen on errors
+func (th *TelegramHandler) allowedMember(ctx context.Context, userID int) bool {
+	member, err := th.checkMembership(ctx, userID)
+	if err != nil {
+		th.Logf("[WARN] can't check membership of %d, fail-open %v: %v", userID, th.MembershipFailOpen, err)
+		return th.MembershipFailOpen
+	}
+	return member
+}
+
+// ChatMemberStatus returns status of the user in the chat, i.e. "member", "left" or "kicked".
+// Chat is a chat id or @channelname, the bot should be a member of it.
+func (tg *tgAPI) ChatMemberStatus(ctx context.Context, chatID string, userID int) (string, error) {
+	var resp = struct {
+		Result struct {
+			Status string `json:"status"`
+		} `json:"result"`
+	}{}
+	method := fmt.Sprintf("getChatMember?chat_id=%s&user_id=%d", neturl.QueryEscape(chatID), userID)
+	if err := tg.request(ctx, method, &resp); err != nil {
+		return "", err
+	}
+	if resp.Result.Status == "" {
+		return "", fmt.Errorf("received empty status")
+	}
+	return resp.Result.Status, nil
+}
@@ -0,0 +1,186 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/auth/logger"
+	authtoken "github.com/go-pkgz/auth/token"
+)
+
+// tgMemberAPIMock adds ChatMemberStatus to TelegramAPIMock
+type tgMemberAPIMock struct {
+	*TelegramAPIMock
+	lock   sync.Mutex
+	calls  []string
+	status map[string]string // status by chat, error if missing
+}
+
+func (m *tgMemberAPIMock) ChatMemberStatus(_ context.Context, chatID string, userID int) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.calls = append(m.calls, fmt.Sprintf("%s:%d", chatID, userID))
+	if st, ok := m.status[chatID]; ok {
+		return st, nil
+	}
+	return "", errors.New("api error")
+}
+
+func newMemberHandler(t *testing.T, status map[string]string) (*TelegramHandler, *tgMemberAPIMock, *[]string) {
+	var replies []string
+	m := &tgMemberAPIMock{
+		TelegramAPIMock: &TelegramAPIMock{
+			AvatarFunc: func(ctx context.Context, userID int) (string, error) { return "", nil },
+			SendFunc: func(ctx context.Context, id int, text string) error {
+				replies = append(replies, text)
+				return nil
+			},
+			BotInfoFunc: botInfoFunc,
+		},
+		status: status,
+	}
+	tg := &TelegramHandler{
+		ProviderName: "telegram",
+		ErrorMsg:     "error",
+		SuccessMsg:   "success",
+		L:            logger.NoOp{},
+		TokenService: authtoken.NewService(authtoken.Opts{
+			SecretReader:   authtoken.SecretFunc(func(string) (string, error) { return "secret", nil }),
+			TokenDuration:  time.Hour,
+			CookieDuration: time.Hour * 24 * 31,
+		}),
+		Telegram:      m,
+		Requests:      &mockTgRequests{data: map[string]TelegramAuthRequest{}},
+		RequiredChats: []string{"@mychannel", "-100123"},
+	}
+	return tg, m, &replies
+}
+
+// loginWithUpdate gets login token, confirms it in telegram and returns login response
+func loginWithUpdate(t *testing.T, tg *TelegramHandler) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	tg.LoginHandler(rr, httptest.NewRequest("GET", "/login", http.NoBody))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	resp := struct {
+		Token string `json:"token"`
+	}{}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+
+	update := tgUpdate{}
+	require.NoError(t, json.Unmarshal([]byte(fmt.Sprintf(webhookUpdate, resp.Token)), &update))
+	tg.processUpdates(context.Background(), &telegramUpdate{Result: []tgUpdate{update}})
+
+	rr = httptest.NewRecorder()
+	tg.LoginHandler(rr, httptest.NewRequest("GET", "/login?token="+resp.Token, http.NoBody))
+	return rr
+}
+
+func TestTelegram_RequiredChats(t *testing.T) {
+	tbl := []struct {
+		name     string
+		status   map[string]string
+		failOpen bool
+		code     int
+	}{
+		{"member", map[string]string{"@mychannel": "member"}, false, http.StatusOK},
+		{"admin of second chat", map[string]string{"@mychannel": "left", "-100123": "administrator"}, false, http.StatusOK},
+		{"creator", map[string]string{"@mychannel": "creator"}, false, http.StatusOK},
+		{"left", map[string]string{"@mychannel": "left", "-100123": "left"}, false, http.StatusForbidden},
+		{"kicked", map[string]string{"@mychannel": "kicked", "-100123": "kicked"}, false, http.StatusForbidden},
+		{"restricted", map[string]string{"@mychannel": "restricted", "-100123": "left"}, true, http.StatusForbidden},
+		{"member despite error", map[string]string{"-100123": "member"}, false, http.StatusOK},
+		{"api error, fail-closed", map[string]string{}, false, http.StatusForbidden},
+		{"api error and left, fail-closed", map[string]string{"-100123": "left"}, false, http.StatusForbidden},
+		{"api error, fail-open", map[string]string{}, true, http.StatusOK},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			tg, _, replies := newMemberHandler(t, tt.status)
+			tg.MembershipFailOpen = tt.failOpen
+			rr := loginWithUpdate(t, tg)
+			require.Equal(t, tt.code, rr.Code, rr.Body.String())
+			if tt.code == http.StatusForbidden {
+				assert.Equal(t, `{"error":"not a member of required chat"}`+"\n", rr.Body.String())
+				assert.Equal(t, []string{defaultMembershipMsg}, *replies)
+				return
+			}
+			assert.Equal(t, []string{"success"}, *replies)
+			assert.NotEmpty(t, rr.Result().Cookies())
+		})
+	}
+}
+
+func TestTelegram_RequiredChatsCache(t *testing.T) {
+	tg, m, replies := newMemberHandler(t, map[string]string{"@mychannel": "left", "-100123": "left"})
+	tg.MembershipMsg = "join @mychannel first"
+
+	rr := loginWithUpdate(t, tg)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Equal(t, []string{"join @mychannel first"}, *replies)
+	assert.Equal(t, []string{"@mychannel:313131313", "-100123:313131313"}, m.calls)
+
+	// retry within cache ttl doesn't hit api
+	m.status["@mychannel"] = "member"
+	rr = loginWithUpdate(t, tg)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Equal(t, 2, len(m.calls))
+
+	// cache expired, joined user allowed
+	tg.membership.Lock()
+	for k, v := range tg.membership.data {
+		v.expires = time.Now().Add(-time.Second)
+		tg.membership.data[k] = v
+	}
+	tg.membership.Unlock()
+	rr = loginWithUpdate(t, tg)
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, 3, len(m.calls), "stopped at the first chat with membership")
+
+	// errors not cached
+	tg, m, _ = newMemberHandler(t, map[string]string{})
+	loginWithUpdate(t, tg)
+	loginWithUpdate(t, tg)
+	assert.Equal(t, 4, len(m.calls))
+}
+
+func TestTelegram_RequiredChatsNotSupported(t *testing.T) {
+	tg, m, _ := newMemberHandler(t, nil)
+	tg.Telegram = m.TelegramAPIMock
+	rr := loginWithUpdate(t, tg)
+	assert.Equal(t, http.StatusForbidden, rr.Code, "api without membership checks rejects login")
+}
+
+func TestTgAPI_ChatMemberStatus(t *testing.T) {
+	tg, cleanup := prepareTgAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Contains(t, r.URL.Path, "getChatMember")
+		assert.Equal(t, "313131313", r.URL.Query().Get("user_id"))
+		switch r.URL.Query().Get("chat_id") {
+		case "@mychannel":
+			_, _ = w.Write([]byte(`{"ok":true,"result":{"status":"kicked","user":{"id":313131313}}}`))
+		case "-100123":
+			_, _ = w.Write([]byte(`{"ok":true,"result":{}}`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"ok":false,"description":"Bad Request: chat not found"}`))
+		}
+	})
+	defer cleanup()
+
+	status, err := tg.ChatMemberStatus(context.Background(), "@mychannel", 313131313)
+	require.NoError(t, err)
+	assert.Equal(t, "kicked", status)
+	_, err = tg.ChatMemberStatus(context.Background(), "-100123", 313131313)
+	assert.EqualError(t, err, "received empty status")
+	_, err = tg.ChatMemberStatus(context.Background(), "@other", 313131313)
+	assert.Error(t, err)
+}
@@ -0,0 +1,147 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-pkgz/auth/httpclient"
+)
+
+const (
+	defaultTgSenderAPI     = "https://api.telegram.org/"
+	defaultTgSenderTimeout = 30 * time.Second
+)
+
+// TelegramChatResolver returns Telegram chat ID of the confirmation address, i.e. by user name from the app's
+// records of users started the bot. Chat ID is a number, or @channelusername for channels.
+type TelegramChatResolver func(address string) (chatID string, err error)
+
+// TelegramSenderOpts defines options of TelegramSender, zero values replaced by defaults
+type TelegramSenderOpts struct {
+	APIURL  string        // bot api url, default https://api.telegram.org/
+	Client  *http.Client  // http client for bot api, default with Timeout
+	Timeout time.Duration // timeout of the whole Send, including wait for retry of rate limited request, default 30s
+}
+
+// TelegramSender implements Sender delivering confirmations with Telegram bot's sendMessage.
+// The address resolved to chat ID with resolver, the user should start the bot before, bots can't message first.
+type TelegramSender struct {
+	token   string
+	resolve TelegramChatResolver
+	opts    TelegramSenderOpts
+}
+
+// NewTelegramSender makes TelegramSender with bot token and resolver of chat IDs
+func NewTelegramSender(token string, resolve TelegramChatResolver, opts TelegramSenderOpts) *TelegramSender {
+	if opts.APIURL == "" {
+		opts.APIURL = defaultTgSenderAPI
+	}
+	if !strings.HasSuffix(opts.APIURL, "/") {
+		opts.APIURL += "/"
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = defaultTgSenderTimeout
+	}
+	if opts.Client == nil {
+		opts.Client = httpclient.New(opts.Timeout)
+	}
+	return &TelegramSender{token: token, resolve: resolve, opts: opts}
+}
+
+// Send delivers text to the chat of address, limited by Timeout
+func (s *TelegramSender) Send(address, text string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.Timeout)
+	defer cancel()
+	return s.SendContext(ctx, address, text)
+}
+
+// SendContext delivers text to the chat of address. Rate limited request retried once after retry_after
+// returned by the api, unless ctx is done before.
+func (s *TelegramSender) SendContext(ctx context.Context, address, text string) error {
+	chatID, err := s.resolve(address)
+	if err != nil {
+		return fmt.Errorf("can't resolve telegram chat of %s: %w", address, err)
+	}
+	body, err := json.Marshal(struct {
+		ChatID string `json:"chat_id"`
+		Text   string `json:"text"`
+	}{ChatID: chatID, Text: text})
+	if err != nil {
+		return fmt.Errorf("failed to marshal telegram message: %w", err)
+	}
+
+	retryAfter, err := s.sendMessage(ctx, body)
+	if err == nil || retryAfter == 0 {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < retryAfter {
+		return fmt.Errorf("%w, no time to retry after %v", err, retryAfter)
+	}
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("%w, no time to retry after %v", err, retryAfter)
+	case <-time.After(retryAfter):
+	}
+	_, err = s.sendMessage(ctx, body)
+	return err
+}
+
+// Channel returns channel name for delivery metrics
+func (s *TelegramSender) Channel() string {
+	return "telegram"
+}
+
+// sendMessage posts the message, returns retry_after of rate limited request with the error
+func (s *TelegramSender) sendMessage(ctx context.Context, body []byte) (retryAfter time.Duration, err error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", s.opts.APIURL+"bot"+s.token+"/sendMessage", bytes.NewReader(body))
+	if err != nil {
+		return 0, errors.New("failed to make telegram request") // error has the url with bot token
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.opts.Client.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err // strip the url with bot token
+		}
+		return 0, &sendErr{err: fmt.Errorf("failed to send telegram message: %w", err), kind: ErrTransientSend}
+	}
+	defer resp.Body.Close() // nolint
+
+	var res struct {
+		OK          bool   `json:"ok"`
+		ErrorCode   int    `json:"error_code"`
+		Description string `json:"description"`
+		Parameters  struct {
+			RetryAfter int `json:"retry_after"`
+		} `json:"parameters"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return 0, fmt.Errorf("failed to decode telegram response, status %d: %w", resp.StatusCode, err)
+	}
+	if res.OK {
+		return 0, nil
+	}
+	err = fmt.Errorf("telegram error %d: %s", res.ErrorCode, res.Description)
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || res.ErrorCode == http.StatusTooManyRequests:
+		retryAfter = time.Second // telegram sets retry_after, one second is a fallback
+		if res.Parameters.RetryAfter > 0 {
+			retryAfter = time.Duration(res.Parameters.RetryAfter) * time.Second
+		}
+		return retryAfter, &sendErr{err: err, kind: ErrTransientSend}
+	case res.ErrorCode >= 500:
+		return 0, &sendErr{err: err, kind: ErrTransientSend}
+	case res.ErrorCode == http.StatusBadRequest || res.ErrorCode == http.StatusForbidden:
+		return 0, &sendErr{err: err, kind: ErrPermanentSend} // i.e. chat not found or bot blocked by the user
+	}
+	return 0, err
+}
@@ -0,0 +1,137 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTelegramSender_Send(t *testing.T) {
+	var got struct {
+		ChatID string `json:"chat_id"`
+		Text   string `json:"text"`
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "/botxyz123/sendMessage", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+		_, _ = w.Write([]byte(sendMessageResp))
+	}))
+	defer ts.Close()
+
+	chats := map[string]string{"admin": "313131313"}
+	s := NewTelegramSender("xyz123", func(address string) (string, error) {
+		id, ok := chats[address]
+		if !ok {
+			return "", errors.New("no chat")
+		}
+		return id, nil
+	}, TelegramSenderOpts{APIURL: ts.URL})
+
+	require.NoError(t, s.Send("admin", "confirm with https://example.com/login?token=abc&x=1"))
+	assert.Equal(t, "313131313", got.ChatID)
+	assert.Equal(t, "confirm with https://example.com/login?token=abc&x=1", got.Text)
+	assert.Equal(t, "telegram", s.Channel())
+
+	err := s.Send("unknown", "text")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "can't resolve telegram chat of unknown: no chat")
+}
+
+func TestTelegramSender_APIError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"ok":false,"error_code":403,"description":"Forbidden: bot was blocked by the user"}`))
+	}))
+	defer ts.Close()
+	s := NewTelegramSender("xyz123", func(string) (string, error) { return "1", nil }, TelegramSenderOpts{APIURL: ts.URL})
+	err := s.Send("admin", "text")
+	require.Error(t, err)
+	assert.Equal(t, "telegram error 403: Forbidden: bot was blocked by the user", err.Error())
+	assert.True(t, errors.Is(err, ErrPermanentSend))
+
+	// ok:false with 200 is an error as well
+	ts200 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"ok":false,"error_code":400,"description":"Bad Request: chat not found"}`))
+	}))
+	defer ts200.Close()
+	s = NewTelegramSender("xyz123", func(string) (string, error) { return "1", nil }, TelegramSenderOpts{APIURL: ts200.URL})
+	err = s.Send("admin", "text")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "chat not found")
+
+	// transport error doesn't leak bot token
+	s = NewTelegramSender("xyz123", func(string) (string, error) { return "1", nil },
+		TelegramSenderOpts{APIURL: "http://127.0.0.1:1/"})
+	err = s.Send("admin", "text")
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), "xyz123")
+	assert.True(t, errors.Is(err, ErrTransientSend))
+}
+
+func TestTelegramSender_RetryAfter(t *testing.T) {
+	var calls, limited int32 // limited is the number of requests to reject with 429
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.AddInt32(&limited, -1) >= 0 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(`{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 1",` +
+				`"parameters":{"retry_after":1}}`))
+			return
+		}
+		_, _ = w.Write([]byte(sendMessageResp))
+	}))
+	defer ts.Close()
+	s := NewTelegramSender("xyz123", func(string) (string, error) { return "1", nil }, TelegramSenderOpts{APIURL: ts.URL})
+
+	atomic.StoreInt32(&limited, 1)
+	st := time.Now()
+	require.NoError(t, s.Send("admin", "text"))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	assert.GreaterOrEqual(t, time.Since(st), time.Second)
+
+	// retried once only
+	atomic.StoreInt32(&calls, 0)
+	atomic.StoreInt32(&limited, 2)
+	err := s.Send("admin", "text")
+	require.Error(t, err)
+	assert.Equal(t, "telegram error 429: Too Many Requests: retry after 1", err.Error())
+	assert.True(t, errors.Is(err, ErrTransientSend))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	// no retry if retry_after beyond the deadline
+	atomic.StoreInt32(&calls, 0)
+	atomic.StoreInt32(&limited, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	st = time.Now()
+	err = s.SendContext(ctx, "admin", "text")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no time to retry after 1s")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	assert.Less(t, time.Since(st), time.Second)
+}
+
+func TestTelegramSender_Timeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer ts.Close()
+	s := NewTelegramSender("xyz123", func(string) (string, error) { return "1", nil },
+		TelegramSenderOpts{APIURL: ts.URL, Timeout: 50 * time.Millisecond})
+	st := time.Now()
+	require.Error(t, s.Send("admin", "text"))
+	assert.Less(t, time.Since(st), 900*time.Millisecond)
+}
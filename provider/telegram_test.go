@@ -10,6 +10,7 @@ import (
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -105,6 +106,7 @@ func TestTelegramConfirmedRequest(t *testing.T) {
 				if err != nil {
 					t.Fatal(err)
 				}
+				servedToken = "" // served once, like real api with offset
 			}
 			return &upd, nil
 		},
@@ -585,3 +587,139 @@ func prepareTgAPI(t *testing.T, h http.HandlerFunc) (tg *tgAPI, cleanup func())
 
 	return NewTelegramAPI("xxxsupersecretxxx", client).(*tgAPI), srv.Close
 }
+
+func TestTgAPI_Options(t *testing.T) {
+	tg, cleanup := prepareTgAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "", r.URL.Query().Get("timeout"), "short polling by default")
+		_, _ = fmt.Fprintf(w, getUpdatesResp, "token")
+	})
+	defer cleanup()
+	assert.Equal(t, 30*time.Second, tg.opts.RequestTimeout)
+	assert.Equal(t, 1024*1024, tg.opts.MaxAvatarSize)
+	_, err := tg.GetUpdates(context.Background())
+	assert.NoError(t, err)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "getUpdates") {
+			assert.Equal(t, "1", r.URL.Query().Get("timeout"))
+			time.Sleep(150 * time.Millisecond) // long poll, longer than request timeout but within long poll timeout
+			_, _ = fmt.Fprintf(w, getUpdatesResp, "token")
+			return
+		}
+		time.Sleep(150 * time.Millisecond)
+		_, _ = w.Write([]byte(getMeResp))
+	}))
+	defer srv.Close()
+	api := NewTelegramAPIWithOpts("xxxsupersecretxxx", TelegramAPIOpts{
+		Client:          &http.Client{Transport: mockRoundTripper{srv.URL}},
+		RequestTimeout:  50 * time.Millisecond,
+		LongPollTimeout: time.Second,
+	})
+	_, err = api.GetUpdates(context.Background())
+	assert.NoError(t, err, "long poll timeout added to request timeout")
+	_, err = api.BotInfo(context.Background())
+	assert.ErrorIs(t, err, context.DeadlineExceeded, "request timeout")
+}
+
+const profilePhotosSizesResp = `{"ok":true,"result":{"total_count":1,"photos":[[
+	{"file_id":"small","file_size":100},{"file_id":"medium","file_size":5000},{"file_id":"large","file_size":2000000}]]}}`
+
+func TestTgAPI_AvatarSizeLimit(t *testing.T) {
+	var files []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "getUserProfilePhotos") {
+			_, _ = w.Write([]byte(profilePhotosSizesResp))
+			return
+		}
+		fileID := r.URL.Query().Get("file_id")
+		files = append(files, fileID)
+		_, _ = fmt.Fprintf(w, `{"ok":true,"result":{"file_id":%q,"file_size":5000,"file_path":"photos/%s.jpg"}}`, fileID, fileID)
+	}))
+	defer srv.Close()
+	client := &http.Client{Transport: mockRoundTripper{srv.URL}}
+
+	api := NewTelegramAPIWithOpts("xxxsupersecretxxx", TelegramAPIOpts{Client: client})
+	avatarURL, err := api.Avatar(context.Background(), 123)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://api.telegram.org/file/botxxxsupersecretxxx/photos/medium.jpg", avatarURL, "the largest within 1MB")
+
+	files = nil
+	api = NewTelegramAPIWithOpts("xxxsupersecretxxx", TelegramAPIOpts{Client: client, MaxAvatarSize: 50})
+	avatarURL, err = api.Avatar(context.Background(), 123)
+	assert.NoError(t, err)
+	assert.Equal(t, "", avatarURL, "all photos too large")
+	assert.Empty(t, files, "file not requested")
+
+	api = NewTelegramAPIWithOpts("xxxsupersecretxxx", TelegramAPIOpts{Client: client, MaxAvatarSize: 1000})
+	avatarURL, err = api.Avatar(context.Background(), 123)
+	assert.NoError(t, err)
+	assert.Equal(t, "", avatarURL, "file metadata reports size above the limit")
+}
+
+func TestTelegram_PollInterval(t *testing.T) {
+	defaultInterval := apiPollInterval
+	apiPollInterval = time.Hour
+	defer func() { apiPollInterval = defaultInterval }()
+
+	var polls int32
+	m := &TelegramAPIMock{
+		GetUpdatesFunc: func(ctx context.Context) (*telegramUpdate, error) {
+			atomic.AddInt32(&polls, 1)
+			return &telegramUpdate{}, nil
+		},
+		BotInfoFunc: botInfoFunc,
+	}
+	tg := &TelegramHandler{ProviderName: "telegram", L: logger.NoOp{}, Telegram: m, PollInterval: 10 * time.Millisecond}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, tg.Run(ctx), context.DeadlineExceeded)
+	assert.Greater(t, atomic.LoadInt32(&polls), int32(3))
+}
+
+func TestTelegram_AvatarPipeline(t *testing.T) {
+	tbl := []struct {
+		name      string
+		avatar    func(ctx context.Context, userID int) (string, error)
+		saver     AvatarSaver
+		picture   string
+		confirmed bool
+	}{
+		{"with photo", func(context.Context, int) (string, error) { return "https://api.telegram.org/file/botX/p.jpg", nil },
+			&mockAvatarSaver{}, "http://example.com/ava12345.png", true},
+		{"no photo", func(context.Context, int) (string, error) { return "", nil },
+			&mockAvatarSaver{}, "http://example.com/fake.png", true},
+		{"avatar failed", func(context.Context, int) (string, error) { return "", fmt.Errorf("api error") },
+			&mockAvatarSaver{}, "http://example.com/fake.png", true},
+		{"no avatar saver", func(context.Context, int) (string, error) { return "https://api.telegram.org/file/botX/p.jpg", nil },
+			nil, "", true},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &TelegramAPIMock{
+				AvatarFunc:  tt.avatar,
+				SendFunc:    func(ctx context.Context, id int, text string) error { return nil },
+				BotInfoFunc: botInfoFunc,
+			}
+			tg := &TelegramHandler{
+				ProviderName: "telegram",
+				L:            logger.NoOp{},
+				TokenService: authtoken.NewService(authtoken.Opts{
+					SecretReader: authtoken.SecretFunc(func(string) (string, error) { return "secret", nil }),
+				}),
+				AvatarSaver: tt.saver,
+				Telegram:    m,
+			}
+			assert.NoError(t, tg.ProcessUpdate(context.Background(), `{"result":[]}`))
+			assert.NoError(t, tg.addToken("token", time.Now().Add(time.Minute)))
+			assert.NoError(t, tg.ProcessUpdate(context.Background(), fmt.Sprintf(getUpdatesResp, "token")))
+
+			w := httptest.NewRecorder()
+			tg.LoginHandler(w, httptest.NewRequest("GET", "/login?token=token", http.NoBody))
+			assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+			u := authtoken.User{}
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &u))
+			assert.Equal(t, "Joe", u.Name)
+			assert.Equal(t, tt.picture, u.Picture)
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package provider
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-pkgz/rest"
+
+	authtoken "github.com/go-pkgz/auth/token"
+)
+
+const (
+	urlTelegramWebhookSuffix = "/webhook"
+	telegramSecretHeader     = "X-Telegram-Bot-Api-Secret-Token" // #nosec G101 header name, not a secret
+)
+
+// TelegramAuthRequest is a pending telegram login request
+type TelegramAuthRequest struct {
+	Confirmed bool            // login confirmed by the user in telegram
+	Rejected  bool            // login rejected, user is not a member of required chats
+	Expires   time.Time       // request expiration
+	User      *authtoken.User // user info, set on confirmation
+}
+
+// TelegramRequestStore keeps pending telegram login requests. In-memory store used by default, shared one,
+// i.e. with redis, allows several replicas to serve webhook and login requests in webhook mode.
+// Store is responsible for removal of expired requests, i.e. with TTL.
+type TelegramRequestStore interface {
+	Set(token string, req TelegramAuthRequest) error
+	Get(token string) (req TelegramAuthRequest, found bool, err error)
+	Delete(token string) error
+}
+
+// TelegramWebhookSetter is implemented by TelegramAPI supporting webhook mode
+type TelegramWebhookSetter interface {
+	SetWebhook(ctx context.Context, url, secret string) error
+}
+
+// ExtraRoutes returns webhook route in webhook mode
+func (th *TelegramHandler) ExtraRoutes() map[string]http.HandlerFunc {
+	if th.WebhookURL == "" {
+		return nil
+	}
+	return map[string]http.HandlerFunc{urlTelegramWebhookSuffix: th.WebhookHandler}
+}
+
+// RegisterWebhook sets WebhookURL with WebhookSecret as bot's webhook, called by Run in webhook mode
+func (th *TelegramHandler) RegisterWebhook(ctx context.Context) error {
+	if th.WebhookSecret == "" {
+		return fmt.Errorf("webhook secret required")
+	}
+	ws, ok := th.Telegram.(TelegramWebhookSetter)
+	if !ok {
+		return fmt.Errorf("telegram api doesn't support webhooks")
+	}
+	if err := ws.SetWebhook(ctx, th.WebhookURL, th.WebhookSecret); err != nil {
+		return fmt.Errorf("failed to set webhook: %w", err)
+	}
+	return nil
+}
+
+// runWebhook registers webhook and cleans up expired requests, blocks till context canceled
+func (th *TelegramHandler) runWebhook(ctx context.Context) error {
+	defer atomic.AddInt32(&th.run, -1)
+	if err := th.RegisterWebhook(ctx); err != nil {
+		return err
+	}
+
+	cleanupTicker := time.NewTicker(expiredCleanupInterval)
+	defer cleanupTicker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-cleanupTicker.C:
+			th.cleanup()
+		}
+	}
+}
+
+// WebhookHandler processes update posted by telegram to the webhook. Requests without valid secret token rejected.
+//
+// POST /webhook
+func (th *TelegramHandler) WebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		rest.SendErrorJSON(w, r, th.L, http.StatusMethodNotAllowed, fmt.Errorf("method %s", r.Method), "POST required")
+		return
+	}
+	secret := r.Header.Get(telegramSecretHeader)
+	if th.WebhookSecret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(th.WebhookSecret)) != 1 {
+		rest.SendErrorJSON(w, r, th.L, http.StatusUnauthorized, fmt.Errorf("bad secret token"), "invalid secret token")
+		return
+	}
+
+	var update tgUpdate
+	limitBody(w, r, th.MaxBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		sendParseError(w, r, th.L, err, "failed to parse update")
+		return
+	}
+	th.initRequests()
+	th.processUpdates(r.Context(), &telegramUpdate{Result: []tgUpdate{update}})
+	rest.RenderJSON(w, rest.JSON{"ok": true})
+}
+
+// initRequests initializes in-memory requests store if not initialized yet
+func (th *TelegramHandler) initRequests() {
+	th.requests.Lock()
+	if th.requests.data == nil {
+		th.requests.data = make(map[string]tgAuthRequest)
+	}
+	th.requests.Unlock()
+}
+
+// cleanup removes expired requests from in-memory store
+func (th *TelegramHandler) cleanup() {
+	now := time.Now()
+	th.requests.Lock()
+	for key, req := range th.requests.data {
+		if now.After(req.expires) {
+			delete(th.requests.data, key)
+		}
+	}
+	th.requests.Unlock()
+}
+
+// getRequest returns request from Requests store if defined, from in-memory store otherwise
+func (th *TelegramHandler) getRequest(token string) (tgAuthRequest, bool, error) {
+	if th.Requests != nil {
+		req, ok, err := th.Requests.Get(token)
+		return tgAuthRequest{confirmed: req.Confirmed, rejected: req.Rejected, expires: req.Expires, user: req.User}, ok, err
+	}
+	th.requests.RLock()
+	defer th.requests.RUnlock()
+	req, ok := th.requests.data[token]
+	return req, ok, nil
+}
+
+// setRequest saves request to Requests store if defined, to in-memory store otherwise
+func (th *TelegramHandler) setRequest(token string, req tgAuthRequest) error {
+	if th.Requests != nil {
+		return th.Requests.Set(token, TelegramAuthRequest{Confirmed: req.confirmed, Rejected: req.rejected, Expires: req.expires,
+			User: req.user})
+	}
+	th.requests.Lock()
+	defer th.requests.Unlock()
+	if th.requests.data == nil {
+		return fmt.Errorf("run goroutine is not running")
+	}
+	th.requests.data[token] = req
+	return nil
+}
+
+// deleteRequest removes request from Requests store if defined, from in-memory store otherwise
+func (th *TelegramHandler) deleteRequest(token string) error {
+	if th.Requests != nil {
+		return th.Requests.Delete(token)
+	}
+	th.requests.Lock()
+	delete(th.requests.data, token)
+	th.requests.Unlock()
+	return nil
+}
+
+// SetWebhook registers url as bot's webhook, telegram sends secret with each update in the header
+func (tg *tgAPI) SetWebhook(ctx context.Context, url, secret string) error {
+	method := fmt.Sprintf(`setWebhook?url=%s&secret_token=%s&allowed_updates=["message"]`,
+		neturl.QueryEscape(url), neturl.QueryEscape(secret))
+	return tg.request(ctx, method, &struct{}{})
+}
@@ -0,0 +1,221 @@
+package provider
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/auth/logger"
+	authtoken "github.com/go-pkgz/auth/token"
+)
+
+const webhookUpdate = `{"update_id":1000,"message":{"message_id":4,"from":{"id":313131313,"first_name":"Joe"},
+"chat":{"id":313131313,"first_name":"Joe","type":"private"},"date":1601665548,"text":"/start %s"}}`
+
+// mockTgRequests is a shared TelegramRequestStore, like redis
+type mockTgRequests struct {
+	lock sync.Mutex
+	data map[string]TelegramAuthRequest
+}
+
+func (m *mockTgRequests) Set(token string, req TelegramAuthRequest) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.data[token] = req
+	return nil
+}
+
+func (m *mockTgRequests) Get(token string) (req TelegramAuthRequest, found bool, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	req, found = m.data[token]
+	return req, found, nil
+}
+
+func (m *mockTgRequests) Delete(token string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.data, token)
+	return nil
+}
+
+// tgWebhookAPIMock adds SetWebhook to TelegramAPIMock
+type tgWebhookAPIMock struct {
+	*TelegramAPIMock
+	setWebhook func(ctx context.Context, url, secret string) error
+}
+
+func (m tgWebhookAPIMock) SetWebhook(ctx context.Context, url, secret string) error {
+	return m.setWebhook(ctx, url, secret)
+}
+
+func newWebhookHandler(t *testing.T, requests TelegramRequestStore) *TelegramHandler {
+	m := &TelegramAPIMock{
+		GetUpdatesFunc: func(ctx context.Context) (*telegramUpdate, error) {
+			t.Fatal("no polling in webhook mode")
+			return nil, nil
+		},
+		AvatarFunc: func(ctx context.Context, userID int) (string, error) {
+			assert.Equal(t, 313131313, userID)
+			return "http://t.me/avatar.png", nil
+		},
+		SendFunc:    func(ctx context.Context, id int, text string) error { return nil },
+		BotInfoFunc: botInfoFunc,
+	}
+	return &TelegramHandler{
+		ProviderName: "telegram",
+		ErrorMsg:     "error",
+		SuccessMsg:   "success",
+		L:            logger.NoOp{},
+		TokenService: authtoken.NewService(authtoken.Opts{
+			SecretReader:   authtoken.SecretFunc(func(string) (string, error) { return "secret", nil }),
+			TokenDuration:  time.Hour,
+			CookieDuration: time.Hour * 24 * 31,
+		}),
+		AvatarSaver:   &mockAvatarSaver{},
+		Telegram:      m,
+		Requests:      requests,
+		WebhookURL:    "https://example.com/auth/telegram/webhook",
+		WebhookSecret: "wh-secret",
+	}
+}
+
+func TestTelegramWebhook_Login(t *testing.T) {
+	for _, requests := range []TelegramRequestStore{nil, &mockTgRequests{data: map[string]TelegramAuthRequest{}}} {
+		tg := newWebhookHandler(t, requests)
+		svc := NewService(tg)
+
+		// get login token, Run is not needed
+		rr := httptest.NewRecorder()
+		svc.Handler(rr, httptest.NewRequest("GET", "/auth/telegram/login", http.NoBody))
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		resp := struct {
+			Token string `json:"token"`
+			Bot   string `json:"bot"`
+		}{}
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+		assert.Equal(t, "my_auth_bot", resp.Bot)
+
+		rr = httptest.NewRecorder()
+		svc.Handler(rr, httptest.NewRequest("GET", "/auth/telegram/login?token="+resp.Token, http.NoBody))
+		assert.Equal(t, http.StatusNotFound, rr.Code, "not confirmed yet")
+
+		webhook := func(secret string) *httptest.ResponseRecorder {
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "/auth/telegram/webhook", strings.NewReader(fmt.Sprintf(webhookUpdate, resp.Token)))
+			if secret != "" {
+				req.Header.Set("X-Telegram-Bot-Api-Secret-Token", secret)
+			}
+			svc.Handler(rr, req)
+			return rr
+		}
+		assert.Equal(t, http.StatusUnauthorized, webhook("").Code)
+		assert.Equal(t, http.StatusUnauthorized, webhook("bad-secret").Code)
+		rr = httptest.NewRecorder()
+		svc.Handler(rr, httptest.NewRequest("GET", "/auth/telegram/login?token="+resp.Token, http.NoBody))
+		assert.Equal(t, http.StatusNotFound, rr.Code, "forged update ignored")
+
+		rr = webhook("wh-secret")
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+		rr = httptest.NewRecorder()
+		svc.Handler(rr, httptest.NewRequest("GET", "/auth/telegram/login?token="+resp.Token, http.NoBody))
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		u := authtoken.User{}
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &u))
+		assert.Equal(t, "Joe", u.Name)
+		assert.Equal(t, "telegram_"+authtoken.HashID(sha1.New(), "313131313"), u.ID)
+		assert.NotEmpty(t, rr.Result().Cookies())
+
+		rr = httptest.NewRecorder()
+		svc.Handler(rr, httptest.NewRequest("GET", "/auth/telegram/login?token="+resp.Token, http.NoBody))
+		assert.Equal(t, http.StatusNotFound, rr.Code, "request removed after login")
+	}
+}
+
+func TestTelegramWebhook_Replicas(t *testing.T) {
+	requests := &mockTgRequests{data: map[string]TelegramAuthRequest{}}
+	replica1, replica2 := newWebhookHandler(t, requests), newWebhookHandler(t, requests)
+
+	rr := httptest.NewRecorder()
+	replica1.LoginHandler(rr, httptest.NewRequest("GET", "/login", http.NoBody))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	resp := struct {
+		Token string `json:"token"`
+	}{}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+
+	// update delivered to another replica
+	rr = httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/webhook", strings.NewReader(fmt.Sprintf(webhookUpdate, resp.Token)))
+	req.Header.Set("X-Telegram-Bot-Api-Secret-Token", "wh-secret")
+	replica2.WebhookHandler(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	replica1.LoginHandler(rr, httptest.NewRequest("GET", "/login?token="+resp.Token, http.NoBody))
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+}
+
+func TestTelegramWebhook_BadRequests(t *testing.T) {
+	tg := newWebhookHandler(t, nil)
+	rr := httptest.NewRecorder()
+	tg.WebhookHandler(rr, httptest.NewRequest("GET", "/webhook", http.NoBody))
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+
+	rr = httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/webhook", strings.NewReader("bad json"))
+	req.Header.Set("X-Telegram-Bot-Api-Secret-Token", "wh-secret")
+	tg.WebhookHandler(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	tg.WebhookSecret = ""
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/webhook", strings.NewReader(fmt.Sprintf(webhookUpdate, "token")))
+	tg.WebhookHandler(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code, "no secret configured, all rejected")
+
+	assert.Empty(t, (&TelegramHandler{}).ExtraRoutes(), "no webhook route in polling mode")
+}
+
+func TestTelegramWebhook_Run(t *testing.T) {
+	tg := newWebhookHandler(t, nil)
+	err := tg.Run(context.Background())
+	assert.EqualError(t, err, "telegram api doesn't support webhooks")
+
+	var gotURL, gotSecret string
+	tg.Telegram = tgWebhookAPIMock{TelegramAPIMock: tg.Telegram.(*TelegramAPIMock),
+		setWebhook: func(ctx context.Context, url, secret string) error {
+			gotURL, gotSecret = url, secret
+			return nil
+		}}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = tg.Run(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, "https://example.com/auth/telegram/webhook", gotURL)
+	assert.Equal(t, "wh-secret", gotSecret)
+	assert.NoError(t, tg.ProcessUpdate(context.Background(), `{"result":[]}`), "run counter released")
+}
+
+func TestTgAPI_SetWebhook(t *testing.T) {
+	tg, cleanup := prepareTgAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Contains(t, r.URL.Path, "setWebhook")
+		assert.Equal(t, "https://example.com/auth/telegram/webhook?a=1&b=2", r.URL.Query().Get("url"))
+		assert.Equal(t, "s&cret", r.URL.Query().Get("secret_token"))
+		assert.Equal(t, `["message"]`, r.URL.Query().Get("allowed_updates"))
+		_, _ = w.Write([]byte(`{"ok":true,"result":true}`))
+	})
+	defer cleanup()
+	assert.NoError(t, tg.SetWebhook(context.Background(), "https://example.com/auth/telegram/webhook?a=1&b=2", "s&cret"))
+}
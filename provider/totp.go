@@ -0,0 +1,442 @@
+package provider
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1" //nolint
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-pkgz/rest"
+	"github.com/golang-jwt/jwt"
+
+	"github.com/go-pkgz/auth/token"
+)
+
+const (
+	urlTOTPSuffix       = "/totp"
+	urlTOTPEnrollSuffix = "/totp/enroll"
+
+	totpState  = "totp"
+	totpDigits = 6
+	totpPeriod = 30 // seconds
+)
+
+// TOTP implements time-based one-time password (RFC 6238) second factor for direct provider.
+// Login of enrolled user with correct password returns short-lived intermediate token instead of the session,
+// POST /totp with this token and the code issues the session token with second factor verification time,
+// checked by StepUp middleware. Logged-in users enroll with POST /totp/enroll.
+// Zero values replaced by defaults.
+type TOTP struct {
+	Store       TOTPStore     // secrets store, required
+	Issuer      string        // issuer shown in authenticator apps, default is handler's Issuer
+	Skew        int           // accepted clock drift in time steps, both ways, default 1, negative for no drift
+	TokenTTL    time.Duration // lifetime of intermediate token and pending enrollment, default 5m
+	MaxAttempts int           // max code attempts per intermediate token, default 5
+
+	// Replay keeps accepted time steps and used intermediate tokens, Attempts keeps code attempts counters.
+	// In-memory defaults suit a single instance only, with several instances behind a load balancer
+	// shared stores, i.e. redis based, should be set, otherwise a code can be reused on another instance.
+	Replay   TOTPReplayStore
+	Attempts LockoutStore
+
+	now     func() time.Time // clock for time steps and pending enrollments, time.Now by default
+	once    sync.Once
+	lock    sync.Mutex
+	pending map[string]pendingSecret // enrollments waiting for confirmation, by user id
+}
+
+// TOTPStore defines interface of the user store keeping TOTP secrets, base32 encoded
+type TOTPStore interface {
+	TOTPSecret(userID string) (secret string, enrolled bool, err error)
+	SetTOTPSecret(userID, secret string) error
+}
+
+// TOTPReplayStore defines interface keeping state rejecting reuse of TOTP codes and intermediate tokens
+type TOTPReplayStore interface {
+	// AcceptStep records time step accepted for the user, false if the same or a later one was accepted before.
+	// Record can be dropped after ttl, the step can't match anymore.
+	AcceptStep(userID string, step int64, ttl time.Duration) (bool, error)
+	UsedTokenStore // used intermediate tokens
+}
+
+// pendingSecret is a secret of not confirmed enrollment
+type pendingSecret struct {
+	secret  string
+	expires time.Time
+}
+
+const (
+	defaultTOTPSkew        = 1
+	defaultTOTPTokenTTL    = 5 * time.Minute
+	defaultTOTPMaxAttempts = 5
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func (t *TOTP) init() {
+	t.once.Do(func() {
+		if t.Skew == 0 {
+			t.Skew = defaultTOTPSkew
+		}
+		if t.Skew < 0 {
+			t.Skew = 0
+		}
+		if t.TokenTTL == 0 {
+			t.TokenTTL = defaultTOTPTokenTTL
+		}
+		if t.MaxAttempts == 0 {
+			t.MaxAttempts = defaultTOTPMaxAttempts
+		}
+		if t.now == nil {
+			t.now = time.Now
+		}
+		if t.Replay == nil {
+			t.Replay = NewMemTOTPReplayStore()
+		}
+		if t.Attempts == nil {
+			t.Attempts = NewMemLockoutStore()
+		}
+		t.pending = map[string]pendingSecret{}
+	})
+}
+
+// totpCode returns code for the key and time step
+func totpCode(key []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	_, _ = mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	bin := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, bin%1000000)
+}
+
+// newTOTPSecret makes random 160-bit secret, base32 encoded
+func newTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("can't get random: %w", err)
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// accept checks the code against secret within allowed drift and rejects reuse of the same or earlier time step
+func (t *TOTP) accept(userID, secret, code string) (bool, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil || len(code) != totpDigits {
+		return false, nil
+	}
+
+	cur := t.now().Unix() / totpPeriod
+	for i := -int64(t.Skew); i <= int64(t.Skew); i++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, cur+i)), []byte(code)) == 1 {
+			// step can match while within the drift, up to 2*Skew+1 periods
+			ok, err := t.Replay.AcceptStep(userID, cur+i, time.Duration(2*t.Skew+1)*totpPeriod*time.Second)
+			if err != nil {
+				return false, fmt.Errorf("can't check totp step: %w", err)
+			}
+			return ok, nil
+		}
+	}
+	return false, nil
+}
+
+// setPending keeps not confirmed secret of the user
+func (t *TOTP) setPending(userID, secret string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := t.now()
+	for k, ps := range t.pending {
+		if now.After(ps.expires) {
+			delete(t.pending, k)
+		}
+	}
+	t.pending[userID] = pendingSecret{secret: secret, expires: now.Add(t.TokenTTL)}
+}
+
+// getPending returns not confirmed secret of the user
+func (t *TOTP) getPending(userID string) (string, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	ps, ok := t.pending[userID]
+	if !ok || t.now().After(ps.expires) {
+		return "", false
+	}
+	return ps.secret, true
+}
+
+// removePending removes not confirmed secret of the user
+func (t *TOTP) removePending(userID string) {
+	t.lock.Lock()
+	delete(t.pending, userID)
+	t.lock.Unlock()
+}
+
+// sendTOTPRequired responds with intermediate token to be exchanged for the session token with TOTP code
+func (p DirectHandler) sendTOTPRequired(w http.ResponseWriter, r *http.Request, u token.User, aud string, sessOnly bool) {
+	tm, ok := p.TokenService.(tokenMaker)
+	if !ok {
+		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, fmt.Errorf("token service can't make tokens"),
+			"failed to make token")
+		return
+	}
+	cid, err := randToken()
+	if err != nil {
+		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "can't make token id")
+		return
+	}
+	claims := token.Claims{
+		Handshake: &token.Handshake{State: totpState, ID: u.ID},
+		User:      &u,
+		StandardClaims: jwt.StandardClaims{
+			Id:        cid,
+			Audience:  aud,
+			ExpiresAt: time.Now().Add(p.TOTP.TokenTTL).Unix(),
+			NotBefore: time.Now().Add(-1 * time.Minute).Unix(),
+			Issuer:    p.IssuerFunc.get(r, p.Issuer),
+		},
+		SessionOnly: sessOnly,
+	}
+	tkn, err := tm.Token(claims)
+	if err != nil {
+		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to make token")
+		return
+	}
+	rest.RenderJSON(w, rest.JSON{"totp_required": true, "token": tkn})
+}
+
+// TOTPHandler checks TOTP code for intermediate token made on login and issues the session token.
+//
+// Intermediate token is single-use and accepts MaxAttempts codes at most.
+//
+// POST /totp with {"token":"intermediate-token","code":"123456"}, json or form encoded
+func (p DirectHandler) TOTPHandler(w http.ResponseWriter, r *http.Request) {
+	if p.TOTP == nil || p.TOTP.Store == nil {
+		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, fmt.Errorf("totp not configured"), "totp not configured")
+		return
+	}
+	p.TOTP.init()
+	if r.Method != "POST" {
+		rest.SendErrorJSON(w, r, p.L, http.StatusMethodNotAllowed, fmt.Errorf("method %s", r.Method), "POST required")
+		return
+	}
+
+	vals, err := requestValues(w, r, p.MaxBodySize)
+	if err != nil {
+		sendParseError(w, r, p.L, err, "failed to parse request")
+		return
+	}
+
+	claims, err := p.TokenService.Parse(vals.Get("token"))
+	if err != nil {
+		rest.SendErrorJSON(w, r, p.L, http.StatusForbidden, err, "invalid token")
+		return
+	}
+	if claims.Handshake == nil || claims.Handshake.State != totpState || claims.User == nil || claims.Id == "" {
+		rest.SendErrorJSON(w, r, p.L, http.StatusForbidden, fmt.Errorf("not a totp token"), "invalid token")
+		return
+	}
+	expires := time.Unix(claims.ExpiresAt, 0)
+	if time.Now().After(expires) {
+		rest.SendErrorJSON(w, r, p.L, http.StatusForbidden, fmt.Errorf("expired"), "invalid token")
+		return
+	}
+	used, err := p.TOTP.Replay.Exists("totp:" + claims.Id)
+	if err != nil {
+		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to check token")
+		return
+	}
+	if used {
+		rest.SendErrorJSON(w, r, p.L, http.StatusForbidden, fmt.Errorf("used"), "invalid token")
+		return
+	}
+
+	count, err := p.TOTP.Attempts.Incr("totp:"+claims.Id, p.TOTP.TokenTTL)
+	if err != nil {
+		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to count attempts")
+		return
+	}
+	if count > p.TOTP.MaxAttempts {
+		rest.SendErrorJSON(w, r, p.L, http.StatusForbidden, fmt.Errorf("%d attempts", count), "too many attempts")
+		return
+	}
+
+	u := *claims.User
+	secret, enrolled, err := p.TOTP.Store.TOTPSecret(u.ID)
+	if err != nil {
+		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to get totp secret")
+		return
+	}
+	accepted := false
+	if enrolled {
+		if accepted, err = p.TOTP.accept(u.ID, secret, vals.Get("code")); err != nil {
+			rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to check code")
+			return
+		}
+	}
+	if !accepted {
+		p.Audit.send(AuditEvent{Type: AuditSecondFactorFailed, Provider: p.ProviderName, User: loginName(u),
+			IP: p.TrustedProxies.ClientIP(r)})
+		rest.SendErrorJSON(w, r, p.L, http.StatusForbidden, nil, "invalid code")
+		return
+	}
+
+	if err = p.TOTP.Replay.Set("totp:"+claims.Id, time.Until(expires)+usedTokenGrace); err != nil {
+		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to mark token used")
+		return
+	}
+
+	u.SetSecondFactor(p.TOTP.now())
+	p.issueToken(w, r, u, claims.Audience, claims.SessionOnly, false)
+}
+
+// TOTPEnrollHandler enrolls logged-in user to TOTP. The first request makes a new secret and returns it with
+// otpauth:// URI, to be shown as QR code for authenticator apps. The second request with the code from the app
+// confirms enrollment, saves the secret to the store and re-issues the session token with second factor time.
+//
+// POST /totp/enroll
+// POST /totp/enroll with {"code":"123456"}, json or form encoded
+func (p DirectHandler) TOTPEnrollHandler(w http.ResponseWriter, r *http.Request) {
+	if p.TOTP == nil || p.TOTP.Store == nil {
+		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, fmt.Errorf("totp not configured"), "totp not configured")
+		return
+	}
+	p.TOTP.init()
+	if r.Method != "POST" {
+		rest.SendErrorJSON(w, r, p.L, http.StatusMethodNotAllowed, fmt.Errorf("method %s", r.Method), "POST required")
+		return
+	}
+
+	claims, ok := p.sessionClaims(w, r)
+	if !ok {
+		return
+	}
+	userID := claims.User.ID
+
+	vals, err := requestValues(w, r, p.MaxBodySize)
+	if err != nil {
+		sendParseError(w, r, p.L, err, "failed to parse request")
+		return
+	}
+
+	_, enrolled, err := p.TOTP.Store.TOTPSecret(userID)
+	if err != nil {
+		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to get totp secret")
+		return
+	}
+	if enrolled {
+		rest.SendErrorJSON(w, r, p.L, http.StatusConflict, fmt.Errorf("user %s enrolled", userID), "already enrolled")
+		return
+	}
+
+	code := vals.Get("code")
+	if code == "" { // start enrollment
+		secret, err := newTOTPSecret()
+		if err != nil {
+			rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "can't make totp secret")
+			return
+		}
+		p.TOTP.setPending(userID, secret)
+		rest.RenderJSON(w, p.TOTP.enrollment(p.IssuerFunc.get(r, p.Issuer), loginName(*claims.User), secret))
+		return
+	}
+
+	secret, ok := p.TOTP.getPending(userID)
+	if !ok {
+		rest.SendErrorJSON(w, r, p.L, http.StatusBadRequest, fmt.Errorf("no pending enrollment"), "no pending enrollment")
+		return
+	}
+	accepted, err := p.TOTP.accept(userID, secret, code)
+	if err != nil {
+		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to check code")
+		return
+	}
+	if !accepted {
+		rest.SendErrorJSON(w, r, p.L, http.StatusForbidden, nil, "invalid code")
+		return
+	}
+	if err = p.TOTP.Store.SetTOTPSecret(userID, secret); err != nil {
+		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to save totp secret")
+		return
+	}
+	p.TOTP.removePending(userID)
+
+	claims.User.SetSecondFactor(p.TOTP.now())
+	claims.ExpiresAt = 0 // re-issued with the regular duration
+	if _, err = p.TokenService.Set(w, claims); err != nil {
+		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to set token")
+		return
+	}
+	rest.RenderJSON(w, rest.JSON{"status": "enrolled"})
+}
+
+// enrollment makes enrollment response with secret, otpauth:// URI and its parts. Issuer is used unless TOTP has one.
+func (t *TOTP) enrollment(issuer, account, secret string) rest.JSON {
+	if t.Issuer != "" {
+		issuer = t.Issuer
+	}
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(totpDigits))
+	q.Set("period", fmt.Sprint(totpPeriod))
+	uri := fmt.Sprintf("otpauth://totp/%s:%s?%s", url.PathEscape(issuer), url.PathEscape(account), q.Encode())
+	return rest.JSON{
+		"secret":    secret,
+		"uri":       uri,
+		"issuer":    issuer,
+		"account":   account,
+		"algorithm": "SHA1",
+		"digits":    totpDigits,
+		"period":    totpPeriod,
+	}
+}
+
+// MemTOTPReplayStore implements TOTPReplayStore with in-memory maps, for a single instance only.
+// Expired records removed on access.
+type MemTOTPReplayStore struct {
+	*MemUsedTokenStore
+	lock        sync.Mutex
+	steps       map[string]memTOTPStep
+	lastCleanup time.Time
+}
+
+type memTOTPStep struct {
+	step    int64
+	expires time.Time
+}
+
+// NewMemTOTPReplayStore makes in-memory TOTP replay store
+func NewMemTOTPReplayStore() *MemTOTPReplayStore {
+	return &MemTOTPReplayStore{MemUsedTokenStore: NewMemUsedTokenStore(), steps: map[string]memTOTPStep{}}
+}
+
+// AcceptStep records time step accepted for the user, false if the same or a later one was accepted before
+func (m *MemTOTPReplayStore) AcceptStep(userID string, step int64, ttl time.Duration) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := time.Now()
+	if now.Sub(m.lastCleanup) >= time.Minute {
+		m.lastCleanup = now
+		for k, rec := range m.steps {
+			if !now.Before(rec.expires) {
+				delete(m.steps, k)
+			}
+		}
+	}
+	if rec, ok := m.steps[userID]; ok && now.Before(rec.expires) && step <= rec.step {
+		return false, nil
+	}
+	m.steps[userID] = memTOTPStep{step: step, expires: now.Add(ttl)}
+	return true, nil
+}
@@ -0,0 +1,309 @@
+package provider
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/auth/logger"
+	"github.com/go-pkgz/auth/token"
+)
+
+func TestTOTP_Code(t *testing.T) {
+	// test vectors from RFC 6238, 6 last digits
+	key := []byte("12345678901234567890")
+	tbl := []struct {
+		ts   int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tbl {
+		assert.Equal(t, tt.code, totpCode(key, tt.ts/totpPeriod), "ts %d", tt.ts)
+	}
+}
+
+func TestTOTP_Accept(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	clock := time.Unix(1111111111, 0) // step 37037037, code 050471
+	tp := &TOTP{now: func() time.Time { return clock }}
+	tp.init()
+	accept := func(userID, secret, code string) bool {
+		ok, err := tp.accept(userID, secret, code)
+		require.NoError(t, err)
+		return ok
+	}
+
+	assert.False(t, accept("u1", secret, "123456"), "wrong code")
+	assert.False(t, accept("u1", secret, "50471"), "wrong length")
+	assert.False(t, accept("u1", "not base32!", "050471"), "bad secret")
+
+	clock = time.Unix(1111111111+totpPeriod, 0)
+	assert.True(t, accept("u1", secret, "050471"), "previous step within drift")
+	assert.False(t, accept("u1", secret, "050471"), "reuse of the same step rejected")
+	assert.True(t, accept("u2", secret, "050471"), "steps tracked per user")
+
+	clock = time.Unix(1111111111+3*totpPeriod, 0)
+	assert.False(t, accept("u3", secret, "050471"), "out of drift window")
+
+	clock = time.Unix(1111111111-totpPeriod, 0)
+	assert.True(t, accept("u4", secret, "050471"), "next step within drift")
+	assert.False(t, accept("u4", secret, totpCode([]byte("12345678901234567890"), 37037036)),
+		"step before accepted one rejected")
+
+	tp = &TOTP{Skew: -1, now: func() time.Time { return clock }}
+	tp.init()
+	assert.False(t, accept("u1", secret, totpCode([]byte("12345678901234567890"), 37037037)), "no drift allowed")
+	assert.True(t, accept("u1", secret, totpCode([]byte("12345678901234567890"), 37037036)), "current step")
+}
+
+func TestTOTP_SharedReplayStore(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	clock := time.Unix(1111111111, 0) // step 37037037, code 050471
+	replay := NewMemTOTPReplayStore()
+	tp1 := &TOTP{Replay: replay, now: func() time.Time { return clock }}
+	tp2 := &TOTP{Replay: replay, now: func() time.Time { return clock }}
+	tp1.init()
+	tp2.init()
+
+	ok, err := tp1.accept("u1", secret, "050471")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = tp2.accept("u1", secret, "050471")
+	require.NoError(t, err)
+	assert.False(t, ok, "code used on another instance rejected")
+
+	tp3 := &TOTP{Replay: failingReplayStore{}, now: func() time.Time { return clock }}
+	tp3.init()
+	_, err = tp3.accept("u1", secret, "050471")
+	assert.EqualError(t, err, "can't check totp step: replay store failed")
+}
+
+func TestMemTOTPReplayStore(t *testing.T) {
+	m := NewMemTOTPReplayStore()
+	ok, err := m.AcceptStep("u1", 10, time.Minute)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, _ = m.AcceptStep("u1", 10, time.Minute)
+	assert.False(t, ok, "the same step")
+	ok, _ = m.AcceptStep("u1", 9, time.Minute)
+	assert.False(t, ok, "earlier step")
+	ok, _ = m.AcceptStep("u1", 11, time.Minute)
+	assert.True(t, ok, "later step")
+	ok, _ = m.AcceptStep("u2", 5, time.Millisecond)
+	assert.True(t, ok)
+	time.Sleep(5 * time.Millisecond)
+	ok, _ = m.AcceptStep("u2", 5, time.Minute)
+	assert.True(t, ok, "expired step forgotten")
+
+	used, err := m.Exists("id1")
+	require.NoError(t, err)
+	assert.False(t, used)
+	require.NoError(t, m.Set("id1", time.Minute))
+	used, _ = m.Exists("id1")
+	assert.True(t, used, "used tokens kept by MemUsedTokenStore")
+}
+
+type failingReplayStore struct{}
+
+func (failingReplayStore) AcceptStep(string, int64, time.Duration) (bool, error) {
+	return false, errors.New("replay store failed")
+}
+func (failingReplayStore) Set(string, time.Duration) error { return errors.New("replay store failed") }
+func (failingReplayStore) Exists(string) (bool, error) {
+	return false, errors.New("replay store failed")
+}
+
+type mockTOTPStore struct {
+	lock    sync.Mutex
+	secrets map[string]string
+}
+
+func (m *mockTOTPStore) TOTPSecret(userID string) (secret string, enrolled bool, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	secret, enrolled = m.secrets[userID]
+	return secret, enrolled, nil
+}
+
+func (m *mockTOTPStore) SetTOTPSecret(userID, secret string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.secrets[userID] = secret
+	return nil
+}
+
+func TestDirect_TOTP(t *testing.T) {
+	clock := time.Now()
+	store := &mockTOTPStore{secrets: map[string]string{}}
+	var events []AuditEvent
+	d := DirectHandler{
+		ProviderName: "test",
+		CredChecker:  &mockCredsChecker{ok: true},
+		TokenService: token.NewService(token.Opts{
+			SecretReader:   token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+			TokenDuration:  time.Hour,
+			CookieDuration: time.Hour * 24 * 31,
+			DisableXSRF:    true,
+		}),
+		Issuer: "iss-test",
+		L:      logger.NoOp{},
+		Audit:  func(ev AuditEvent) { events = append(events, ev) },
+		TOTP:   &TOTP{Store: store, Issuer: "My App", now: func() time.Time { return clock }},
+	}
+	svc := NewService(d)
+	userID := d.userID("myuser", "", nil)
+
+	post := func(path, tkn string, body url.Values) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", path, strings.NewReader(body.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tkn != "" {
+			req.Header.Set("X-JWT", tkn)
+		}
+		svc.Handler(rr, req)
+		return rr
+	}
+	codeFor := func(secret string, ts time.Time) string {
+		key, err := totpEncoding.DecodeString(secret)
+		require.NoError(t, err)
+		return totpCode(key, ts.Unix()/totpPeriod)
+	}
+
+	// not enrolled, regular login
+	rr := httptest.NewRecorder()
+	svc.Handler(rr, httptest.NewRequest("GET", "/auth/test/login?user=myuser&passwd=pppp&aud=xyz123", http.NoBody))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.NotContains(t, rr.Body.String(), "totp_required")
+
+	// enrollment requires session
+	rr = post("/auth/test/totp/enroll", "", url.Values{})
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	sessTkn, err := d.TokenService.(tokenMaker).Token(token.Claims{
+		User:           &token.User{Name: "myuser", ID: userID},
+		StandardClaims: jwt.StandardClaims{Id: "sess1", Audience: "xyz123", ExpiresAt: time.Now().Add(time.Hour).Unix()},
+	})
+	require.NoError(t, err)
+
+	rr = post("/auth/test/totp/enroll", sessTkn, url.Values{})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	enrollResp := struct {
+		Secret  string `json:"secret"`
+		URI     string `json:"uri"`
+		Account string `json:"account"`
+		Digits  int    `json:"digits"`
+		Period  int    `json:"period"`
+	}{}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &enrollResp))
+	assert.Equal(t, 32, len(enrollResp.Secret))
+	assert.Equal(t, "myuser", enrollResp.Account)
+	assert.Equal(t, 6, enrollResp.Digits)
+	assert.Equal(t, 30, enrollResp.Period)
+	assert.Equal(t, "otpauth://totp/My%20App:myuser?algorithm=SHA1&digits=6&issuer=My+App&period=30&secret="+
+		enrollResp.Secret, enrollResp.URI)
+	assert.Empty(t, store.secrets, "not enrolled before confirmation")
+
+	rr = post("/auth/test/totp/enroll", sessTkn, url.Values{"code": {"000000"}})
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	rr = post("/auth/test/totp/enroll", sessTkn, url.Values{"code": {codeFor(enrollResp.Secret, clock)}})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, enrollResp.Secret, store.secrets[userID])
+	rr = post("/auth/test/totp/enroll", sessTkn, url.Values{})
+	assert.Equal(t, http.StatusConflict, rr.Code, "already enrolled")
+
+	// enrolled, login returns intermediate token
+	clock = clock.Add(time.Minute)
+	rr = httptest.NewRecorder()
+	svc.Handler(rr, httptest.NewRequest("GET", "/auth/test/login?user=myuser&passwd=pppp&aud=xyz123&sess=1", http.NoBody))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Empty(t, rr.Result().Cookies(), "no session before second factor")
+	loginResp := struct {
+		Required bool   `json:"totp_required"`
+		Token    string `json:"token"`
+	}{}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &loginResp))
+	assert.True(t, loginResp.Required)
+
+	rr = post("/auth/test/totp", "", url.Values{"token": {loginResp.Token}, "code": {"000000"}})
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Equal(t, `{"error":"invalid code"}`+"\n", rr.Body.String())
+	require.Equal(t, 1, len(events))
+	assert.Equal(t, AuditSecondFactorFailed, events[0].Type)
+
+	code := codeFor(enrollResp.Secret, clock)
+	rr = post("/auth/test/totp", "", url.Values{"token": {loginResp.Token}, "code": {code}})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	request := &http.Request{Header: http.Header{"Cookie": rr.Header()["Set-Cookie"]}}
+	c, err := request.Cookie("JWT")
+	require.NoError(t, err)
+	claims, err := d.TokenService.Parse(c.Value)
+	require.NoError(t, err)
+	assert.Nil(t, claims.Handshake)
+	assert.Equal(t, userID, claims.User.ID)
+	assert.Equal(t, "xyz123", claims.Audience)
+	assert.True(t, claims.SessionOnly)
+	assert.Equal(t, clock.Unix(), claims.User.SecondFactorAt().Unix(), "second factor stamped")
+
+	rr = post("/auth/test/totp", "", url.Values{"token": {loginResp.Token}, "code": {code}})
+	assert.Equal(t, `{"error":"invalid token"}`+"\n", rr.Body.String(), "intermediate token is single-use")
+
+	login := func() string {
+		rr := httptest.NewRecorder()
+		svc.Handler(rr, httptest.NewRequest("GET", "/auth/test/login?user=myuser&passwd=pppp", http.NoBody))
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &loginResp))
+		return loginResp.Token
+	}
+
+	tkn := login()
+	rr = post("/auth/test/totp", "", url.Values{"token": {tkn}, "code": {code}})
+	assert.Equal(t, `{"error":"invalid code"}`+"\n", rr.Body.String(), "code reuse rejected")
+
+	// drift, the code of the previous step accepted if not used
+	clock = clock.Add(totpPeriod * time.Second)
+	rr = post("/auth/test/totp", "", url.Values{"token": {tkn}, "code": {codeFor(enrollResp.Secret, clock.Add(-totpPeriod*time.Second))}})
+	assert.Equal(t, `{"error":"invalid code"}`+"\n", rr.Body.String(), "previous step is the used one")
+	clock = clock.Add(totpPeriod * time.Second)
+	rr = post("/auth/test/totp", "", url.Values{"token": {tkn}, "code": {codeFor(enrollResp.Secret, clock.Add(-totpPeriod*time.Second))}})
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	// attempts limit per intermediate token
+	tkn = login()
+	for i := 0; i < 5; i++ {
+		rr = post("/auth/test/totp", "", url.Values{"token": {tkn}, "code": {"000000"}})
+		assert.Equal(t, `{"error":"invalid code"}`+"\n", rr.Body.String())
+	}
+	rr = post("/auth/test/totp", "", url.Values{"token": {tkn}, "code": {codeFor(enrollResp.Secret, clock)}})
+	assert.Equal(t, `{"error":"too many attempts"}`+"\n", rr.Body.String())
+
+	// intermediate token expired
+	tkn, err = d.TokenService.(tokenMaker).Token(token.Claims{
+		Handshake:      &token.Handshake{State: totpState, ID: userID},
+		User:           &token.User{Name: "myuser", ID: userID},
+		StandardClaims: jwt.StandardClaims{Id: "expired1", ExpiresAt: time.Now().Add(-time.Second).Unix()},
+	})
+	require.NoError(t, err)
+	clock = clock.Add(time.Minute)
+	rr = post("/auth/test/totp", "", url.Values{"token": {tkn}, "code": {codeFor(enrollResp.Secret, clock)}})
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Equal(t, `{"error":"invalid token"}`+"\n", rr.Body.String())
+
+	// session token can't be used instead of intermediate
+	rr = post("/auth/test/totp", "", url.Values{"token": {sessTkn}, "code": {codeFor(enrollResp.Secret, clock)}})
+	assert.Equal(t, `{"error":"invalid token"}`+"\n", rr.Body.String())
+}
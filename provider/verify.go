@@ -2,18 +2,24 @@ package provider
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
 	"mime"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-pkgz/rest"
 	"github.com/golang-jwt/jwt"
-	"github.com/microcosm-cc/bluemonday"
 
 	"github.com/go-pkgz/auth/avatar"
 	"github.com/go-pkgz/auth/logger"
@@ -24,15 +30,141 @@ import (
 // can be email, IM or anything else implementing Sender interface
 type VerifyHandler struct {
 	logger.L
-	ProviderName string
-	TokenService VerifTokenService
-	Issuer       string
-	AvatarSaver  AvatarSaver
-	UserSaver    func(token.User) error
-	WithPassword bool
-	Sender       Sender
-	Template     *template.Template
-	UseGravatar  bool
+	ProviderName  string
+	TokenService  VerifTokenService
+	Issuer        string
+	IssuerFunc    IssuerFunc // optional issuer of tokens by request, Issuer used if not set or empty
+	AvatarSaver   AvatarSaver
+	AvatarFetch   AvatarFetch   // client and policy of avatar downloads
+	PictureUpdate PictureUpdate // update of existing user's picture on login, saved on every login by default
+	UserSaver     func(token.User) error
+	WithPassword  bool
+	Sender        Sender
+	Template      *template.Template
+	Templates     *TemplateRegistry // optional templates by site and locale, Template used if it has none for the request
+	UseGravatar   bool
+	Gravatar      *avatar.GravatarCache // optional cache of gravatar lookups made with UseGravatar
+
+	// Sanitizer cleans user, address and site of requests, i.e. Sanitize with longer MaxLen for names in some
+	// locales. Sanitize with default options used if not set. Input with text, cleaned to empty, rejected with 400.
+	Sanitizer func(string) string
+
+	// TemplateData makes data of confirmation template from the base one, i.e. embedding it with confirmation url
+	// built from the request and branding. Base data used if not set.
+	TemplateData func(r *http.Request, base ConfirmData) interface{}
+
+	// SiteDisplayName returns display name of the site passed to confirmation templates as SiteName,
+	// i.e. "Acme Corp" for "acme". Raw site used if not set or returns empty.
+	SiteDisplayName func(site string) string
+
+	// PasswordChecker checks password posted on the password step of WithPassword flow, required with it, login
+	// rejected with 403 on mismatch. ErrPasswordNotSet returned for the user without password registers it:
+	// the password, checked by PasswordPolicy, saved with PasswordSaver, and login rejected without it.
+	PasswordChecker func(user, address, password string) (ok bool, err error)
+	PasswordSaver   func(user, address, password string) error
+	Lockout         *Lockout // optional brute-force lockout of the password step, per user and client IP
+
+	CollectAllErrors   bool           // report all invalid fields at once as {"errors":{field:msg}}, default is first error only
+	PasswordPolicy     PasswordPolicy // optional policy for passwords set with WithPassword
+	SharedState        bool           // use handshake states shared by all providers, disables rejection of other providers' tokens
+	BindNonce          bool           // bind confirmation link to the browser requested it with nonce cookie, prevents login CSRF
+	TokenLifetime      time.Duration  // lifetime of confirmation tokens, default 30m
+	ConfirmTTL         time.Duration  // Deprecated: use TokenLifetime, the same setting, used if TokenLifetime not set
+	CredentialsTTL     time.Duration  // lifetime of password step token WithPassword, default TokenLifetime
+	SendInterval       time.Duration  // min interval between confirmations sent to the same address, disabled if 0
+	MaxSendsPerAddress int            // max confirmations sent to the same address within SendWindow, unlimited if 0
+	MaxSendsPerIP      int            // max confirmation requests from the same client IP within SendWindow, unlimited if 0
+	SendWindow         time.Duration  // window of MaxSendsPerAddress and MaxSendsPerIP, default 1h
+	LimitStore         LockoutStore   // send interval counters and login locks, shared one works across instances, default in-memory
+	MaxConcurrentSends int            // max Sender.Send calls running at once, by all requests to the provider, unlimited if 0
+	SendWait           time.Duration  // wait for a free send slot up to it or the request deadline, 503 at once if 0
+	LoginLockTTL       time.Duration  // serialize login completions of the same user with lock in LimitStore, disabled if 0
+	LoginLockWait      time.Duration  // wait for the lock held by another completion up to it, 409 at once if 0
+	RequireTLS         bool           // reject plain http requests with 426, keeps tokens and passwords off the wire
+	TrustProxyTLS      bool           // with RequireTLS accept "X-Forwarded-Proto: https" set by reverse proxy terminating TLS
+	MaxBodySize        int64          // max size of request body with password, default MaxHTTPBodySize
+	RedirectStatus     int            // status of redirect to back url after login, default 307, 303 for posted request
+	AllowedRedirects   []string       // origins or url prefixes of back urls redirected to after login, any url if empty
+
+	// ConfirmAttrsAllowed checks the request may post attrs to be carried by confirmation into the user's
+	// attributes, i.e. by api key of the app sending invites. Posted attrs rejected with 403 if not set.
+	ConfirmAttrsAllowed func(r *http.Request) bool
+	MaxConfirmAttrsSize int // max size of posted attrs json, default 1KB, the token is a part of the link
+
+	DomainBlocklist  *DomainBlocklist // optional blocklist of address domains, i.e. disposable emails, rejected with 400
+	BlockSilently    bool             // respond to blocked address as if confirmation sent, prevents probing the list
+	AddressValidator AddressValidator // checks and normalizes address, i.e. EmailAddress, any address accepted if nil
+
+	TrustedProxies *TrustedProxies // proxies trusted to pass client ip for MaxSendsPerIP, default ones if nil
+
+	AllowNumericPassword bool // accept json number as password, i.e. {"passwd": 123456} for numeric PINs
+	LinkBypassesPassword bool // with WithPassword log in by confirmation link directly, without password step
+
+	// SendCode sends short code of CodeLength digits instead of confirmation token, i.e. to fit SMS. Token kept
+	// in CodeStore by the address for CodeTTL and redeemed once with code and address, query parameters or posted
+	// fields. Pending code dropped after MaxCodeAttempts wrong ones.
+	SendCode        bool
+	CodeStore       ConfirmCodeStore // store of pending codes by address, shared one works across instances, default in-memory
+	CodeLength      int              // digits of the code, default 6
+	CodeTTL         time.Duration    // validity of the code, default 10m, limited by TokenLifetime
+	MaxCodeAttempts int              // wrong codes for the address before its pending code dropped, default 5
+
+	UsedTokens UsedTokenStore // marks consumed confirmation tokens, used again rejected with 403, replays allowed if nil
+
+	CorrelationTracking bool                   // link sent confirmations to redeemed ones with correlation cookie
+	CorrelationFunc     func(CorrelationEvent) // receives redemption events with CorrelationTracking, logged if not set
+
+	// AuthTTLFunc returns ttl of the auth token for the login flow, with or without password, and the user.
+	// TokenDuration of the token service used if not set or returns 0.
+	AuthTTLFunc func(withPassword bool, u token.User) time.Duration
+}
+
+const urlConfirmSuffix = "/confirm"
+
+// ConfirmAttrsKey is the user attribute with attrs posted with confirmation request, nested not to clobber
+// attributes set by the library or the app, i.e. "admin"
+const ConfirmAttrsKey = "confirm_attrs"
+
+const defaultMaxConfirmAttrsSize = 1024
+
+const (
+	confirmState     = "confirm"
+	credentialsState = "credentials"
+
+	nonceCookiePrefix      = "VERIFY-NONCE-"
+	defaultConfirmTokenTTL = 30 * time.Minute
+	defaultSendWindow      = time.Hour
+)
+
+// confirmation token rejection codes, sent to the client as "code" with 403 (400 for malformed handshake)
+const (
+	TokenInvalid       = "token_invalid"  // bad signature, malformed or unparsable token
+	TokenExpired       = "token_expired"  // confirmation link expired
+	TokenWrongState    = "wrong_state"    // not a confirmation token, i.e. issued for another flow or provider
+	TokenNonceMismatch = "nonce_mismatch" // link opened in another browser, with BindNonce only
+)
+
+// LoginInProgress is the code of login completion rejected with 409, as another one of the same user holds the lock
+const LoginInProgress = "login_in_progress"
+
+const loginLockPoll = 50 * time.Millisecond
+
+// defaultSendLimitStore keeps send interval counters and login locks of handlers without LimitStore, per process only
+var defaultSendLimitStore = NewMemLockoutStore()
+
+// sendSlots keeps semaphores of handlers with MaxConcurrentSends, by provider name and the limit
+var sendSlots = struct {
+	sync.Mutex
+	sems map[string]chan struct{}
+}{sems: map[string]chan struct{}{}}
+
+// handshakeState returns handshake state namespaced by provider name, i.e. "confirm:email", so tokens made by one
+// provider can't be redeemed by another provider with the same token service. SharedState disables namespacing.
+func (e VerifyHandler) handshakeState(state string) string {
+	if e.SharedState {
+		return state
+	}
+	return state + ":" + e.ProviderName
 }
 
 // Sender defines interface to send emails
@@ -40,6 +172,12 @@ type Sender interface {
 	Send(address, text string) error
 }
 
+// SenderWithContext can be implemented by Sender to get the context of confirmation request. VerifyHandler calls
+// SendContext instead of Send then, so delivery stops once the client is gone.
+type SenderWithContext interface {
+	SendContext(ctx context.Context, address, text string) error
+}
+
 // SenderFunc type is an adapter to allow the use of ordinary functions as Sender.
 type SenderFunc func(address, text string) error
 
@@ -48,6 +186,72 @@ func (f SenderFunc) Send(address, text string) error {
 	return f(address, text)
 }
 
+// Close drains confirmations queued by Sender implementing Drainer, i.e. AsyncSender, up to ctx deadline.
+// Should be called on shutdown, before the process exits.
+func (e VerifyHandler) Close(ctx context.Context) error {
+	d, ok := e.Sender.(Drainer)
+	if !ok {
+		return nil
+	}
+	if n, err := d.Drain(ctx); err != nil {
+		return fmt.Errorf("%d confirmations undelivered: %w", n, err)
+	}
+	return nil
+}
+
+// LogConfig logs effective configuration of the handler once, with Info, i.e. on startup for support triage.
+// Only settings and types are logged, never secrets, templates, addresses or values of stores and sender.
+func (e VerifyHandler) LogConfig() {
+	if e.L == nil {
+		return
+	}
+	codeTTL, codeAttempts := time.Duration(0), 0
+	if e.SendCode {
+		codeTTL, codeAttempts = e.codeTTL(), e.MaxCodeAttempts
+		if codeAttempts <= 0 {
+			codeAttempts = defaultConfirmCodeAttempts
+		}
+	}
+	maxBody := e.MaxBodySize
+	if maxBody == 0 {
+		maxBody = MaxHTTPBodySize
+	}
+	fields := []string{
+		"with_password=" + strconv.FormatBool(e.WithPassword),
+		"password_checker=" + strconv.FormatBool(e.PasswordChecker != nil),
+		"password_lockout=" + strconv.FormatBool(e.Lockout != nil),
+		"link_bypasses_password=" + strconv.FormatBool(e.LinkBypassesPassword),
+		"confirm_ttl=" + e.tokenLifetime().String(),
+		"credentials_ttl=" + e.credentialsTTL().String(),
+		"auth_ttl_func=" + strconv.FormatBool(e.AuthTTLFunc != nil),
+		"send_code=" + strconv.FormatBool(e.SendCode),
+		"code_ttl=" + codeTTL.String(),
+		"code_attempts=" + strconv.Itoa(codeAttempts),
+		"send_interval=" + e.SendInterval.String(),
+		"max_sends_per_address=" + strconv.Itoa(e.MaxSendsPerAddress),
+		"max_sends_per_ip=" + strconv.Itoa(e.MaxSendsPerIP),
+		"send_window=" + e.sendWindow().String(),
+		"max_concurrent_sends=" + strconv.Itoa(e.MaxConcurrentSends),
+		"login_lock_ttl=" + e.LoginLockTTL.String(),
+		"gravatar=" + strconv.FormatBool(e.UseGravatar),
+		"bind_nonce=" + strconv.FormatBool(e.BindNonce),
+		"shared_state=" + strconv.FormatBool(e.SharedState),
+		"require_tls=" + strconv.FormatBool(e.RequireTLS),
+		"domain_blocklist=" + strconv.FormatBool(e.DomainBlocklist != nil),
+		"address_validator=" + strconv.FormatBool(e.AddressValidator != nil),
+		"correlation=" + strconv.FormatBool(e.CorrelationTracking),
+		"max_body_size=" + strconv.FormatInt(maxBody, 10),
+		"allowed_redirects=" + strconv.Itoa(len(e.AllowedRedirects)),
+		fmt.Sprintf("sender=%T", e.Sender),
+		fmt.Sprintf("limit_store=%T", e.LimitStore),
+		fmt.Sprintf("used_tokens=%T", e.UsedTokens),
+	}
+	e.Info("[INFO] verified provider %s config: %s", e.ProviderName, strings.Join(fields, ", "))
+}
+
+// ErrPasswordNotSet returned by PasswordChecker for the user without password, i.e. new one
+var ErrPasswordNotSet = errors.New("password not set")
+
 // VerifTokenService defines interface accessing tokens
 type VerifTokenService interface {
 	Token(claims token.Claims) (string, error)
@@ -66,56 +270,151 @@ func (e VerifyHandler) Name() string {
 // LoginHandler gets name and address from query, makes confirmation token and sends it to user.
 // In case if confirmation token presented in the query uses it to create auth token
 func (e VerifyHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	if e.RequireTLS && !e.secure(r) {
+		e.rejectInsecure(w, r)
+		return
+	}
+
 	// GET /login?site=site&user=name&address=someone@example.com
-	tkn := r.URL.Query().Get("token")
-	if tkn == "" { // no token, ask confirmation via email
+	tkn, code := r.URL.Query().Get("token"), r.URL.Query().Get("code")
+	if tkn == "" && code == "" { // no token, ask confirmation via email
 		e.sendConfirmation(w, r)
 		return
 	}
 
-	// confirmation token presented
-	// GET /login?token=confirmation-jwt&sess=1
-	confClaims, err := e.TokenService.Parse(tkn)
-	if err != nil {
-		rest.SendErrorJSON(w, r, e.L, http.StatusForbidden, err, "failed to verify confirmation token")
+	// confirmation token or code presented
+	// GET /login?token=confirmation-jwt&session=1 or GET /login?code=123456&address=someone@example.com
+	e.confirm(w, r, confirmRequest{Token: tkn, Code: code, Address: r.URL.Query().Get("address"),
+		Session: r.URL.Query().Get("session") == "1", Site: r.URL.Query().Get("site")}, true)
+}
+
+// ConfirmHandler verifies confirmation token posted by SPA, i.e. taken from the link in the email, the same way
+// LoginHandler does for the link. Responds with the user, or "confirmed" for the password step, never redirects.
+//
+// POST /confirm with {"token":"confirmation-jwt","session":true,"site":"site"}, or {"code":"123456","address":"..."}
+// with SendCode
+func (e VerifyHandler) ConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	if e.RequireTLS && !e.secure(r) {
+		e.rejectInsecure(w, r)
 		return
 	}
-
-	if e.TokenService.IsExpired(confClaims) {
-		rest.SendErrorJSON(w, r, e.L, http.StatusForbidden, fmt.Errorf("expired"), "failed to verify confirmation token")
+	if r.Method != "POST" {
+		rest.SendErrorJSON(w, r, e.L, http.StatusMethodNotAllowed, fmt.Errorf("method %s", r.Method), "POST required")
 		return
 	}
 
-	if confClaims.Handshake.State != "confirm" {
-		rest.SendErrorJSON(w, r, e.L, http.StatusForbidden, fmt.Errorf("confirm"), "failed to verify confirmation token")
+	var req confirmRequest
+	limitBody(w, r, e.MaxBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendParseError(w, r, e.L, err, "failed to parse request")
 		return
 	}
+	if req.Token == "" && req.Code == "" {
+		rest.SendErrorJSON(w, r, e.L, http.StatusBadRequest, errors.New("no token"), "token required")
+		return
+	}
+	e.confirm(w, r, req, false)
+}
+
+// ExtraRoutes returns POST /confirm for SPAs
+func (e VerifyHandler) ExtraRoutes() map[string]http.HandlerFunc {
+	return map[string]http.HandlerFunc{urlConfirmSuffix: e.ConfirmHandler}
+}
+
+// confirmRequest is confirmation token with login options, from query of the link or posted json
+type confirmRequest struct {
+	Token   string `json:"token"`
+	Code    string `json:"code"`    // short code sent instead of the token with SendCode
+	Address string `json:"address"` // address the code sent to, required with code
+	Session bool   `json:"session"` // session only auth token
+	Site    string `json:"site"`    // audience of credentials step token WithPassword
+}
+
+// confirm verifies confirmation token and issues auth token, or credentials step token WithPassword.
+// With redirect set the auth token response redirects to back url of the login, if any.
+func (e VerifyHandler) confirm(w http.ResponseWriter, r *http.Request, req confirmRequest, redirect bool) {
+	if req.Token == "" && req.Code != "" {
+		address, err := e.sanitizeField("address", req.Address, SanitizeOpts{})
+		if err != nil || address == "" {
+			rest.SendErrorJSON(w, r, e.L, http.StatusBadRequest, errors.New("no address"), "address required with code")
+			return
+		}
+		tkn, err := e.takeCode(address, req.Code)
+		switch {
+		case errors.Is(err, errCodeAttempts):
+			e.Logf("[DEBUG] confirmation code rejected, %s", CodeAttemptsExceeded)
+			renderJSONWithStatus(w, rest.JSON{"error": "too many wrong codes, request a new one",
+				"code": CodeAttemptsExceeded}, http.StatusForbidden)
+			return
+		case errors.Is(err, errCodeInvalid):
+			e.Logf("[DEBUG] confirmation code rejected, %s: %v", CodeInvalid, err)
+			renderJSONWithStatus(w, rest.JSON{"error": "invalid or expired confirmation code", "code": CodeInvalid},
+				http.StatusForbidden)
+			return
+		case err != nil:
+			rest.SendErrorJSON(w, r, e.L, http.StatusInternalServerError, err, "can't check confirmation code")
+			return
+		}
+		req.Token = tkn
+	}
 
-	elems := strings.Split(confClaims.Handshake.ID, "::")
-	if len(elems) != 2 {
-		rest.SendErrorJSON(w, r, e.L, http.StatusBadRequest, fmt.Errorf("%s", confClaims.Handshake.ID), "invalid handshake token")
+	confClaims, u, err := e.Verify(req.Token)
+	if err != nil {
+		status, code, msg := verifyErrStatus(err)
+		e.Logf("[DEBUG] confirmation token rejected, %s: %v", code, err)
+		renderJSONWithStatus(w, rest.JSON{"error": msg, "code": code}, status)
 		return
 	}
+	if e.BindNonce {
+		if err = e.checkNonce(r, confClaims); err != nil {
+			e.Logf("[DEBUG] confirmation token rejected, %s: %v", TokenNonceMismatch, err)
+			renderJSONWithStatus(w, rest.JSON{"error": "confirmation link opened in another browser",
+				"code": TokenNonceMismatch}, http.StatusForbidden)
+			return
+		}
+		e.resetNonce(w)
+	}
+	if e.UsedTokens != nil {
+		if err = e.useToken(req.Token, confClaims.ExpiresAt); err != nil {
+			if errors.Is(err, errTokenUsed) {
+				e.Logf("[DEBUG] confirmation token rejected, %s", TokenUsed)
+				renderJSONWithStatus(w, rest.JSON{"error": "confirmation link already used", "code": TokenUsed},
+					http.StatusForbidden)
+				return
+			}
+			rest.SendErrorJSON(w, r, e.L, http.StatusInternalServerError, err, "can't check confirmation token")
+			return
+		}
+	}
+	if e.CorrelationTracking {
+		e.trackRedemption(w, r, confClaims)
+	}
 
-	user, address := elems[0], elems[1]
-	sessOnly := r.URL.Query().Get("session") == "1"
+	user, address := u.Name, u.Email
 
-	if e.WithPassword {
+	// with password the link leads to the password step, unless LinkBypassesPassword makes it a login by itself
+	if e.WithPassword && !e.LinkBypassesPassword {
+		aud, err := e.sanitizeField("site", req.Site, SanitizeOpts{})
+		if err != nil {
+			rest.SendErrorJSON(w, r, e.L, http.StatusBadRequest, err, err.Error())
+			return
+		}
 		claims := token.Claims{
 			Handshake: &token.Handshake{
-				State: "credentials",
+				State: e.handshakeState(credentialsState),
 				ID:    confClaims.Handshake.ID,
 			},
 			User: &token.User{
-				Name: user,
-				ID:   e.ProviderName + "_" + token.HashID(sha1.New(), address),
+				Name:       user,
+				ID:         u.ID,
+				Attributes: u.Attributes,
 			},
-			SessionOnly: sessOnly,
+			SessionOnly: req.Session,
 			StandardClaims: jwt.StandardClaims{
-				Audience:  e.sanitize(r.URL.Query().Get("site")),
-				ExpiresAt: time.Now().Add(30 * time.Minute).Unix(),
+				Audience:  aud,
+				ExpiresAt: time.Now().Add(e.credentialsTTL()).Unix(),
 				NotBefore: time.Now().Add(-1 * time.Minute).Unix(),
-				Issuer:    e.Issuer,
+				Issuer:    e.IssuerFunc.get(r, e.Issuer),
 			},
 		}
 
@@ -128,26 +427,38 @@ func (e VerifyHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	u := token.User{
-		Name: user,
-		ID:   e.ProviderName + "_" + token.HashID(sha1.New(), address),
+	unlock, ok := e.lockLogin(r, u.ID)
+	if !ok {
+		e.Logf("[DEBUG] login of %s rejected, another one in progress", u.ID)
+		renderJSONWithStatus(w, rest.JSON{"error": "login of the user in progress", "code": LoginInProgress},
+			http.StatusConflict)
+		return
 	}
-	// try to get gravatar for email
-	if e.UseGravatar && strings.Contains(address, "@") { // TODO: better email check to avoid silly hits to gravatar api
-		if picURL, e := avatar.GetGravatarURL(address); e == nil {
+	defer unlock()
+
+	u.Email = "" // address is not always an email, it is not a part of user info
+	// try to get gravatar for email, other addresses skipped to avoid silly hits to gravatar api
+	if e.UseGravatar && isEmail(address) {
+		getGravatarURL := avatar.GetGravatarURL
+		if e.Gravatar != nil {
+			getGravatarURL = e.Gravatar.GetGravatarURL
+		}
+		if picURL, e := getGravatarURL(address); e == nil {
 			u.Picture = picURL
 		}
 	}
 
-	if u, err = setAvatar(e.AvatarSaver, u, &http.Client{Timeout: 5 * time.Second}); err != nil {
-		rest.SendErrorJSON(w, r, e.L, http.StatusInternalServerError, err, "failed to save avatar to proxy")
-		return
+	if !e.AvatarFetch.Skip {
+		if u, err = e.PictureUpdate.setAvatar(e.L, e.AvatarSaver, u, e.AvatarFetch.client(nil)); err != nil {
+			rest.SendErrorJSON(w, r, e.L, http.StatusInternalServerError, err, "failed to save avatar to proxy")
+			return
+		}
 	}
 
 	if e.UserSaver != nil {
 		err = e.UserSaver(u)
 		if err != nil {
-			rest.SendErrorJSON(w, r, e.L, http.StatusInternalServerError, err, "failed to save user")
+			sendSaveUserError(w, r, e.L, err)
 			return
 		}
 	}
@@ -161,85 +472,663 @@ func (e VerifyHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	claims := token.Claims{
 		User: &u,
 		StandardClaims: jwt.StandardClaims{
-			Id:       cid,
-			Issuer:   e.Issuer,
-			Audience: confClaims.Audience,
+			Id:        cid,
+			Issuer:    e.IssuerFunc.get(r, e.Issuer),
+			Audience:  confClaims.Audience,
+			ExpiresAt: e.authExpiresAt(false, u),
 		},
-		SessionOnly: sessOnly,
+		SessionOnly: req.Session,
+		Provider:    e.ProviderName,
 	}
 
 	if _, err = e.TokenService.Set(w, claims); err != nil {
 		rest.SendErrorJSON(w, r, e.L, http.StatusInternalServerError, err, "failed to set token")
 		return
 	}
-	if confClaims.Handshake != nil && confClaims.Handshake.From != "" {
-		http.Redirect(w, r, confClaims.Handshake.From, http.StatusTemporaryRedirect)
+	if redirect && confClaims.Handshake != nil && confClaims.Handshake.From != "" && e.canRedirect(confClaims.Handshake.From) {
+		redirectBack(w, r, confClaims.Handshake.From, e.RedirectStatus)
 		return
 	}
 	rest.RenderJSON(w, claims.User)
 }
 
+// canRedirect checks back url is allowed by AllowedRedirects, any one allowed with a warning if it is empty
+func (e VerifyHandler) canRedirect(from string) bool {
+	if len(e.AllowedRedirects) == 0 {
+		e.Logf("[WARN] unrestricted redirect to %s, set AllowedRedirects to limit back urls", from)
+		return true
+	}
+	if !redirectAllowed(from, e.AllowedRedirects) {
+		e.Logf("[WARN] redirect to %s rejected, not in AllowedRedirects", from)
+		return false
+	}
+	return true
+}
+
+var (
+	errBadHandshake = errors.New("invalid handshake token")
+	errExpired      = errors.New("expired")
+	errWrongState   = errors.New("not a confirmation")
+)
+
+// Verify checks confirmation token without http and returns its claims and the user.
+// It validates signature, expiration, state and handshake, but doesn't issue auth token, it is up to the caller.
+// Returned user has Name and ID set, Email field has the confirmed address, and attrs posted with confirmation
+// request nested under ConfirmAttrsKey attribute.
+func (e VerifyHandler) Verify(tokenStr string) (token.Claims, token.User, error) {
+	confClaims, err := e.TokenService.Parse(tokenStr)
+	if err != nil {
+		return token.Claims{}, token.User{}, fmt.Errorf("failed to verify confirmation token: %w", err)
+	}
+
+	if e.TokenService.IsExpired(confClaims) {
+		return token.Claims{}, token.User{}, fmt.Errorf("failed to verify confirmation token: %w", errExpired)
+	}
+
+	if confClaims.Handshake == nil || confClaims.Handshake.State != e.handshakeState(confirmState) {
+		return token.Claims{}, token.User{}, fmt.Errorf("failed to verify confirmation token: %w", errWrongState)
+	}
+
+	user, address, err := token.ParseHandshakeID(confClaims.Handshake.ID)
+	if err != nil {
+		return token.Claims{}, token.User{}, fmt.Errorf("%w: %s", errBadHandshake, confClaims.Handshake.ID)
+	}
+
+	u := token.User{
+		Name:  user,
+		ID:    e.ProviderName + "_" + token.HashID(sha1.New(), address),
+		Email: address,
+	}
+	if len(confClaims.Handshake.Attrs) > 0 {
+		u.Attributes = map[string]interface{}{ConfirmAttrsKey: confClaims.Handshake.Attrs}
+	}
+	return confClaims, u, nil
+}
+
+// verifyErrStatus returns http status, rejection code and client facing message for Verify error
+func verifyErrStatus(err error) (status int, code, msg string) {
+	switch {
+	case errors.Is(err, errBadHandshake):
+		return http.StatusBadRequest, TokenInvalid, "invalid handshake token"
+	case errors.Is(err, errExpired):
+		return http.StatusForbidden, TokenExpired, "confirmation link expired"
+	case errors.Is(err, errWrongState):
+		return http.StatusForbidden, TokenWrongState, "not a confirmation token"
+	}
+	return http.StatusForbidden, TokenInvalid, "failed to verify confirmation token"
+}
+
 // GET /login?site=site&user=name&address=someone@example.com
+// POST /login with {"user":"name","address":"someone@example.com","site":"site","session":true} or the same form
 func (e VerifyHandler) sendConfirmation(w http.ResponseWriter, r *http.Request) {
-	user, address := r.URL.Query().Get("user"), r.URL.Query().Get("address")
-	user = e.sanitize(user)
-	address = e.sanitize(address)
+	req, err := e.parseSendRequest(w, r)
+	if err != nil {
+		sendParseError(w, r, e.L, err, "failed to parse request")
+		return
+	}
+
+	fields, rejected := map[string]string{}, map[string]error{}
+	raw := map[string]string{"user": req.User, "address": req.Address, "site": req.Site}
+	for _, name := range []string{"user", "address", "site"} {
+		var err error
+		if fields[name], err = e.sanitizeField(name, raw[name], SanitizeOpts{}); err != nil {
+			rejected[name] = err
+		}
+	}
+	// address with CR, LF or NUL is crafted to inject headers by sender, rejected rather than cleaned
+	if strings.ContainsAny(req.Address, "\r\n\x00") {
+		rejected["address"] = errors.New("address rejected, contains control characters")
+	}
+	if e.AddressValidator != nil && fields["address"] != "" && rejected["address"] == nil {
+		if fields["address"], err = e.AddressValidator(fields["address"]); err != nil {
+			rejected["address"] = err
+		}
+	}
+	user, address, site := fields["user"], fields["address"], fields["site"]
+	blocked := e.DomainBlocklist != nil && address != "" && rejected["address"] == nil && e.DomainBlocklist.Blocked(address)
+
+	if e.CollectAllErrors {
+		errs := e.validateConfirmation(user, address, blocked)
+		for name, err := range rejected {
+			errs[name] = err.Error()
+		}
+		if len(errs) > 0 {
+			e.Logf("[DEBUG] invalid confirmation request, %v", errs)
+			renderJSONWithStatus(w, rest.JSON{"errors": errs}, http.StatusBadRequest)
+			return
+		}
+	}
+
+	for _, name := range []string{"user", "address", "site"} {
+		if err := rejected[name]; err != nil {
+			rest.SendErrorJSON(w, r, e.L, http.StatusBadRequest, err, err.Error())
+			return
+		}
+	}
 
 	if user == "" || address == "" {
 		rest.SendErrorJSON(w, r, e.L, http.StatusBadRequest, fmt.Errorf("wrong request"), "can't get user and address")
 		return
 	}
 
+	if blocked {
+		e.Logf("[WARN] confirmation to %s rejected, blocked domain", address)
+		if e.BlockSilently {
+			rest.RenderJSON(w, rest.JSON{"user": user, "address": address})
+			return
+		}
+		renderJSONWithStatus(w, rest.JSON{"error": "email domain is not allowed", "code": AddressDisposable},
+			http.StatusBadRequest)
+		return
+	}
+
+	attrs, status, err := e.confirmAttrs(r, req.Attrs)
+	if err != nil {
+		rest.SendErrorJSON(w, r, e.L, status, err, err.Error())
+		return
+	}
+
+	ip := e.TrustedProxies.ClientIP(r)
+	if retryAfter, limited := e.windowLimited("verify-ip:"+e.ProviderName+":"+ip, e.MaxSendsPerIP); limited {
+		e.Logf("[DEBUG] confirmation to %s rejected, over %d requests from %s", address, e.MaxSendsPerIP, ip)
+		rejectTooMany(w, retryAfter)
+		return
+	}
+	if retryAfter, limited := e.sendLimited(address); limited {
+		e.Logf("[DEBUG] confirmation to %s rejected, sent less than %v ago", address, e.SendInterval)
+		rejectTooMany(w, retryAfter)
+		return
+	}
+	addressKey := "verify-address:" + e.ProviderName + ":" + strings.ToLower(address)
+	if retryAfter, limited := e.windowLimited(addressKey, e.MaxSendsPerAddress); limited {
+		e.Logf("[DEBUG] confirmation to %s rejected, over %d sent within %v", address, e.MaxSendsPerAddress,
+			e.sendWindow())
+		rejectTooMany(w, retryAfter)
+		return
+	}
+
 	claims := token.Claims{
 		Handshake: &token.Handshake{
-			State: "confirm",
-			ID:    user + "::" + address,
+			State: e.handshakeState(confirmState),
+			ID:    token.HandshakeID(user, address),
+			Attrs: attrs,
 		},
-		SessionOnly: r.URL.Query().Get("session") != "" && r.URL.Query().Get("session") != "0",
+		SessionOnly: req.Session,
 		StandardClaims: jwt.StandardClaims{
-			Audience:  e.sanitize(r.URL.Query().Get("site")),
-			ExpiresAt: time.Now().Add(30 * time.Minute).Unix(),
+			Audience:  site,
+			ExpiresAt: time.Now().Add(e.tokenLifetime()).Unix(),
 			NotBefore: time.Now().Add(-1 * time.Minute).Unix(),
-			Issuer:    e.Issuer,
+			Issuer:    e.IssuerFunc.get(r, e.Issuer),
 		},
 	}
 
+	if e.UsedTokens != nil { // unique id, otherwise tokens sent to the same user within a second are the same
+		id, err := randToken()
+		if err != nil {
+			rest.SendErrorJSON(w, r, e.L, http.StatusInternalServerError, err, "can't make token id")
+			return
+		}
+		claims.Id = id
+	}
+
+	if e.BindNonce {
+		nonce, err := randToken()
+		if err != nil {
+			rest.SendErrorJSON(w, r, e.L, http.StatusInternalServerError, err, "can't make nonce")
+			return
+		}
+		claims.Handshake.Nonce = nonceHash(nonce)
+		http.SetCookie(w, &http.Cookie{Name: e.nonceCookieName(), Value: nonce, HttpOnly: true, Path: "/",
+			MaxAge: int(e.tokenLifetime().Seconds()), Secure: r.TLS != nil, SameSite: http.SameSiteLaxMode})
+	}
+
+	if e.CorrelationTracking {
+		if err := e.trackSend(w, r, &claims); err != nil {
+			rest.SendErrorJSON(w, r, e.L, http.StatusInternalServerError, err, "can't make correlation id")
+			return
+		}
+	}
+
 	tkn, err := e.TokenService.Token(claims)
 	if err != nil {
 		rest.SendErrorJSON(w, r, e.L, http.StatusForbidden, err, "failed to make login token")
 		return
 	}
 
-	tmplData := struct {
-		User    string
-		Address string
-		Token   string
-		Site    string
-	}{
+	tmplData := ConfirmData{
 		User:    user,
 		Address: address,
 		Token:   tkn,
-		Site:    r.URL.Query().Get("site"),
+		Site:    req.Site,
+		Locale:  requestLocale(r),
+	}
+	if e.SendCode {
+		if tmplData.Code, err = e.saveCode(address, tkn); err != nil {
+			rest.SendErrorJSON(w, r, e.L, http.StatusInternalServerError, err, "can't make confirmation code")
+			return
+		}
+		tmplData.Token = ""
+	}
+	tmplData.SiteName = tmplData.Site
+	if e.SiteDisplayName != nil {
+		if name := e.SiteDisplayName(tmplData.Site); name != "" {
+			tmplData.SiteName = name
+		}
+	}
+	tmpl, err := e.confirmationTemplate(r, site)
+	if err != nil {
+		rest.SendErrorJSON(w, r, e.L, http.StatusInternalServerError, err, "can't get confirmation template")
+		return
+	}
+	var data interface{} = tmplData
+	if e.TemplateData != nil {
+		data = e.TemplateData(r, tmplData)
 	}
 	buf := bytes.Buffer{}
-	if err = e.Template.Execute(&buf, tmplData); err != nil {
+	if err = tmpl.Execute(&buf, data); err != nil {
 		rest.SendErrorJSON(w, r, e.L, http.StatusInternalServerError, err, "can't execute confirmation template")
 		return
 	}
 
-	if err := e.Sender.Send(address, buf.String()); err != nil {
-		rest.SendErrorJSON(w, r, e.L, http.StatusInternalServerError, err, "failed to send confirmation")
+	release, ok := e.acquireSend(r)
+	if !ok {
+		e.Logf("[WARN] confirmation to %s rejected, %d sends in progress", address, e.MaxConcurrentSends)
+		e.resetSendLimit(address) // nothing sent, retry shouldn't be limited by SendInterval
+		w.Header().Set("Retry-After", "1")
+		renderJSONWithStatus(w, rest.JSON{"error": "too many confirmations sending, try again later"},
+			http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	if err := sendContext(r.Context(), e.Sender, address, buf.String()); err != nil {
+		e.sendFailed(w, r, address, err)
 		return
 	}
 
 	rest.RenderJSON(w, rest.JSON{"user": user, "address": address})
 }
 
+// sendFailed responds to failed delivery of confirmation, 400 if the sender rejected the address for good,
+// 502 if the delivery may succeed later and 500 for errors not marked by the sender
+func (e VerifyHandler) sendFailed(w http.ResponseWriter, r *http.Request, address string, err error) {
+	switch {
+	case errors.Is(err, ErrPermanentSend):
+		e.Logf("[INFO] confirmation to %s rejected by sender, %v", address, err)
+		renderJSONWithStatus(w, rest.JSON{"error": "can't send confirmation to the address"}, http.StatusBadRequest)
+	case errors.Is(err, ErrTransientSend), errors.Is(err, context.DeadlineExceeded):
+		e.Logf("[WARN] failed to send confirmation to %s, %v", address, err)
+		e.resetSendLimit(address) // nothing sent, retry shouldn't be limited by SendInterval
+		renderJSONWithStatus(w, rest.JSON{"error": "failed to send confirmation, try again later"}, http.StatusBadGateway)
+	default:
+		rest.SendErrorJSON(w, r, e.L, http.StatusInternalServerError, err, "failed to send confirmation")
+	}
+}
+
+// secure reports if the request came over TLS, directly or, with TrustProxyTLS, via reverse proxy
+func (e VerifyHandler) secure(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	if !e.TrustProxyTLS {
+		return false
+	}
+	proto := strings.Split(r.Header.Get("X-Forwarded-Proto"), ",")[0] // the first one is set by the edge proxy
+	return strings.EqualFold(strings.TrimSpace(proto), "https")
+}
+
+// rejectInsecure responds to plain http request with 426 Upgrade Required
+func (e VerifyHandler) rejectInsecure(w http.ResponseWriter, r *http.Request) {
+	e.Logf("[WARN] plain http request to %s rejected, from %s", r.URL.Path, e.TrustedProxies.ClientIP(r))
+	w.Header().Set("Upgrade", "TLS/1.2, HTTP/1.1")
+	renderJSONWithStatus(w, rest.JSON{"error": "https required"}, http.StatusUpgradeRequired)
+}
+
+// sendLimited counts confirmation request for the address in LimitStore and reports if another one was sent
+// within SendInterval, with time left till the next one allowed. Store errors logged and ignored.
+func (e VerifyHandler) sendLimited(address string) (retryAfter time.Duration, limited bool) {
+	if e.SendInterval <= 0 {
+		return 0, false
+	}
+	store := e.limitStore()
+	key := e.sendLimitKey(address)
+	count, err := store.Incr(key, e.SendInterval)
+	if err != nil {
+		e.Logf("[WARN] can't increment send interval counter for %s, %v", address, err)
+		return 0, false
+	}
+	if count <= 1 {
+		return 0, false
+	}
+	if _, ttl, err := store.Get(key); err == nil && ttl > 0 {
+		return ttl, true
+	}
+	return e.SendInterval, true
+}
+
+// confirmAttrs returns attrs posted with confirmation request as {"attrs":{...}}, nil if not posted.
+// Returns error with response status for attrs not allowed by ConfirmAttrsAllowed, too large or malformed.
+func (e VerifyHandler) confirmAttrs(r *http.Request, raw json.RawMessage) (map[string]interface{}, int, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, 0, nil
+	}
+	if e.ConfirmAttrsAllowed == nil || !e.ConfirmAttrsAllowed(r) {
+		return nil, http.StatusForbidden, errors.New("attrs not allowed")
+	}
+
+	maxSize := e.MaxConfirmAttrsSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxConfirmAttrsSize
+	}
+	compact := bytes.Buffer{}
+	if err := json.Compact(&compact, raw); err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("failed to parse attrs: %w", err)
+	}
+	if compact.Len() > maxSize {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("attrs too large, max %d bytes", maxSize)
+	}
+	attrs := map[string]interface{}{}
+	if err := json.Unmarshal(compact.Bytes(), &attrs); err != nil {
+		return nil, http.StatusBadRequest, errors.New("attrs must be json object")
+	}
+	return attrs, 0, nil
+}
+
+// sendRequest is confirmation request made with query, or posted json or form
+type sendRequest struct {
+	User    string          `json:"user"`
+	Address string          `json:"address"`
+	Site    string          `json:"site"`
+	Session *bool           `json:"session"`
+	Attrs   json.RawMessage `json:"attrs"` // posted json only
+}
+
+// confirmationRequest is confirmation request with query values overridden by posted ones
+type confirmationRequest struct {
+	User, Address, Site string
+	Session             bool
+	Attrs               json.RawMessage
+}
+
+// parseSendRequest gets confirmation request from query and, for POST, from json or form body, so address doesn't
+// get to access logs. Non-empty posted values win over query ones.
+func (e VerifyHandler) parseSendRequest(w http.ResponseWriter, r *http.Request) (confirmationRequest, error) {
+	q := r.URL.Query()
+	res := confirmationRequest{User: q.Get("user"), Address: q.Get("address"), Site: q.Get("site"),
+		Session: q.Get("session") != "" && q.Get("session") != "0"}
+	if r.Method != "POST" || r.Body == nil {
+		return res, nil
+	}
+
+	limitBody(w, r, e.MaxBodySize)
+	body := sendRequest{}
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "application/x-www-form-urlencoded" {
+		if err := r.ParseForm(); err != nil {
+			return res, err
+		}
+		body.User, body.Address, body.Site = r.PostForm.Get("user"), r.PostForm.Get("address"), r.PostForm.Get("site")
+		if v, ok := r.PostForm["session"]; ok {
+			session := v[0] != "" && v[0] != "0"
+			body.Session = &session
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) { // empty body ok
+		return res, err
+	}
+
+	if body.User != "" {
+		res.User = body.User
+	}
+	if body.Address != "" {
+		res.Address = body.Address
+	}
+	if body.Site != "" {
+		res.Site = body.Site
+	}
+	if body.Session != nil {
+		res.Session = *body.Session
+	}
+	res.Attrs = body.Attrs
+	return res, nil
+}
+
+// windowLimited counts confirmation request for key in LimitStore and reports if it exceeds max within SendWindow,
+// with time left till the window end. Disabled with max 0, store errors logged and ignored.
+func (e VerifyHandler) windowLimited(key string, max int) (retryAfter time.Duration, limited bool) {
+	if max <= 0 {
+		return 0, false
+	}
+	store, window := e.limitStore(), e.sendWindow()
+	count, err := store.Incr(key, window)
+	if err != nil {
+		e.Logf("[WARN] can't increment send limit counter %s, %v", key, err)
+		return 0, false
+	}
+	if count <= max {
+		return 0, false
+	}
+	if _, ttl, err := store.Get(key); err == nil && ttl > 0 {
+		return ttl, true
+	}
+	return window, true
+}
+
+func (e VerifyHandler) sendWindow() time.Duration {
+	if e.SendWindow <= 0 {
+		return defaultSendWindow
+	}
+	return e.SendWindow
+}
+
+// rejectTooMany responds to rate limited confirmation request with 429 and Retry-After header
+func rejectTooMany(w http.ResponseWriter, retryAfter time.Duration) {
+	secs := int(retryAfter.Round(time.Second) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	renderJSONWithStatus(w, rest.JSON{"error": "too many requests"}, http.StatusTooManyRequests)
+}
+
+// resetSendLimit removes send interval counter of the address
+func (e VerifyHandler) resetSendLimit(address string) {
+	if e.SendInterval <= 0 {
+		return
+	}
+	store := e.limitStore()
+	if err := store.Reset(e.sendLimitKey(address)); err != nil {
+		e.Logf("[WARN] can't reset send interval counter for %s, %v", address, err)
+	}
+}
+
+// limitStore returns LimitStore or default in-memory one
+func (e VerifyHandler) limitStore() LockoutStore {
+	if e.LimitStore == nil {
+		return defaultSendLimitStore
+	}
+	return e.LimitStore
+}
+
+func (e VerifyHandler) sendLimitKey(address string) string {
+	return "verify-send:" + e.ProviderName + ":" + strings.ToLower(address)
+}
+
+// lockLogin takes lock of the user's login completion, counter in LimitStore with LoginLockTTL, so concurrent
+// completions, i.e. the link opened in two tabs, don't call UserSaver and set cookies at once. Waits for the lock
+// held by another completion up to LoginLockWait or the request deadline. Returns func releasing the lock, or false
+// if it is still held. Store errors logged and the login not serialized. Lock not released in LoginLockTTL, i.e.
+// by crashed instance, expires.
+func (e VerifyHandler) lockLogin(r *http.Request, userID string) (unlock func(), ok bool) {
+	if e.LoginLockTTL <= 0 {
+		return func() {}, true
+	}
+	store := e.limitStore()
+	key := "verify-login:" + e.ProviderName + ":" + userID
+	deadline := time.Now().Add(e.LoginLockWait)
+	for {
+		// check before increment, so waiting doesn't extend ttl of the lock
+		held, _, err := store.Get(key)
+		count := 0
+		if err == nil && held == 0 {
+			count, err = store.Incr(key, e.LoginLockTTL)
+		}
+		if err != nil {
+			e.Logf("[WARN] can't lock login of %s, %v", userID, err)
+			return func() {}, true
+		}
+		if count == 1 {
+			return func() {
+				if err := store.Reset(key); err != nil {
+					e.Logf("[WARN] can't unlock login of %s, %v", userID, err)
+				}
+			}, true
+		}
+		if time.Now().Add(loginLockPoll).After(deadline) {
+			return nil, false
+		}
+		select {
+		case <-r.Context().Done():
+			return nil, false
+		case <-time.After(loginLockPoll):
+		}
+	}
+}
+
+// acquireSend takes one of MaxConcurrentSends slots of the provider, waiting for it up to SendWait with it set.
+// Returns func releasing the slot, or false if no slot available in time.
+func (e VerifyHandler) acquireSend(r *http.Request) (release func(), ok bool) {
+	if e.MaxConcurrentSends <= 0 {
+		return func() {}, true
+	}
+	sendSlots.Lock()
+	key := e.ProviderName + ":" + strconv.Itoa(e.MaxConcurrentSends)
+	sem, found := sendSlots.sems[key]
+	if !found {
+		sem = make(chan struct{}, e.MaxConcurrentSends)
+		sendSlots.sems[key] = sem
+	}
+	sendSlots.Unlock()
+
+	release = func() { <-sem }
+	select {
+	case sem <- struct{}{}:
+		return release, true
+	default:
+	}
+	if e.SendWait <= 0 {
+		return nil, false
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), e.SendWait)
+	defer cancel()
+	select {
+	case sem <- struct{}{}:
+		return release, true
+	case <-ctx.Done():
+		return nil, false
+	}
+}
+
+// authExpiresAt returns expiration of the auth token by AuthTTLFunc, 0 lets token service set the default one
+func (e VerifyHandler) authExpiresAt(withPassword bool, u token.User) int64 {
+	if e.AuthTTLFunc == nil {
+		return 0
+	}
+	ttl := e.AuthTTLFunc(withPassword, u)
+	if ttl <= 0 {
+		return 0
+	}
+	return time.Now().Add(ttl).Unix()
+}
+
+// Validate checks handler's settings, negative lifetimes rejected. Called once on construction,
+// i.e. by auth.Service adding the provider, handlers don't check it.
+func (e VerifyHandler) Validate() error {
+	switch {
+	case e.TokenLifetime < 0:
+		return fmt.Errorf("negative TokenLifetime %v", e.TokenLifetime)
+	case e.ConfirmTTL < 0:
+		return fmt.Errorf("negative ConfirmTTL %v", e.ConfirmTTL)
+	case e.CredentialsTTL < 0:
+		return fmt.Errorf("negative CredentialsTTL %v", e.CredentialsTTL)
+	}
+	return nil
+}
+
+// tokenLifetime returns lifetime of confirmation tokens, TokenLifetime, ConfirmTTL or default
+func (e VerifyHandler) tokenLifetime() time.Duration {
+	switch {
+	case e.TokenLifetime > 0:
+		return e.TokenLifetime
+	case e.ConfirmTTL > 0:
+		return e.ConfirmTTL
+	}
+	return defaultConfirmTokenTTL
+}
+
+// credentialsTTL returns lifetime of password step token, CredentialsTTL or lifetime of confirmation tokens
+func (e VerifyHandler) credentialsTTL() time.Duration {
+	if e.CredentialsTTL <= 0 {
+		return e.tokenLifetime()
+	}
+	return e.CredentialsTTL
+}
+
+// validateConfirmation checks all fields of confirmation request and returns errors keyed by field name.
+// Blocked address reported unless BlockSilently, silently blocked one is responded as sent later.
+func (e VerifyHandler) validateConfirmation(user, address string, blocked bool) map[string]string {
+	errs := map[string]string{}
+	if user == "" {
+		errs["user"] = "user is required"
+	}
+	if address == "" {
+		errs["address"] = "address is required"
+	}
+	if blocked && !e.BlockSilently {
+		errs["address"] = "email domain is not allowed"
+	}
+	return errs
+}
+
+// nonceCookieName returns name of the nonce cookie, per provider to allow parallel flows of different providers
+func (e VerifyHandler) nonceCookieName() string {
+	return nonceCookiePrefix + e.ProviderName
+}
+
+// checkNonce checks the confirmation token was requested from the same browser, i.e. it has the nonce cookie.
+// Lax same-site cookie sent with the link opened from email, but attacker can't set it in the victim's browser.
+func (e VerifyHandler) checkNonce(r *http.Request, claims token.Claims) error {
+	if claims.Handshake == nil || claims.Handshake.Nonce == "" {
+		return fmt.Errorf("no nonce in confirmation token")
+	}
+	c, err := r.Cookie(e.nonceCookieName())
+	if err != nil {
+		return fmt.Errorf("no nonce cookie: %w", err)
+	}
+	if subtle.ConstantTimeCompare([]byte(nonceHash(c.Value)), []byte(claims.Handshake.Nonce)) != 1 {
+		return fmt.Errorf("nonce mismatch")
+	}
+	return nil
+}
+
+// resetNonce removes nonce cookie, so the confirmation link can't be reused in the same browser
+func (e VerifyHandler) resetNonce(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: e.nonceCookieName(), Value: "", HttpOnly: true, Path: "/", MaxAge: -1,
+		Expires: time.Unix(0, 0)})
+}
+
+// nonceHash returns hash of the nonce kept in the token, so the token sent to the user doesn't reveal the cookie
+func nonceHash(nonce string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(nonce)))
+}
+
 // AuthHandler doesn't do anything for direct login as it has no callbacks
 func (e VerifyHandler) AuthHandler(w http.ResponseWriter, r *http.Request) {
 	if !e.WithPassword {
 		return
 	}
+	if e.RequireTLS && !e.secure(r) {
+		e.rejectInsecure(w, r)
+		return
+	}
 
 	sessOnly := r.URL.Query().Get("session") == "1"
 
@@ -249,15 +1138,54 @@ func (e VerifyHandler) AuthHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if claims.Handshake == nil || claims.Handshake.State != "credentials" {
+	if claims.Handshake == nil || claims.Handshake.State != e.handshakeState(credentialsState) {
 		rest.SendErrorJSON(w, r, e.L, http.StatusInternalServerError, err, "invalid kind of token")
 		return
 	}
 
+	passwd, err := e.getPassword(w, r)
+	if err != nil {
+		sendParseError(w, r, e.L, err, "failed to get password")
+		return
+	}
+	if passwd == "" {
+		rest.SendErrorJSON(w, r, e.L, http.StatusBadRequest, errors.New("empty password"), "password required")
+		return
+	}
+	ip := e.TrustedProxies.ClientIP(r)
+	if e.Lockout != nil {
+		// checked before password, so locked response doesn't depend on it
+		if retryAfter, locked := e.Lockout.locked(e.L, e.ProviderName, claims.User.ID, ip); locked {
+			e.Lockout.sendLocked(w, retryAfter)
+			return
+		}
+	}
+	_, address, _ := token.ParseHandshakeID(claims.Handshake.ID)
+	if status, err := e.checkPassword(claims.User.Name, address, passwd); err != nil {
+		if e.Lockout != nil && status == http.StatusForbidden {
+			e.Lockout.failed(r.Context(), e.L, e.ProviderName, claims.User.ID, ip)
+		}
+		rest.SendErrorJSON(w, r, e.L, status, err, err.Error())
+		return
+	}
+	if e.Lockout != nil {
+		e.Lockout.succeeded(e.L, e.ProviderName, claims.User.ID)
+	}
+	claims.User.Password = passwd // not a part of the token, passed to UserSaver only
+
+	unlock, ok := e.lockLogin(r, claims.User.ID)
+	if !ok {
+		e.Logf("[DEBUG] login of %s rejected, another one in progress", claims.User.ID)
+		renderJSONWithStatus(w, rest.JSON{"error": "login of the user in progress", "code": LoginInProgress},
+			http.StatusConflict)
+		return
+	}
+	defer unlock()
+
 	if e.UserSaver != nil {
 		err = e.UserSaver(*claims.User)
 		if err != nil {
-			rest.SendErrorJSON(w, r, e.L, http.StatusInternalServerError, err, "failed to save user")
+			sendSaveUserError(w, r, e.L, err)
 			return
 		}
 	}
@@ -271,11 +1199,13 @@ func (e VerifyHandler) AuthHandler(w http.ResponseWriter, r *http.Request) {
 	authClaims := token.Claims{
 		User: claims.User,
 		StandardClaims: jwt.StandardClaims{
-			Id:       cid,
-			Issuer:   e.Issuer,
-			Audience: claims.Audience,
+			Id:        cid,
+			Issuer:    e.IssuerFunc.get(r, e.Issuer),
+			Audience:  claims.Audience,
+			ExpiresAt: e.authExpiresAt(true, *claims.User),
 		},
 		SessionOnly: sessOnly,
+		Provider:    e.ProviderName,
 	}
 
 	if _, err = e.TokenService.Set(w, authClaims); err != nil {
@@ -287,6 +1217,41 @@ func (e VerifyHandler) AuthHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// checkPassword checks password with PasswordChecker, registers it with PasswordSaver for user without password.
+// Returns http status and client facing error if password rejected. Fails closed without PasswordChecker.
+func (e VerifyHandler) checkPassword(user, address, passwd string) (int, error) {
+	if e.PasswordChecker == nil {
+		e.Logf("[WARN] password of %s rejected, no password checker of %s", user, e.ProviderName)
+		return http.StatusInternalServerError, errors.New("password check not available")
+	}
+	ok, err := e.PasswordChecker(user, address, passwd)
+	switch {
+	case errors.Is(err, ErrPasswordNotSet):
+		if e.PasswordSaver == nil {
+			e.Logf("[DEBUG] password of %s rejected, not set and no password saver", user)
+			return http.StatusForbidden, errors.New("incorrect password")
+		}
+		if e.PasswordPolicy != nil {
+			if err = e.PasswordPolicy.Validate(passwd, PasswordUserContext{User: user, Email: address}); err != nil {
+				return http.StatusBadRequest, err
+			}
+		}
+		if err = e.PasswordSaver(user, address, passwd); err != nil {
+			e.Logf("[WARN] can't save password of %s, %v", user, err)
+			return http.StatusInternalServerError, errors.New("failed to save password")
+		}
+		e.Logf("[DEBUG] password of %s registered", user)
+		return http.StatusOK, nil
+	case err != nil:
+		e.Logf("[WARN] can't check password of %s, %v", user, err)
+		return http.StatusInternalServerError, errors.New("failed to check password")
+	case !ok:
+		e.Logf("[DEBUG] password of %s rejected, mismatch", user)
+		return http.StatusForbidden, errors.New("incorrect password")
+	}
+	return http.StatusOK, nil
+}
+
 // getPassword extracts password from request
 func (e VerifyHandler) getPassword(w http.ResponseWriter, r *http.Request) (string, error) {
 	// GET /something?user=name&passwd=xyz&aud=bar
@@ -298,9 +1263,7 @@ func (e VerifyHandler) getPassword(w http.ResponseWriter, r *http.Request) (stri
 		return "", fmt.Errorf("method %s not supported", r.Method)
 	}
 
-	if r.Body != nil {
-		r.Body = http.MaxBytesReader(w, r.Body, MaxHTTPBodySize)
-	}
+	limitBody(w, r, e.MaxBodySize)
 	contentType := r.Header.Get("Content-Type")
 	if contentType != "" {
 		mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
@@ -313,12 +1276,12 @@ func (e VerifyHandler) getPassword(w http.ResponseWriter, r *http.Request) (stri
 	// POST with json body
 	if contentType == "application/json" {
 		var creds struct {
-			Password string `json:"passwd"`
+			Password json.RawMessage `json:"passwd"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
 			return "", fmt.Errorf("failed to parse request body: %w", err)
 		}
-		return creds.Password, nil
+		return e.jsonPassword(creds.Password)
 	}
 
 	// POST with form
@@ -329,22 +1292,42 @@ func (e VerifyHandler) getPassword(w http.ResponseWriter, r *http.Request) (stri
 	return r.Form.Get("passwd"), nil
 }
 
+// jsonPassword returns password from json value, string or, with AllowNumericPassword, number in its literal form.
+// Numbers can't keep leading zeros, so PINs like "0123" should be sent as strings anyway.
+func (e VerifyHandler) jsonPassword(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 {
+		return "", nil
+	}
+	var passwd string
+	err := json.Unmarshal(raw, &passwd)
+	if err == nil {
+		return passwd, nil
+	}
+	if e.AllowNumericPassword {
+		var num json.Number
+		if json.Unmarshal(raw, &num) == nil {
+			return num.String(), nil
+		}
+	}
+	return "", fmt.Errorf("failed to parse request body: %w", err)
+}
+
 // LogoutHandler - GET /logout
 func (e VerifyHandler) LogoutHandler(w http.ResponseWriter, _ *http.Request) {
 	e.TokenService.Reset(w)
 }
 
-func (e VerifyHandler) sanitize(inp string) string {
-	p := bluemonday.UGCPolicy()
-	res := p.Sanitize(inp)
-	res = template.HTMLEscapeString(res)
-	res = strings.ReplaceAll(res, "&amp;", "&")
-	res = strings.ReplaceAll(res, "&#34;", "\"")
-	res = strings.ReplaceAll(res, "&#39;", "'")
-	res = strings.ReplaceAll(res, "\n", "")
-	res = strings.TrimSpace(res)
-	if len(res) > 128 {
-		return res[:128]
+// sanitizeField sanitizes input of the named field with Sanitizer, or with its opts, i.e. KeepNewlines for
+// multi-line one, returns error if non-empty input became empty, i.e. consisted of disallowed html only
+func (e VerifyHandler) sanitizeField(name, inp string, opts SanitizeOpts) (string, error) {
+	var res string
+	if e.Sanitizer != nil {
+		res = e.Sanitizer(inp)
+	} else {
+		res = Sanitize(inp, opts)
+	}
+	if res == "" && strings.TrimSpace(inp) != "" {
+		return "", fmt.Errorf("%s rejected, contains disallowed html only", name)
 	}
-	return res
+	return res, nil
 }
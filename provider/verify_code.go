@@ -0,0 +1,195 @@
+package provider
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConfirmCodeStore keeps pending confirmations of VerifyHandler.SendCode by address, each one with the token and
+// hash of the code sent for it. Take returns the value and removes it, so each code redeemed once, and should be
+// atomic with shared store, i.e. GETDEL of redis. Store is responsible for removal of values expired in ttl.
+type ConfirmCodeStore interface {
+	Set(key, value string, ttl time.Duration) error
+	Take(key string) (value string, found bool, err error)
+}
+
+const (
+	defaultConfirmCodeLength   = 6
+	defaultConfirmCodeTTL      = 10 * time.Minute
+	defaultConfirmCodeAttempts = 5
+)
+
+// confirmation code rejection codes, sent to the client as "code" with 403
+const (
+	CodeInvalid          = "code_invalid"           // unknown, already used or expired code, or code of another address
+	CodeAttemptsExceeded = "code_attempts_exceeded" // too many wrong codes, pending code dropped and a new one needed
+)
+
+var (
+	errCodeInvalid  = errors.New("invalid or expired confirmation code")
+	errCodeAttempts = errors.New("too many wrong confirmation codes")
+)
+
+// defaultConfirmCodeStore keeps codes of handlers without CodeStore, per process only
+var defaultConfirmCodeStore = NewMemConfirmCodeStore()
+
+// pendingCode is the value kept in CodeStore by address
+type pendingCode struct {
+	Hash    string `json:"hash"`    // hex sha256 of address and code, compared in constant time
+	Token   string `json:"token"`   // confirmation token
+	Expires int64  `json:"expires"` // unix time, keeps the rest of ttl when put back after wrong code
+}
+
+// saveCode makes new random code of CodeLength digits for the address and keeps confirmation token with it in
+// CodeStore for CodeTTL, replacing pending code of the address, if any. Counter of wrong codes reset.
+func (e VerifyHandler) saveCode(address, tkn string) (string, error) {
+	n := e.CodeLength
+	if n <= 0 {
+		n = defaultConfirmCodeLength
+	}
+	code, err := randomDigits(n)
+	if err != nil {
+		return "", err
+	}
+	ttl := e.codeTTL()
+	val, err := json.Marshal(pendingCode{Hash: codeHash(address, code), Token: tkn,
+		Expires: time.Now().Add(ttl).Unix()})
+	if err != nil {
+		return "", fmt.Errorf("can't marshal confirmation code: %w", err)
+	}
+	if err = e.codeStore().Set(e.codeKey(address), string(val), ttl); err != nil {
+		return "", fmt.Errorf("can't save confirmation code: %w", err)
+	}
+	if err = e.limitStore().Reset(e.codeAttemptsKey(address)); err != nil {
+		e.Logf("[WARN] can't reset confirmation code attempts for %s, %v", address, err)
+	}
+	return code, nil
+}
+
+// takeCode returns confirmation token of the address if the code matches, and removes it from CodeStore.
+// Wrong code counted, and the pending code kept for the next attempt until MaxCodeAttempts reached.
+// Returns errCodeInvalid or errCodeAttempts for rejected code, other errors are errors of the stores.
+func (e VerifyHandler) takeCode(address, code string) (string, error) {
+	key := e.codeKey(address)
+	val, found, err := e.codeStore().Take(key)
+	if err != nil {
+		return "", fmt.Errorf("can't get confirmation code: %w", err)
+	}
+	if !found {
+		return "", errCodeInvalid
+	}
+	pending := pendingCode{}
+	if err = json.Unmarshal([]byte(val), &pending); err != nil {
+		return "", fmt.Errorf("%w, can't unmarshal: %v", errCodeInvalid, err)
+	}
+	if subtle.ConstantTimeCompare([]byte(codeHash(address, code)), []byte(pending.Hash)) == 1 {
+		if err = e.limitStore().Reset(e.codeAttemptsKey(address)); err != nil {
+			e.Logf("[WARN] can't reset confirmation code attempts for %s, %v", address, err)
+		}
+		return pending.Token, nil
+	}
+
+	ttl := time.Until(time.Unix(pending.Expires, 0))
+	if ttl <= 0 {
+		return "", errCodeInvalid
+	}
+	maxAttempts := e.MaxCodeAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultConfirmCodeAttempts
+	}
+	count, err := e.limitStore().Incr(e.codeAttemptsKey(address), ttl)
+	if err != nil {
+		return "", fmt.Errorf("can't count confirmation code attempts: %w", err) // code dropped, fail closed
+	}
+	if count >= maxAttempts {
+		return "", errCodeAttempts
+	}
+	if err = e.codeStore().Set(key, val, ttl); err != nil {
+		return "", fmt.Errorf("can't restore confirmation code: %w", err)
+	}
+	return "", errCodeInvalid
+}
+
+func (e VerifyHandler) codeStore() ConfirmCodeStore {
+	if e.CodeStore == nil {
+		return defaultConfirmCodeStore
+	}
+	return e.CodeStore
+}
+
+// codeTTL returns CodeTTL or default, limited by lifetime of the token kept by the code
+func (e VerifyHandler) codeTTL() time.Duration {
+	ttl := e.CodeTTL
+	if ttl <= 0 {
+		ttl = defaultConfirmCodeTTL
+	}
+	if ttl > e.tokenLifetime() {
+		return e.tokenLifetime()
+	}
+	return ttl
+}
+
+// codeKey namespaces pending code of the address by provider name, so providers sharing the store don't collide
+func (e VerifyHandler) codeKey(address string) string {
+	return "verify-code:" + e.ProviderName + ":" + strings.ToLower(address)
+}
+
+func (e VerifyHandler) codeAttemptsKey(address string) string {
+	return "verify-code-attempts:" + e.ProviderName + ":" + strings.ToLower(address)
+}
+
+// codeHash returns hash of the code bound to the address
+func codeHash(address, code string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(strings.ToLower(address)+":"+code)))
+}
+
+// MemConfirmCodeStore implements ConfirmCodeStore with in-memory map. Expired values removed on access.
+type MemConfirmCodeStore struct {
+	lock  sync.Mutex
+	codes map[string]memConfirmCode
+}
+
+type memConfirmCode struct {
+	value   string
+	expires time.Time
+}
+
+// NewMemConfirmCodeStore makes in-memory confirmation codes store
+func NewMemConfirmCodeStore() *MemConfirmCodeStore {
+	return &MemConfirmCodeStore{codes: map[string]memConfirmCode{}}
+}
+
+// Set saves the value by key for ttl
+func (m *MemConfirmCodeStore) Set(key, value string, ttl time.Duration) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := time.Now()
+	for k, c := range m.codes {
+		if now.After(c.expires) {
+			delete(m.codes, k)
+		}
+	}
+	m.codes[key] = memConfirmCode{value: value, expires: now.Add(ttl)}
+	return nil
+}
+
+// Take returns not expired value of the key and removes it
+func (m *MemConfirmCodeStore) Take(key string) (string, bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	c, ok := m.codes[key]
+	if !ok {
+		return "", false, nil
+	}
+	delete(m.codes, key)
+	if time.Now().After(c.expires) {
+		return "", false, nil
+	}
+	return c.value, true, nil
+}
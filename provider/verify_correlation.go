@@ -0,0 +1,62 @@
+package provider
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"time"
+
+	"github.com/go-pkgz/auth/token"
+)
+
+const correlationCookiePrefix = "VERIFY-CID-"
+
+// CorrelationEvent reports redemption of confirmation sent with CorrelationTracking.
+// It has no user info, only the opaque id set at send time, for funnel analytics.
+type CorrelationEvent struct {
+	Provider    string        // provider name
+	ID          string        // correlation id, random, the same in the cookie and the confirmation token
+	Site        string        // site (audience) of the confirmation
+	Elapsed     time.Duration // time from sending the confirmation to its redemption
+	SameBrowser bool          // correlation cookie presented and matched, false for links opened on another device
+}
+
+// trackSend adds new correlation id to confirmation claims and sets it as a cookie
+func (e VerifyHandler) trackSend(w http.ResponseWriter, r *http.Request, claims *token.Claims) error {
+	cid, err := randToken()
+	if err != nil {
+		return err
+	}
+	claims.Handshake.CID = cid
+	claims.IssuedAt = time.Now().Unix()
+	http.SetCookie(w, &http.Cookie{Name: e.correlationCookieName(), Value: cid, HttpOnly: true, Path: "/",
+		MaxAge: int(e.tokenLifetime().Seconds()), Secure: e.secure(r), SameSite: http.SameSiteLaxMode})
+	return nil
+}
+
+// trackRedemption compares correlation id of the confirmation token with the cookie and reports the event.
+// Missing cookie is fine, i.e. the link opened on another device, the event is reported with SameBrowser false.
+// Tokens sent without tracking ignored.
+func (e VerifyHandler) trackRedemption(w http.ResponseWriter, r *http.Request, claims token.Claims) {
+	if claims.Handshake == nil || claims.Handshake.CID == "" {
+		return
+	}
+	ev := CorrelationEvent{Provider: e.ProviderName, ID: claims.Handshake.CID, Site: claims.Audience}
+	if claims.IssuedAt > 0 {
+		ev.Elapsed = time.Since(time.Unix(claims.IssuedAt, 0)).Truncate(time.Second)
+	}
+	if c, err := r.Cookie(e.correlationCookieName()); err == nil {
+		ev.SameBrowser = subtle.ConstantTimeCompare([]byte(c.Value), []byte(ev.ID)) == 1
+		http.SetCookie(w, &http.Cookie{Name: e.correlationCookieName(), Value: "", HttpOnly: true, Path: "/",
+			MaxAge: -1, Expires: time.Unix(0, 0)})
+	}
+	if e.CorrelationFunc == nil {
+		e.Logf("[DEBUG] confirmation %s redeemed after %v, same browser: %v", ev.ID, ev.Elapsed, ev.SameBrowser)
+		return
+	}
+	e.CorrelationFunc(ev)
+}
+
+// correlationCookieName returns name of the correlation cookie, per provider as the nonce one
+func (e VerifyHandler) correlationCookieName() string {
+	return correlationCookiePrefix + e.ProviderName
+}
@@ -0,0 +1,115 @@
+package provider
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/auth/logger"
+	"github.com/go-pkgz/auth/token"
+)
+
+func TestVerifyHandler_CorrelationTracking(t *testing.T) {
+	var sent string
+	var events []CorrelationEvent
+	e := VerifyHandler{
+		ProviderName: "email",
+		TokenService: token.NewService(token.Opts{
+			SecretReader:   token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+			TokenDuration:  time.Hour,
+			CookieDuration: time.Hour * 24 * 31,
+		}),
+		Issuer:              "iss-test",
+		L:                   logger.NoOp{},
+		Sender:              SenderFunc(func(address, text string) error { sent = text; return nil }),
+		Template:            template.Must(template.New("confirm").Parse("{{.Token}}")),
+		CorrelationTracking: true,
+		CorrelationFunc:     func(ev CorrelationEvent) { events = append(events, ev) },
+	}
+
+	send := func() *http.Cookie {
+		rr := httptest.NewRecorder()
+		e.LoginHandler(rr, httptest.NewRequest("GET", "/login?user=myuser&address=blah@user.com&site=remark", http.NoBody))
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		cookies := rr.Result().Cookies()
+		require.Equal(t, 1, len(cookies))
+		return cookies[0]
+	}
+	confirm := func(c *http.Cookie) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/login?token="+sent, http.NoBody)
+		if c != nil {
+			req.AddCookie(c)
+		}
+		e.LoginHandler(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		return rr
+	}
+
+	// the same browser
+	cid := send()
+	assert.Equal(t, "VERIFY-CID-email", cid.Name)
+	assert.True(t, cid.HttpOnly)
+	assert.Equal(t, http.SameSiteLaxMode, cid.SameSite)
+	claims, err := e.TokenService.Parse(sent)
+	require.NoError(t, err)
+	assert.Equal(t, cid.Value, claims.Handshake.CID)
+	assert.NotZero(t, claims.IssuedAt)
+
+	rr := confirm(cid)
+	require.Equal(t, 1, len(events))
+	assert.Equal(t, CorrelationEvent{Provider: "email", ID: cid.Value, Site: "remark", SameBrowser: true}, events[0])
+	var reset bool
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == "VERIFY-CID-email" && c.MaxAge < 0 {
+			reset = true
+		}
+	}
+	assert.True(t, reset, "correlation cookie removed")
+
+	// another device, no cookie, login still works
+	cid = send()
+	confirm(nil)
+	require.Equal(t, 2, len(events))
+	assert.Equal(t, cid.Value, events[1].ID)
+	assert.False(t, events[1].SameBrowser)
+
+	// cookie of another confirmation
+	old := cid
+	send()
+	confirm(old)
+	require.Equal(t, 3, len(events))
+	assert.NotEqual(t, old.Value, events[2].ID)
+	assert.False(t, events[2].SameBrowser)
+
+	// elapsed time from the token
+	tkn, err := e.TokenService.Token(token.Claims{
+		Handshake: &token.Handshake{State: "confirm:email", ID: "myuser::blah@user.com", CID: "cid1"},
+		StandardClaims: jwt.StandardClaims{IssuedAt: time.Now().Add(-90 * time.Second).Unix(),
+			ExpiresAt: time.Now().Add(time.Hour).Unix()},
+	})
+	require.NoError(t, err)
+	sent = tkn
+	confirm(nil)
+	require.Equal(t, 4, len(events))
+	assert.Equal(t, "cid1", events[3].ID)
+	assert.InDelta(t, 90, events[3].Elapsed.Seconds(), 2)
+
+	// tracking disabled, no cookie and no events
+	e.CorrelationTracking = false
+	rr = httptest.NewRecorder()
+	e.LoginHandler(rr, httptest.NewRequest("GET", "/login?user=myuser&address=blah@user.com", http.NoBody))
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Result().Cookies())
+	claims, err = e.TokenService.Parse(sent)
+	require.NoError(t, err)
+	assert.Empty(t, claims.Handshake.CID)
+	confirm(nil)
+	assert.Equal(t, 4, len(events))
+}
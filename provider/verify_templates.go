@@ -0,0 +1,191 @@
+package provider
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// maxCachedTemplateMisses limits cached misses, as site and locale come from the request
+const maxCachedTemplateMisses = 1000
+
+// TemplateLoader returns source of confirmation template for the site and locale, found=false if there is none.
+// Empty site or locale requests the default template for the locale or site.
+type TemplateLoader func(site, locale string) (src string, found bool, err error)
+
+// TemplateRegistry keeps parsed confirmation templates by site and locale. Templates parsed with Loader on the first
+// use and cached, concurrent requests for the same template wait for a single parse. Reload drops cached templates,
+// so changed sources picked up by the next request. Safe for concurrent use.
+type TemplateRegistry struct {
+	Loader TemplateLoader
+	Funcs  template.FuncMap // optional functions available to templates
+
+	lock      sync.Mutex
+	templates map[tmplKey]*tmplEntry
+	misses    int
+}
+
+type tmplKey struct {
+	site, locale string
+}
+
+type tmplEntry struct {
+	once sync.Once
+	tmpl *template.Template // nil for missing template
+	err  error
+}
+
+// Get returns template for the site and locale. Falls back to the language of the locale, i.e. "pt" for "pt-br",
+// the site default, and then to the same locales of the global default. Returns nil without error if none found.
+func (tr *TemplateRegistry) Get(site, locale string) (*template.Template, error) {
+	lang := strings.SplitN(locale, "-", 2)[0]
+	keys := []tmplKey{{site, locale}, {site, lang}, {site, ""}, {"", locale}, {"", lang}, {"", ""}}
+	for i, k := range keys {
+		if hasTmplKey(keys[:i], k) {
+			continue // no region, site or locale
+		}
+		t, err := tr.get(k)
+		if err != nil {
+			return nil, err
+		}
+		if t != nil {
+			return t, nil
+		}
+	}
+	return nil, nil
+}
+
+// Set puts parsed template for the site and locale, replaces loaded one
+func (tr *TemplateRegistry) Set(site, locale string, t *template.Template) {
+	e := &tmplEntry{tmpl: t}
+	e.once.Do(func() {})
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	if tr.templates == nil {
+		tr.templates = map[tmplKey]*tmplEntry{}
+	}
+	tr.templates[tmplKey{site, locale}] = e
+}
+
+// Preload parses templates of all sites and locales in advance, to fail fast on broken sources
+func (tr *TemplateRegistry) Preload(sites, locales []string) error {
+	for _, site := range append([]string{""}, sites...) {
+		for _, locale := range append([]string{""}, locales...) {
+			if _, err := tr.get(tmplKey{site, locale}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Reload drops cached templates, they are loaded again on the next use. Templates added with Set dropped as well.
+func (tr *TemplateRegistry) Reload() {
+	tr.lock.Lock()
+	tr.templates, tr.misses = nil, 0
+	tr.lock.Unlock()
+}
+
+// get returns cached template or loads it. Load errors are not cached.
+func (tr *TemplateRegistry) get(k tmplKey) (*template.Template, error) {
+	tr.lock.Lock()
+	if tr.templates == nil {
+		tr.templates = map[tmplKey]*tmplEntry{}
+	}
+	e, ok := tr.templates[k]
+	if !ok {
+		e = &tmplEntry{}
+		tr.templates[k] = e
+	}
+	tr.lock.Unlock()
+
+	e.once.Do(func() { e.tmpl, e.err = tr.load(k) })
+
+	if e.err != nil || e.tmpl == nil {
+		tr.lock.Lock()
+		if tr.templates[k] == e {
+			if e.err != nil || tr.misses >= maxCachedTemplateMisses {
+				delete(tr.templates, k)
+			} else if !ok {
+				tr.misses++
+			}
+		}
+		tr.lock.Unlock()
+	}
+	return e.tmpl, e.err
+}
+
+func (tr *TemplateRegistry) load(k tmplKey) (*template.Template, error) {
+	if tr.Loader == nil {
+		return nil, nil
+	}
+	src, found, err := tr.Loader(k.site, k.locale)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load template for site %q, locale %q: %w", k.site, k.locale, err)
+	}
+	if !found {
+		return nil, nil
+	}
+	t, err := template.New(k.site + ":" + k.locale).Funcs(tr.Funcs).Parse(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse template for site %q, locale %q: %w", k.site, k.locale, err)
+	}
+	return t, nil
+}
+
+func hasTmplKey(keys []tmplKey, k tmplKey) bool {
+	for _, key := range keys {
+		if key == k {
+			return true
+		}
+	}
+	return false
+}
+
+// ConfirmData is the data of confirmation template
+type ConfirmData struct {
+	User     string
+	Address  string
+	Token    string
+	Code     string // sent instead of the token with SendCode
+	Site     string
+	SiteName string // display name of the site by SiteDisplayName, Site if not set
+	Locale   string // locale of the request, as used to pick template from Templates
+}
+
+// confirmationTemplate returns template for the site and locale of the request from Templates if defined,
+// Template otherwise or if Templates has none
+func (e VerifyHandler) confirmationTemplate(r *http.Request, site string) (*template.Template, error) {
+	if e.Templates != nil {
+		t, err := e.Templates.Get(site, requestLocale(r))
+		if err != nil || t != nil {
+			return t, err
+		}
+	}
+	if e.Template == nil {
+		return nil, fmt.Errorf("no confirmation template for site %q", site)
+	}
+	return e.Template, nil
+}
+
+// requestLocale returns normalized locale from "locale" query parameter or the first Accept-Language tag,
+// i.e. "pt-br" for "pt_BR". Empty for missing or malformed locale.
+func requestLocale(r *http.Request) string {
+	locale := r.URL.Query().Get("locale")
+	if locale == "" {
+		locale = strings.Split(r.Header.Get("Accept-Language"), ",")[0]
+		locale = strings.Split(locale, ";")[0]
+	}
+	locale = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(locale), "_", "-"))
+	if len(locale) > 16 {
+		return ""
+	}
+	for _, c := range locale {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return ""
+		}
+	}
+	return locale
+}
@@ -0,0 +1,307 @@
+package provider
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/auth/logger"
+	"github.com/go-pkgz/auth/token"
+)
+
+// mockTemplateLoader serves template sources by "site:locale" key and counts loads
+type mockTemplateLoader struct {
+	lock  sync.Mutex
+	src   map[string]string
+	err   error
+	loads int32
+}
+
+func (m *mockTemplateLoader) load(site, locale string) (string, bool, error) {
+	atomic.AddInt32(&m.loads, 1)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.err != nil {
+		return "", false, m.err
+	}
+	src, ok := m.src[site+":"+locale]
+	return src, ok, nil
+}
+
+func (m *mockTemplateLoader) set(key, src string) {
+	m.lock.Lock()
+	m.src[key] = src
+	m.lock.Unlock()
+}
+
+func execTemplate(t *testing.T, tmpl *template.Template) string {
+	require.NotNil(t, tmpl)
+	buf := bytes.Buffer{}
+	require.NoError(t, tmpl.Execute(&buf, nil))
+	return buf.String()
+}
+
+func TestTemplateRegistry_Get(t *testing.T) {
+	m := &mockTemplateLoader{src: map[string]string{
+		"remark:de":   "remark de",
+		"remark:":     "remark default",
+		"remark:pt":   "remark pt",
+		":de":         "global de",
+		":fr-ca":      "global fr-ca",
+		":":           "global default",
+		"broken:":     "{{.Bad",
+		"other:pt-br": "other pt-br",
+	}}
+	tr := TemplateRegistry{Loader: m.load}
+
+	tbl := []struct {
+		site, locale string
+		res          string
+	}{
+		{"remark", "de", "remark de"},
+		{"remark", "de-at", "remark de"},
+		{"remark", "pt-br", "remark pt"},
+		{"remark", "es", "remark default"},
+		{"remark", "", "remark default"},
+		{"other", "de", "global de"},
+		{"other", "pt-br", "other pt-br"},
+		{"other", "fr-ca", "global fr-ca"},
+		{"other", "fr", "global default"},
+		{"", "de", "global de"},
+		{"", "", "global default"},
+	}
+	for _, tt := range tbl {
+		tmpl, err := tr.Get(tt.site, tt.locale)
+		require.NoError(t, err)
+		assert.Equal(t, tt.res, execTemplate(t, tmpl), "%s/%s", tt.site, tt.locale)
+	}
+
+	loads := atomic.LoadInt32(&m.loads)
+	for _, tt := range tbl {
+		_, err := tr.Get(tt.site, tt.locale)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, loads, atomic.LoadInt32(&m.loads), "found and missing templates cached")
+
+	_, err := tr.Get("broken", "de")
+	assert.Contains(t, err.Error(), `failed to parse template for site "broken", locale ""`)
+
+	tr = TemplateRegistry{Loader: func(site, locale string) (string, bool, error) { return "", false, nil }}
+	tmpl, err := tr.Get("remark", "de")
+	require.NoError(t, err)
+	assert.Nil(t, tmpl, "nothing found")
+}
+
+func TestTemplateRegistry_Reload(t *testing.T) {
+	m := &mockTemplateLoader{src: map[string]string{":": "v1"}}
+	tr := TemplateRegistry{Loader: m.load, Funcs: template.FuncMap{"upper": strings.ToUpper}}
+
+	tmpl, err := tr.Get("remark", "en")
+	require.NoError(t, err)
+	assert.Equal(t, "v1", execTemplate(t, tmpl))
+
+	m.set("remark:en", `{{upper "v2"}}`)
+	tmpl, err = tr.Get("remark", "en")
+	require.NoError(t, err)
+	assert.Equal(t, "v1", execTemplate(t, tmpl), "cached till reload")
+
+	tr.Reload()
+	tmpl, err = tr.Get("remark", "en")
+	require.NoError(t, err)
+	assert.Equal(t, "V2", execTemplate(t, tmpl))
+
+	tr.Set("remark", "en", template.Must(template.New("set").Parse("v3")))
+	tmpl, err = tr.Get("remark", "en")
+	require.NoError(t, err)
+	assert.Equal(t, "v3", execTemplate(t, tmpl))
+
+	// errors not cached
+	m.err = errors.New("storage error")
+	tr.Reload()
+	_, err = tr.Get("remark", "en")
+	assert.EqualError(t, err, `failed to load template for site "remark", locale "en": storage error`)
+	m.err = nil
+	tmpl, err = tr.Get("remark", "en")
+	require.NoError(t, err)
+	assert.Equal(t, "V2", execTemplate(t, tmpl))
+}
+
+func TestTemplateRegistry_Preload(t *testing.T) {
+	m := &mockTemplateLoader{src: map[string]string{":": "default", "remark:en": "remark en"}}
+	tr := TemplateRegistry{Loader: m.load}
+	require.NoError(t, tr.Preload([]string{"remark"}, []string{"en"}))
+	assert.Equal(t, int32(4), atomic.LoadInt32(&m.loads))
+	_, err := tr.Get("remark", "en")
+	require.NoError(t, err)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&m.loads), "preloaded")
+
+	m.set("remark:de", "{{end}}")
+	assert.Error(t, tr.Preload([]string{"remark"}, []string{"de"}))
+}
+
+func TestTemplateRegistry_MissesLimit(t *testing.T) {
+	m := &mockTemplateLoader{src: map[string]string{":": "default"}}
+	tr := TemplateRegistry{Loader: m.load}
+	for i := 0; i < maxCachedTemplateMisses+100; i++ {
+		_, err := tr.Get(fmt.Sprintf("site%d", i), "")
+		require.NoError(t, err)
+	}
+	tr.lock.Lock()
+	assert.Equal(t, maxCachedTemplateMisses+1, len(tr.templates))
+	tr.lock.Unlock()
+}
+
+func TestTemplateRegistry_Race(t *testing.T) {
+	m := &mockTemplateLoader{src: map[string]string{":": "default", "remark:en": "remark en", ":de": "de"}}
+	tr := &TemplateRegistry{Loader: m.load}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				switch {
+				case i == 0 && j%20 == 0:
+					tr.Reload()
+				case i == 1 && j%20 == 0:
+					m.set("remark:en", fmt.Sprintf("remark en %d", j))
+				case i == 2 && j%50 == 0:
+					tr.Set("other", "de", template.Must(template.New("x").Parse("other de")))
+				default:
+					tmpl, err := tr.Get([]string{"remark", "other", ""}[j%3], []string{"en", "de", "fr"}[i%3])
+					assert.NoError(t, err)
+					assert.NotNil(t, tmpl)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestVerifyHandler_Templates(t *testing.T) {
+	m := &mockTemplateLoader{src: map[string]string{
+		":":          "{{.User}} default",
+		":de":        "{{.User}} de",
+		"remark:":    "{{.User}} remark",
+		"remark:de":  "{{.User}} remark de",
+		"broken:":    "{{.Unknown}}",
+		"private:fr": "{{.User}} private fr",
+	}}
+	emailer := mockSender{}
+	e := VerifyHandler{
+		ProviderName: "test",
+		TokenService: token.NewService(token.Opts{
+			SecretReader:   token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+			TokenDuration:  time.Hour,
+			CookieDuration: time.Hour * 24 * 31,
+		}),
+		Issuer:    "iss-test",
+		L:         logger.NoOp{},
+		Sender:    SenderFunc(emailer.Send),
+		Templates: &TemplateRegistry{Loader: m.load},
+	}
+
+	tbl := []struct {
+		query, lang string
+		code        int
+		text        string
+	}{
+		{"site=remark&locale=de", "", http.StatusOK, "user1 remark de"},
+		{"site=remark&locale=de_AT", "fr", http.StatusOK, "user1 remark de"},
+		{"site=remark", "de-CH,de;q=0.9,en;q=0.8", http.StatusOK, "user1 remark de"},
+		{"site=remark", "en-US,en;q=0.9", http.StatusOK, "user1 remark"},
+		{"site=other", "de", http.StatusOK, "user1 de"},
+		{"site=other&locale=<de>", "", http.StatusOK, "user1 default"},
+		{"site=private", "fr", http.StatusOK, "user1 private fr"},
+		{"site=broken", "", http.StatusInternalServerError, ""},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.query+" "+tt.lang, func(t *testing.T) {
+			emailer.text = ""
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/login?address=blah@user.com&user=user1&"+tt.query, http.NoBody)
+			if tt.lang != "" {
+				req.Header.Set("Accept-Language", tt.lang)
+			}
+			e.LoginHandler(rr, req)
+			require.Equal(t, tt.code, rr.Code, rr.Body.String())
+			assert.Equal(t, tt.text, emailer.text)
+		})
+	}
+
+	// falls back to Template if registry has none
+	delete(m.src, ":")
+	e.Templates.Reload()
+	e.Template = template.Must(template.New("confirm").Parse("{{.User}} fallback"))
+	rr := httptest.NewRecorder()
+	e.LoginHandler(rr, httptest.NewRequest("GET", "/login?address=blah@user.com&user=user1&site=other", http.NoBody))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, "user1 fallback", emailer.text)
+
+	e.Template = nil
+	rr = httptest.NewRecorder()
+	e.LoginHandler(rr, httptest.NewRequest("GET", "/login?address=blah@user.com&user=user1&site=other", http.NoBody))
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	assert.Equal(t, `{"error":"can't get confirmation template"}`+"\n", rr.Body.String())
+}
+
+func TestVerifyHandler_TemplateData(t *testing.T) {
+	emailer := mockSender{}
+	e := VerifyHandler{
+		ProviderName: "email",
+		TokenService: token.NewService(token.Opts{
+			SecretReader:   token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+			TokenDuration:  time.Hour,
+			CookieDuration: time.Hour * 24 * 31,
+		}),
+		L:      logger.NoOp{},
+		Sender: SenderFunc(emailer.Send),
+		Template: template.Must(template.New("confirm").Funcs(template.FuncMap{"upper": strings.ToUpper}).
+			Parse("{{upper .User}}, confirm with {{.ConfirmURL}} | {{.Company}} {{.Locale}}")),
+		TemplateData: func(r *http.Request, base ConfirmData) interface{} {
+			return struct {
+				ConfirmData
+				ConfirmURL string
+				Company    string
+			}{
+				ConfirmData: base,
+				ConfirmURL:  "https://" + r.Host + "/auth/email/login?token=" + base.Token,
+				Company:     "Acme Corp",
+			}
+		},
+	}
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/login?address=blah@user.com&user=user1&locale=de", http.NoBody)
+	req.Host = "auth.example.com"
+	e.LoginHandler(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	prefix, suffix := "USER1, confirm with https://auth.example.com/auth/email/login?token=", " | Acme Corp de"
+	require.True(t, strings.HasPrefix(emailer.text, prefix), emailer.text)
+	require.True(t, strings.HasSuffix(emailer.text, suffix), emailer.text)
+	tkn := strings.TrimSuffix(strings.TrimPrefix(emailer.text, prefix), suffix)
+	_, u, err := e.Verify(tkn)
+	require.NoError(t, err)
+	assert.Equal(t, "user1", u.Name)
+
+	// base data without the hook
+	e.TemplateData = nil
+	e.Template = template.Must(template.New("confirm").Parse("{{.User}} {{.Address}} {{.Locale}} {{.Site}}"))
+	rr = httptest.NewRecorder()
+	e.LoginHandler(rr, httptest.NewRequest("GET", "/login?address=blah@user.com&user=user1&site=remark", http.NoBody))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, "user1 blah@user.com  remark", emailer.text)
+}
@@ -0,0 +1,84 @@
+package provider
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// UsedTokenStore keeps confirmation tokens consumed by VerifyHandler, so each one redeemed once.
+// Store is responsible for removal of keys expired in ttl, i.e. SET with EX and EXISTS of redis.
+type UsedTokenStore interface {
+	Set(key string, ttl time.Duration) error
+	Exists(key string) (bool, error)
+}
+
+// TokenUsed is the code of confirmation token rejected with 403 as already used, with UsedTokens only
+const TokenUsed = "token_used"
+
+// usedTokenGrace extends ttl of used token mark past the token's expiration, covers clock skew tolerance of token service
+const usedTokenGrace = 5 * time.Minute
+
+// errTokenUsed returned by useToken for confirmation token consumed before
+var errTokenUsed = errors.New("confirmation token used")
+
+// useToken marks confirmation token consumed in UsedTokens until it expires, returns errTokenUsed if it was
+// consumed before. Check and mark are separate calls, so concurrent uses of the same token may pass both.
+func (e VerifyHandler) useToken(tkn string, expiresAt int64) error {
+	key := e.usedTokenKey(tkn)
+	used, err := e.UsedTokens.Exists(key)
+	if err != nil {
+		return fmt.Errorf("can't check used token: %w", err)
+	}
+	if used {
+		return errTokenUsed
+	}
+	ttl := usedTokenGrace
+	if expiresAt > 0 {
+		ttl += time.Until(time.Unix(expiresAt, 0))
+	}
+	if err = e.UsedTokens.Set(key, ttl); err != nil {
+		return fmt.Errorf("can't mark used token: %w", err)
+	}
+	return nil
+}
+
+// usedTokenKey makes key of the token by its hash namespaced by provider name, keeps tokens out of the store
+func (e VerifyHandler) usedTokenKey(tkn string) string {
+	return fmt.Sprintf("%s:%x", e.ProviderName, sha256.Sum256([]byte(tkn)))
+}
+
+// MemUsedTokenStore implements UsedTokenStore with in-memory map. Expired keys removed on Set.
+type MemUsedTokenStore struct {
+	lock sync.Mutex
+	keys map[string]time.Time
+}
+
+// NewMemUsedTokenStore makes in-memory used tokens store
+func NewMemUsedTokenStore() *MemUsedTokenStore {
+	return &MemUsedTokenStore{keys: map[string]time.Time{}}
+}
+
+// Set marks the key for ttl
+func (m *MemUsedTokenStore) Set(key string, ttl time.Duration) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := time.Now()
+	for k, expires := range m.keys {
+		if now.After(expires) {
+			delete(m.keys, k)
+		}
+	}
+	m.keys[key] = now.Add(ttl)
+	return nil
+}
+
+// Exists checks the key marked and not expired
+func (m *MemUsedTokenStore) Exists(key string) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	expires, ok := m.keys[key]
+	return ok && !time.Now().After(expires), nil
+}
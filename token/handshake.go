@@ -0,0 +1,41 @@
+package token
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// handshakeIDMarker prefixes handshake ID with base64 encoded user and address
+const handshakeIDMarker = "b64:"
+
+// HandshakeID makes ID of confirmation handshake from user and address. Plain "user::address" used if it
+// splits back to the same values, so tokens stay readable by older versions. Otherwise, i.e. with "::" in user
+// or address, each one base64 encoded after handshakeIDMarker.
+func HandshakeID(user, address string) string {
+	id := user + "::" + address
+	if u, a, err := ParseHandshakeID(id); err == nil && u == user && a == address {
+		return id
+	}
+	enc := base64.RawURLEncoding
+	return handshakeIDMarker + enc.EncodeToString([]byte(user)) + ":" + enc.EncodeToString([]byte(address))
+}
+
+// ParseHandshakeID returns user and address of handshake ID made by HandshakeID, or of legacy "user::address"
+func ParseHandshakeID(id string) (user, address string, err error) {
+	if strings.HasPrefix(id, handshakeIDMarker) {
+		if elems := strings.Split(strings.TrimPrefix(id, handshakeIDMarker), ":"); len(elems) == 2 {
+			u, errU := base64.RawURLEncoding.DecodeString(elems[0])
+			a, errA := base64.RawURLEncoding.DecodeString(elems[1])
+			if errU == nil && errA == nil {
+				return string(u), string(a), nil
+			}
+		}
+		// not encoded, legacy id of user starting with the marker
+	}
+	elems := strings.Split(id, "::")
+	if len(elems) != 2 {
+		return "", "", errors.New("invalid handshake id")
+	}
+	return elems[0], elems[1], nil
+}
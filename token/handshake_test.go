@@ -0,0 +1,44 @@
+package token
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandshakeID(t *testing.T) {
+	tbl := []struct {
+		user, address, id string
+	}{
+		{"test123", "blah@user.com", "test123::blah@user.com"},
+		{"a:b", "c:d@user.com", "a:b::c:d@user.com"},
+		{"a::b::c", "blah@user.com", "b64:YTo6Yjo6Yw:YmxhaEB1c2VyLmNvbQ"},
+		{"test123", `"a::b"@user.com`, "b64:dGVzdDEyMw:ImE6OmIiQHVzZXIuY29t"},
+		{"user:", "blah@user.com", "b64:dXNlcjo:YmxhaEB1c2VyLmNvbQ"},
+		{"test123", ":blah@user.com", "test123:::blah@user.com"},
+		{"b64:YQ:Yg", "x", "b64:YQ:Yg::x"},
+		{"", "", "::"},
+	}
+	for _, tt := range tbl {
+		id := HandshakeID(tt.user, tt.address)
+		assert.Equal(t, tt.id, id)
+		user, address, err := ParseHandshakeID(id)
+		require.NoError(t, err, id)
+		assert.Equal(t, tt.user, user, id)
+		assert.Equal(t, tt.address, address, id)
+	}
+}
+
+func TestParseHandshakeID(t *testing.T) {
+	// legacy ids, including user starting with the marker
+	user, address, err := ParseHandshakeID("b64:abc::blah@user.com")
+	require.NoError(t, err)
+	assert.Equal(t, "b64:abc", user)
+	assert.Equal(t, "blah@user.com", address)
+
+	for _, id := range []string{"", "blah@user.com", "a::b::c", "b64:!!:YQ", "b64:YQ"} {
+		_, _, err = ParseHandshakeID(id)
+		assert.Error(t, err, id)
+	}
+}
@@ -0,0 +1,80 @@
+package token
+
+import (
+	"sync"
+	"time"
+)
+
+// UserInvalidator keeps per-user invalidation time. Validate rejects user's tokens issued before it,
+// i.e. all sessions of the user made before password change.
+// Relies on IssuedAt claim, tokens made with DisableIAT can't be invalidated this way.
+type UserInvalidator interface {
+	Validator
+	InvalidateUser(userID string) error // invalidate all tokens of the user issued before now
+}
+
+// MemUserInvalidator implements UserInvalidator with in-memory map
+type MemUserInvalidator struct {
+	lock sync.RWMutex
+	data map[string]int64 // user id -> invalidation time, unix seconds
+}
+
+// NewMemUserInvalidator makes in-memory user invalidator
+func NewMemUserInvalidator() *MemUserInvalidator {
+	return &MemUserInvalidator{data: map[string]int64{}}
+}
+
+// InvalidateUser sets invalidation time of the user to now
+func (m *MemUserInvalidator) InvalidateUser(userID string) error {
+	m.lock.Lock()
+	m.data[userID] = time.Now().Unix()
+	m.lock.Unlock()
+	return nil
+}
+
+// Validate rejects token if it was issued before user's invalidation time.
+// Token issued in the same second as invalidation is accepted, it can be the one made right after the invalidation.
+func (m *MemUserInvalidator) Validate(_ string, claims Claims) bool {
+	if claims.User == nil || claims.IssuedAt == 0 {
+		return true
+	}
+	m.lock.RLock()
+	ts, ok := m.data[claims.User.ID]
+	m.lock.RUnlock()
+	return !ok || claims.IssuedAt >= ts
+}
+
+// AudienceInvalidator keeps per-audience invalidation time, i.e. for offboarding of the site. Validate rejects
+// tokens of the audience issued before it, and tokens without IssuedAt if the audience invalidated.
+type AudienceInvalidator interface {
+	Validator
+	InvalidateAudience(aud string) error // invalidate all tokens of the audience issued before now
+}
+
+// MemAudienceInvalidator implements AudienceInvalidator with in-memory map
+type MemAudienceInvalidator struct {
+	lock sync.RWMutex
+	data map[string]int64 // audience -> invalidation time, unix seconds
+}
+
+// NewMemAudienceInvalidator makes in-memory audience invalidator
+func NewMemAudienceInvalidator() *MemAudienceInvalidator {
+	return &MemAudienceInvalidator{data: map[string]int64{}}
+}
+
+// InvalidateAudience sets invalidation time of the audience to now
+func (m *MemAudienceInvalidator) InvalidateAudience(aud string) error {
+	m.lock.Lock()
+	m.data[aud] = time.Now().Unix()
+	m.lock.Unlock()
+	return nil
+}
+
+// Validate rejects token if it was issued before audience's invalidation time or has no IssuedAt.
+// Token issued in the same second as invalidation is accepted.
+func (m *MemAudienceInvalidator) Validate(_ string, claims Claims) bool {
+	m.lock.RLock()
+	ts, ok := m.data[claims.Audience]
+	m.lock.RUnlock()
+	return !ok || (claims.IssuedAt != 0 && claims.IssuedAt >= ts)
+}
@@ -0,0 +1,41 @@
+package token
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemUserInvalidator(t *testing.T) {
+	inv := NewMemUserInvalidator()
+	old := Claims{User: &User{ID: "user1"}, StandardClaims: jwt.StandardClaims{IssuedAt: time.Now().Add(-time.Hour).Unix()}}
+	other := Claims{User: &User{ID: "user2"}, StandardClaims: jwt.StandardClaims{IssuedAt: time.Now().Add(-time.Hour).Unix()}}
+	assert.True(t, inv.Validate("", old))
+
+	require.NoError(t, inv.InvalidateUser("user1"))
+	assert.False(t, inv.Validate("", old), "issued before invalidation")
+	assert.True(t, inv.Validate("", other), "other user not affected")
+
+	fresh := Claims{User: &User{ID: "user1"}, StandardClaims: jwt.StandardClaims{IssuedAt: time.Now().Unix()}}
+	assert.True(t, inv.Validate("", fresh), "issued after invalidation")
+}
+
+func TestMemAudienceInvalidator(t *testing.T) {
+	inv := NewMemAudienceInvalidator()
+	old := Claims{StandardClaims: jwt.StandardClaims{Audience: "site1", IssuedAt: time.Now().Add(-time.Hour).Unix()}}
+	other := Claims{StandardClaims: jwt.StandardClaims{Audience: "site2", IssuedAt: time.Now().Add(-time.Hour).Unix()}}
+	noIAT := Claims{StandardClaims: jwt.StandardClaims{Audience: "site1"}}
+	assert.True(t, inv.Validate("", old))
+	assert.True(t, inv.Validate("", noIAT), "no iat accepted if audience not invalidated")
+
+	require.NoError(t, inv.InvalidateAudience("site1"))
+	assert.False(t, inv.Validate("", old), "issued before invalidation")
+	assert.False(t, inv.Validate("", noIAT), "no iat rejected for invalidated audience")
+	assert.True(t, inv.Validate("", other), "other audience not affected")
+
+	fresh := Claims{StandardClaims: jwt.StandardClaims{Audience: "site1", IssuedAt: time.Now().Unix()}}
+	assert.True(t, inv.Validate("", fresh), "issued after invalidation")
+}
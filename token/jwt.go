@@ -2,10 +2,16 @@
 package token
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt"
@@ -15,6 +21,7 @@ import (
 // supports both header and cookie tokens
 type Service struct {
 	Opts
+	secrets *secretCache // secrets by aud with SecretTTL
 }
 
 // Claims stores user info for token and state & from from login
@@ -24,13 +31,85 @@ type Claims struct {
 	SessionOnly bool       `json:"sess_only,omitempty"`
 	Handshake   *Handshake `json:"handshake,omitempty"` // used for oauth handshake
 	NoAva       bool       `json:"no-ava,omitempty"`    // disable avatar, always use identicon
+	Provider    string     `json:"provider,omitempty"`  // name of the provider user logged in with
+
+	// Extra keeps custom top-level claims, set by Opts.ExtraClaims and restored by Parse.
+	// Values of parsed claims are decoded from json, i.e. numbers are float64.
+	Extra map[string]interface{} `json:"-"`
+}
+
+// reservedClaims can't be set with Extra, registered ones of RFC 7519 and ones of Claims
+var reservedClaims = map[string]bool{"iss": true, "sub": true, "aud": true, "exp": true, "nbf": true, "iat": true,
+	"jti": true, "user": true, "sess_only": true, "handshake": true, "no-ava": true, "provider": true}
+
+// claimsJSON is Claims without methods, to marshal it with default encoding
+type claimsJSON Claims
+
+// MarshalJSON encodes claims with Extra merged as top-level ones, reserved names skipped
+func (c Claims) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal(claimsJSON(c))
+	if err != nil || len(c.Extra) == 0 {
+		return b, err
+	}
+	res := map[string]interface{}{}
+	if err = json.Unmarshal(b, &res); err != nil {
+		return nil, err
+	}
+	for k, v := range c.Extra {
+		if !reservedClaims[k] {
+			res[k] = v
+		}
+	}
+	return json.Marshal(res)
+}
+
+// UnmarshalJSON decodes claims, unknown top-level ones kept in Extra
+func (c *Claims) UnmarshalJSON(b []byte) error {
+	var res claimsJSON
+	if err := json.Unmarshal(b, &res); err != nil {
+		return err
+	}
+	all := map[string]json.RawMessage{} // values decoded for extra claims only, not for user and others
+	if err := json.Unmarshal(b, &all); err != nil {
+		return err
+	}
+	for k, raw := range all {
+		if reservedClaims[k] {
+			continue
+		}
+		var v interface{}
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return err
+		}
+		if res.Extra == nil {
+			res.Extra = map[string]interface{}{}
+		}
+		res.Extra[k] = v
+	}
+	*c = Claims(res)
+	return nil
 }
 
 // Handshake used for oauth handshake
 type Handshake struct {
-	State string `json:"state,omitempty"`
-	From  string `json:"from,omitempty"`
-	ID    string `json:"id,omitempty"`
+	State string                 `json:"state,omitempty"`
+	From  string                 `json:"from,omitempty"`
+	ID    string                 `json:"id,omitempty"`
+	Nonce string                 `json:"nonce,omitempty"` // hash of the nonce binding the handshake to the browser
+	CID   string                 `json:"cid,omitempty"`   // opaque correlation id linking the handshake to its redemption
+	Attrs map[string]interface{} `json:"attrs,omitempty"` // attributes of confirmation request, copied to the user
+
+	Pending []PendingLogin `json:"pending,omitempty"` // login flows in progress in the same browser
+}
+
+// PendingLogin is oauth login flow in progress, kept to complete it after another one started in the same browser
+type PendingLogin struct {
+	State       string `json:"state"`
+	From        string `json:"from,omitempty"`
+	Audience    string `json:"aud,omitempty"`
+	SessionOnly bool   `json:"sess_only,omitempty"`
+	NoAva       bool   `json:"no-ava,omitempty"`
+	ExpiresAt   int64  `json:"exp"`
 }
 
 const (
@@ -47,8 +126,13 @@ const (
 	defaultCookieDuration = time.Hour * 24 * 31
 
 	defaultTokenQuery = "token"
+
+	defaultXSRFGrace = time.Minute
 )
 
+// defaultAllowedAlgs is the list of accepted signing algorithms, tokens made by Service signed with HS256
+var defaultAllowedAlgs = []string{jwt.SigningMethodHS256.Alg()}
+
 // Opts holds constructor params
 type Opts struct {
 	SecretReader   Secret
@@ -56,6 +140,7 @@ type Opts struct {
 	SecureCookies  bool
 	TokenDuration  time.Duration
 	CookieDuration time.Duration
+	PersistentTTL  time.Duration // lifetime (Max-Age) of persistent, non-session, cookies. Overrides CookieDuration if set
 	DisableXSRF    bool
 	DisableIAT     bool // disable IssuedAt claim
 	// optional (custom) names for cookies and headers
@@ -67,9 +152,31 @@ type Opts struct {
 	JWTQuery        string
 	AudienceReader  Audience      // allowed aud values
 	Issuer          string        // optional value for iss claim, usually application name
+	AllowedIssuers  []string      // iss values accepted by Parse besides Issuer, i.e. per-brand ones, no check if empty
 	AudSecrets      bool          // uses different secret for differed auds. important: adds pre-parsing of unverified token
 	SendJWTHeader   bool          // if enabled send JWT as a header instead of cookie
+	TokenHeader     string        // response header with token of the user, in addition to cookie, i.e. "X-Auth-Token"
 	SameSite        http.SameSite // define a cookie attribute making it impossible for the browser to send this cookie cross-site
+	AllowedAlgs     []string      // signing algorithms accepted by Parse, default is HS256 only. Only HMAC algorithms supported
+	Leeway          time.Duration // tolerance of clock skew between nodes checking expiration, i.e. 30s, default 0
+
+	AudienceInvalidator AudienceInvalidator // optional per-audience invalidation, checked by Parse
+
+	// ExtraClaims returns custom top-level claims added to the token by Token, i.e. tenant id or plan, so other
+	// consumers of the token read them without knowing the user's schema. Merged over Claims.Extra, names
+	// of registered and our own claims, like exp, aud or user, can't be overridden and skipped.
+	ExtraClaims func(claims Claims) map[string]interface{}
+
+	// RotateXSRF makes xsrf value HMAC of token's jti and expiration instead of jti itself, so it is bound
+	// to the session and rotated each time the token re-issued, on login and refresh.
+	RotateXSRF bool
+	XSRFGrace  time.Duration // previous xsrf value accepted for it after rotation with RotateXSRF, default 1m
+
+	// SecretTTL memoizes secrets returned by SecretReader per aud for it, so Parse doesn't call the reader
+	// for each token. Token signed with a secret other than cached one makes Parse re-read the secret, so
+	// rotated secret picked at once, at most once per 10s per aud; ResetSecrets drops cached ones,
+	// i.e. after revoking the old secret.
+	SecretTTL time.Duration
 }
 
 // NewService makes JWT service
@@ -98,6 +205,10 @@ func NewService(opts Opts) *Service {
 		res.CookieDuration = defaultCookieDuration
 	}
 
+	if opts.SecretTTL > 0 {
+		res.secrets = newSecretCache(opts.SecretTTL)
+	}
+
 	return &res
 }
 
@@ -111,6 +222,17 @@ func (j *Service) Token(claims Claims) (string, error) {
 		claims = j.ClaimsUpd.Update(claims)
 	}
 
+	if j.ExtraClaims != nil {
+		extra := make(map[string]interface{}, len(claims.Extra))
+		for k, v := range claims.Extra {
+			extra[k] = v
+		}
+		for k, v := range j.ExtraClaims(claims) {
+			extra[k] = v
+		}
+		claims.Extra = extra
+	}
+
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 
 	if j.SecretReader == nil {
@@ -133,9 +255,11 @@ func (j *Service) Token(claims Claims) (string, error) {
 	return tokenString, nil
 }
 
-// Parse token string and verify. Not checking for expiration
+// Parse token string and verify. Not checking for expiration.
+// Tokens signed with algorithms not in AllowedAlgs, including "none", rejected.
 func (j *Service) Parse(tokenString string) (Claims, error) {
-	parser := jwt.Parser{SkipClaimsValidation: true} // allow parsing of expired tokens
+	// allow parsing of expired tokens, pin algorithms to prevent alg confusion
+	parser := jwt.Parser{SkipClaimsValidation: true, ValidMethods: j.allowedAlgs()}
 
 	if j.SecretReader == nil {
 		return Claims{}, fmt.Errorf("secret reader not defined")
@@ -150,17 +274,26 @@ func (j *Service) Parse(tokenString string) (Claims, error) {
 		}
 	}
 
-	secret, err := j.SecretReader.Get(aud)
+	secret, cached, err := j.secret(aud)
 	if err != nil {
 		return Claims{}, fmt.Errorf("can't get secret: %w", err)
 	}
 
-	token, err := parser.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+	keyFunc := func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok { // secret is symmetric, never accept none or RS/ES
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
 		return []byte(secret), nil
-	})
+	}
+	token, err := parser.ParseWithClaims(tokenString, &Claims{}, keyFunc)
+	if cached && isSignatureErr(err) && j.secrets.allowRefresh(aud) { // secret may be rotated after it was cached
+		fresh, ferr := j.SecretReader.Get(aud)
+		if ferr == nil && fresh != secret {
+			j.secrets.set(aud, fresh)
+			secret = fresh
+			token, err = parser.ParseWithClaims(tokenString, &Claims{}, keyFunc)
+		}
+	}
 	if err != nil {
 		return Claims{}, fmt.Errorf("can't parse token: %w", err)
 	}
@@ -173,20 +306,94 @@ func (j *Service) Parse(tokenString string) (Claims, error) {
 	if err = j.checkAuds(claims, j.AudienceReader); err != nil {
 		return Claims{}, fmt.Errorf("aud rejected: %w", err)
 	}
+	if j.AudienceInvalidator != nil && !j.AudienceInvalidator.Validate(tokenString, *claims) {
+		return Claims{}, fmt.Errorf("aud %q invalidated", claims.Audience)
+	}
+	if err = j.checkIssuer(claims.Issuer); err != nil {
+		return Claims{}, err
+	}
 	return *claims, j.validate(claims)
 }
 
+// secret returns secret of aud, cached one with SecretTTL, cached is true if the reader not called
+func (j *Service) secret(aud string) (secret string, cached bool, err error) {
+	if j.secrets != nil {
+		if secret, ok := j.secrets.get(aud); ok {
+			return secret, true, nil
+		}
+	}
+	if secret, err = j.SecretReader.Get(aud); err != nil {
+		return "", false, err
+	}
+	if j.secrets != nil {
+		j.secrets.set(aud, secret)
+	}
+	return secret, false, nil
+}
+
+// ResetSecrets drops secrets of auds cached with SecretTTL, all of them if no auds passed, so the next Parse
+// reads them from SecretReader. Tokens signed with the old secret rejected after it, if the reader doesn't return it.
+func (j *Service) ResetSecrets(auds ...string) {
+	if j.secrets != nil {
+		j.secrets.reset(auds...)
+	}
+}
+
+func isSignatureErr(err error) bool {
+	var verr *jwt.ValidationError
+	return errors.As(err, &verr) && verr.Errors&jwt.ValidationErrorSignatureInvalid != 0
+}
+
+// checkIssuer rejects iss other than Issuer and AllowedIssuers, if any allowed. Tokens without iss accepted.
+func (j *Service) checkIssuer(iss string) error {
+	if len(j.AllowedIssuers) == 0 || iss == "" || iss == j.Issuer {
+		return nil
+	}
+	for _, a := range j.AllowedIssuers {
+		if a == iss {
+			return nil
+		}
+	}
+	return fmt.Errorf("issuer %q rejected", iss)
+}
+
+// allowedAlgs returns accepted signing algorithms, "none" is never accepted
+func (j *Service) allowedAlgs() []string {
+	if len(j.AllowedAlgs) == 0 {
+		return defaultAllowedAlgs
+	}
+	res := make([]string, 0, len(j.AllowedAlgs))
+	for _, alg := range j.AllowedAlgs {
+		if !strings.EqualFold(alg, "none") {
+			res = append(res, alg)
+		}
+	}
+	return res
+}
+
 // aud pre-parse token and extracts aud from the claim
 // important! this step ignores token verification, should not be used for any validations
 func (j *Service) aud(tokenString string) (string, error) {
-	parser := jwt.Parser{}
-	token, _, err := parser.ParseUnverified(tokenString, &Claims{})
+	parts := strings.Split(tokenString, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("can't pre-parse token: token contains an invalid number of segments")
+	}
+	// decode payload only, header and signature checked by the parser later
+	payload := strings.TrimRight(parts[1], "=")
+	buf := audBufPool.Get().(*[]byte)
+	defer audBufPool.Put(buf)
+	if n := base64.RawURLEncoding.DecodedLen(len(payload)); cap(*buf) < n {
+		*buf = make([]byte, n)
+	}
+	n, err := base64.RawURLEncoding.Decode((*buf)[:cap(*buf)], []byte(payload))
 	if err != nil {
 		return "", fmt.Errorf("can't pre-parse token: %w", err)
 	}
-	claims, ok := token.Claims.(*Claims)
-	if !ok {
-		return "", fmt.Errorf("invalid token")
+	var claims struct {
+		Audience string `json:"aud"`
+	}
+	if err = json.Unmarshal((*buf)[:n], &claims); err != nil {
+		return "", fmt.Errorf("can't pre-parse token: %w", err)
 	}
 	if strings.TrimSpace(claims.Audience) == "" {
 		return "", fmt.Errorf("empty aud")
@@ -194,6 +401,9 @@ func (j *Service) aud(tokenString string) (string, error) {
 	return claims.Audience, nil
 }
 
+// audBufPool keeps buffers of decoded payloads pre-parsed by aud
+var audBufPool = sync.Pool{New: func() interface{} { b := make([]byte, 0, 1024); return &b }}
+
 func (j *Service) validate(claims *Claims) error {
 	cerr := claims.Valid()
 
@@ -231,28 +441,48 @@ func (j *Service) Set(w http.ResponseWriter, claims Claims) (Claims, error) {
 		return Claims{}, fmt.Errorf("failed to make token token: %w", err)
 	}
 
+	xsrf := claims.Id
+	if j.RotateXSRF {
+		if xsrf, err = j.xsrfMAC(claims, claims.ExpiresAt); err != nil {
+			return Claims{}, fmt.Errorf("failed to make xsrf token: %w", err)
+		}
+	}
+
+	if j.TokenHeader != "" && claims.Handshake == nil {
+		w.Header().Set(j.TokenHeader, tokenString)
+	}
+
 	if j.SendJWTHeader {
 		w.Header().Set(j.JWTHeaderKey, tokenString)
-		w.Header().Set(j.XSRFHeaderKey, claims.Id)
+		w.Header().Set(j.XSRFHeaderKey, xsrf)
 		return claims, nil
 	}
 
 	cookieExpiration := 0 // session cookie
 	if !claims.SessionOnly && claims.Handshake == nil {
-		cookieExpiration = int(j.CookieDuration.Seconds())
+		cookieExpiration = int(j.persistentTTL().Seconds())
 	}
 
 	jwtCookie := http.Cookie{Name: j.JWTCookieName, Value: tokenString, HttpOnly: true, Path: "/", Domain: j.JWTCookieDomain,
 		MaxAge: cookieExpiration, Secure: j.SecureCookies, SameSite: j.SameSite}
 	http.SetCookie(w, &jwtCookie)
 
-	xsrfCookie := http.Cookie{Name: j.XSRFCookieName, Value: claims.Id, HttpOnly: false, Path: "/", Domain: j.JWTCookieDomain,
+	xsrfCookie := http.Cookie{Name: j.XSRFCookieName, Value: xsrf, HttpOnly: false, Path: "/", Domain: j.JWTCookieDomain,
 		MaxAge: cookieExpiration, Secure: j.SecureCookies, SameSite: j.SameSite}
 	http.SetCookie(w, &xsrfCookie)
 
 	return claims, nil
 }
 
+// persistentTTL returns lifetime of persistent cookies.
+// It is independent of token's ExpiresAt, expired token in a live cookie refreshed by middleware.
+func (j *Service) persistentTTL() time.Duration {
+	if j.PersistentTTL > 0 {
+		return j.PersistentTTL
+	}
+	return j.CookieDuration
+}
+
 // Get token from url, header or cookie
 // if cookie used, verify xsrf token to match
 func (j *Service) Get(r *http.Request) (Claims, string, error) {
@@ -315,22 +545,74 @@ func (j *Service) Get(r *http.Request) (Claims, string, error) {
 			xsrf = jc.Value
 		}
 
-		if claims.Id != xsrf {
-			return Claims{}, "", fmt.Errorf("xsrf mismatch")
+		if err := j.checkXSRF(claims, xsrf); err != nil {
+			return Claims{}, "", err
 		}
 	}
 
 	return claims, tokenString, nil
 }
 
-// IsExpired returns true if claims expired
+// checkXSRF verifies xsrf value matches the token. With RotateXSRF the value made for the previous token of the
+// same session is accepted for XSRFGrace after the current one issued, not to break requests sent during refresh.
+func (j *Service) checkXSRF(claims Claims, xsrf string) error {
+	if !j.RotateXSRF {
+		if claims.Id != xsrf {
+			return fmt.Errorf("xsrf mismatch")
+		}
+		return nil
+	}
+
+	elems := strings.SplitN(xsrf, ".", 2)
+	exp, err := strconv.ParseInt(elems[0], 10, 64)
+	if len(elems) != 2 || err != nil {
+		return fmt.Errorf("xsrf mismatch")
+	}
+	expected, err := j.xsrfMAC(claims, exp)
+	if err != nil {
+		return fmt.Errorf("can't check xsrf: %w", err)
+	}
+	if !hmac.Equal([]byte(expected), []byte(xsrf)) {
+		return fmt.Errorf("xsrf mismatch")
+	}
+	if exp == claims.ExpiresAt {
+		return nil
+	}
+
+	grace := j.XSRFGrace
+	if grace == 0 {
+		grace = defaultXSRFGrace
+	}
+	// issue time known only with iat claim, no grace without it
+	if exp < claims.ExpiresAt && claims.IssuedAt > 0 && time.Since(time.Unix(claims.IssuedAt, 0)) <= grace {
+		return nil
+	}
+	return fmt.Errorf("xsrf expired")
+}
+
+// xsrfMAC makes xsrf value as "exp.hmac" with hmac of jti and exp signed by the secret of token's audience
+func (j *Service) xsrfMAC(claims Claims, exp int64) (string, error) {
+	if j.SecretReader == nil {
+		return "", fmt.Errorf("secret reader not defined")
+	}
+	secret, err := j.SecretReader.Get(claims.Audience)
+	if err != nil {
+		return "", fmt.Errorf("can't get secret: %w", err)
+	}
+	expStr := strconv.FormatInt(exp, 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("xsrf:" + claims.Id + ":" + expStr))
+	return expStr + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// IsExpired returns true if claims expired, more than Leeway ago
 func (j *Service) IsExpired(claims Claims) bool {
-	return !claims.VerifyExpiresAt(time.Now().Unix(), true)
+	return !claims.VerifyExpiresAt(time.Now().Add(-j.Leeway).Unix(), true)
 }
 
 // Reset token's cookies
 func (j *Service) Reset(w http.ResponseWriter) {
-	jwtCookie := http.Cookie{Name: j.JWTCookieName, Value: "", HttpOnly: false, Path: "/", Domain: j.JWTCookieDomain,
+	jwtCookie := http.Cookie{Name: j.JWTCookieName, Value: "", HttpOnly: true, Path: "/", Domain: j.JWTCookieDomain,
 		MaxAge: -1, Expires: time.Unix(0, 0), Secure: j.SecureCookies, SameSite: j.SameSite}
 	http.SetCookie(w, &jwtCookie)
 
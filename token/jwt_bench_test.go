@@ -0,0 +1,93 @@
+package token
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/require"
+)
+
+// benchAudSecret derives secret per aud, as readers looking it up in a store would do some work per call
+var benchAudSecret = SecretFunc(func(aud string) (string, error) {
+	h := sha256.Sum256([]byte("master-secret:" + aud))
+	return hex.EncodeToString(h[:]), nil
+})
+
+// benchSecret derives the same secret for any aud
+var benchSecret = SecretFunc(func(string) (string, error) { return benchAudSecret("") })
+
+func benchToken(b *testing.B, j *Service) string {
+	return benchTokenExtra(b, j, nil)
+}
+
+// benchTokenExtra makes token with extra top-level claims, decoded by Claims.UnmarshalJSON in the second pass
+func benchTokenExtra(b *testing.B, j *Service, extra map[string]interface{}) string {
+	tkn, err := j.Token(Claims{
+		Extra: extra,
+		User: &User{ID: "github_1234567890", Name: "user name", Picture: "https://example.com/avatar/1234.image",
+			Attributes: map[string]interface{}{"admin": true, "plan": "pro"}},
+		StandardClaims: jwt.StandardClaims{Audience: "remark42", Id: "random-id", Issuer: "go-pkgz/auth",
+			ExpiresAt: time.Now().Add(time.Hour).Unix(), NotBefore: time.Now().Add(-time.Minute).Unix()},
+	})
+	require.NoError(b, err)
+	return tkn
+}
+
+func benchParse(b *testing.B, j *Service) {
+	benchParseToken(b, j, benchToken(b, j))
+}
+
+func benchParseToken(b *testing.B, j *Service, tkn string) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := j.Parse(tkn); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	benchParse(b, NewService(Opts{SecretReader: benchSecret}))
+}
+
+func BenchmarkParse_AudSecrets(b *testing.B) {
+	benchParse(b, NewService(Opts{SecretReader: benchAudSecret, AudSecrets: true}))
+}
+
+func BenchmarkParse_SecretTTL(b *testing.B) {
+	benchParse(b, NewService(Opts{SecretReader: benchSecret, SecretTTL: time.Minute}))
+}
+
+func BenchmarkParse_AudSecretsTTL(b *testing.B) {
+	benchParse(b, NewService(Opts{SecretReader: benchAudSecret, AudSecrets: true, SecretTTL: time.Minute}))
+}
+
+func BenchmarkParse_Extra(b *testing.B) {
+	j := NewService(Opts{SecretReader: benchSecret})
+	benchParseToken(b, j, benchTokenExtra(b, j, map[string]interface{}{"tenant": "acme", "roles": []string{"admin", "editor"},
+		"org": map[string]interface{}{"id": 42, "name": "acme inc"}}))
+}
+
+func BenchmarkClaimsUnmarshal(b *testing.B) {
+	data := []byte(`{"aud":"remark42","exp":1700000000,"jti":"random-id","iss":"go-pkgz/auth","nbf":1600000000,` +
+		`"user":{"name":"user name","id":"github_1234567890","picture":"https://example.com/avatar/1234.image",` +
+		`"attrs":{"admin":true,"plan":"pro"}}}`)
+	dataExtra := append(data[:len(data)-1:len(data)-1], []byte(`,"tenant":"acme","roles":["admin","editor"]}`)...)
+	for name, d := range map[string][]byte{"no extra": data, "extra": dataExtra} {
+		d := d
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var c Claims
+				if err := json.Unmarshal(d, &c); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
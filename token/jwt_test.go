@@ -1,10 +1,13 @@
 package token
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -145,6 +148,93 @@ func TestJWT_Parse(t *testing.T) {
 
 }
 
+func TestJWT_SetTokenHeader(t *testing.T) {
+	opts := Opts{SecretReader: SecretFunc(mockKeyStore), TokenDuration: time.Hour, CookieDuration: days31,
+		Issuer: "remark42", DisableIAT: true}
+	claims := testClaims
+	claims.Handshake = nil
+	tkn, err := NewService(opts).Token(claims)
+	require.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	_, err = NewService(opts).Set(rr, claims)
+	require.NoError(t, err)
+	assert.Equal(t, "", rr.Header().Get("X-Auth-Token"), "not sent by default")
+	for k := range rr.Header() {
+		assert.Equal(t, "Set-Cookie", k, "no headers but cookies")
+	}
+
+	opts.TokenHeader = "X-Auth-Token"
+	rr = httptest.NewRecorder()
+	_, err = NewService(opts).Set(rr, claims)
+	require.NoError(t, err)
+	assert.Equal(t, tkn, rr.Header().Get("X-Auth-Token"))
+	assert.Equal(t, 2, len(rr.Result().Cookies()), "cookies set too")
+
+	opts.SendJWTHeader = true
+	rr = httptest.NewRecorder()
+	_, err = NewService(opts).Set(rr, claims)
+	require.NoError(t, err)
+	assert.Equal(t, tkn, rr.Header().Get("X-Auth-Token"))
+	assert.Equal(t, tkn, rr.Header().Get("X-JWT"))
+	assert.Equal(t, 0, len(rr.Result().Cookies()))
+
+	rr = httptest.NewRecorder()
+	_, err = NewService(opts).Set(rr, testClaims)
+	require.NoError(t, err)
+	assert.Equal(t, "", rr.Header().Get("X-Auth-Token"), "not sent for handshake token")
+}
+
+func TestJWT_ExtraClaims(t *testing.T) {
+	opts := Opts{SecretReader: SecretFunc(mockKeyStore), TokenDuration: time.Hour, CookieDuration: days31,
+		Issuer: "remark42", DisableIAT: true,
+		ExtraClaims: func(claims Claims) map[string]interface{} {
+			return map[string]interface{}{"tenant": "t-" + claims.User.ID, "flags": 5, "plan": "pro",
+				"exp": 1, "aud": "other", "user": "hacked", "provider": "fake"}
+		},
+	}
+	claims := testClaims
+	claims.Handshake = nil
+	claims.Provider = "github"
+	tkn, err := NewService(opts).Token(claims)
+	require.NoError(t, err)
+
+	// third-party consumer reads extras as top-level claims
+	mc := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(tkn, mc, func(*jwt.Token) (interface{}, error) { return []byte("xyz 12345"), nil })
+	require.NoError(t, err)
+	assert.Equal(t, "t-id1", mc["tenant"])
+	assert.Equal(t, float64(5), mc["flags"])
+	assert.Equal(t, "pro", mc["plan"])
+	assert.Equal(t, float64(testClaims.ExpiresAt), mc["exp"], "reserved not overridden")
+	assert.Equal(t, "test_sys", mc["aud"], "reserved not overridden")
+	assert.Equal(t, "github", mc["provider"], "reserved not overridden")
+	assert.IsType(t, map[string]interface{}{}, mc["user"], "reserved not overridden")
+
+	parsed, err := NewService(opts).Parse(tkn)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"tenant": "t-id1", "flags": float64(5), "plan": "pro"}, parsed.Extra)
+	assert.Equal(t, "name1", parsed.User.Name)
+	assert.Equal(t, testClaims.ExpiresAt, parsed.ExpiresAt)
+	assert.Equal(t, "github", parsed.Provider)
+
+	// extras of parsed claims kept on re-issue, i.e. refresh, hook result merged over them
+	opts.ExtraClaims = func(Claims) map[string]interface{} { return map[string]interface{}{"plan": "free"} }
+	tkn, err = NewService(opts).Token(parsed)
+	require.NoError(t, err)
+	parsed, err = NewService(opts).Parse(tkn)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"tenant": "t-id1", "flags": float64(5), "plan": "free"}, parsed.Extra)
+
+	// no extras without hook and in the token
+	opts.ExtraClaims = nil
+	tkn, err = NewService(opts).Token(claims)
+	require.NoError(t, err)
+	parsed, err = NewService(opts).Parse(tkn)
+	require.NoError(t, err)
+	assert.Nil(t, parsed.Extra)
+}
+
 func TestJWT_Set(t *testing.T) {
 	j := NewService(Opts{SecretReader: SecretFunc(mockKeyStore), SecureCookies: false,
 		TokenDuration: time.Hour, CookieDuration: days31, Issuer: "remark42",
@@ -200,6 +290,32 @@ func TestJWT_Set(t *testing.T) {
 	assert.Equal(t, "", rr.Result().Header.Get(jwtCustomHeaderKey), "no JWT header set")
 }
 
+func TestJWT_SetPersistentTTL(t *testing.T) {
+	j := NewService(Opts{SecretReader: SecretFunc(mockKeyStore), TokenDuration: time.Hour, CookieDuration: days31,
+		PersistentTTL: 30 * 24 * time.Hour})
+
+	claims := testClaims
+	claims.Handshake = nil
+	claims.ExpiresAt = 0
+
+	rr := httptest.NewRecorder()
+	c, err := j.Set(rr, claims)
+	require.NoError(t, err)
+	cookies := rr.Result().Cookies()
+	require.Equal(t, 2, len(cookies))
+	assert.Equal(t, 30*24*3600, cookies[0].MaxAge, "jwt cookie lives for PersistentTTL")
+	assert.Equal(t, 30*24*3600, cookies[1].MaxAge, "xsrf cookie lives for PersistentTTL")
+	assert.InDelta(t, time.Now().Add(time.Hour).Unix(), c.ExpiresAt, 5, "token expiration not affected")
+
+	claims.SessionOnly = true
+	rr = httptest.NewRecorder()
+	_, err = j.Set(rr, claims)
+	require.NoError(t, err)
+	cookies = rr.Result().Cookies()
+	require.Equal(t, 2, len(cookies))
+	assert.Equal(t, 0, cookies[0].MaxAge, "session cookie ignores PersistentTTL")
+}
+
 func TestJWT_SetWithDomain(t *testing.T) {
 	j := NewService(Opts{SecretReader: SecretFunc(mockKeyStore), SecureCookies: false,
 		TokenDuration: time.Hour, CookieDuration: days31, Issuer: "remark42",
@@ -529,10 +645,94 @@ func TestJWT_Reset(t *testing.T) {
 	require.Nil(t, err)
 	assert.Equal(t, 200, resp.StatusCode)
 
-	assert.Equal(t, "jc1=; Path=/; Expires=Thu, 01 Jan 1970 00:00:00 GMT; Max-Age=0", resp.Header.Get("Set-Cookie"))
+	assert.Equal(t, "jc1=; Path=/; Expires=Thu, 01 Jan 1970 00:00:00 GMT; Max-Age=0; HttpOnly", resp.Header.Get("Set-Cookie"))
+	require.Equal(t, 2, len(resp.Cookies()))
+	assert.Equal(t, xsrfCustomCookieName, resp.Cookies()[1].Name)
+	assert.Equal(t, -1, resp.Cookies()[1].MaxAge)
+	assert.Equal(t, "/", resp.Cookies()[1].Path)
 	assert.Equal(t, "0", resp.Header.Get("Content-Length"))
 }
 
+func TestJWT_RotateXSRF(t *testing.T) {
+	j := NewService(Opts{SecretReader: SecretFunc(mockKeyStore), TokenDuration: time.Hour, CookieDuration: days31,
+		RotateXSRF: true})
+
+	set := func(claims Claims) (jwtCookie, xsrf string) {
+		rr := httptest.NewRecorder()
+		_, err := j.Set(rr, claims)
+		require.NoError(t, err)
+		cookies := rr.Result().Cookies()
+		require.Equal(t, 2, len(cookies))
+		return cookies[0].Value, cookies[1].Value
+	}
+	get := func(jwtCookie, xsrf string) error {
+		req := httptest.NewRequest("GET", "/valid", http.NoBody)
+		req.AddCookie(&http.Cookie{Name: "JWT", Value: jwtCookie})
+		req.Header.Set("X-XSRF-TOKEN", xsrf)
+		_, _, err := j.Get(req)
+		return err
+	}
+
+	claims := Claims{User: &User{ID: "id1", Name: "name1"}, StandardClaims: jwt.StandardClaims{Id: "session1"}}
+	jwt1, xsrf1 := set(claims)
+	assert.NotEqual(t, "session1", xsrf1, "not jti")
+	assert.NoError(t, get(jwt1, xsrf1))
+	assert.EqualError(t, get(jwt1, "session1"), "xsrf mismatch")
+
+	// refreshed token gets new xsrf value, previous one accepted for grace period
+	j.TokenDuration = 2 * time.Hour // refresh made later expires later
+	jwt2, xsrf2 := set(claims)
+	assert.NotEqual(t, xsrf1, xsrf2)
+	assert.NoError(t, get(jwt2, xsrf2))
+	assert.NoError(t, get(jwt2, xsrf1), "previous value in grace period")
+	assert.EqualError(t, get(jwt1, xsrf2), "xsrf expired", "value of newer token not accepted with older one")
+	j.XSRFGrace = time.Nanosecond
+	assert.EqualError(t, get(jwt2, xsrf1), "xsrf expired")
+	assert.NoError(t, get(jwt2, xsrf2))
+
+	// value of another session rejected
+	claims.Id = "session2"
+	jwt3, _ := set(claims)
+	assert.EqualError(t, get(jwt3, xsrf2), "xsrf mismatch")
+	elems := strings.SplitN(xsrf2, ".", 2)
+	assert.EqualError(t, get(jwt2, elems[0]+".forged"), "xsrf mismatch")
+	assert.EqualError(t, get(jwt2, "forged"), "xsrf mismatch")
+
+	// header tokens get the same value
+	j.SendJWTHeader = true
+	rr := httptest.NewRecorder()
+	c, err := j.Set(rr, claims)
+	require.NoError(t, err)
+	assert.NotEqual(t, "session2", rr.Header().Get("X-XSRF-TOKEN"))
+	assert.NoError(t, j.checkXSRF(c, rr.Header().Get("X-XSRF-TOKEN")))
+}
+
+func TestJWT_IsExpiredLeeway(t *testing.T) {
+	j := NewService(Opts{SecretReader: SecretFunc(mockKeyStore)})
+	claims := func(exp time.Duration) Claims {
+		return Claims{StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(exp).Unix()}}
+	}
+	assert.False(t, j.IsExpired(claims(time.Minute)))
+	assert.True(t, j.IsExpired(claims(-2*time.Second)), "no leeway by default")
+
+	j = NewService(Opts{SecretReader: SecretFunc(mockKeyStore), Leeway: 30 * time.Second})
+	assert.False(t, j.IsExpired(claims(-2*time.Second)), "expired within leeway")
+	assert.False(t, j.IsExpired(claims(-29*time.Second)))
+	assert.True(t, j.IsExpired(claims(-32*time.Second)), "expired beyond leeway")
+
+	// token from header checked with leeway
+	tkn, err := j.Token(Claims{User: &User{ID: "id1"}, StandardClaims: jwt.StandardClaims{
+		ExpiresAt: time.Now().Add(-10 * time.Second).Unix()}})
+	require.NoError(t, err)
+	req := httptest.NewRequest("GET", "/", http.NoBody)
+	req.Header.Set("X-JWT", tkn)
+	_, _, err = j.Get(req)
+	assert.NoError(t, err)
+	j.Leeway = 0
+	_, _, err = j.Get(req)
+	assert.EqualError(t, err, "token expired")
+}
+
 func TestJWT_Validator(t *testing.T) {
 	ch := ValidatorFunc(func(token string, claims Claims) bool {
 		return token == "good"
@@ -614,6 +814,99 @@ func TestParseWithAud(t *testing.T) {
 	assert.EqualError(t, err, "can't parse token: signature is invalid")
 }
 
+func TestJWT_SecretTTL(t *testing.T) {
+	var reads int32
+	secret := atomic.Value{}
+	secret.Store("secret1")
+	j := NewService(Opts{TokenDuration: time.Hour, CookieDuration: days31, AudSecrets: true, SecretTTL: time.Hour,
+		SecretReader: SecretFunc(func(string) (string, error) {
+			atomic.AddInt32(&reads, 1)
+			return secret.Load().(string), nil
+		})})
+	sign := func() string {
+		tkn, err := j.Token(testClaims)
+		require.NoError(t, err)
+		return tkn
+	}
+
+	tkn1 := sign()
+	atomic.StoreInt32(&reads, 0)
+	for i := 0; i < 3; i++ {
+		_, err := j.Parse(tkn1)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&reads), "secret cached")
+
+	secret.Store("secret2") // rotated, token signed with new secret makes cached one re-read
+	tkn2 := sign()
+	_, err := j.Parse(tkn2)
+	require.NoError(t, err)
+	_, err = j.Parse(tkn1)
+	assert.EqualError(t, err, "can't parse token: signature is invalid", "old secret not cached anymore")
+
+	secret.Store("secret3") // rotated again, cached secret2 accepted till reset
+	atomic.StoreInt32(&reads, 0)
+	_, err = j.Parse(tkn2)
+	require.NoError(t, err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&reads))
+	j.ResetSecrets("other_aud")
+	_, err = j.Parse(tkn2)
+	require.NoError(t, err, "secret of other aud reset")
+	j.ResetSecrets(testClaims.Audience)
+	_, err = j.Parse(tkn2)
+	assert.EqualError(t, err, "can't parse token: signature is invalid")
+	_, err = j.Parse(sign())
+	require.NoError(t, err)
+
+	j.secrets.ttl = time.Millisecond // expired secret re-read
+	j.ResetSecrets()
+	_, err = j.Parse(sign())
+	require.NoError(t, err)
+	time.Sleep(5 * time.Millisecond)
+	atomic.StoreInt32(&reads, 0)
+	_, err = j.Parse(sign())
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&reads), "signed and expired one re-read")
+}
+
+func TestJWT_SecretTTLRefreshLimited(t *testing.T) {
+	var reads int32
+	j := NewService(Opts{TokenDuration: time.Hour, CookieDuration: days31, AudSecrets: true, SecretTTL: time.Hour,
+		SecretReader: SecretFunc(func(string) (string, error) {
+			atomic.AddInt32(&reads, 1)
+			return "secret", nil
+		})})
+	tkn, err := j.Token(testClaims)
+	require.NoError(t, err)
+	_, err = j.Parse(tkn)
+	require.NoError(t, err)
+	forged := tkn[:strings.LastIndex(tkn, ".")+1] + "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+
+	atomic.StoreInt32(&reads, 0)
+	for i := 0; i < 10; i++ {
+		_, err = j.Parse(forged)
+		assert.EqualError(t, err, "can't parse token: signature is invalid")
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&reads), "secret re-read once for forged tokens")
+
+	j.secrets.refresh = time.Millisecond
+	time.Sleep(5 * time.Millisecond)
+	_, err = j.Parse(forged)
+	require.Error(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&reads), "re-read after refresh interval")
+}
+
+func TestAudReaderMalformed(t *testing.T) {
+	j := NewService(Opts{SecretReader: SecretFunc(mockKeyStore), AudSecrets: true})
+	for _, tkn := range []string{"", "abc", "a.b", "a.!!!.c", "a." + "bm90LWpzb24" + ".c", "a.e30.c"} {
+		_, err := j.aud(tkn)
+		assert.Error(t, err, tkn)
+	}
+	aud, err := j.aud("a.eyJhdWQiOiJ4In0=.c") // padded payload
+	require.NoError(t, err)
+	assert.Equal(t, "x", aud)
+}
+
 var testClaims = Claims{
 	StandardClaims: jwt.StandardClaims{
 		Id:        "random id",
@@ -637,3 +930,97 @@ var testClaims = Claims{
 		ID:    "myid-123456",
 	},
 }
+
+func TestJWT_ParseAlgAllowlist(t *testing.T) {
+	j := NewService(Opts{SecretReader: SecretFunc(mockKeyStore)})
+	claims := testClaims
+	claims.ExpiresAt = time.Now().Add(time.Hour).Unix()
+
+	sign := func(method jwt.SigningMethod, key interface{}) string {
+		tkn, err := jwt.NewWithClaims(method, claims).SignedString(key)
+		require.NoError(t, err)
+		return tkn
+	}
+
+	_, err := j.Parse(sign(jwt.SigningMethodHS256, []byte("xyz 12345")))
+	assert.NoError(t, err, "HS256 accepted by default")
+
+	_, err = j.Parse(sign(jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType))
+	assert.Error(t, err, "alg none rejected")
+
+	hs512 := sign(jwt.SigningMethodHS512, []byte("xyz 12345"))
+	_, err = j.Parse(hs512)
+	assert.Error(t, err, "HS512 not in default allowlist")
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	_, err = j.Parse(sign(jwt.SigningMethodRS256, rsaKey))
+	assert.Error(t, err, "RS256 rejected")
+
+	// algorithm swapped, header says HS512 but the token is signed as HS256
+	parts := strings.Split(sign(jwt.SigningMethodHS256, []byte("xyz 12345")), ".")
+	parts[0] = strings.Split(hs512, ".")[0]
+	_, err = j.Parse(strings.Join(parts, "."))
+	assert.Error(t, err, "swapped alg rejected")
+
+	j.AllowedAlgs = []string{"HS256", "HS512", "RS256", "none"}
+	_, err = j.Parse(hs512)
+	assert.NoError(t, err, "HS512 allowed explicitly")
+	_, err = j.Parse(strings.Join(parts, "."))
+	assert.Error(t, err, "swapped alg rejected even if allowed, signature mismatch")
+	_, err = j.Parse(sign(jwt.SigningMethodRS256, rsaKey))
+	assert.Error(t, err, "RS256 rejected even if allowed, secret is symmetric")
+	_, err = j.Parse(sign(jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType))
+	assert.Error(t, err, "alg none rejected even if allowed")
+}
+
+func TestJWT_ParseAudienceInvalidator(t *testing.T) {
+	inv := NewMemAudienceInvalidator()
+	j := NewService(Opts{SecretReader: SecretFunc(mockKeyStore), AudienceInvalidator: inv})
+	makeToken := func(aud string, iat int64) string {
+		claims := testClaims
+		claims.Audience = aud
+		claims.IssuedAt = iat
+		claims.ExpiresAt = time.Now().Add(time.Hour).Unix()
+		tkn, err := j.Token(claims)
+		require.NoError(t, err)
+		return tkn
+	}
+	site1, site2 := makeToken("site1", time.Now().Add(-time.Hour).Unix()), makeToken("site2", time.Now().Add(-time.Hour).Unix())
+
+	_, err := j.Parse(site1)
+	assert.NoError(t, err)
+
+	require.NoError(t, inv.InvalidateAudience("site1"))
+	_, err = j.Parse(site1)
+	assert.EqualError(t, err, `aud "site1" invalidated`)
+	_, err = j.Parse(site2)
+	assert.NoError(t, err, "other audience not affected")
+
+	_, err = j.Parse(makeToken("site1", time.Now().Unix()))
+	assert.NoError(t, err, "issued after invalidation")
+	_, err = j.Parse(makeToken("site1", 0))
+	assert.Error(t, err, "no iat for invalidated audience")
+}
+
+func TestJWT_ParseAllowedIssuers(t *testing.T) {
+	j := NewService(Opts{SecretReader: SecretFunc(func(string) (string, error) { return "secret", nil }),
+		Issuer: "main", AllowedIssuers: []string{"brand-a"}})
+	makeToken := func(iss string) string {
+		tkn, err := j.Token(Claims{User: &User{ID: "id1"}, StandardClaims: jwt.StandardClaims{Issuer: iss}})
+		require.NoError(t, err)
+		return tkn
+	}
+
+	for _, iss := range []string{"main", "brand-a", ""} {
+		claims, err := j.Parse(makeToken(iss))
+		require.NoError(t, err, iss)
+		assert.Equal(t, iss, claims.Issuer)
+	}
+	_, err := j.Parse(makeToken("brand-x"))
+	assert.EqualError(t, err, `issuer "brand-x" rejected`)
+
+	j.AllowedIssuers = nil
+	_, err = j.Parse(makeToken("brand-x"))
+	assert.NoError(t, err, "any issuer accepted without AllowedIssuers")
+}
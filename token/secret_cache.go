@@ -0,0 +1,96 @@
+package token
+
+import (
+	"sync"
+	"time"
+)
+
+// maxCachedSecrets limits cached auds, reader may return secret for any aud, i.e. derived ones
+const maxCachedSecrets = 1024
+
+// defaultSecretRefresh is the min interval of re-reading cached secret of aud on signature mismatch,
+// so tokens with forged signature don't make a call to the secrets store each
+const defaultSecretRefresh = 10 * time.Second
+
+// secretCache memoizes secrets returned by SecretReader per aud for ttl
+type secretCache struct {
+	ttl       time.Duration
+	refresh   time.Duration // min interval of refreshes per aud
+	lock      sync.RWMutex
+	items     map[string]cachedSecret
+	refreshed map[string]time.Time // last refresh per aud
+}
+
+type cachedSecret struct {
+	secret  string
+	expires time.Time
+}
+
+func newSecretCache(ttl time.Duration) *secretCache {
+	return &secretCache{ttl: ttl, refresh: defaultSecretRefresh, items: map[string]cachedSecret{},
+		refreshed: map[string]time.Time{}}
+}
+
+// get returns not expired secret of aud
+func (c *secretCache) get(aud string) (string, bool) {
+	c.lock.RLock()
+	item, ok := c.items[aud]
+	c.lock.RUnlock()
+	if !ok || time.Now().After(item.expires) {
+		return "", false
+	}
+	return item.secret, true
+}
+
+// set keeps secret of aud for ttl
+func (c *secretCache) set(aud, secret string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	if len(c.items) >= maxCachedSecrets {
+		for k, item := range c.items {
+			if now.After(item.expires) {
+				delete(c.items, k)
+			}
+		}
+		if len(c.items) >= maxCachedSecrets {
+			c.items = map[string]cachedSecret{}
+		}
+	}
+	c.items[aud] = cachedSecret{secret: secret, expires: now.Add(c.ttl)}
+}
+
+// allowRefresh reports if cached secret of aud can be re-read, once per refresh interval
+func (c *secretCache) allowRefresh(aud string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	if last, ok := c.refreshed[aud]; ok && now.Sub(last) < c.refresh {
+		return false
+	}
+	if len(c.refreshed) >= maxCachedSecrets {
+		for k, last := range c.refreshed {
+			if now.Sub(last) >= c.refresh {
+				delete(c.refreshed, k)
+			}
+		}
+		if len(c.refreshed) >= maxCachedSecrets {
+			c.refreshed = map[string]time.Time{}
+		}
+	}
+	c.refreshed[aud] = now
+	return true
+}
+
+// reset drops cached secrets of auds, all of them if none passed
+func (c *secretCache) reset(auds ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(auds) == 0 {
+		c.items = map[string]cachedSecret{}
+		return
+	}
+	for _, aud := range auds {
+		delete(c.items, aud)
+	}
+}
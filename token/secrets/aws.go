@@ -0,0 +1,160 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-pkgz/auth/logger"
+)
+
+// AWSSecretsManager reads secrets from AWS Secrets Manager secret, implements token.Secret.
+// Secret string is json object with secrets by key, or the secret itself, used as Key then.
+// Requests signed with static credentials, from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+// env by default.
+type AWSSecretsManager struct {
+	Region   string // i.e. "us-east-1", from AWS_REGION env by default
+	SecretID string // name or ARN of the secret
+	Key      string // key of the secret in json secret string, default "jwt_secret"
+	AudKeys  bool   // per-aud secrets in keys "<Key>_<aud>", Key used for empty aud
+
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string // optional, for temporary credentials
+	Endpoint        string // optional, default https://secretsmanager.<region>.amazonaws.com
+
+	Cache  CacheOpts
+	Client *http.Client // optional client, shared transport with Cache.Timeout by default
+	L      logger.L
+
+	once  sync.Once
+	cache *cache
+}
+
+// Get returns secret for aud
+func (a *AWSSecretsManager) Get(aud string) (string, error) {
+	a.once.Do(func() { a.cache = newCache(a.Cache, a.L, a.fetch) })
+	data, err := a.cache.get()
+	if err != nil {
+		return "", fmt.Errorf("can't get secret from secrets manager: %w", err)
+	}
+	return secretKey(data, a.Key, aud, a.AudKeys)
+}
+
+func (a *AWSSecretsManager) fetch(ctx context.Context) (map[string]string, error) {
+	region := a.Region
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	endpoint := a.Endpoint
+	if endpoint == "" {
+		endpoint = "https://secretsmanager." + region + ".amazonaws.com"
+	}
+	body, err := json.Marshal(map[string]string{"SecretId": a.SecretID})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimSuffix(endpoint, "/")+"/", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	keyID, secret, session := a.AccessKeyID, a.SecretAccessKey, a.SessionToken
+	if keyID == "" {
+		keyID, secret, session = os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if keyID == "" || secret == "" {
+		return nil, fmt.Errorf("no aws credentials")
+	}
+	signV4(req, body, keyID, secret, session, region, "secretsmanager", time.Now().UTC())
+
+	resp, err := client(a.Client, a.cache.Timeout).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() // nolint
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("secrets manager responded with %s, %s", resp.Status, msg)
+	}
+	var res struct {
+		SecretString string `json:"SecretString"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("can't decode secrets manager response: %w", err)
+	}
+
+	data := map[string]string{}
+	if err = json.Unmarshal([]byte(res.SecretString), &data); err != nil {
+		key := a.Key
+		if key == "" {
+			key = defaultKey
+		}
+		data = map[string]string{key: res.SecretString} // plain secret string
+	}
+	return data, nil
+}
+
+// signV4 adds signature version 4 headers to the request
+func signV4(req *http.Request, body []byte, keyID, secret, session, region, service string, now time.Time) {
+	amzDate, date := now.Format("20060102T150405Z"), now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if session != "" {
+		req.Header.Set("X-Amz-Security-Token", session)
+	}
+	req.Header.Set("Host", req.URL.Host)
+
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+	canonHeaders := ""
+	for _, name := range names {
+		canonHeaders += name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+	req.Header.Del("Host") // set by client from the url
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	bodyHash := sha256.Sum256(body)
+	canonReq := strings.Join([]string{req.Method, path, canonQuery(req.URL.Query()), canonHeaders, signedHeaders,
+		hex.EncodeToString(bodyHash[:])}, "\n")
+	canonHash := sha256.Sum256([]byte(canonReq))
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	for _, s := range []string{region, service, "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		keyID, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+func canonQuery(q url.Values) string {
+	return strings.ReplaceAll(q.Encode(), "+", "%20")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
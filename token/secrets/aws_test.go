@@ -0,0 +1,73 @@
+package secrets
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAWSSecretsManager(t *testing.T) {
+	var fetches int32
+	secretString := atomic.Value{}
+	secretString.Store(`{"jwt_secret":"secret1","jwt_secret_site1":"site1-secret"}`)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "secretsmanager.GetSecretValue", r.Header.Get("X-Amz-Target"))
+		assert.Equal(t, "session", r.Header.Get("X-Amz-Security-Token"))
+		auth := r.Header.Get("Authorization")
+		assert.True(t, strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/"), auth)
+		assert.Contains(t, auth, "/us-east-1/secretsmanager/aws4_request")
+		assert.Contains(t, auth, "SignedHeaders=content-type;host;x-amz-date;x-amz-security-token;x-amz-target")
+		var req map[string]string
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		if req["SecretId"] != "prod/jwt" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"__type":"ResourceNotFoundException"}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"SecretString": secretString.Load().(string)})
+	}))
+	defer ts.Close()
+
+	a := &AWSSecretsManager{Region: "us-east-1", SecretID: "prod/jwt", AudKeys: true, Endpoint: ts.URL,
+		AccessKeyID: "AKID", SecretAccessKey: "secret", SessionToken: "session", Cache: CacheOpts{TTL: 100 * time.Millisecond}}
+	s, err := a.Get("")
+	require.NoError(t, err)
+	assert.Equal(t, "secret1", s)
+	s, err = a.Get("site1")
+	require.NoError(t, err)
+	assert.Equal(t, "site1-secret", s)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+
+	// plain secret string rotated
+	secretString.Store("plain-secret")
+	a.AudKeys = false
+	assert.Eventually(t, func() bool { s, err := a.Get("site1"); return err == nil && s == "plain-secret" },
+		time.Second, 10*time.Millisecond)
+
+	a = &AWSSecretsManager{Region: "us-east-1", SecretID: "other", Endpoint: ts.URL, AccessKeyID: "AKID",
+		SecretAccessKey: "secret", SessionToken: "session"}
+	_, err = a.Get("")
+	assert.EqualError(t, err, "can't get secret from secrets manager: secrets manager responded with 400 Bad Request, "+
+		`{"__type":"ResourceNotFoundException"}`)
+}
+
+func TestSignV4(t *testing.T) {
+	// get-vanilla case of aws signature v4 test suite
+	req, err := http.NewRequest("GET", "https://example.amazonaws.com/", http.NoBody)
+	require.NoError(t, err)
+	signV4(req, nil, "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "", "us-east-1", "service",
+		time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+		"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		req.Header.Get("Authorization"))
+	assert.Equal(t, "20150830T123600Z", req.Header.Get("X-Amz-Date"))
+}
@@ -0,0 +1,136 @@
+// Package secrets provides token.Secret implementations reading JWT secrets from Vault KV v2 and
+// AWS Secrets Manager. Secrets cached for TTL and refreshed in background before expiration, so the secret
+// rotated in the backend picked up without restart, and stale secret used while the backend is unreachable,
+// unless FailClosed set.
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-pkgz/auth/httpclient"
+	"github.com/go-pkgz/auth/logger"
+)
+
+const (
+	defaultTTL     = 5 * time.Minute
+	defaultTimeout = 10 * time.Second
+	defaultKey     = "jwt_secret"
+)
+
+// CacheOpts defines caching of secrets fetched from the backend. Zero values replaced by defaults.
+type CacheOpts struct {
+	TTL        time.Duration // how long fetched secrets used, refreshed in background after 3/4 of it, default 5m
+	Timeout    time.Duration // timeout of backend requests, default 10s
+	FailClosed bool          // fail with error if secrets expired and backend unreachable, stale ones used otherwise
+}
+
+// cache keeps secret data fetched from the backend for TTL
+type cache struct {
+	CacheOpts
+	l     logger.L
+	fetch func(ctx context.Context) (map[string]string, error)
+
+	fetchLock sync.Mutex // serializes fetches, only one request to the backend at a time
+
+	lock        sync.Mutex
+	data        map[string]string
+	fetched     time.Time
+	refreshing  bool
+	nextRefresh time.Time // refresh failed, next one not started before it
+}
+
+func newCache(opts CacheOpts, l logger.L, fetch func(ctx context.Context) (map[string]string, error)) *cache {
+	if opts.TTL <= 0 {
+		opts.TTL = defaultTTL
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultTimeout
+	}
+	if l == nil {
+		l = logger.NoOp{}
+	}
+	return &cache{CacheOpts: opts, l: l, fetch: fetch}
+}
+
+// get returns cached data, fetches it if not fetched yet or expired with FailClosed.
+// Expired data without FailClosed returned as-is and refreshed in background.
+func (c *cache) get() (map[string]string, error) {
+	c.lock.Lock()
+	data, age := c.data, time.Since(c.fetched)
+	if data != nil && (age < c.TTL || !c.FailClosed) {
+		if age > c.TTL*3/4 && !c.refreshing && time.Now().After(c.nextRefresh) {
+			c.refreshing = true
+			go c.refresh()
+		}
+		c.lock.Unlock()
+		if age >= c.TTL {
+			c.l.Logf("[DEBUG] secrets expired %v ago, used till refreshed", age-c.TTL)
+		}
+		return data, nil
+	}
+	c.lock.Unlock()
+	return c.load()
+}
+
+// load fetches data unless it was fetched by concurrent call while waiting
+func (c *cache) load() (map[string]string, error) {
+	c.fetchLock.Lock()
+	defer c.fetchLock.Unlock()
+
+	c.lock.Lock()
+	if c.data != nil && time.Since(c.fetched) < c.TTL*3/4 {
+		defer c.lock.Unlock()
+		return c.data, nil
+	}
+	c.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	data, err := c.fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	c.data, c.fetched = data, time.Now()
+	c.lock.Unlock()
+	return data, nil
+}
+
+// refresh loads data in background, failed refresh retried after TTL/10, not on each request
+func (c *cache) refresh() {
+	_, err := c.load()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.refreshing = false
+	if err != nil {
+		c.l.Logf("[WARN] can't refresh secrets, cached ones used, %v", err)
+		c.nextRefresh = time.Now().Add(c.TTL / 10)
+	}
+}
+
+// secretKey returns secret for aud from the data, keyed by key or by "<key>_<aud>" with audKeys
+func secretKey(data map[string]string, key, aud string, audKeys bool) (string, error) {
+	if key == "" {
+		key = defaultKey
+	}
+	if audKeys && aud != "" {
+		key += "_" + aud
+	}
+	secret, ok := data[key]
+	if !ok || secret == "" {
+		return "", fmt.Errorf("no secret %q", key)
+	}
+	return secret, nil
+}
+
+func client(c *http.Client, timeout time.Duration) *http.Client {
+	if c != nil {
+		return c
+	}
+	return httpclient.New(timeout)
+}
@@ -0,0 +1,108 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/auth/logger"
+)
+
+// fakeBackend returns secret with the number of the fetch, fails while down
+type fakeBackend struct {
+	fetches int32
+	down    int32
+}
+
+func (f *fakeBackend) fetch(context.Context) (map[string]string, error) {
+	if atomic.LoadInt32(&f.down) == 1 {
+		return nil, errors.New("backend unreachable")
+	}
+	n := atomic.AddInt32(&f.fetches, 1)
+	return map[string]string{"jwt_secret": string(rune('0' + n))}, nil
+}
+
+func TestCache(t *testing.T) {
+	b := &fakeBackend{}
+	c := newCache(CacheOpts{TTL: 100 * time.Millisecond}, logger.NoOp{}, b.fetch)
+
+	data, err := c.get()
+	require.NoError(t, err)
+	assert.Equal(t, "1", data["jwt_secret"])
+	data, err = c.get()
+	require.NoError(t, err)
+	assert.Equal(t, "1", data["jwt_secret"], "cached")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&b.fetches))
+
+	// refreshed in background before expiration, rotated secret picked up
+	time.Sleep(80 * time.Millisecond)
+	data, err = c.get()
+	require.NoError(t, err)
+	assert.Equal(t, "1", data["jwt_secret"], "cached one returned while refreshing")
+	assert.Eventually(t, func() bool {
+		d, e := c.get()
+		return e == nil && d["jwt_secret"] == "2"
+	}, time.Second, 5*time.Millisecond)
+
+	// stale secret used while backend unreachable
+	atomic.StoreInt32(&b.down, 1)
+	time.Sleep(150 * time.Millisecond)
+	data, err = c.get()
+	require.NoError(t, err)
+	assert.Equal(t, "2", data["jwt_secret"])
+
+	// and refreshed once it is back
+	atomic.StoreInt32(&b.down, 0)
+	assert.Eventually(t, func() bool {
+		d, e := c.get()
+		return e == nil && d["jwt_secret"] == "3"
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestCache_FailClosed(t *testing.T) {
+	b := &fakeBackend{}
+	c := newCache(CacheOpts{TTL: 50 * time.Millisecond, FailClosed: true}, logger.NoOp{}, b.fetch)
+
+	atomic.StoreInt32(&b.down, 1)
+	_, err := c.get()
+	assert.EqualError(t, err, "backend unreachable", "nothing fetched yet")
+
+	atomic.StoreInt32(&b.down, 0)
+	data, err := c.get()
+	require.NoError(t, err)
+	assert.Equal(t, "1", data["jwt_secret"])
+
+	// expired secret not used with backend unreachable
+	atomic.StoreInt32(&b.down, 1)
+	time.Sleep(60 * time.Millisecond)
+	_, err = c.get()
+	assert.EqualError(t, err, "backend unreachable")
+
+	atomic.StoreInt32(&b.down, 0)
+	data, err = c.get()
+	require.NoError(t, err)
+	assert.Equal(t, "2", data["jwt_secret"])
+}
+
+func TestSecretKey(t *testing.T) {
+	data := map[string]string{"jwt_secret": "s0", "jwt_secret_site1": "s1", "other": "o"}
+	s, err := secretKey(data, "", "site1", false)
+	require.NoError(t, err)
+	assert.Equal(t, "s0", s)
+	s, err = secretKey(data, "", "site1", true)
+	require.NoError(t, err)
+	assert.Equal(t, "s1", s)
+	s, err = secretKey(data, "", "", true)
+	require.NoError(t, err)
+	assert.Equal(t, "s0", s, "key for empty aud")
+	s, err = secretKey(data, "other", "", false)
+	require.NoError(t, err)
+	assert.Equal(t, "o", s)
+	_, err = secretKey(data, "", "site2", true)
+	assert.EqualError(t, err, `no secret "jwt_secret_site2"`)
+}
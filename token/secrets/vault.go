@@ -0,0 +1,149 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-pkgz/auth/logger"
+)
+
+// Vault reads secrets from Vault KV v2 secret, implements token.Secret. Authenticates with Token,
+// or logs in with AppRole RoleID and SecretID and renews the login when its lease expires.
+type Vault struct {
+	Address   string // vault address, i.e. https://vault.example.com:8200
+	Mount     string // mount of KV v2 engine, default "secret"
+	Path      string // path of the secret under the mount, i.e. "auth/jwt"
+	Key       string // key of the secret in secret data, default "jwt_secret"
+	AudKeys   bool   // per-aud secrets in keys "<Key>_<aud>", Key used for empty aud
+	Namespace string // optional namespace of vault enterprise
+
+	Token    string // vault token, AppRole login used if empty
+	RoleID   string // AppRole role_id
+	SecretID string // AppRole secret_id
+
+	Cache  CacheOpts
+	Client *http.Client // optional client, shared transport with Cache.Timeout by default
+	L      logger.L
+
+	once  sync.Once
+	cache *cache
+
+	lock     sync.Mutex
+	login    string    // token made by AppRole login
+	loginExp time.Time // renew login after it
+}
+
+// Get returns secret for aud
+func (v *Vault) Get(aud string) (string, error) {
+	v.once.Do(func() { v.cache = newCache(v.Cache, v.L, v.fetch) })
+	data, err := v.cache.get()
+	if err != nil {
+		return "", fmt.Errorf("can't get secret from vault: %w", err)
+	}
+	return secretKey(data, v.Key, aud, v.AudKeys)
+}
+
+func (v *Vault) fetch(ctx context.Context) (map[string]string, error) {
+	tkn, err := v.authToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	mount := v.Mount
+	if mount == "" {
+		mount = "secret"
+	}
+	var resp struct {
+		Data struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+	}
+	u := strings.TrimSuffix(v.Address, "/") + "/v1/" + strings.Trim(mount, "/") + "/data/" + strings.Trim(v.Path, "/")
+	status, err := v.request(ctx, "GET", u, tkn, nil, &resp)
+	if status == http.StatusForbidden && v.Token == "" {
+		v.lock.Lock()
+		v.login = "" // login expired or revoked, made again on next fetch
+		v.lock.Unlock()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]string, len(resp.Data.Data))
+	for k, val := range resp.Data.Data {
+		if s, ok := val.(string); ok {
+			res[k] = s
+		}
+	}
+	return res, nil
+}
+
+// authToken returns Token or token of AppRole login, logs in if not logged in yet or login expires
+func (v *Vault) authToken(ctx context.Context) (string, error) {
+	if v.Token != "" {
+		return v.Token, nil
+	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.login != "" && time.Now().Before(v.loginExp) {
+		return v.login, nil
+	}
+
+	var resp struct {
+		Auth struct {
+			ClientToken   string `json:"client_token"`
+			LeaseDuration int    `json:"lease_duration"`
+		} `json:"auth"`
+	}
+	body := map[string]string{"role_id": v.RoleID, "secret_id": v.SecretID}
+	if _, err := v.request(ctx, "POST", strings.TrimSuffix(v.Address, "/")+"/v1/auth/approle/login", "", body,
+		&resp); err != nil {
+		return "", fmt.Errorf("approle login failed: %w", err)
+	}
+	if resp.Auth.ClientToken == "" {
+		return "", fmt.Errorf("approle login failed: no token")
+	}
+	v.login = resp.Auth.ClientToken
+	v.loginExp = time.Now().Add(time.Duration(resp.Auth.LeaseDuration) * time.Second * 9 / 10) // renewed a bit earlier
+	return v.login, nil
+}
+
+// request makes request to vault api and decodes json response to res, returns status of the response
+func (v *Vault) request(ctx context.Context, method, u, tkn string, body, res interface{}) (int, error) {
+	var reqBody io.Reader = http.NoBody
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, reqBody)
+	if err != nil {
+		return 0, err
+	}
+	if tkn != "" {
+		req.Header.Set("X-Vault-Token", tkn)
+	}
+	if v.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.Namespace)
+	}
+	resp, err := client(v.Client, v.cache.Timeout).Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close() // nolint
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, fmt.Errorf("vault responded with %s", resp.Status)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return resp.StatusCode, fmt.Errorf("can't decode vault response: %w", err)
+	}
+	return resp.StatusCode, nil
+}
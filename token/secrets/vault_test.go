@@ -0,0 +1,116 @@
+package secrets
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/auth/token"
+)
+
+func TestVault(t *testing.T) {
+	var logins, reads int32
+	secret := atomic.Value{}
+	secret.Store("secret1")
+	validToken := atomic.Value{}
+	validToken.Store("static-token")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/auth/approle/login":
+			var req map[string]string
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			if req["role_id"] != "role" || req["secret_id"] != "sid" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			n := atomic.AddInt32(&logins, 1)
+			validToken.Store("login-" + string(rune('0'+n)))
+			_, _ = w.Write([]byte(`{"auth":{"client_token":"` + validToken.Load().(string) + `","lease_duration":3600}}`))
+		case "/v1/kv/data/auth/jwt":
+			atomic.AddInt32(&reads, 1)
+			if r.Header.Get("X-Vault-Token") != validToken.Load().(string) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			assert.Equal(t, "ns1", r.Header.Get("X-Vault-Namespace"))
+			_, _ = w.Write([]byte(`{"data":{"data":{"jwt_secret":"` + secret.Load().(string) +
+				`","jwt_secret_site1":"site1-secret","num":1},"metadata":{"version":3}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	v := &Vault{Address: ts.URL + "/", Mount: "kv", Path: "/auth/jwt", Namespace: "ns1", Token: "static-token",
+		AudKeys: true, Cache: CacheOpts{TTL: 100 * time.Millisecond}}
+	var _ token.Secret = v
+
+	s, err := v.Get("")
+	require.NoError(t, err)
+	assert.Equal(t, "secret1", s)
+	s, err = v.Get("site1")
+	require.NoError(t, err)
+	assert.Equal(t, "site1-secret", s)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&reads), "fetched once for all auds")
+	_, err = v.Get("site2")
+	assert.EqualError(t, err, `no secret "jwt_secret_site2"`)
+
+	// rotated secret picked up without restart
+	secret.Store("secret2")
+	assert.Eventually(t, func() bool { s, err := v.Get(""); return err == nil && s == "secret2" },
+		time.Second, 10*time.Millisecond)
+
+	// bad token
+	_, err = (&Vault{Address: ts.URL, Mount: "kv", Path: "auth/jwt", Token: "bad"}).Get("")
+	assert.EqualError(t, err, "can't get secret from vault: vault responded with 403 Forbidden")
+}
+
+func TestVault_AppRole(t *testing.T) {
+	var logins int32
+	validToken := atomic.Value{}
+	validToken.Store("")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/auth/approle/login":
+			n := atomic.AddInt32(&logins, 1)
+			validToken.Store("login-" + string(rune('0'+n)))
+			_, _ = w.Write([]byte(`{"auth":{"client_token":"` + validToken.Load().(string) + `","lease_duration":3600}}`))
+		case "/v1/secret/data/jwt":
+			if r.Header.Get("X-Vault-Token") != validToken.Load().(string) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			_, _ = w.Write([]byte(`{"data":{"data":{"jwt_secret":"secret1"}}}`))
+		}
+	}))
+	defer ts.Close()
+
+	v := &Vault{Address: ts.URL, Path: "jwt", RoleID: "role", SecretID: "sid",
+		Cache: CacheOpts{TTL: 50 * time.Millisecond, FailClosed: true}}
+	s, err := v.Get("")
+	require.NoError(t, err)
+	assert.Equal(t, "secret1", s)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&logins))
+
+	// login token reused
+	time.Sleep(60 * time.Millisecond)
+	_, err = v.Get("")
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&logins))
+
+	// revoked login token made again
+	validToken.Store("revoked")
+	time.Sleep(60 * time.Millisecond)
+	_, err = v.Get("")
+	assert.Error(t, err, "rejected with revoked token")
+	s, err = v.Get("")
+	require.NoError(t, err)
+	assert.Equal(t, "secret1", s)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&logins))
+}
@@ -0,0 +1,89 @@
+package token
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignatureHeader is the response header with detached signature of the body, i.e. "t=1700000000,v1=5257a869..."
+const SignatureHeader = "X-Auth-Signature"
+
+const responseKeyContext = "go-pkgz/auth response signature"
+
+// ResponseKey returns key of response signatures derived from the token secret. The key can be given to apps
+// verifying responses, it can't be used to make tokens. Note the app keeping the key can sign responses as well.
+func ResponseKey(secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(responseKeyContext))
+	return mac.Sum(nil)
+}
+
+// SignResponse returns value of SignatureHeader for the response body with given headers. The key derived from
+// the secret of token's audience, the token is taken from JWT cookie set by the response, default secret used without.
+func (j *Service) SignResponse(h http.Header, body []byte) (string, error) {
+	if j.SecretReader == nil {
+		return "", fmt.Errorf("secret reader not defined")
+	}
+	aud := ""
+	cookieName := j.JWTCookieName
+	if cookieName == "" {
+		cookieName = defaultJWTCookieName
+	}
+	for _, c := range (&http.Response{Header: h}).Cookies() {
+		if c.Name != cookieName || c.Value == "" {
+			continue
+		}
+		if claims, err := j.Parse(c.Value); err == nil {
+			aud = claims.Audience
+		}
+	}
+	secret, err := j.SecretReader.Get(aud)
+	if err != nil {
+		return "", fmt.Errorf("can't get secret: %w", err)
+	}
+	return signResponse(ResponseKey(secret), time.Now().Unix(), body), nil
+}
+
+// VerifyResponse checks SignatureHeader value sig of the response body with the key made by ResponseKey.
+// Signatures made more than maxAge ago rejected, 0 disables the check.
+func VerifyResponse(key []byte, sig string, body []byte, maxAge time.Duration) error {
+	var ts int64
+	var mac string
+	for _, elem := range strings.Split(sig, ",") {
+		kv := strings.SplitN(strings.TrimSpace(elem), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			ts, _ = strconv.ParseInt(kv[1], 10, 64)
+		case "v1":
+			mac = kv[1]
+		}
+	}
+	if ts == 0 || mac == "" {
+		return errors.New("malformed signature")
+	}
+	if !hmac.Equal([]byte(signResponse(key, ts, body)), []byte("t="+strconv.FormatInt(ts, 10)+",v1="+mac)) {
+		return errors.New("signature mismatch")
+	}
+	if maxAge > 0 && time.Since(time.Unix(ts, 0)) > maxAge {
+		return fmt.Errorf("signature expired, made at %s", time.Unix(ts, 0).Format(time.RFC3339))
+	}
+	return nil
+}
+
+// signResponse returns signature of timestamp and body, as "t=<ts>,v1=<hex hmac-sha256>"
+func signResponse(key []byte, ts int64, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strconv.FormatInt(ts, 10) + "."))
+	mac.Write(body)
+	return "t=" + strconv.FormatInt(ts, 10) + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,56 @@
+package token
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignResponse(t *testing.T) {
+	j := NewService(Opts{
+		SecretReader: SecretFunc(func(aud string) (string, error) { return "secret-" + aud, nil }),
+		AudSecrets:   true,
+	})
+	body := []byte(`{"name":"user"}`)
+
+	sig, err := j.SignResponse(http.Header{}, body)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(sig, "t="), sig)
+	assert.Contains(t, sig, ",v1=")
+	require.NoError(t, VerifyResponse(ResponseKey("secret-"), sig, body, time.Minute))
+
+	assert.EqualError(t, VerifyResponse(ResponseKey("secret-"), sig, []byte(`{"name":"admin"}`), 0), "signature mismatch")
+	assert.EqualError(t, VerifyResponse(ResponseKey("secret-remark"), sig, body, 0), "signature mismatch")
+	assert.EqualError(t, VerifyResponse(ResponseKey("secret-"), "blah", body, 0), "malformed signature")
+	assert.NotEqual(t, []byte("secret-"), ResponseKey("secret-"), "derived key differs from secret")
+
+	old := signResponse(ResponseKey("secret-"), time.Now().Add(-time.Hour).Unix(), body)
+	assert.NoError(t, VerifyResponse(ResponseKey("secret-"), old, body, 0), "no max age")
+	err = VerifyResponse(ResponseKey("secret-"), old, body, time.Minute)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "signature expired")
+}
+
+func TestSignResponse_Audience(t *testing.T) {
+	j := NewService(Opts{
+		SecretReader:   SecretFunc(func(aud string) (string, error) { return "secret-" + aud, nil }),
+		AudSecrets:     true,
+		TokenDuration:  time.Hour,
+		CookieDuration: time.Hour,
+	})
+	rr := httptest.NewRecorder()
+	_, err := j.Set(rr, Claims{User: &User{ID: "id1", Name: "user"}, StandardClaims: jwt.StandardClaims{Audience: "remark"}})
+	require.NoError(t, err)
+
+	body := []byte(`{"name":"user"}`)
+	sig, err := j.SignResponse(rr.Header(), body)
+	require.NoError(t, err)
+	assert.NoError(t, VerifyResponse(ResponseKey("secret-remark"), sig, body, 0), "key of token's audience")
+	assert.Error(t, VerifyResponse(ResponseKey("secret-"), sig, body, 0))
+}
@@ -0,0 +1,64 @@
+// Package tokentest provides fixtures of token.Claims in the canonical shape of each state: confirmation and
+// credentials handshakes of verified providers and issued auth token. Used by tests of the library and its consumers.
+package tokentest
+
+import (
+	"crypto/sha1" //nolint gosec
+	"time"
+
+	"github.com/golang-jwt/jwt"
+
+	"github.com/go-pkgz/auth/token"
+)
+
+// Issuer set by fixtures, the default issuer of token.Service
+const Issuer = "go-pkgz/auth"
+
+// ConfirmClaims returns claims of confirmation token sent by verified provider to the user's address.
+// Empty provider makes state shared by all providers, as with SharedState of verified provider.
+func ConfirmClaims(provider, user, address, site string) token.Claims {
+	return token.Claims{
+		Handshake: &token.Handshake{State: state("confirm", provider), ID: token.HandshakeID(user, address)},
+		StandardClaims: jwt.StandardClaims{
+			Audience:  site,
+			ExpiresAt: time.Now().Add(30 * time.Minute).Unix(),
+			NotBefore: time.Now().Add(-1 * time.Minute).Unix(),
+			Issuer:    Issuer,
+		},
+	}
+}
+
+// CredentialsClaims returns claims of token set by verified provider with password after the confirmation,
+// it is exchanged to auth token by posting the password
+func CredentialsClaims(provider, user, address, site string) token.Claims {
+	res := ConfirmClaims(provider, user, address, site)
+	res.Handshake.State = state("credentials", provider)
+	res.User = &token.User{Name: user, ID: UserID(provider, address)}
+	return res
+}
+
+// IssuedClaims returns claims of auth token issued for the user, expiring in 15 minutes like the default token
+func IssuedClaims(u token.User, site string) token.Claims {
+	return token.Claims{
+		User: &u,
+		StandardClaims: jwt.StandardClaims{
+			Id:        "fixture-" + u.ID,
+			Audience:  site,
+			ExpiresAt: time.Now().Add(15 * time.Minute).Unix(),
+			IssuedAt:  time.Now().Unix(),
+			Issuer:    Issuer,
+		},
+	}
+}
+
+// UserID returns ID of the user confirmed by verified provider with the address
+func UserID(provider, address string) string {
+	return provider + "_" + token.HashID(sha1.New(), address)
+}
+
+func state(st, provider string) string {
+	if provider == "" {
+		return st
+	}
+	return st + ":" + provider
+}
@@ -0,0 +1,40 @@
+package tokentest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/auth/token"
+)
+
+func TestFixtures(t *testing.T) {
+	j := token.NewService(token.Opts{SecretReader: token.SecretFunc(func(string) (string, error) { return "secret", nil })})
+	parse := func(c token.Claims) token.Claims {
+		tkn, err := j.Token(c)
+		require.NoError(t, err)
+		res, err := j.Parse(tkn)
+		require.NoError(t, err)
+		assert.False(t, j.IsExpired(res))
+		return res
+	}
+
+	c := parse(ConfirmClaims("email", "user1", "user1@example.com", "site1"))
+	assert.Equal(t, &token.Handshake{State: "confirm:email", ID: "user1::user1@example.com"}, c.Handshake)
+	assert.Nil(t, c.User)
+	assert.Equal(t, "site1", c.Audience)
+	assert.Equal(t, "confirm", ConfirmClaims("", "user1", "user1@example.com", "").Handshake.State, "shared state")
+
+	c = parse(CredentialsClaims("email", "user1", "user1@example.com", "site1"))
+	assert.Equal(t, "credentials:email", c.Handshake.State)
+	assert.Equal(t, &token.User{Name: "user1", ID: UserID("email", "user1@example.com")}, c.User)
+	assert.Equal(t, "email_4d42f50e4040fd3d04eb0063774faedba1ad3c9f", c.User.ID)
+
+	c = parse(IssuedClaims(token.User{Name: "user1", ID: "email_123"}, "site1"))
+	assert.Nil(t, c.Handshake)
+	assert.Equal(t, "user1", c.User.Name)
+	assert.Equal(t, Issuer, c.Issuer)
+	assert.InDelta(t, time.Now().Add(15*time.Minute).Unix(), c.ExpiresAt, 2)
+}
@@ -9,6 +9,7 @@ import (
 	"io"
 	"net/http"
 	"regexp"
+	"time"
 )
 
 var reValidSha = regexp.MustCompile("^[a-fA-F0-9]{40}$")
@@ -17,6 +18,7 @@ var reValidCrc64 = regexp.MustCompile("^[a-fA-F0-9]{16}$")
 const (
 	adminAttr          = "admin"       // predefined attribute key for bool isAdmin status
 	paidSubscriberAttr = "is_paid_sub" // predefined attribute key for bool paid subscriptions status
+	secondFactorAttr   = "2fa_at"      // predefined attribute key for time of second factor verification, RFC3339
 )
 
 // User is the basic part of oauth data provided by service
@@ -89,6 +91,20 @@ func (u *User) IsPaidSub() bool {
 	return u.BoolAttr(paidSubscriberAttr)
 }
 
+// SetSecondFactor is a shortcut to set "secondFactorAttr" attribute with time of second factor verification
+func (u *User) SetSecondFactor(ts time.Time) {
+	u.SetStrAttr(secondFactorAttr, ts.UTC().Format(time.RFC3339))
+}
+
+// SecondFactorAt is a shortcut to get time of second factor verification, zero time if not verified
+func (u *User) SecondFactorAt() time.Time {
+	ts, err := time.Parse(time.RFC3339, u.StrAttr(secondFactorAttr))
+	if err != nil {
+		return time.Time{}
+	}
+	return ts
+}
+
 // SliceAttr gets slice attribute
 func (u *User) SliceAttr(key string) []string {
 	r, ok := u.Attributes[key].([]string)
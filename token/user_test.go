@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -98,6 +99,15 @@ func TestUser_PaidSubscriber(t *testing.T) {
 	assert.False(t, u.IsPaidSub())
 }
 
+func TestUser_SecondFactor(t *testing.T) {
+	u := User{Name: "test"}
+	assert.True(t, u.SecondFactorAt().IsZero())
+	ts := time.Date(2022, 5, 10, 12, 30, 45, 0, time.UTC)
+	u.SetSecondFactor(ts)
+	assert.Equal(t, ts, u.SecondFactorAt())
+	assert.Equal(t, "2022-05-10T12:30:45Z", u.StrAttr("2fa_at"))
+}
+
 func TestUser_GetUserInfo(t *testing.T) {
 	r, err := http.NewRequest("GET", "http://blah.com", http.NoBody)
 	assert.NoError(t, err)